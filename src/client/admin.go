@@ -0,0 +1,304 @@
+package client
+
+import (
+    "context"
+    "daemon"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "strconv"
+)
+
+// AdminClient calls the admin API of the daemon
+type AdminClient struct {
+    t *transport
+}
+
+func NewAdminClient(config Config) (*AdminClient, error) {
+    t, err := newTransport(config)
+    if err != nil {
+        return nil, err
+    }
+    return &AdminClient{t: t}, nil
+}
+
+func volumePath(name string) (string) {
+    return "/" + daemon.AdminApiVersion + "/volumes/" + url.PathEscape(name)
+}
+
+// call sends a request to the admin API and decodes the response into out
+// unless it is nil. GET requests are retried.
+func (c *AdminClient) call(ctx context.Context, method string, path string, in interface{}, out interface{}) (error) {
+    status, body, err := c.t.do(ctx, method, path, in, method == "GET")
+    if err != nil {
+        return err
+    }
+    if status >= 300 {
+        return responseError(status, body)
+    }
+    if out == nil || status == http.StatusNoContent {
+        return nil
+    }
+    return decode(body, out)
+}
+
+func (c *AdminClient) ListVolumes(ctx context.Context) ([]daemon.VolumeInfo, error) {
+    var list daemon.VolumeList
+    if err := c.call(ctx, "GET", "/" + daemon.AdminApiVersion + "/volumes", nil, &list); err != nil {
+        return nil, err
+    }
+    return list.Volumes, nil
+}
+
+func (c *AdminClient) InspectVolume(ctx context.Context, name string) (*daemon.VolumeInfo, error) {
+    var info daemon.VolumeInfo
+    if err := c.call(ctx, "GET", volumePath(name), nil, &info); err != nil {
+        return nil, err
+    }
+    return &info, nil
+}
+
+func (c *AdminClient) CreateVolume(ctx context.Context, name string, options map[string]string) (*daemon.VolumeInfo, error) {
+    var info daemon.VolumeInfo
+    req := daemon.CreateVolumeRequest{Name: name, Options: options}
+    if err := c.call(ctx, "POST", "/" + daemon.AdminApiVersion + "/volumes", req, &info); err != nil {
+        return nil, err
+    }
+    return &info, nil
+}
+
+func (c *AdminClient) RemoveVolume(ctx context.Context, name string) (error) {
+    return c.call(ctx, "DELETE", volumePath(name), nil, nil)
+}
+
+// ResizeVolume grows a volume to size, e.g. "4G"
+func (c *AdminClient) ResizeVolume(ctx context.Context, name string, size string) (*daemon.VolumeInfo, error) {
+    var info daemon.VolumeInfo
+    if err := c.call(ctx, "POST", volumePath(name) + "/resize", daemon.ResizeVolumeRequest{Size: size}, &info); err != nil {
+        return nil, err
+    }
+    return &info, nil
+}
+
+func (c *AdminClient) ListSnapshots(ctx context.Context, origin string) ([]daemon.VolumeInfo, error) {
+    var list daemon.VolumeList
+    if err := c.call(ctx, "GET", volumePath(origin) + "/snapshots", nil, &list); err != nil {
+        return nil, err
+    }
+    return list.Volumes, nil
+}
+
+// CreateSnapshot creates a snapshot of origin; an empty size uses the size of
+// the origin
+func (c *AdminClient) CreateSnapshot(ctx context.Context, origin string, name string, size string) (*daemon.VolumeInfo, error) {
+    var info daemon.VolumeInfo
+    req := daemon.CreateSnapshotRequest{Name: name, Size: size}
+    if err := c.call(ctx, "POST", volumePath(origin) + "/snapshots", req, &info); err != nil {
+        return nil, err
+    }
+    return &info, nil
+}
+
+// MergeSnapshot merges a snapshot into its origin. With force a mounted
+// origin is accepted and the merge starts when it is unmounted.
+func (c *AdminClient) MergeSnapshot(ctx context.Context, name string, force bool) (*daemon.MergeStatus, error) {
+    var status daemon.MergeStatus
+    path := volumePath(name) + "/merge?force=" + strconv.FormatBool(force)
+    if err := c.call(ctx, "POST", path, nil, &status); err != nil {
+        return nil, err
+    }
+    return &status, nil
+}
+
+// CloneStatus returns the source and the copy progress of a clone
+func (c *AdminClient) CloneStatus(ctx context.Context, name string) (*daemon.CloneStatus, error) {
+    var status daemon.CloneStatus
+    if err := c.call(ctx, "GET", volumePath(name) + "/clone", nil, &status); err != nil {
+        return nil, err
+    }
+    return &status, nil
+}
+
+// CancelClone stops the running copy of a clone and returns its final status
+func (c *AdminClient) CancelClone(ctx context.Context, name string) (*daemon.CloneStatus, error) {
+    var status daemon.CloneStatus
+    if err := c.call(ctx, "DELETE", volumePath(name) + "/clone", nil, &status); err != nil {
+        return nil, err
+    }
+    return &status, nil
+}
+
+// ExportVolume writes the export stream of a volume to w. format and
+// compression may be empty for the defaults. An export which fails after
+// the stream has started leaves an incomplete stream in w and returns an
+// error.
+func (c *AdminClient) ExportVolume(ctx context.Context, name string, format string, compression string, w io.Writer) (error) {
+    query := url.Values{}
+    if format != "" {
+        query.Set("format", format)
+    }
+    if compression != "" {
+        query.Set("compression", compression)
+    }
+    path := volumePath(name) + "/export"
+    if len(query) > 0 {
+        path += "?" + query.Encode()
+    }
+    resp, err := c.t.streamRequest(ctx, "GET", path, nil)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if _, err := io.Copy(w, resp.Body); err != nil {
+        return daemon.Internal("Export of volume " + name + " failed: " + err.Error())
+    }
+    return nil
+}
+
+// ImportVolume creates a volume from an export stream read from r. The
+// options are the create options, by default the volume is created like
+// the exported one.
+func (c *AdminClient) ImportVolume(ctx context.Context, name string, options map[string]string, r io.Reader) (*daemon.VolumeInfo, error) {
+    query := url.Values{}
+    for k, v := range options {
+        query.Set(k, v)
+    }
+    path := volumePath(name) + "/import"
+    if len(query) > 0 {
+        path += "?" + query.Encode()
+    }
+    resp, err := c.t.streamRequest(ctx, "POST", path, r)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    var info daemon.VolumeInfo
+    if err := decode(body, &info); err != nil {
+        return nil, err
+    }
+    return &info, nil
+}
+
+// ListBackups returns the backups of a volume, oldest first
+func (c *AdminClient) ListBackups(ctx context.Context, name string) ([]daemon.BackupRecord, error) {
+    var list daemon.BackupList
+    if err := c.call(ctx, "GET", volumePath(name) + "/backups", nil, &list); err != nil {
+        return nil, err
+    }
+    return list.Backups, nil
+}
+
+// CreateBackup backs up a volume and returns the catalog record once the
+// backup is stored
+func (c *AdminClient) CreateBackup(ctx context.Context, name string) (*daemon.BackupRecord, error) {
+    var record daemon.BackupRecord
+    if err := c.call(ctx, "POST", volumePath(name) + "/backups", nil, &record); err != nil {
+        return nil, err
+    }
+    return &record, nil
+}
+
+func (c *AdminClient) GetBackup(ctx context.Context, name string, id string) (*daemon.BackupRecord, error) {
+    var record daemon.BackupRecord
+    if err := c.call(ctx, "GET", volumePath(name) + "/backups/" + url.PathEscape(id), nil, &record); err != nil {
+        return nil, err
+    }
+    return &record, nil
+}
+
+func (c *AdminClient) DeleteBackup(ctx context.Context, name string, id string) (error) {
+    return c.call(ctx, "DELETE", volumePath(name) + "/backups/" + url.PathEscape(id), nil, nil)
+}
+
+// BackupChain returns the backups to import to restore a backup, from the
+// full backup on, and whether they are all stored
+func (c *AdminClient) BackupChain(ctx context.Context, name string, id string) (*daemon.BackupChain, error) {
+    var chain daemon.BackupChain
+    if err := c.call(ctx, "GET", volumePath(name) + "/backups/" + url.PathEscape(id) + "/chain", nil, &chain); err != nil {
+        return nil, err
+    }
+    return &chain, nil
+}
+
+// RestoreBackup creates the volume name from a backup of a volume with the
+// create options given; an empty name restores to the name of the backed up
+// volume
+func (c *AdminClient) RestoreBackup(ctx context.Context, volume string, id string, name string, options map[string]string) (*daemon.VolumeInfo, error) {
+    var info daemon.VolumeInfo
+    req := daemon.RestoreBackupRequest{Name: name, Options: options}
+    if err := c.call(ctx, "POST", volumePath(volume) + "/backups/" + url.PathEscape(id) + "/restore", req, &info); err != nil {
+        return nil, err
+    }
+    return &info, nil
+}
+
+// VolumeGroup returns the volume group of a storage class, of the default
+// class if class is empty
+func (c *AdminClient) VolumeGroup(ctx context.Context, class string) (*daemon.VolumeGroupInfo, error) {
+    var info daemon.VolumeGroupInfo
+    path := "/" + daemon.AdminApiVersion + "/volumegroup"
+    if class != "" {
+        path += "?class=" + url.QueryEscape(class)
+    }
+    if err := c.call(ctx, "GET", path, nil, &info); err != nil {
+        return nil, err
+    }
+    return &info, nil
+}
+
+func (c *AdminClient) Classes(ctx context.Context) ([]daemon.ClassInfo, error) {
+    var list daemon.ClassList
+    if err := c.call(ctx, "GET", "/" + daemon.AdminApiVersion + "/classes", nil, &list); err != nil {
+        return nil, err
+    }
+    return list.Classes, nil
+}
+
+func (c *AdminClient) Reconcile(ctx context.Context, dryRun bool) (*daemon.ReconcileReport, error) {
+    var report daemon.ReconcileReport
+    path := "/" + daemon.AdminApiVersion + "/reconcile?dry_run=" + strconv.FormatBool(dryRun)
+    if err := c.call(ctx, "POST", path, nil, &report); err != nil {
+        return nil, err
+    }
+    return &report, nil
+}
+
+// GC runs the garbage collector of the daemon; a dry run only reports the
+// orphans
+func (c *AdminClient) GC(ctx context.Context, dryRun bool) (*daemon.GCReport, error) {
+    var report daemon.GCReport
+    path := "/" + daemon.AdminApiVersion + "/gc?dry_run=" + strconv.FormatBool(dryRun)
+    if err := c.call(ctx, "POST", path, nil, &report); err != nil {
+        return nil, err
+    }
+    return &report, nil
+}
+
+// Logs returns up to lines recent log lines, only those of the request with
+// the given id if requestId is not empty
+func (c *AdminClient) Logs(ctx context.Context, lines int, requestId string) ([]string, error) {
+    query := url.Values{}
+    query.Set("lines", strconv.Itoa(lines))
+    if requestId != "" {
+        query.Set("request_id", requestId)
+    }
+    var resp daemon.LogResponse
+    if err := c.call(ctx, "GET", "/" + daemon.AdminApiVersion + "/logs?" + query.Encode(), nil, &resp); err != nil {
+        return nil, err
+    }
+    return resp.Lines, nil
+}
+
+// OpenAPI returns the OpenAPI document of the admin API
+func (c *AdminClient) OpenAPI(ctx context.Context) (map[string]interface{}, error) {
+    var doc map[string]interface{}
+    if err := c.call(ctx, "GET", "/" + daemon.AdminApiVersion + "/openapi.json", nil, &doc); err != nil {
+        return nil, err
+    }
+    return doc, nil
+}
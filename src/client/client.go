@@ -0,0 +1,225 @@
+// Package client is a Go client for the lvm volume driver. DockerClient
+// speaks the docker volume plugin protocol, AdminClient the admin API.
+// Errors returned by the daemon are *daemon.Error values, so callers can
+// check them with daemon.HasCode.
+package client
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "daemon"
+    "encoding/json"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    DefaultTimeout = 10 * time.Minute
+    DefaultRetries = 3
+    DefaultRetryDelay = 500 * time.Millisecond
+    // host name used in urls for unix sockets, it is not resolved
+    unixHost = "http://lvmvd"
+)
+
+// Config describes how to reach one listener of the daemon
+type Config struct {
+    // path of a unix socket, used if URL is empty
+    Socket string
+    // address of an http or https listener, e.g. https://host:8443
+    URL string
+    // certificates for https, optional
+    TLSConfig *tls.Config
+    // bearer token for the admin API, optional
+    Token string
+    // timeout for a single attempt, default 10m
+    Timeout time.Duration
+    // additional attempts of idempotent calls after connection errors or
+    // if the daemon is unavailable; negative disables retries, default 3
+    Retries int
+    // delay before the first retry, doubled for every further retry
+    RetryDelay time.Duration
+}
+
+type transport struct {
+    http *http.Client
+    // client without a timeout for exports and imports, which may take
+    // hours
+    stream *http.Client
+    base string
+    token string
+    retries int
+    retryDelay time.Duration
+}
+
+func newTransport(config Config) (*transport, error) {
+    t := &transport{
+        http: &http.Client{Timeout: config.Timeout},
+        token: config.Token,
+        retries: config.Retries,
+        retryDelay: config.RetryDelay,
+    }
+    if t.http.Timeout == 0 {
+        t.http.Timeout = DefaultTimeout
+    }
+    if t.retries == 0 {
+        t.retries = DefaultRetries
+    } else if t.retries < 0 {
+        t.retries = 0
+    }
+    if t.retryDelay == 0 {
+        t.retryDelay = DefaultRetryDelay
+    }
+    switch {
+    case config.URL != "":
+        if !strings.HasPrefix(config.URL, "http://") && !strings.HasPrefix(config.URL, "https://") {
+            return nil, errors.New("Illegal url " + config.URL + ", expected http:// or https://")
+        }
+        t.base = strings.TrimSuffix(config.URL, "/")
+        t.http.Transport = &http.Transport{TLSClientConfig: config.TLSConfig}
+    case config.Socket != "":
+        socket := config.Socket
+        t.base = unixHost
+        t.http.Transport = &http.Transport{
+            DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+                var d net.Dialer
+                return d.DialContext(ctx, "unix", socket)
+            },
+        }
+    default:
+        return nil, errors.New("Either a socket or a url is required")
+    }
+    t.stream = &http.Client{Transport: t.http.Transport}
+    return t, nil
+}
+
+// retryable reports whether a failed attempt of an idempotent call may be
+// repeated
+func retryable(status int, err error) (bool) {
+    if err != nil {
+        var netErr net.Error
+        return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+    }
+    return status == http.StatusServiceUnavailable
+}
+
+// do sends a request with in as JSON body and returns the status and body
+// of the response. Idempotent calls are retried.
+func (t *transport) do(ctx context.Context, method string, path string, in interface{}, idempotent bool) (int, []byte, error) {
+    var data []byte
+    if in != nil {
+        var err error
+        if data, err = json.Marshal(in); err != nil {
+            return 0, nil, err
+        }
+    }
+    delay := t.retryDelay
+    for attempt := 0; ; attempt++ {
+        status, body, err := t.attempt(ctx, method, path, data, in != nil)
+        if !idempotent || attempt >= t.retries || ctx.Err() != nil || !retryable(status, err) {
+            return status, body, err
+        }
+        select {
+        case <-ctx.Done():
+            return status, body, err
+        case <-time.After(delay):
+        }
+        delay *= 2
+    }
+}
+
+func (t *transport) attempt(ctx context.Context, method string, path string, data []byte, hasBody bool) (int, []byte, error) {
+    var body io.Reader
+    contentType := ""
+    if hasBody {
+        body = bytes.NewReader(data)
+        contentType = "application/json"
+    }
+    req, err := t.newRequest(ctx, method, path, contentType, body)
+    if err != nil {
+        return 0, nil, err
+    }
+    resp, err := t.http.Do(req)
+    if err != nil {
+        return 0, nil, err
+    }
+    defer resp.Body.Close()
+    respBody, err := ioutil.ReadAll(resp.Body)
+    return resp.StatusCode, respBody, err
+}
+
+func (t *transport) newRequest(ctx context.Context, method string, path string, contentType string, body io.Reader) (*http.Request, error) {
+    req, err := http.NewRequestWithContext(ctx, method, t.base + path, body)
+    if err != nil {
+        return nil, err
+    }
+    if contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
+    if t.token != "" {
+        req.Header.Set("Authorization", "Bearer " + t.token)
+    }
+    if id := daemon.RequestIdFrom(ctx); id != "" {
+        req.Header.Set(daemon.RequestIdHeader, id)
+    }
+    return req, nil
+}
+
+// streamRequest sends a request with a binary body and returns the response
+// with its body unread, it is not retried. Error responses are decoded and
+// returned as errors.
+func (t *transport) streamRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Response, error) {
+    contentType := ""
+    if body != nil {
+        contentType = daemon.ExportContentType
+    }
+    req, err := t.newRequest(ctx, method, path, contentType, body)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := t.stream.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode >= 300 {
+        defer resp.Body.Close()
+        respBody, err := ioutil.ReadAll(resp.Body)
+        if err != nil {
+            return nil, err
+        }
+        return nil, responseError(resp.StatusCode, respBody)
+    }
+    return resp, nil
+}
+
+// responseError returns the error of an error response, decoded from its
+// error document if it has one
+func responseError(status int, body []byte) (error) {
+    var resp daemon.ErrorResponse
+    if err := decode(body, &resp); err != nil || resp.Code == "" {
+        return statusError(status, body)
+    }
+    return &daemon.Error{Code: resp.Code, Message: resp.Message}
+}
+
+// statusError is the error for responses without an error document
+func statusError(status int, body []byte) (*daemon.Error) {
+    msg := "Unexpected HTTP status " + strconv.Itoa(status)
+    if text := strings.TrimSpace(string(body)); text != "" {
+        msg += ": " + text
+    }
+    return daemon.Internal(msg)
+}
+
+func decode(body []byte, out interface{}) (error) {
+    if err := json.Unmarshal(body, out); err != nil {
+        return daemon.Internal("Cannot decode response: " + err.Error())
+    }
+    return nil
+}
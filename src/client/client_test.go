@@ -0,0 +1,253 @@
+//go:build fake
+
+package client
+
+import (
+    "context"
+    "daemon"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "sync"
+    "testing"
+    "time"
+)
+
+func newTestServer(t *testing.T) (*TestServer) {
+    s, err := NewTestServer()
+    if err != nil {
+        t.Fatalf("Cannot start test server: %v", err)
+    }
+    return s
+}
+
+// flaky passes requests to the daemon after failing the first ones with
+// fail, and counts all requests
+type flaky struct {
+    m sync.Mutex
+    requests int
+    failures int
+    fail http.HandlerFunc
+    next http.Handler
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.m.Lock()
+    f.requests++
+    failing := f.requests <= f.failures
+    f.m.Unlock()
+    if failing {
+        f.fail(w, r)
+        return
+    }
+    f.next.ServeHTTP(w, r)
+}
+
+func (f *flaky) count() (int) {
+    f.m.Lock()
+    defer f.m.Unlock()
+    return f.requests
+}
+
+func unavailable(w http.ResponseWriter, r *http.Request) {
+    http.Error(w, "unavailable", http.StatusServiceUnavailable)
+}
+
+// hangUp closes the connection without a response
+func hangUp(w http.ResponseWriter, r *http.Request) {
+    conn, _, err := w.(http.Hijacker).Hijack()
+    if err == nil {
+        conn.Close()
+    }
+}
+
+func newFlakyClients(t *testing.T, s *TestServer, f *flaky, retries int) (*DockerClient, *AdminClient, func()) {
+    mux := http.NewServeMux()
+    mux.Handle("/", s.Daemon.DockerHandler())
+    mux.Handle("/" + daemon.AdminApiVersion + "/", s.Daemon.AdminHandler())
+    f.next = mux
+    srv := httptest.NewServer(f)
+    config := Config{URL: srv.URL, Retries: retries, RetryDelay: time.Millisecond}
+    docker, err := NewDockerClient(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    admin, err := NewAdminClient(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return docker, admin, srv.Close
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+    s := newTestServer(t)
+    defer s.Close()
+    ctx := context.Background()
+
+    if err := s.Docker.Create(ctx, "vol1", map[string]string{"size": "100M"}); err != nil {
+        t.Fatalf("Create failed: %v", err)
+    }
+    if err := s.Docker.Create(ctx, "vol1", nil); !daemon.HasCode(err, daemon.CodeAlreadyExists) {
+        t.Errorf("Second create: expected AlreadyExists, got %v", err)
+    }
+    mountpoint, err := s.Docker.Mount(ctx, "vol1", "c1")
+    if err != nil {
+        t.Fatalf("Mount failed: %v", err)
+    }
+    info, err := s.Admin.InspectVolume(ctx, "vol1")
+    if err != nil {
+        t.Fatalf("Inspect failed: %v", err)
+    }
+    if info.SizeMB != 100 || !info.Mounted || info.Mountpoint != mountpoint {
+        t.Errorf("Unexpected volume %+v, expected 100MB mounted on %s", info, mountpoint)
+    }
+    if err := s.Docker.Remove(ctx, "vol1"); !daemon.HasCode(err, daemon.CodeInUse) {
+        t.Errorf("Remove of mounted volume: expected InUse, got %v", err)
+    }
+    if err := s.Docker.Unmount(ctx, "vol1", "c1"); err != nil {
+        t.Fatalf("Unmount failed: %v", err)
+    }
+    if err := s.Docker.Remove(ctx, "vol1"); err != nil {
+        t.Fatalf("Remove failed: %v", err)
+    }
+    if _, err := s.Docker.Get(ctx, "vol1"); !daemon.HasCode(err, daemon.CodeNotFound) {
+        t.Errorf("Get of removed volume: expected NotFound, got %v", err)
+    }
+}
+
+func TestRetryUnavailable(t *testing.T) {
+    s := newTestServer(t)
+    defer s.Close()
+    f := &flaky{failures: 2, fail: unavailable}
+    _, admin, closeServer := newFlakyClients(t, s, f, 3)
+    defer closeServer()
+
+    if _, err := admin.ListVolumes(context.Background()); err != nil {
+        t.Fatalf("List failed despite retries: %v", err)
+    }
+    if n := f.count(); n != 3 {
+        t.Errorf("Expected 3 attempts, got %d", n)
+    }
+}
+
+func TestRetryConnectionError(t *testing.T) {
+    s := newTestServer(t)
+    defer s.Close()
+    f := &flaky{failures: 1, fail: hangUp}
+    docker, _, closeServer := newFlakyClients(t, s, f, 3)
+    defer closeServer()
+
+    if _, err := docker.List(context.Background()); err != nil {
+        t.Fatalf("List failed despite retries: %v", err)
+    }
+    if n := f.count(); n != 2 {
+        t.Errorf("Expected 2 attempts, got %d", n)
+    }
+}
+
+func TestRetriesExhausted(t *testing.T) {
+    s := newTestServer(t)
+    defer s.Close()
+    f := &flaky{failures: 100, fail: unavailable}
+    _, admin, closeServer := newFlakyClients(t, s, f, 2)
+    defer closeServer()
+
+    if _, err := admin.ListVolumes(context.Background()); err == nil {
+        t.Fatal("List succeeded against an unavailable daemon")
+    }
+    if n := f.count(); n != 3 {
+        t.Errorf("Expected 3 attempts, got %d", n)
+    }
+}
+
+func TestNoRetries(t *testing.T) {
+    s := newTestServer(t)
+    defer s.Close()
+    f := &flaky{failures: 1, fail: unavailable}
+    _, admin, closeServer := newFlakyClients(t, s, f, -1)
+    defer closeServer()
+
+    if _, err := admin.ListVolumes(context.Background()); err == nil {
+        t.Fatal("List succeeded although retries are disabled")
+    }
+    if n := f.count(); n != 1 {
+        t.Errorf("Expected 1 attempt, got %d", n)
+    }
+}
+
+func TestNoRetryOfCreate(t *testing.T) {
+    s := newTestServer(t)
+    defer s.Close()
+    f := &flaky{failures: 1, fail: hangUp}
+    docker, admin, closeServer := newFlakyClients(t, s, f, 3)
+    defer closeServer()
+    ctx := context.Background()
+
+    if err := docker.Create(ctx, "vol1", nil); err == nil {
+        t.Fatal("Create succeeded although the connection was closed")
+    }
+    if _, err := admin.CreateVolume(ctx, "vol2", nil); err != nil {
+        t.Fatalf("Create failed: %v", err)
+    }
+    // POST requests are not idempotent
+    f.m.Lock()
+    f.failures = f.requests + 1
+    f.fail = unavailable
+    f.m.Unlock()
+    before := f.count()
+    if _, err := admin.CreateVolume(ctx, "vol3", nil); !daemon.HasCode(err, daemon.CodeInternal) {
+        t.Errorf("Create: expected Internal for status 503, got %v", err)
+    }
+    if n := f.count() - before; n != 1 {
+        t.Errorf("Expected 1 attempt of create, got %d", n)
+    }
+}
+
+func TestRetryCanceled(t *testing.T) {
+    s := newTestServer(t)
+    defer s.Close()
+    f := &flaky{failures: 100, fail: unavailable}
+    _, admin, closeServer := newFlakyClients(t, s, f, 10)
+    defer closeServer()
+    admin.t.retryDelay = time.Hour
+
+    ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    if _, err := admin.ListVolumes(ctx); err == nil {
+        t.Fatal("List succeeded against an unavailable daemon")
+    }
+    if d := time.Since(start); d > 10 * time.Second {
+        t.Errorf("Canceled call waited %s for its retry", d)
+    }
+    if n := f.count(); n != 1 {
+        t.Errorf("Expected 1 attempt, got %d", n)
+    }
+}
+
+func TestCloseStopsCopies(t *testing.T) {
+    s := newTestServer(t)
+    ctx := context.Background()
+    if err := s.Docker.Create(ctx, "src", map[string]string{"size": "1G"}); err != nil {
+        s.Close()
+        t.Fatalf("Create failed: %v", err)
+    }
+    // the copy would take 100s
+    s.Lvm.CopyRateMB = 10
+    if err := s.Docker.Create(ctx, "clone", map[string]string{"clone-from": "src"}); err != nil {
+        s.Close()
+        t.Fatalf("Create of clone failed: %v", err)
+    }
+    status, err := s.Admin.CloneStatus(ctx, "clone")
+    if err != nil || status.State != daemon.CloneCopying {
+        t.Errorf("Expected a running copy, got %+v, %v", status, err)
+    }
+    start := time.Now()
+    s.Close()
+    if d := time.Since(start); d > 10 * time.Second {
+        t.Errorf("Close took %s", d)
+    }
+    if _, err := os.Stat(s.Dir); !os.IsNotExist(err) {
+        t.Errorf("Directory %s of the test server was not removed", s.Dir)
+    }
+}
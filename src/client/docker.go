@@ -0,0 +1,162 @@
+package client
+
+import (
+    "context"
+    "daemon"
+    "net/http"
+)
+
+// DockerClient calls the docker volume plugin endpoints of the daemon and
+// its health endpoints.
+type DockerClient struct {
+    t *transport
+}
+
+type dockerRequest struct {
+    Name string
+    Opts map[string]string `json:",omitempty"`
+    ID string `json:",omitempty"`
+}
+
+type dockerResponse struct {
+    Err string
+    Mountpoint string
+    Volume *daemon.Volume
+    Volumes []daemon.Volume
+    Implements []string
+    Capabilities *daemon.VolumeDriverCapabilities
+}
+
+func NewDockerClient(config Config) (*DockerClient, error) {
+    t, err := newTransport(config)
+    if err != nil {
+        return nil, err
+    }
+    return &DockerClient{t: t}, nil
+}
+
+func (c *DockerClient) call(ctx context.Context, endpoint string, req *dockerRequest, idempotent bool) (*dockerResponse, error) {
+    var in interface{}
+    if req != nil {
+        in = req
+    }
+    status, body, err := c.t.do(ctx, "POST", "/" + endpoint, in, idempotent)
+    if err != nil {
+        return nil, err
+    }
+    if status != http.StatusOK {
+        return nil, statusError(status, body)
+    }
+    var resp dockerResponse
+    if err := decode(body, &resp); err != nil {
+        return nil, err
+    }
+    if e := daemon.ParseError(resp.Err); e != nil {
+        return nil, e
+    }
+    return &resp, nil
+}
+
+// Activate returns the plugin types implemented by the daemon
+func (c *DockerClient) Activate(ctx context.Context) ([]string, error) {
+    resp, err := c.call(ctx, "Plugin.Activate", nil, true)
+    if err != nil {
+        return nil, err
+    }
+    return resp.Implements, nil
+}
+
+// Create creates a volume; options are the docker volume options, e.g. size
+func (c *DockerClient) Create(ctx context.Context, name string, options map[string]string) (error) {
+    _, err := c.call(ctx, "VolumeDriver.Create", &dockerRequest{Name: name, Opts: options}, false)
+    return err
+}
+
+func (c *DockerClient) Remove(ctx context.Context, name string) (error) {
+    _, err := c.call(ctx, "VolumeDriver.Remove", &dockerRequest{Name: name}, false)
+    return err
+}
+
+// Mount mounts the volume for the container with the given id and returns
+// the mountpoint
+func (c *DockerClient) Mount(ctx context.Context, name string, id string) (string, error) {
+    resp, err := c.call(ctx, "VolumeDriver.Mount", &dockerRequest{Name: name, ID: id}, false)
+    if err != nil {
+        return "", err
+    }
+    return resp.Mountpoint, nil
+}
+
+func (c *DockerClient) Unmount(ctx context.Context, name string, id string) (error) {
+    _, err := c.call(ctx, "VolumeDriver.Unmount", &dockerRequest{Name: name, ID: id}, false)
+    return err
+}
+
+// Path returns the mountpoint of a mounted volume
+func (c *DockerClient) Path(ctx context.Context, name string) (string, error) {
+    resp, err := c.call(ctx, "VolumeDriver.Path", &dockerRequest{Name: name}, true)
+    if err != nil {
+        return "", err
+    }
+    return resp.Mountpoint, nil
+}
+
+func (c *DockerClient) Get(ctx context.Context, name string) (*daemon.Volume, error) {
+    resp, err := c.call(ctx, "VolumeDriver.Get", &dockerRequest{Name: name}, true)
+    if err != nil {
+        return nil, err
+    }
+    if resp.Volume == nil {
+        return nil, daemon.Internal("Response without volume")
+    }
+    return resp.Volume, nil
+}
+
+func (c *DockerClient) List(ctx context.Context) ([]daemon.Volume, error) {
+    resp, err := c.call(ctx, "VolumeDriver.List", nil, true)
+    if err != nil {
+        return nil, err
+    }
+    if resp.Volumes == nil {
+        return []daemon.Volume{}, nil
+    }
+    return resp.Volumes, nil
+}
+
+func (c *DockerClient) Capabilities(ctx context.Context) (*daemon.VolumeDriverCapabilities, error) {
+    resp, err := c.call(ctx, "VolumeDriver.Capabilities", nil, true)
+    if err != nil {
+        return nil, err
+    }
+    if resp.Capabilities == nil {
+        return nil, daemon.Internal("Response without capabilities")
+    }
+    return resp.Capabilities, nil
+}
+
+func (c *DockerClient) health(ctx context.Context, path string) (*daemon.HealthReport, error) {
+    status, body, err := c.t.do(ctx, "GET", path, nil, false)
+    if err != nil {
+        return nil, err
+    }
+    // a failed check is reported with 503 and a report
+    if status != http.StatusOK && status != http.StatusServiceUnavailable {
+        return nil, statusError(status, body)
+    }
+    var report daemon.HealthReport
+    if err := decode(body, &report); err != nil {
+        return nil, err
+    }
+    return &report, nil
+}
+
+// Health returns the result of the liveness checks. A failed check is no
+// error, the status of the report is set accordingly.
+func (c *DockerClient) Health(ctx context.Context) (*daemon.HealthReport, error) {
+    return c.health(ctx, "/health")
+}
+
+// Ready returns the result of all checks, see Health
+func (c *DockerClient) Ready(ctx context.Context) (*daemon.HealthReport, error) {
+    return c.health(ctx, "/ready")
+}
@@ -0,0 +1,115 @@
+//go:build fake
+
+package client
+
+import (
+    "daemon"
+    "io/ioutil"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+)
+
+// --------------------------------------------------------------------------
+// Test server
+//
+// TestServer runs the daemon in-process on the fake LVM backend, so that
+// consumers can test their code against the real request handling without
+// root privileges or a volume group.
+// --------------------------------------------------------------------------
+
+const (
+    TestVolumeGroup = "test-vg"
+    // size of the fake volume group in megabytes
+    TestVolumeGroupSize = 10240
+)
+
+type TestServer struct {
+    // temporary directory with fake devices, mountpoints and state
+    Dir string
+    Lvm *daemon.FakeLvm
+    Daemon *daemon.Daemon
+    Docker *DockerClient
+    Admin *AdminClient
+    docker *httptest.Server
+    admin *httptest.Server
+}
+
+// NewTestServer starts a daemon serving the volume group TestVolumeGroup.
+// Close must be called to stop it and remove all files.
+func NewTestServer() (*TestServer, error) {
+    dir, err := ioutil.TempDir("", "lvmvd-test")
+    if err != nil {
+        return nil, err
+    }
+    s := &TestServer{Dir: dir}
+    if err := s.start(); err != nil {
+        s.Close()
+        return nil, err
+    }
+    return s, nil
+}
+
+func (s *TestServer) start() (error) {
+    var err error
+    if s.Lvm, err = daemon.NewFakeLvm(filepath.Join(s.Dir, "lvm")); err != nil {
+        return err
+    }
+    if err := s.Lvm.AddVolumeGroup(TestVolumeGroup, TestVolumeGroupSize, 1); err != nil {
+        return err
+    }
+    keys, err := daemon.NewFileKeyProvider(filepath.Join(s.Dir, "keys"))
+    if err != nil {
+        return err
+    }
+    backups, err := daemon.NewDirectoryTarget(filepath.Join(s.Dir, "backups"))
+    if err != nil {
+        return err
+    }
+    s.Daemon = &daemon.Daemon{
+        MountRoot: filepath.Join(s.Dir, "mnt"),
+        VolumeGroupName: TestVolumeGroup,
+        DefaultLogicalVolumeSize: daemon.DefaultVolumeSize,
+        StateDir: filepath.Join(s.Dir, "state"),
+        Executor: s.Lvm,
+        DevDir: s.Lvm.DevDir(),
+        CopyDevice: s.Lvm.CopyDevice,
+        KeyProvider: keys,
+        BackupTarget: backups,
+    }
+    if err := s.Daemon.Init(); err != nil {
+        return err
+    }
+    s.docker = httptest.NewServer(s.Daemon.DockerHandler())
+    s.admin = httptest.NewServer(s.Daemon.AdminHandler())
+    // no retries, tests should see failures immediately
+    if s.Docker, err = NewDockerClient(Config{URL: s.docker.URL, Retries: -1}); err != nil {
+        return err
+    }
+    s.Admin, err = NewAdminClient(Config{URL: s.admin.URL, Retries: -1})
+    return err
+}
+
+// DockerURL returns the address of the docker plugin endpoints
+func (s *TestServer) DockerURL() (string) {
+    return s.docker.URL
+}
+
+// AdminURL returns the address of the admin API
+func (s *TestServer) AdminURL() (string) {
+    return s.admin.URL
+}
+
+// Close stops the servers and the daemon and removes all files
+func (s *TestServer) Close() {
+    if s.docker != nil {
+        s.docker.Close()
+    }
+    if s.admin != nil {
+        s.admin.Close()
+    }
+    if s.Daemon != nil {
+        s.Daemon.Close()
+    }
+    os.RemoveAll(s.Dir)
+}
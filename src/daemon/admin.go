@@ -0,0 +1,754 @@
+package daemon
+
+import (
+    "bufio"
+    "context"
+    "crypto/subtle"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "net/http"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// --------------------------------------------------------------------------
+// Admin API
+//
+// Versioned REST API for operators, served on its own listener: a unix
+// socket only accessible by root or https with optional client certificates.
+// Additionally a bearer token can be required. All operations go through
+// the same volume driver and request lock as the docker requests.
+// --------------------------------------------------------------------------
+
+const (
+    AdminApiVersion = "v1"
+    DefaultAdminSocket = "/run/lvm-volume-driver/admin.sock"
+    DefaultAdminPort = 8443
+    adminContentType = "application/json"
+    defaultLogLines = 100
+)
+
+type CreateVolumeRequest struct {
+    Name string `json:"name"`
+    Options map[string]string `json:"options,omitempty"`
+}
+
+type RestoreBackupRequest struct {
+    // name of the new volume, default the name of the backed up volume
+    Name string `json:"name,omitempty"`
+    // create options; size, encryption and mount options default to the
+    // backed up volume
+    Options map[string]string `json:"options,omitempty"`
+}
+
+type ResizeVolumeRequest struct {
+    // new size, e.g. "2G"
+    Size string `json:"size"`
+}
+
+type CreateSnapshotRequest struct {
+    Name string `json:"name"`
+    // space for changes, defaults to the size of the volume
+    Size string `json:"size,omitempty"`
+}
+
+type VolumeList struct {
+    Volumes []VolumeInfo `json:"volumes"`
+}
+
+type ClassList struct {
+    Classes []ClassInfo `json:"classes"`
+}
+
+type BackupList struct {
+    Backups []BackupRecord `json:"backups"`
+}
+
+type LogResponse struct {
+    Lines []string `json:"lines"`
+}
+
+type ErrorResponse struct {
+    Code ErrorCode `json:"code"`
+    Message string `json:"message"`
+}
+
+type queryParam struct {
+    Name string
+    Type string
+    Description string
+}
+
+type adminRoute struct {
+    Method string
+    // path with parameters in braces, e.g. /v1/volumes/{name}
+    Path string
+    Summary string
+    Query []queryParam
+    // zero values of the request and response bodies, used for the
+    // OpenAPI document
+    Request interface{}
+    Response interface{}
+    // the request or response body is a binary stream
+    StreamRequest bool
+    StreamResponse bool
+    Status int
+    handler func(w http.ResponseWriter, r *http.Request, params map[string]string)
+}
+
+func (d *Daemon) adminRoutes() ([]adminRoute) {
+    return []adminRoute{
+        {Method: "GET", Path: "/v1/volumes", Summary: "List all volumes",
+            Response: VolumeList{}, Status: http.StatusOK, handler: d.adminListVolumes},
+        {Method: "POST", Path: "/v1/volumes", Summary: "Create a volume",
+            Request: CreateVolumeRequest{}, Response: VolumeInfo{}, Status: http.StatusCreated, handler: d.adminCreateVolume},
+        {Method: "GET", Path: "/v1/volumes/{name}", Summary: "Inspect a volume",
+            Response: VolumeInfo{}, Status: http.StatusOK, handler: d.adminInspectVolume},
+        {Method: "DELETE", Path: "/v1/volumes/{name}", Summary: "Remove a volume",
+            Status: http.StatusNoContent, handler: d.adminRemoveVolume},
+        {Method: "POST", Path: "/v1/volumes/{name}/resize", Summary: "Grow a volume and its filesystem",
+            Request: ResizeVolumeRequest{}, Response: VolumeInfo{}, Status: http.StatusOK, handler: d.adminResizeVolume},
+        {Method: "GET", Path: "/v1/volumes/{name}/snapshots", Summary: "List the snapshots of a volume",
+            Response: VolumeList{}, Status: http.StatusOK, handler: d.adminListSnapshots},
+        {Method: "POST", Path: "/v1/volumes/{name}/snapshots", Summary: "Create a snapshot of a volume",
+            Request: CreateSnapshotRequest{}, Response: VolumeInfo{}, Status: http.StatusCreated, handler: d.adminCreateSnapshot},
+        {Method: "POST", Path: "/v1/volumes/{name}/merge", Summary: "Merge a snapshot into its origin, which rolls the origin back to the snapshot",
+            Query: []queryParam{{"force", "boolean", "merge into a mounted origin once it is unmounted"}},
+            Response: MergeStatus{}, Status: http.StatusOK, handler: d.adminMergeSnapshot},
+        {Method: "GET", Path: "/v1/volumes/{name}/clone", Summary: "Show source and copy progress of a clone",
+            Response: CloneStatus{}, Status: http.StatusOK, handler: d.adminCloneStatus},
+        {Method: "DELETE", Path: "/v1/volumes/{name}/clone", Summary: "Cancel the running copy of a clone, the clone has to be removed afterwards",
+            Response: CloneStatus{}, Status: http.StatusOK, handler: d.adminCancelClone},
+        {Method: "GET", Path: "/v1/volumes/{name}/export", Summary: "Export a volume as a checksummed stream, a mounted volume through a snapshot",
+            Query: []queryParam{
+                {"format", "string", "raw (the block device) or tar (the files), default raw"},
+                {"compression", "string", "none, gzip or zstd, default none"},
+            },
+            StreamResponse: true, Status: http.StatusOK, handler: d.adminExportVolume},
+        {Method: "POST", Path: "/v1/volumes/{name}/import", Summary: "Create a volume from an export stream, the query parameters are the create options which default to the exported volume; an incremental backup is applied to the volume its base was imported into",
+            StreamRequest: true, Response: VolumeInfo{}, Status: http.StatusCreated, handler: d.adminImportVolume},
+        {Method: "GET", Path: "/v1/volumes/{name}/backups", Summary: "List the backups of a volume from the catalog, also of removed volumes",
+            Response: BackupList{}, Status: http.StatusOK, handler: d.adminListBackups},
+        {Method: "POST", Path: "/v1/volumes/{name}/backups", Summary: "Back up a volume now",
+            Response: BackupRecord{}, Status: http.StatusCreated, handler: d.adminCreateBackup},
+        {Method: "GET", Path: "/v1/volumes/{name}/backups/{id}", Summary: "Show the catalog record of a backup",
+            Response: BackupRecord{}, Status: http.StatusOK, handler: d.adminGetBackup},
+        {Method: "DELETE", Path: "/v1/volumes/{name}/backups/{id}", Summary: "Delete a backup, unless an incremental backup is based on it",
+            Status: http.StatusNoContent, handler: d.adminDeleteBackup},
+        {Method: "GET", Path: "/v1/volumes/{name}/backups/{id}/chain", Summary: "List the backups to import to restore a backup and verify that they are stored",
+            Response: BackupChain{}, Status: http.StatusOK, handler: d.adminBackupChain},
+        {Method: "POST", Path: "/v1/volumes/{name}/backups/{id}/restore", Summary: "Create a volume from a backup and the incremental backups it is based on",
+            Request: RestoreBackupRequest{}, Response: VolumeInfo{}, Status: http.StatusCreated, handler: d.adminRestoreBackup},
+        {Method: "GET", Path: "/v1/volumegroup", Summary: "Show size and free space of the volume group of a storage class",
+            Query: []queryParam{{"class", "string", "storage class, default the default class"}},
+            Response: VolumeGroupInfo{}, Status: http.StatusOK, handler: d.adminVolumeGroup},
+        {Method: "GET", Path: "/v1/classes", Summary: "List the storage classes with their volume groups and usage",
+            Response: ClassList{}, Status: http.StatusOK, handler: d.adminListClasses},
+        {Method: "POST", Path: "/v1/reconcile", Summary: "Align metadata with the logical volumes and remove stale mountpoints",
+            Query: []queryParam{{"dry_run", "boolean", "only report what would be changed"}},
+            Response: ReconcileReport{}, Status: http.StatusOK, handler: d.adminReconcile},
+        {Method: "POST", Path: "/v1/gc", Summary: "Find orphaned volumes, mountpoints and device mapper targets and remove them according to the gc policy",
+            Query: []queryParam{{"dry_run", "boolean", "only report the orphans"}},
+            Response: GCReport{}, Status: http.StatusOK, handler: d.adminGC},
+        {Method: "GET", Path: "/v1/logs", Summary: "Recent log lines of the daemon",
+            Query: []queryParam{
+                {"lines", "integer", "number of lines, default 100"},
+                {"request_id", "string", "only lines of this request"},
+            },
+            Response: LogResponse{}, Status: http.StatusOK, handler: d.adminLogs},
+        {Method: "GET", Path: "/v1/openapi.json", Summary: "OpenAPI document of this API",
+            Status: http.StatusOK, handler: d.adminOpenAPI},
+    }
+}
+
+// matchPath matches a request path against a route path and returns the
+// values of the path parameters
+func matchPath(pattern string, path string) (map[string]string, bool) {
+    pp := strings.Split(strings.Trim(pattern, "/"), "/")
+    sp := strings.Split(strings.Trim(path, "/"), "/")
+    if len(pp) != len(sp) {
+        return nil, false
+    }
+    params := make(map[string]string)
+    for i := range pp {
+        if strings.HasPrefix(pp[i], "{") && strings.HasSuffix(pp[i], "}") {
+            if sp[i] == "" {
+                return nil, false
+            }
+            params[pp[i][1:len(pp[i])-1]] = sp[i]
+        } else if pp[i] != sp[i] {
+            return nil, false
+        }
+    }
+    return params, true
+}
+
+func writeAdminJson(w http.ResponseWriter, r *http.Request, code int, body interface{}) {
+    w.Header().Set("Content-Type", adminContentType)
+    if body == nil {
+        w.WriteHeader(code)
+        return
+    }
+    msg, _ := json.Marshal(body)
+    w.WriteHeader(code)
+    w.Write(msg)
+    LoggerFrom(r.Context()).Debug("Response sent", "status", code, "body", string(msg))
+}
+
+func writeAdminError(w http.ResponseWriter, r *http.Request, err error) {
+    e := AsError(err)
+    status := HTTPStatus(e)
+    if status >= 500 {
+        LoggerFrom(r.Context()).Error(e.Error())
+    } else {
+        LoggerFrom(r.Context()).Debug(e.Error())
+    }
+    writeAdminJson(w, r, status, ErrorResponse{Code: e.Code, Message: e.Message})
+}
+
+func decodeAdminRequest(r *http.Request, v interface{}) (error) {
+    dec := json.NewDecoder(r.Body)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(v); err != nil {
+        return InvalidArgument("Illegal request body: " + err.Error())
+    }
+    return nil
+}
+
+// authorizeAdmin checks the bearer token if one is configured
+func (d *Daemon) authorizeAdmin(r *http.Request) (error) {
+    if d.AdminToken == "" {
+        return nil
+    }
+    auth := r.Header.Get("Authorization")
+    if !strings.HasPrefix(auth, "Bearer ") ||
+        subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(d.AdminToken)) != 1 {
+        return Unauthorized("Missing or invalid bearer token")
+    }
+    return nil
+}
+
+// AdminHandler returns the handler for the admin API
+func (d *Daemon) AdminHandler() (http.Handler) {
+    routes := d.adminRoutes()
+    return withRequestLogger(func(w http.ResponseWriter, r *http.Request) {
+        if err := d.authorizeAdmin(r); err != nil {
+            writeAdminError(w, r, err)
+            return
+        }
+        pathMatched := false
+        for _, route := range routes {
+            if params, ok := matchPath(route.Path, r.URL.Path); ok {
+                pathMatched = true
+                if route.Method == r.Method {
+                    route.handler(w, r, params)
+                    return
+                }
+            }
+        }
+        if pathMatched {
+            w.Header().Set("Allow", strings.Join(allowedMethods(routes, r.URL.Path), ", "))
+            writeAdminJson(w, r, http.StatusMethodNotAllowed, ErrorResponse{Code: CodeInvalidArgument, Message: "Method " + r.Method + " not allowed"})
+            return
+        }
+        writeAdminError(w, r, NotFound("No such resource " + r.URL.Path))
+    })
+}
+
+func allowedMethods(routes []adminRoute, path string) ([]string) {
+    methods := []string{}
+    for _, route := range routes {
+        if _, ok := matchPath(route.Path, path); ok {
+            methods = append(methods, route.Method)
+        }
+    }
+    return methods
+}
+
+// --------------------------------------------------------------------------
+// Handlers
+// --------------------------------------------------------------------------
+
+func (d *Daemon) adminListVolumes(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    if infos, err := d.driver.ListVolumeInfos(r.Context()); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, VolumeList{Volumes: infos})
+    }
+}
+
+func (d *Daemon) adminCreateVolume(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    var req CreateVolumeRequest
+    if err := decodeAdminRequest(r, &req); err != nil {
+        writeAdminError(w, r, err)
+        return
+    }
+    options := make(map[string]string)
+    for k, v := range req.Options {
+        options[strings.ToLower(k)] = v
+    }
+    err := d.createVolume(r.Context(), r.URL.Path, req.Name, options)
+    d.audit(r, "admin-create", req.Name, options, err)
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else if info, err := d.driver.InspectVolume(r.Context(), req.Name); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusCreated, info)
+    }
+}
+
+func (d *Daemon) adminInspectVolume(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    if info, err := d.driver.InspectVolume(r.Context(), params["name"]); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, info)
+    }
+}
+
+func (d *Daemon) adminRemoveVolume(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    err := d.driver.DockerRemoveVolume(r.Context(), params["name"])
+    d.audit(r, "admin-remove", params["name"], nil, err)
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusNoContent, nil)
+    }
+}
+
+func (d *Daemon) adminResizeVolume(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    var req ResizeVolumeRequest
+    if err := decodeAdminRequest(r, &req); err != nil {
+        writeAdminError(w, r, err)
+        return
+    }
+    size, err := parseSize(req.Size)
+    if err != nil {
+        writeAdminError(w, r, err)
+        return
+    }
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    name := params["name"]
+    err = d.driver.ResizeVolume(r.Context(), name, size)
+    d.audit(r, "admin-resize", name, map[string]string{"size": req.Size}, err)
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else if info, err := d.driver.InspectVolume(r.Context(), name); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, info)
+    }
+}
+
+func (d *Daemon) adminListSnapshots(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    if infos, err := d.driver.ListSnapshots(r.Context(), params["name"]); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, VolumeList{Volumes: infos})
+    }
+}
+
+func (d *Daemon) adminCreateSnapshot(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    var req CreateSnapshotRequest
+    if err := decodeAdminRequest(r, &req); err != nil {
+        writeAdminError(w, r, err)
+        return
+    }
+    size := 0
+    if req.Size != "" {
+        var err error
+        if size, err = parseSize(req.Size); err != nil {
+            writeAdminError(w, r, err)
+            return
+        }
+    }
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    origin := params["name"]
+    err := d.driver.CreateSnapshot(r.Context(), origin, req.Name, size)
+    d.audit(r, "admin-snapshot", origin, map[string]string{"snapshot": req.Name, "size": req.Size}, err)
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else if info, err := d.driver.InspectVolume(r.Context(), req.Name); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusCreated, info)
+    }
+}
+
+func (d *Daemon) adminCloneStatus(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    if status, err := d.driver.CloneStatus(r.Context(), params["name"]); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, status)
+    }
+}
+
+func (d *Daemon) adminMergeSnapshot(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    force := false
+    if v := r.URL.Query().Get("force"); v != "" {
+        var err error
+        if force, err = strconv.ParseBool(v); err != nil {
+            writeAdminError(w, r, InvalidArgument("Illegal value for force: " + v))
+            return
+        }
+    }
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    name := params["name"]
+    status, err := d.driver.MergeSnapshot(r.Context(), name, force)
+    d.audit(r, "admin-merge", name, map[string]string{"force": strconv.FormatBool(force)}, err)
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, status)
+    }
+}
+
+func (d *Daemon) adminCancelClone(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    name := params["name"]
+    status, err := d.driver.CancelClone(r.Context(), name)
+    d.audit(r, "admin-cancel-clone", name, nil, err)
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, status)
+    }
+}
+
+// adminExportVolume streams the export of a volume. The request lock is only
+// held to set up and to clean up the export, so that other requests are not
+// blocked by a long download. Once the stream has started an error can only
+// be reported by aborting the connection; the missing trailer tells the
+// client.
+func (d *Daemon) adminExportVolume(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    ctx := r.Context()
+    name := params["name"]
+    query := r.URL.Query()
+    opts := map[string]string{"format": query.Get("format"), "compression": query.Get("compression")}
+    d.m.Lock(r.URL.Path)
+    job, err := d.driver.StartExport(ctx, name, opts["format"], opts["compression"])
+    d.m.Unlock()
+    if err != nil {
+        d.audit(r, "admin-export", name, opts, err)
+        writeAdminError(w, r, err)
+        return
+    }
+    opts["format"], opts["compression"] = job.header.Format, job.header.Compression
+    w.Header().Set("Content-Type", ExportContentType)
+    w.WriteHeader(http.StatusOK)
+    n, err := d.driver.WriteExport(ctx, job, w)
+    d.m.Lock(r.URL.Path)
+    d.driver.FinishExport(context.WithoutCancel(ctx), job)
+    d.m.Unlock()
+    d.audit(r, "admin-export", name, opts, err)
+    if err != nil {
+        LoggerFrom(ctx).Error("Export failed", "volume", name, "bytes", n, "error", err)
+        panic(http.ErrAbortHandler)
+    }
+    LoggerFrom(ctx).Info("Volume exported", "volume", name, "bytes", n)
+}
+
+// adminImportVolume creates a volume from the export stream in the request
+// body. The options are taken from the query, the request lock is not held
+// while the data is written.
+func (d *Daemon) adminImportVolume(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    ctx := r.Context()
+    name := params["name"]
+    options := make(map[string]string)
+    for k, v := range r.URL.Query() {
+        if len(v) > 0 {
+            options[strings.ToLower(k)] = v[len(v)-1]
+        }
+    }
+    body := bufio.NewReaderSize(r.Body, transferFrameSize)
+    header, err := ReadExportHeader(body)
+    if err != nil {
+        d.audit(r, "admin-import", name, options, err)
+        writeAdminError(w, r, err)
+        return
+    }
+    d.m.Lock(r.URL.Path)
+    job, err := d.driver.StartImport(ctx, name, options, header)
+    d.m.Unlock()
+    if err != nil {
+        d.audit(r, "admin-import", name, options, err)
+        writeAdminError(w, r, err)
+        return
+    }
+    err = d.driver.ReadImport(ctx, job, body)
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    err = d.driver.FinishImport(context.WithoutCancel(ctx), job, err)
+    d.audit(r, "admin-import", name, options, err)
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else if info, err := d.driver.InspectVolume(ctx, name); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusCreated, info)
+    }
+}
+
+// the backup handlers do not take the request lock, the catalog lives in
+// the backup target and a backup takes the lock itself
+
+func (d *Daemon) adminListBackups(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    if backups, err := d.driver.ListBackups(r.Context(), params["name"]); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, BackupList{Backups: backups})
+    }
+}
+
+func (d *Daemon) adminCreateBackup(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    name := params["name"]
+    record, err := d.Backup(r.Context(), name)
+    opts := map[string]string{}
+    if record != nil {
+        opts["backup"] = record.Id
+    }
+    d.audit(r, "admin-backup", name, opts, err)
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusCreated, record)
+    }
+}
+
+func (d *Daemon) adminGetBackup(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    if record, err := d.driver.GetBackup(r.Context(), params["name"], params["id"]); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, record)
+    }
+}
+
+func (d *Daemon) adminBackupChain(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    if chain, err := d.driver.BackupChain(r.Context(), params["name"], params["id"]); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, chain)
+    }
+}
+
+func (d *Daemon) adminDeleteBackup(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    name := params["name"]
+    err := d.driver.DeleteBackup(r.Context(), name, params["id"])
+    d.audit(r, "admin-delete-backup", name, map[string]string{"backup": params["id"]}, err)
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusNoContent, nil)
+    }
+}
+
+// adminRestoreBackup restores a backup into a new volume, the request lock
+// is not held while the data is restored
+func (d *Daemon) adminRestoreBackup(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    var req RestoreBackupRequest
+    // the body is optional
+    if r.ContentLength != 0 {
+        if err := decodeAdminRequest(r, &req); err != nil {
+            writeAdminError(w, r, err)
+            return
+        }
+    }
+    name := req.Name
+    if name == "" {
+        name = params["name"]
+    }
+    options := make(map[string]string)
+    for k, v := range req.Options {
+        options[strings.ToLower(k)] = v
+    }
+    options[RestoreFromOption] = params["name"] + "/" + params["id"]
+    err := d.Restore(r.Context(), name, options)
+    d.audit(r, "admin-restore", name, options, err)
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else if info, err := d.driver.InspectVolume(r.Context(), name); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusCreated, info)
+    }
+}
+
+func (d *Daemon) adminVolumeGroup(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    class := d.StorageClasses.DefaultClass()
+    if name := r.URL.Query().Get("class"); name != "" {
+        if class = d.StorageClasses.Get(name); class == nil {
+            writeAdminError(w, r, NotFound("No such storage class: " + name))
+            return
+        }
+    }
+    if info, err := d.driver.VolumeGroupInfo(r.Context(), class.VolumeGroup); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, info)
+    }
+}
+
+func (d *Daemon) adminListClasses(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    if classes, err := d.driver.ListClasses(r.Context()); err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, ClassList{Classes: classes})
+    }
+}
+
+func (d *Daemon) adminReconcile(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    dryRun := false
+    if v := r.URL.Query().Get("dry_run"); v != "" {
+        var err error
+        if dryRun, err = strconv.ParseBool(v); err != nil {
+            writeAdminError(w, r, InvalidArgument("Illegal value for dry_run: " + v))
+            return
+        }
+    }
+    d.m.Lock(r.URL.Path)
+    defer d.m.Unlock()
+    report, err := d.driver.Reconcile(r.Context(), dryRun)
+    if !dryRun {
+        d.audit(r, "admin-reconcile", "", nil, err)
+    }
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, report)
+    }
+}
+
+func (d *Daemon) adminGC(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    dryRun := false
+    if v := r.URL.Query().Get("dry_run"); v != "" {
+        var err error
+        if dryRun, err = strconv.ParseBool(v); err != nil {
+            writeAdminError(w, r, InvalidArgument("Illegal value for dry_run: " + v))
+            return
+        }
+    }
+    // takes the request lock itself, after asking docker
+    report, err := d.CollectGarbage(r.Context(), dryRun)
+    if !dryRun {
+        d.audit(r, "admin-gc", "", nil, err)
+    }
+    if err != nil {
+        writeAdminError(w, r, err)
+    } else {
+        writeAdminJson(w, r, http.StatusOK, report)
+    }
+}
+
+func (d *Daemon) adminLogs(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    lines := defaultLogLines
+    if v := r.URL.Query().Get("lines"); v != "" {
+        var err error
+        if lines, err = strconv.Atoi(v); err != nil || lines < 0 {
+            writeAdminError(w, r, InvalidArgument("Illegal value for lines: " + v))
+            return
+        }
+    }
+    if d.LogBuffer == nil {
+        writeAdminError(w, r, NotFound("Log buffer is disabled"))
+        return
+    }
+    // no request lock, the logs must be readable while a request hangs. The
+    // response is not logged, it would end up in the buffer again.
+    msg, _ := json.Marshal(LogResponse{Lines: d.LogBuffer.Lines(lines, r.URL.Query().Get("request_id"))})
+    w.Header().Set("Content-Type", adminContentType)
+    w.Write(msg)
+}
+
+func (d *Daemon) adminOpenAPI(w http.ResponseWriter, r *http.Request, params map[string]string) {
+    writeAdminJson(w, r, http.StatusOK, openAPIDocument(d.adminRoutes()))
+}
+
+// --------------------------------------------------------------------------
+// Listener
+// --------------------------------------------------------------------------
+
+func (d *Daemon) adminTLSConfig() (*tls.Config, error) {
+    if d.AdminTLSCert == "" || d.AdminTLSKey == "" {
+        return nil, errors.New("The admin API on http requires --admin-tls-cert and --admin-tls-key")
+    }
+    cert, err := tls.LoadX509KeyPair(d.AdminTLSCert, d.AdminTLSKey)
+    if err != nil {
+        return nil, err
+    }
+    config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+    if d.AdminTLSClientCA != "" {
+        pem, err := ioutil.ReadFile(d.AdminTLSClientCA)
+        if err != nil {
+            return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, errors.New("No certificates found in " + d.AdminTLSClientCA)
+        }
+        config.ClientCAs = pool
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+    return config, nil
+}
+
+// ServeAdmin serves the admin API on the configured listener. It only
+// returns on errors.
+func (d *Daemon) ServeAdmin() (error) {
+    switch d.AdminListener {
+    case "unix":
+        path := d.AdminSocket
+        if path == "" {
+            path = DefaultAdminSocket
+        }
+        if err := Mkdir(filepath.Dir(path), 0700, ""); err != nil {
+            return err
+        }
+        listener, err := NewUnixSocket(path, "")
+        if err != nil {
+            return errors.New("Cannot create admin socket: " + err.Error())
+        }
+        DefaultLogger().Info("Admin API listening", "socket", path)
+        srv := &http.Server{Handler: d.AdminHandler(), ConnContext: connContext}
+        return srv.Serve(listener)
+    case "http":
+        config, err := d.adminTLSConfig()
+        if err != nil {
+            return err
+        }
+        port := d.AdminPort
+        if port == 0 {
+            port = DefaultAdminPort
+        }
+        addr := d.AdminHost + ":" + strconv.Itoa(port)
+        DefaultLogger().Info("Admin API listening", "addr", addr, "client_certificates", d.AdminTLSClientCA != "")
+        srv := &http.Server{Addr: addr, Handler: d.AdminHandler(), TLSConfig: config}
+        return srv.ListenAndServeTLS("", "")
+    }
+    return errors.New("unrecognized admin listener " + d.AdminListener)
+}
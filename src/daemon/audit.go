@@ -0,0 +1,215 @@
+package daemon
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Audit log
+//
+// Append-only record of all operations which change volumes. Each entry is a
+// single JSON document on its own line. When the file grows beyond MaxSize
+// it is rotated to <file>.1, <file>.2, ... keeping at most MaxFiles old files.
+// --------------------------------------------------------------------------
+
+const (
+    DefaultAuditLogMaxSize = 100
+    DefaultAuditLogMaxFiles = 10
+)
+
+type Caller struct {
+    Transport string `json:"transport"`
+    RemoteAddr string `json:"remote_addr,omitempty"`
+    Pid *int32 `json:"pid,omitempty"`
+    Uid *uint32 `json:"uid,omitempty"`
+    Gid *uint32 `json:"gid,omitempty"`
+}
+
+type AuditEntry struct {
+    Time time.Time `json:"time"`
+    RequestId string `json:"request_id,omitempty"`
+    Operation string `json:"operation"`
+    Volume string `json:"volume,omitempty"`
+    Options map[string]string `json:"options,omitempty"`
+    Caller Caller `json:"caller"`
+    Result string `json:"result"`
+    Error string `json:"error,omitempty"`
+    Commands []string `json:"commands"`
+}
+
+type AuditLog struct {
+    Path string
+    MaxSize int64
+    MaxFiles int
+    m sync.Mutex
+    f *os.File
+    size int64
+}
+
+// OpenAuditLog opens (or creates) the audit log file for appending. maxSize
+// is given in megabytes.
+func OpenAuditLog(path string, maxSize int, maxFiles int) (*AuditLog, error) {
+    a := &AuditLog{Path: path, MaxSize: int64(maxSize) * 1024 * 1024, MaxFiles: maxFiles}
+    if err := a.open(); err != nil {
+        return nil, err
+    }
+    return a, nil
+}
+
+func (a *AuditLog) open() (error) {
+    f, err := os.OpenFile(a.Path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+    if err != nil {
+        return err
+    }
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    a.f = f
+    a.size = fi.Size()
+    return nil
+}
+
+func (a *AuditLog) rotate() (error) {
+    a.f.Close()
+    a.f = nil
+    if a.MaxFiles > 0 {
+        os.Remove(a.Path + "." + strconv.Itoa(a.MaxFiles))
+        for i := a.MaxFiles - 1; i > 0; i-- {
+            os.Rename(a.Path + "." + strconv.Itoa(i), a.Path + "." + strconv.Itoa(i + 1))
+        }
+        if err := os.Rename(a.Path, a.Path + ".1"); err != nil {
+            return err
+        }
+    } else {
+        if err := os.Truncate(a.Path, 0); err != nil {
+            return err
+        }
+    }
+    return a.open()
+}
+
+// Write appends the entry and syncs the file so that the entry survives a
+// crash of the daemon or the host.
+func (a *AuditLog) Write(entry AuditEntry) (error) {
+    line, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    line = append(line, '\n')
+
+    a.m.Lock()
+    defer a.m.Unlock()
+    if a.f == nil {
+        if err := a.open(); err != nil {
+            return err
+        }
+    }
+    if a.MaxSize > 0 && a.size > 0 && a.size + int64(len(line)) > a.MaxSize {
+        if err := a.rotate(); err != nil {
+            return err
+        }
+    }
+    n, err := a.f.Write(line)
+    a.size += int64(n)
+    if err != nil {
+        return err
+    }
+    return a.f.Sync()
+}
+
+func (a *AuditLog) Close() (error) {
+    a.m.Lock()
+    defer a.m.Unlock()
+    if a.f == nil {
+        return nil
+    }
+    err := a.f.Close()
+    a.f = nil
+    return err
+}
+
+// --------------------------------------------------------------------------
+// Recording of executed commands and of the caller
+// --------------------------------------------------------------------------
+
+type commandRecorder struct {
+    m sync.Mutex
+    commands []string
+}
+
+type commandRecorderKey struct{}
+
+// WithCommandRecorder returns a context in which every command executed by
+// runCommand is recorded.
+func WithCommandRecorder(ctx context.Context) (context.Context) {
+    return context.WithValue(ctx, commandRecorderKey{}, &commandRecorder{})
+}
+
+func recordCommand(ctx context.Context, cmd string) {
+    if rec, ok := ctx.Value(commandRecorderKey{}).(*commandRecorder); ok {
+        rec.m.Lock()
+        rec.commands = append(rec.commands, cmd)
+        rec.m.Unlock()
+    }
+}
+
+// RecordedCommands returns the commands executed within the context so far.
+func RecordedCommands(ctx context.Context) ([]string) {
+    cmds := []string{}
+    if rec, ok := ctx.Value(commandRecorderKey{}).(*commandRecorder); ok {
+        rec.m.Lock()
+        cmds = append(cmds, rec.commands...)
+        rec.m.Unlock()
+    }
+    return cmds
+}
+
+type callerKey struct{}
+
+func withCaller(ctx context.Context, c Caller) (context.Context) {
+    return context.WithValue(ctx, callerKey{}, c)
+}
+
+// CallerFrom returns the caller of the request: the peer credentials for
+// requests received on a unix socket and the remote address otherwise.
+func CallerFrom(r *http.Request) (Caller) {
+    if c, ok := r.Context().Value(callerKey{}).(Caller); ok {
+        return c
+    }
+    return Caller{Transport: "http", RemoteAddr: r.RemoteAddr}
+}
+
+// audit writes an audit entry for an operation executed on behalf of the
+// request. Failures to write are logged but do not fail the operation which
+// has already been carried out.
+func (d *Daemon) audit(r *http.Request, operation string, volume string, options map[string]string, err error) {
+    if d.AuditLog == nil {
+        return
+    }
+    ctx := r.Context()
+    entry := AuditEntry{
+        Time: time.Now().UTC(),
+        RequestId: RequestIdFrom(ctx),
+        Operation: operation,
+        Volume: volume,
+        Options: options,
+        Caller: CallerFrom(r),
+        Result: "success",
+        Commands: RecordedCommands(ctx),
+    }
+    if err != nil {
+        entry.Result = "failure"
+        entry.Error = err.Error()
+    }
+    if werr := d.AuditLog.Write(entry); werr != nil {
+        LoggerFrom(ctx).Error("Cannot write audit log", "path", d.AuditLog.Path, "error", werr)
+    }
+}
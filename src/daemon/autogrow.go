@@ -0,0 +1,335 @@
+package daemon
+
+import (
+    "context"
+    "errors"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Usage monitor and auto-grow
+//
+// A background monitor samples the usage of all mounted volumes with statfs
+// every MonitorInterval and exports it as metrics. Volumes created with an
+// autogrow threshold (-o autogrow=80 -o autogrow_step=1G -o autogrow_max=20G)
+// are extended online, logical volume and filesystem, once their usage
+// reaches the threshold; by one step per run of the monitor. A volume never
+// grows beyond its maximum, and only if the volume group keeps
+// AutoGrowReserveMB megabytes free afterwards, so that creating new volumes
+// is still possible.
+// --------------------------------------------------------------------------
+
+const (
+    AutoGrowOption = "autogrow"
+    AutoGrowStepOption = "autogrow_step"
+    AutoGrowMaxOption = "autogrow_max"
+    defaultAutoGrowStepPercent = 20
+    DefaultMonitorInterval = time.Minute
+
+    // results of a grow recorded in the lvmvd_autogrow_total metric
+    AutoGrowGrown = "grown"
+    AutoGrowLimitReached = "limit_reached"
+    AutoGrowInsufficientCapacity = "insufficient_capacity"
+    AutoGrowFailed = "failed"
+
+    metricVolumeSize = "lvmvd_volume_size_bytes"
+    metricVolumeUsed = "lvmvd_volume_used_bytes"
+    metricVolumeAvail = "lvmvd_volume_avail_bytes"
+    metricAutoGrow = "lvmvd_autogrow_total"
+    metricAutoGrowBytes = "lvmvd_autogrow_bytes_total"
+    metricMonitorLastRun = "lvmvd_monitor_last_run_timestamp_seconds"
+)
+
+var (
+    thresholdPattern = regexp.MustCompile("^([0-9]{1,2})%?$")
+    stepPercentPattern = regexp.MustCompile("^([0-9]{1,3})%$")
+)
+
+type AutoGrowPolicy struct {
+    // usage in percent at which the volume is grown
+    Threshold int `json:"threshold"`
+    // growth per step in megabytes, or in percent of the current size if
+    // StepPercent is set
+    StepMB int `json:"step_mb,omitempty"`
+    StepPercent int `json:"step_percent,omitempty"`
+    MaxMB int `json:"max_mb"`
+}
+
+// step returns the growth in megabytes of a volume of the given size
+func (p *AutoGrowPolicy) step(sizeMB int) (int) {
+    if p.StepPercent == 0 {
+        return p.StepMB
+    }
+    step := (sizeMB * p.StepPercent + 99) / 100
+    if step < 1 {
+        step = 1
+    }
+    return step
+}
+
+type FsUsage struct {
+    SizeBytes uint64
+    UsedBytes uint64
+    // available to unprivileged users, without the reserved blocks
+    AvailBytes uint64
+}
+
+// percent returns the usage like df does, reserved blocks count as used
+func (u FsUsage) percent() (float64) {
+    if u.UsedBytes + u.AvailBytes == 0 {
+        return 0
+    }
+    return float64(u.UsedBytes) * 100 / float64(u.UsedBytes + u.AvailBytes)
+}
+
+// parseAutoGrow returns the auto-grow policy requested by the options, nil
+// if the volume does not grow
+func parseAutoGrow(options map[string]string, sizeMB int) (*AutoGrowPolicy, error) {
+    val, ok := options[AutoGrowOption]
+    if !ok {
+        for _, o := range []string{AutoGrowStepOption, AutoGrowMaxOption} {
+            if _, ok := options[o]; ok {
+                return nil, InvalidArgument("Option " + o + " requires option " + AutoGrowOption)
+            }
+        }
+        return nil, nil
+    }
+    m := thresholdPattern.FindStringSubmatch(val)
+    if m == nil || m[1] == "0" || m[1] == "00" {
+        return nil, InvalidArgument("Illegal value " + val + " for option " + AutoGrowOption + ", expected a usage in percent between 1 and 99")
+    }
+    p := &AutoGrowPolicy{StepPercent: defaultAutoGrowStepPercent}
+    p.Threshold, _ = strconv.Atoi(m[1])
+    if step, ok := options[AutoGrowStepOption]; ok {
+        if m := stepPercentPattern.FindStringSubmatch(step); m != nil {
+            p.StepPercent, _ = strconv.Atoi(m[1])
+            if p.StepPercent == 0 {
+                return nil, InvalidArgument("Illegal value " + step + " for option " + AutoGrowStepOption)
+            }
+        } else {
+            var err error
+            if p.StepMB, err = parseSize(step); err != nil {
+                return nil, InvalidArgument("Illegal value " + step + " for option " + AutoGrowStepOption + ", expected a size or a percentage")
+            }
+            p.StepPercent = 0
+        }
+    }
+    max, ok := options[AutoGrowMaxOption]
+    if !ok {
+        return nil, InvalidArgument("Option " + AutoGrowOption + " requires option " + AutoGrowMaxOption)
+    }
+    var err error
+    if p.MaxMB, err = parseSize(max); err != nil {
+        return nil, err
+    }
+    if p.MaxMB <= sizeMB {
+        return nil, InvalidArgument("Option " + AutoGrowMaxOption + " must be larger than the size of the volume")
+    }
+    return p, nil
+}
+
+// ParseReserve parses the free space auto-grow has to leave in the volume
+// group, a size like 10G or 0
+func ParseReserve(s string) (int, error) {
+    if strings.TrimSpace(s) == "0" {
+        return 0, nil
+    }
+    mb, err := parseSize(s)
+    if err != nil {
+        return 0, errors.New("Illegal auto-grow reserve " + s + ", expected <number>[M|G]")
+    }
+    return mb, nil
+}
+
+func (d *VolumeDriver) statfs(path string) (FsUsage, error) {
+    if d.Statfs != nil {
+        return d.Statfs(path)
+    }
+    return statfs(path)
+}
+
+// autoGrow extends a volume and its filesystem to newSizeMB if its volume
+// group has enough free space. Thin volumes take no space in the volume
+// group when they grow, RAID volumes also for their copies and parity.
+func (d *VolumeDriver) autoGrow(ctx context.Context, info VolumeInfo, newSizeMB int) (error) {
+    if info.ThinPool == "" {
+        vg, err := d.VolumeGroupInfo(ctx, info.VolumeGroup)
+        if err != nil {
+            return err
+        }
+        growth := newSizeMB - int(info.SizeMB)
+        allocated := growth
+        if info.Raid != nil {
+            allocated = info.Raid.allocatedMB(growth)
+        }
+        if vg.FreeMB - int64(allocated) < int64(d.AutoGrowReserveMB) {
+            msg := "Volume group " + vg.Name + " has " + strconv.FormatInt(vg.FreeMB, 10) + "MB free, growing volume " +
+                info.Name + " by " + strconv.Itoa(growth) + "MB"
+            if allocated != growth {
+                msg += " takes " + strconv.Itoa(allocated) + "MB with its " + info.Raid.Type + " layout and"
+            }
+            return InsufficientCapacity(msg + " would leave less than " + strconv.Itoa(d.AutoGrowReserveMB) + "MB")
+        }
+    }
+    return d.ResizeVolume(ctx, info.Name, newSizeMB)
+}
+
+type monitor struct {
+    d *VolumeDriver
+    // grows are serialized with the requests from docker
+    lock *requestLock
+    interval time.Duration
+    // volumes over their threshold which cannot grow, by reason; logged
+    // again once the reason changes
+    blocked map[string]string
+}
+
+// startMonitor starts the usage monitor unless the interval is zero. It
+// returns immediately.
+func (s *Daemon) startMonitor(ctx context.Context) {
+    if s.MonitorInterval <= 0 {
+        return
+    }
+    m := &monitor{d: s.driver, lock: s.m, interval: s.MonitorInterval, blocked: make(map[string]string)}
+    for _, name := range []string{metricAutoGrow, metricAutoGrowBytes} {
+        s.Metrics.Describe(name, metricCounter, autoGrowHelp[name])
+    }
+    s.driver.background(func() { m.run(ctx) })
+}
+
+var autoGrowHelp = map[string]string{
+    metricVolumeSize: "Size of the filesystem of a mounted volume.",
+    metricVolumeUsed: "Used space of the filesystem of a mounted volume.",
+    metricVolumeAvail: "Space of the filesystem of a mounted volume available to unprivileged users.",
+    metricAutoGrow: "Volumes grown by auto-grow and grows not possible, by result.",
+    metricAutoGrowBytes: "Bytes added to volumes by auto-grow.",
+    metricMonitorLastRun: "Time of the last run of the usage monitor.",
+}
+
+func (m *monitor) run(ctx context.Context) {
+    ticker := time.NewTicker(m.interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            m.sample(ctx)
+        }
+    }
+}
+
+// sample records the usage of all mounted volumes and grows those over
+// their threshold
+func (m *monitor) sample(ctx context.Context) {
+    l := DefaultLogger().With("component", "monitor")
+    ctx = WithLogger(ctx, l)
+    metrics := m.d.Metrics
+    m.lock.Lock("usage monitor")
+    infos, err := m.d.volumeInfos(ctx)
+    m.lock.Unlock()
+    if err != nil {
+        l.Error("Cannot list volumes", "error", err)
+        return
+    }
+    // volumes which are not mounted anymore have no usage, the samples of
+    // the run replace the previous ones at once
+    gauges := map[string]map[string]float64{metricVolumeSize: {}, metricVolumeUsed: {}, metricVolumeAvail: {}}
+    type candidate struct {
+        info VolumeInfo
+        policy *AutoGrowPolicy
+        percent float64
+    }
+    candidates := []candidate{}
+    for _, info := range infos {
+        if !info.Mounted {
+            continue
+        }
+        usage, err := m.d.statfs(info.Mountpoint)
+        if err != nil {
+            l.Warn("Cannot determine usage of volume", "volume", info.Name, "error", err)
+            continue
+        }
+        labels := renderLabels([]string{"volume", info.Name})
+        gauges[metricVolumeSize][labels] = float64(usage.SizeBytes)
+        gauges[metricVolumeUsed][labels] = float64(usage.UsedBytes)
+        gauges[metricVolumeAvail][labels] = float64(usage.AvailBytes)
+        meta, err := m.d.loadMetadata(info.Name)
+        if err != nil || meta.AutoGrow == nil {
+            continue
+        }
+        if percent := usage.percent(); percent >= float64(meta.AutoGrow.Threshold) {
+            candidates = append(candidates, candidate{info: info, policy: meta.AutoGrow, percent: percent})
+        } else {
+            delete(m.blocked, info.Name)
+        }
+    }
+    metrics.Replace(autoGrowHelp, gauges)
+    for _, c := range candidates {
+        m.grow(ctx, c.info, c.policy, c.percent)
+    }
+    metrics.Set(metricMonitorLastRun, autoGrowHelp[metricMonitorLastRun], float64(time.Now().Unix()))
+}
+
+func (m *monitor) grow(ctx context.Context, info VolumeInfo, p *AutoGrowPolicy, percent float64) {
+    l := LoggerFrom(ctx).With("volume", info.Name, "usage_percent", int(percent), "threshold", p.Threshold)
+    size := int(info.SizeMB)
+    if size >= p.MaxMB {
+        m.block(l, info.Name, AutoGrowLimitReached, "Volume reached its maximum size, not growing", "size_mb", size, "max_mb", p.MaxMB)
+        return
+    }
+    newSize := size + p.step(size)
+    if newSize > p.MaxMB {
+        newSize = p.MaxMB
+    }
+    m.lock.Lock("auto-grow " + info.Name)
+    // the volume may have been removed, unmounted or resized since it was
+    // sampled without the lock
+    current, err := m.d.InspectVolume(ctx, info.Name)
+    switch {
+    case HasCode(err, CodeNotFound):
+        m.lock.Unlock()
+        l.Info("Volume removed since it was sampled, not growing")
+        return
+    case err == nil && !current.Mounted:
+        m.lock.Unlock()
+        l.Info("Volume unmounted since it was sampled, not growing")
+        return
+    case err == nil && int(current.SizeMB) >= newSize:
+        m.lock.Unlock()
+        l.Info("Volume grown since it was sampled, not growing", "size_mb", current.SizeMB)
+        return
+    }
+    start := time.Now()
+    if err == nil {
+        size = int(current.SizeMB)
+        err = m.d.autoGrow(WithLogger(ctx, l), *current, newSize)
+    }
+    m.lock.Unlock()
+    switch {
+    case HasCode(err, CodeInsufficientCapacity):
+        m.block(l, info.Name, AutoGrowInsufficientCapacity, "Not enough free space to grow volume", "error", err)
+    case err != nil:
+        m.d.Metrics.Inc(metricAutoGrow, autoGrowHelp[metricAutoGrow], "volume", info.Name, "result", AutoGrowFailed)
+        l.Error("Auto-grow failed", "error", err)
+    default:
+        delete(m.blocked, info.Name)
+        m.d.Metrics.Inc(metricAutoGrow, autoGrowHelp[metricAutoGrow], "volume", info.Name, "result", AutoGrowGrown)
+        m.d.Metrics.Add(metricAutoGrowBytes, autoGrowHelp[metricAutoGrowBytes], float64(newSize - size) * 1024 * 1024, "volume", info.Name)
+        l.Info("Volume grown", "from_mb", size, "to_mb", newSize, "max_mb", p.MaxMB, "duration", time.Since(start).Round(time.Millisecond).String())
+    }
+}
+
+// block records that a volume cannot grow; logged and counted only when the
+// reason changes, not on every run of the monitor
+func (m *monitor) block(l *Logger, name string, reason string, msg string, kv ...interface{}) {
+    if m.blocked[name] == reason {
+        return
+    }
+    m.blocked[name] = reason
+    m.d.Metrics.Inc(metricAutoGrow, autoGrowHelp[metricAutoGrow], "volume", name, "result", reason)
+    l.Warn(msg, kv...)
+}
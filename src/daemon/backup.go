@@ -0,0 +1,589 @@
+package daemon
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "io/ioutil"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Backups
+//
+// Volumes created with -o backup-interval=24h are backed up on that
+// schedule; a backup can also be taken at any time through the admin API.
+// A backup is the export stream of the volume (see transfer.go), always read
+// from a snapshot so that the volume stays usable, which is removed again
+// afterwards. The stream goes to the BackupTarget of the daemon, followed by
+// its catalog record, so the target alone is enough to find and restore the
+// backups of a volume, also after the volume or the host is gone.
+//
+// Retention is per volume: -o backup-keep=7 keeps the newest seven backups,
+// -o backup-max-age=30d additionally removes older ones; the newest backup
+// is never removed by the age. A backup is due one interval after the last
+// attempt, or after the creation of the volume; failed backups are retried
+// after an interval as well. The scheduler checks for due backups every
+// BackupCheckInterval and takes one backup after the other. Thin volumes
+// can be backed up incrementally, see incremental.go.
+// --------------------------------------------------------------------------
+
+const (
+    BackupIntervalOption = "backup-interval"
+    BackupKeepOption = "backup-keep"
+    BackupMaxAgeOption = "backup-max-age"
+    BackupFormatOption = "backup-format"
+    BackupCompressionOption = "backup-compression"
+    defaultBackupKeep = 7
+    defaultBackupFormat = TransferFormatRaw
+    defaultBackupCompression = CompressionGzip
+    DefaultBackupCheckInterval = time.Minute
+
+    BackupTriggerSchedule = "schedule"
+    BackupTriggerManual = "manual"
+    BackupSucceeded = "success"
+    BackupFailed = "failure"
+
+    // objects in the backup target below <volume>/
+    backupStreamSuffix = ".stream"
+    backupRecordSuffix = ".json"
+
+    metricBackup = "lvmvd_backup_total"
+    metricBackupBytes = "lvmvd_backup_bytes_total"
+    metricBackupLastSuccess = "lvmvd_backup_last_success_timestamp_seconds"
+)
+
+var (
+    backupDurationPattern = regexp.MustCompile("^([0-9]+)d$")
+    backupIdPattern = regexp.MustCompile("^[0-9]{8}T[0-9]{6}Z-[0-9a-f]{4}$")
+)
+
+type BackupPolicy struct {
+    IntervalSeconds int64 `json:"interval_seconds"`
+    // number of backups kept
+    Keep int `json:"keep"`
+    // backups older than this are removed, unlimited if zero
+    MaxAgeSeconds int64 `json:"max_age_seconds,omitempty"`
+    // export format and compression of the backups
+    Format string `json:"format"`
+    Compression string `json:"compression"`
+    // only changed blocks are backed up, with a full backup every
+    // FullEvery backups
+    Incremental bool `json:"incremental,omitempty"`
+    FullEvery int `json:"full_every,omitempty"`
+}
+
+func (p *BackupPolicy) interval() (time.Duration) {
+    return time.Duration(p.IntervalSeconds) * time.Second
+}
+
+// BackupStatus is the result of the last backup of a volume
+type BackupStatus struct {
+    Time time.Time `json:"time"`
+    // success or failure
+    Result string `json:"result"`
+    Id string `json:"id,omitempty"`
+    Error string `json:"error,omitempty"`
+}
+
+// BackupRecord is the catalog entry of a backup, stored next to its stream
+type BackupRecord struct {
+    Id string `json:"id"`
+    Volume string `json:"volume"`
+    Created time.Time `json:"created"`
+    // schedule or manual
+    Trigger string `json:"trigger"`
+    Format string `json:"format"`
+    Compression string `json:"compression"`
+    SizeMB int64 `json:"size_mb"`
+    Filesystem string `json:"filesystem"`
+    Encrypted bool `json:"encrypted"`
+    // length and SHA-256 of the uncompressed payload, as in the trailer of
+    // the stream
+    Bytes int64 `json:"bytes"`
+    SHA256 string `json:"sha256"`
+    // length of the stored stream
+    StoredBytes int64 `json:"stored_bytes"`
+    Duration string `json:"duration"`
+    // backup an incremental backup applies to, empty for full backups
+    Base string `json:"base,omitempty"`
+}
+
+// parseBackupDuration parses a duration like 12h or 30d
+func parseBackupDuration(option string, val string) (time.Duration, error) {
+    if m := backupDurationPattern.FindStringSubmatch(val); m != nil {
+        days, err := strconv.Atoi(m[1])
+        if err == nil && days > 0 {
+            return time.Duration(days) * 24 * time.Hour, nil
+        }
+    } else if d, err := time.ParseDuration(val); err == nil && d >= time.Second {
+        return d, nil
+    }
+    return 0, InvalidArgument("Illegal value " + val + " for option " + option + ", expected a duration like 12h or 7d of at least 1s")
+}
+
+// parseBackupPolicy returns the backup schedule requested by the options,
+// nil if the volume is not backed up on a schedule
+func parseBackupPolicy(options map[string]string) (*BackupPolicy, error) {
+    val, ok := options[BackupIntervalOption]
+    if !ok {
+        for _, o := range []string{BackupKeepOption, BackupMaxAgeOption, BackupFormatOption, BackupCompressionOption,
+            BackupIncrementalOption, BackupFullEveryOption} {
+            if _, ok := options[o]; ok {
+                return nil, InvalidArgument("Option " + o + " requires option " + BackupIntervalOption)
+            }
+        }
+        return nil, nil
+    }
+    interval, err := parseBackupDuration(BackupIntervalOption, val)
+    if err != nil {
+        return nil, err
+    }
+    p := &BackupPolicy{IntervalSeconds: int64(interval / time.Second), Keep: defaultBackupKeep}
+    if keep, ok := options[BackupKeepOption]; ok {
+        if p.Keep, err = strconv.Atoi(keep); err != nil || p.Keep < 1 {
+            return nil, InvalidArgument("Illegal value " + keep + " for option " + BackupKeepOption + ", expected a number of at least 1")
+        }
+    }
+    if age, ok := options[BackupMaxAgeOption]; ok {
+        maxAge, err := parseBackupDuration(BackupMaxAgeOption, age)
+        if err != nil {
+            return nil, err
+        }
+        p.MaxAgeSeconds = int64(maxAge / time.Second)
+    }
+    if p.Format, p.Compression, err = parseTransferFormat(options[BackupFormatOption], options[BackupCompressionOption]); err != nil {
+        return nil, err
+    }
+    if _, ok := options[BackupCompressionOption]; !ok {
+        p.Compression = defaultBackupCompression
+    }
+    if val, ok := options[BackupIncrementalOption]; ok {
+        if p.Incremental, err = strconv.ParseBool(val); err != nil {
+            return nil, InvalidArgument("Illegal value " + val + " for option " + BackupIncrementalOption + ", expected true or false")
+        }
+    }
+    full, ok := options[BackupFullEveryOption]
+    switch {
+    case ok && !p.Incremental:
+        return nil, InvalidArgument("Option " + BackupFullEveryOption + " requires option " + BackupIncrementalOption)
+    case !p.Incremental:
+        return p, nil
+    case p.Format != TransferFormatRaw:
+        return nil, InvalidArgument("Incremental backups are raw, option " + BackupFormatOption + "=" + p.Format + " is not supported")
+    }
+    p.FullEvery = defaultBackupFullEvery
+    if ok {
+        if p.FullEvery, err = strconv.Atoi(full); err != nil || p.FullEvery < 1 {
+            return nil, InvalidArgument("Illegal value " + full + " for option " + BackupFullEveryOption + ", expected a number of at least 1")
+        }
+    }
+    return p, nil
+}
+
+func (d *VolumeDriver) requireBackupTarget() (error) {
+    if d.BackupTarget == nil {
+        return InvalidArgument("Backups are not enabled, the daemon has to be started with a backup target")
+    }
+    return nil
+}
+
+func backupKey(volume string, id string, suffix string) (string) {
+    return volume + "/" + id + suffix
+}
+
+// newBackupId returns an id which sorts by time
+func newBackupId(t time.Time) (string, error) {
+    b := make([]byte, 2)
+    if _, err := rand.Read(b); err != nil {
+        return "", Internal("Cannot generate backup id: " + err.Error())
+    }
+    return t.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b), nil
+}
+
+// ListBackups returns the catalog of a volume from the backup target,
+// oldest first. The volume does not have to exist anymore.
+func (d *VolumeDriver) ListBackups(ctx context.Context, volume string) ([]BackupRecord, error) {
+    if err := d.requireBackupTarget(); err != nil {
+        return nil, err
+    }
+    if err := validateName(volume); err != nil {
+        return nil, err
+    }
+    keys, err := d.BackupTarget.List(ctx, volume + "/")
+    if err != nil {
+        return nil, err
+    }
+    records := []BackupRecord{}
+    for _, key := range keys {
+        if !strings.HasSuffix(key, backupRecordSuffix) {
+            continue
+        }
+        record, err := d.loadBackupRecord(ctx, key)
+        if err != nil {
+            LoggerFrom(ctx).Warn("Ignoring unreadable backup record", "key", key, "error", err)
+            continue
+        }
+        records = append(records, *record)
+    }
+    sort.Slice(records, func(i, j int) (bool) { return records[i].Created.Before(records[j].Created) })
+    return records, nil
+}
+
+func (d *VolumeDriver) loadBackupRecord(ctx context.Context, key string) (*BackupRecord, error) {
+    r, err := d.BackupTarget.Get(ctx, key)
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    data, err := ioutil.ReadAll(r)
+    if err != nil {
+        return nil, Internal("Cannot read backup record " + key + ": " + err.Error())
+    }
+    var record BackupRecord
+    if err := json.Unmarshal(data, &record); err != nil {
+        return nil, Internal("Cannot decode backup record " + key + ": " + err.Error())
+    }
+    return &record, nil
+}
+
+// GetBackup returns the catalog record of a backup
+func (d *VolumeDriver) GetBackup(ctx context.Context, volume string, id string) (*BackupRecord, error) {
+    if err := d.requireBackupTarget(); err != nil {
+        return nil, err
+    }
+    if err := validateName(volume); err != nil {
+        return nil, err
+    }
+    if !backupIdPattern.MatchString(id) {
+        return nil, InvalidArgument("Illegal backup id " + id)
+    }
+    record, err := d.loadBackupRecord(ctx, backupKey(volume, id, backupRecordSuffix))
+    if HasCode(err, CodeNotFound) {
+        return nil, NotFound("Backup " + id + " of volume " + volume + " does not exist")
+    }
+    return record, err
+}
+
+// DeleteBackup removes a backup from the catalog and the target, unless an
+// incremental backup is based on it
+func (d *VolumeDriver) DeleteBackup(ctx context.Context, volume string, id string) (error) {
+    if _, err := d.GetBackup(ctx, volume, id); err != nil {
+        return err
+    }
+    records, err := d.ListBackups(ctx, volume)
+    if err != nil {
+        return err
+    }
+    for _, record := range records {
+        if record.Base == id {
+            return InUse("Backup " + id + " is the base of backup " + record.Id + ", delete that first")
+        }
+    }
+    return d.deleteBackup(ctx, volume, id)
+}
+
+// deleteBackup removes a backup. The record goes first, a stream without
+// record is no backup.
+func (d *VolumeDriver) deleteBackup(ctx context.Context, volume string, id string) (error) {
+    if err := d.BackupTarget.Delete(ctx, backupKey(volume, id, backupRecordSuffix)); err != nil {
+        return err
+    }
+    LoggerFrom(ctx).Info("Backup deleted", "volume", volume, "backup", id)
+    return d.BackupTarget.Delete(ctx, backupKey(volume, id, backupStreamSuffix))
+}
+
+// startBackup prepares the export of a volume for a backup, with the
+// policy of the volume or the defaults for volumes without schedule
+func (d *VolumeDriver) startBackup(ctx context.Context, name string) (*transferJob, error) {
+    if err := d.requireBackupTarget(); err != nil {
+        return nil, err
+    }
+    info, err := d.InspectVolume(ctx, name)
+    if err != nil {
+        return nil, err
+    }
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return nil, Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    format, compression := defaultBackupFormat, defaultBackupCompression
+    if meta.Backup != nil {
+        format, compression = meta.Backup.Format, meta.Backup.Compression
+    }
+    job, err := d.startExport(ctx, name, format, compression, true)
+    if err == nil && meta.Backup != nil && meta.Backup.Incremental && info.ThinPool != "" && !info.Encrypted {
+        job.keepSnapshot = true
+        d.prepareIncremental(ctx, job, info, meta)
+    }
+    return job, err
+}
+
+// writeBackup streams the export to the backup target and stores its
+// record. Neither is left in the target if the backup fails.
+func (d *VolumeDriver) writeBackup(ctx context.Context, job *transferJob, trigger string) (*BackupRecord, error) {
+    start := time.Now()
+    id, err := newBackupId(start)
+    if err != nil {
+        return nil, err
+    }
+    job.header.Backup = id
+    record := &BackupRecord{
+        Id: id,
+        Volume: job.name,
+        Created: start.UTC(),
+        Trigger: trigger,
+        Format: job.header.Format,
+        Compression: job.header.Compression,
+        SizeMB: job.header.SizeMB,
+        Filesystem: job.header.Filesystem,
+        Encrypted: job.header.Encrypted,
+        Base: job.header.Base,
+    }
+    stream := backupKey(job.name, id, backupStreamSuffix)
+    pr, pw := io.Pipe()
+    done := make(chan error, 1)
+    go func() {
+        _, err := d.WriteExport(ctx, job, pw)
+        pw.CloseWithError(err)
+        done <- err
+    }()
+    stored, err := d.BackupTarget.Put(ctx, stream, pr)
+    // stops the export if the target gave up
+    pr.CloseWithError(io.ErrClosedPipe)
+    if werr := <-done; err == nil {
+        err = werr
+    }
+    if err == nil {
+        record.Bytes, record.SHA256 = job.trailer.Bytes, job.trailer.SHA256
+        record.StoredBytes = stored
+        record.Duration = time.Since(start).Round(time.Millisecond).String()
+        data, _ := json.Marshal(record)
+        _, err = d.BackupTarget.Put(ctx, backupKey(job.name, id, backupRecordSuffix), bytes.NewReader(data))
+    }
+    if err != nil {
+        if derr := d.BackupTarget.Delete(context.WithoutCancel(ctx), stream); derr != nil {
+            LoggerFrom(ctx).Warn("Cannot delete stream of failed backup", "key", stream, "error", derr)
+        }
+        return nil, err
+    }
+    return record, nil
+}
+
+// recordBackup stores the result of the last backup in the metadata of the
+// volume, unless it was removed meanwhile
+func (d *VolumeDriver) recordBackup(ctx context.Context, name string, status *BackupStatus) {
+    meta, err := d.loadMetadata(name)
+    if err != nil || meta == nil || d.State == nil {
+        return
+    }
+    meta.LastBackup = status
+    if err := d.saveMetadata(meta); err != nil {
+        LoggerFrom(ctx).Warn("Cannot record result of backup", "volume", name, "error", err)
+    }
+}
+
+// applyRetention removes the backups of a volume the policy does not keep
+// and returns their ids. The bases of incremental backups kept are kept as
+// well.
+func (d *VolumeDriver) applyRetention(ctx context.Context, volume string, p *BackupPolicy, now time.Time) ([]string, error) {
+    records, err := d.ListBackups(ctx, volume)
+    if err != nil {
+        return nil, err
+    }
+    bases := make(map[string]string)
+    for _, record := range records {
+        bases[record.Id] = record.Base
+    }
+    keep := make(map[string]bool)
+    for i, record := range records {
+        newer := len(records) - i - 1
+        expired := p.MaxAgeSeconds > 0 && newer > 0 && now.Sub(record.Created) > time.Duration(p.MaxAgeSeconds) * time.Second
+        if newer < p.Keep && !expired {
+            for id := record.Id; id != "" && !keep[id]; id = bases[id] {
+                keep[id] = true
+            }
+        }
+    }
+    removed := []string{}
+    // newest first, incremental backups before their bases
+    for i := len(records) - 1; i >= 0; i-- {
+        if keep[records[i].Id] {
+            continue
+        }
+        if err := d.deleteBackup(ctx, volume, records[i].Id); err != nil {
+            return removed, err
+        }
+        removed = append(removed, records[i].Id)
+    }
+    return removed, nil
+}
+
+// --------------------------------------------------------------------------
+// Backup scheduler
+// --------------------------------------------------------------------------
+
+type backupScheduler struct {
+    d *VolumeDriver
+    lock *requestLock
+    interval time.Duration
+    m sync.Mutex
+    // volumes being backed up
+    running map[string]bool
+}
+
+var backupHelp = map[string]string{
+    metricBackup: "Backups by volume and result.",
+    metricBackupBytes: "Bytes stored in the backup target by backups.",
+    metricBackupLastSuccess: "Time of the last successful backup of a volume.",
+}
+
+// startBackups sets up the backups if the daemon has a backup target and
+// starts the scheduler unless the check interval is zero. It returns
+// immediately.
+func (s *Daemon) startBackups(ctx context.Context) {
+    if s.BackupTarget == nil {
+        return
+    }
+    s.backups = &backupScheduler{d: s.driver, lock: s.m, interval: s.BackupCheckInterval, running: make(map[string]bool)}
+    for _, name := range []string{metricBackup, metricBackupBytes} {
+        s.Metrics.Describe(name, metricCounter, backupHelp[name])
+    }
+    if s.BackupCheckInterval > 0 {
+        s.driver.background(func() { s.backups.run(ctx) })
+    }
+}
+
+// Backup takes a backup of a volume now
+func (s *Daemon) Backup(ctx context.Context, name string) (*BackupRecord, error) {
+    if s.backups == nil {
+        return nil, s.driver.requireBackupTarget()
+    }
+    return s.backups.backup(ctx, name, BackupTriggerManual)
+}
+
+func (b *backupScheduler) run(ctx context.Context) {
+    ticker := time.NewTicker(b.interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            b.check(ctx)
+        }
+    }
+}
+
+// check backs up all volumes whose backup is due
+func (b *backupScheduler) check(ctx context.Context) {
+    l := DefaultLogger().With("component", "backups")
+    ctx = WithLogger(ctx, l)
+    now := time.Now()
+    due := []string{}
+    b.lock.Lock("backup scheduler")
+    names, err := b.d.State.Names()
+    for _, name := range names {
+        meta, err := b.d.loadMetadata(name)
+        if err != nil || meta == nil || meta.Backup == nil || meta.Importing {
+            continue
+        }
+        last := meta.Created
+        if meta.LastBackup != nil {
+            last = meta.LastBackup.Time
+        }
+        if now.Sub(last) >= meta.Backup.interval() {
+            due = append(due, name)
+        }
+    }
+    b.lock.Unlock()
+    if err != nil {
+        l.Error("Cannot list volumes", "error", err)
+        return
+    }
+    for _, name := range due {
+        if ctx.Err() != nil {
+            return
+        }
+        // errors are logged and recorded by backup
+        b.backup(ctx, name, BackupTriggerSchedule)
+    }
+}
+
+// backup takes a backup of a volume and applies the retention of its
+// policy afterwards. The request lock is not held while the data is
+// streamed.
+func (b *backupScheduler) backup(ctx context.Context, name string, trigger string) (*BackupRecord, error) {
+    b.m.Lock()
+    if b.running[name] {
+        b.m.Unlock()
+        return nil, InUse("Volume " + name + " is being backed up")
+    }
+    b.running[name] = true
+    b.m.Unlock()
+    defer func() {
+        b.m.Lock()
+        delete(b.running, name)
+        b.m.Unlock()
+    }()
+
+    l := LoggerFrom(ctx).With("volume", name, "trigger", trigger)
+    ctx = WithLogger(ctx, l)
+    metrics := b.d.Metrics
+    b.lock.Lock("backup " + name)
+    job, err := b.d.startBackup(ctx, name)
+    b.lock.Unlock()
+    if HasCode(err, CodeNotFound) {
+        return nil, err
+    }
+    var record *BackupRecord
+    if err == nil {
+        record, err = b.d.writeBackup(ctx, job, trigger)
+    }
+    status := &BackupStatus{Time: time.Now().UTC(), Result: BackupSucceeded}
+    if err != nil {
+        status.Result, status.Error = BackupFailed, err.Error()
+    } else {
+        status.Id = record.Id
+    }
+    b.lock.Lock("backup " + name)
+    if job != nil {
+        if err == nil && job.keepSnapshot {
+            if kerr := b.d.keepBackupBase(context.WithoutCancel(ctx), job, record); kerr != nil {
+                l.Warn("Cannot keep the snapshot as base of the next backup", "error", kerr)
+            }
+        }
+        b.d.FinishExport(context.WithoutCancel(ctx), job)
+    }
+    b.d.recordBackup(ctx, name, status)
+    var policy *BackupPolicy
+    if meta, merr := b.d.loadMetadata(name); merr == nil && meta != nil {
+        policy = meta.Backup
+    }
+    b.lock.Unlock()
+    metrics.Inc(metricBackup, backupHelp[metricBackup], "volume", name, "result", status.Result)
+    if err != nil {
+        l.Error("Backup failed", "error", err)
+        return nil, err
+    }
+    metrics.Add(metricBackupBytes, backupHelp[metricBackupBytes], float64(record.StoredBytes), "volume", name)
+    metrics.Set(metricBackupLastSuccess, backupHelp[metricBackupLastSuccess], float64(status.Time.Unix()), "volume", name)
+    l.Info("Backup finished", "backup", record.Id, "bytes", record.Bytes, "stored_bytes", record.StoredBytes, "duration", record.Duration)
+    if policy != nil {
+        removed, err := b.d.applyRetention(ctx, name, policy, time.Now())
+        if err != nil {
+            l.Error("Cannot remove expired backups", "error", err)
+        } else if len(removed) > 0 {
+            l.Info("Expired backups removed", "backups", strings.Join(removed, ","))
+        }
+    }
+    return record, nil
+}
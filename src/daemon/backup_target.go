@@ -0,0 +1,187 @@
+package daemon
+
+import (
+    "context"
+    "errors"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// --------------------------------------------------------------------------
+// Backup targets
+//
+// Backups are not kept by the driver itself but stored in a BackupTarget,
+// so that they can live off the host, e.g. in an object store. A target
+// stores objects under keys like paths, <volume>/<id>.json; it knows
+// nothing about volumes or the format of the objects. The directory target
+// keeps every object in a file below a directory, which may be a mounted
+// network filesystem.
+// --------------------------------------------------------------------------
+
+const (
+    BackupTargetNone = "none"
+    BackupTargetDirectory = "dir"
+    // objects being written are hidden from List and removed at start
+    partialObjectSuffix = ".partial"
+)
+
+type BackupTarget interface {
+    // Put stores the object read from r under key, replacing an existing
+    // one, and returns its length. Nothing is stored if reading fails.
+    Put(ctx context.Context, key string, r io.Reader) (int64, error)
+    // Get returns the content of an object, NotFound if it does not exist
+    Get(ctx context.Context, key string) (io.ReadCloser, error)
+    // Delete removes an object; removing a missing object is no error
+    Delete(ctx context.Context, key string) (error)
+    // List returns the keys of all objects starting with prefix, sorted
+    List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// DirectoryTarget keeps every object in the file <dir>/<key>
+type DirectoryTarget struct {
+    Dir string
+}
+
+func NewDirectoryTarget(dir string) (*DirectoryTarget, error) {
+    if dir == "" {
+        return nil, errors.New("The directory backup target requires a directory")
+    }
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    t := &DirectoryTarget{Dir: dir}
+    // leftovers of writes interrupted by a restart
+    err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) (error) {
+        if err == nil && !fi.IsDir() && strings.HasSuffix(path, partialObjectSuffix) {
+            err = os.Remove(path)
+        }
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return t, nil
+}
+
+// path returns the file of an object, keys must not leave the directory
+func (t *DirectoryTarget) path(key string) (string, error) {
+    clean := filepath.Clean("/" + key)
+    if key == "" || clean != "/" + key || strings.HasSuffix(key, partialObjectSuffix) {
+        return "", InvalidArgument("Illegal backup object key " + key)
+    }
+    return filepath.Join(t.Dir, filepath.FromSlash(key)), nil
+}
+
+func (t *DirectoryTarget) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+    path, err := t.path(key)
+    if err != nil {
+        return 0, err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return 0, Internal("Cannot create directory for backup object " + key + ": " + err.Error())
+    }
+    tmp := path + partialObjectSuffix
+    f, err := os.OpenFile(tmp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+    if err != nil {
+        return 0, Internal("Cannot store backup object " + key + ": " + err.Error())
+    }
+    n, err := io.Copy(f, r)
+    if err == nil {
+        err = f.Sync()
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp, path)
+    }
+    if err != nil {
+        os.Remove(tmp)
+        if _, ok := err.(*Error); ok {
+            return n, err
+        }
+        return n, Internal("Cannot store backup object " + key + ": " + err.Error())
+    }
+    return n, nil
+}
+
+func (t *DirectoryTarget) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+    path, err := t.path(key)
+    if err != nil {
+        return nil, err
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, NotFound("Backup object " + key + " does not exist")
+        }
+        return nil, Internal("Cannot read backup object " + key + ": " + err.Error())
+    }
+    return f, nil
+}
+
+func (t *DirectoryTarget) Delete(ctx context.Context, key string) (error) {
+    path, err := t.path(key)
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+        return Internal("Cannot delete backup object " + key + ": " + err.Error())
+    }
+    // directories of volumes without backups are not kept
+    os.Remove(filepath.Dir(path))
+    return nil
+}
+
+func (t *DirectoryTarget) List(ctx context.Context, prefix string) ([]string, error) {
+    keys := []string{}
+    err := filepath.Walk(t.Dir, func(path string, fi os.FileInfo, err error) (error) {
+        if err != nil || fi.IsDir() || strings.HasSuffix(path, partialObjectSuffix) {
+            return err
+        }
+        rel, err := filepath.Rel(t.Dir, path)
+        if err != nil {
+            return err
+        }
+        if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+            keys = append(keys, key)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, Internal("Cannot list backup objects: " + err.Error())
+    }
+    sort.Strings(keys)
+    return keys, nil
+}
+
+// Check verifies that the backup directory is accessible
+func (t *DirectoryTarget) Check() (error) {
+    fi, err := os.Stat(t.Dir)
+    if err != nil {
+        return err
+    }
+    if !fi.IsDir() {
+        return errors.New(t.Dir + " is not a directory")
+    }
+    return checkWritable(t.Dir)
+}
+
+// NewBackupTarget creates the backup target selected by name; nil is
+// returned for "none", which disables backups
+func NewBackupTarget(name string, dir string) (BackupTarget, error) {
+    switch name {
+    case "", BackupTargetNone:
+        return nil, nil
+    case BackupTargetDirectory:
+        t, err := NewDirectoryTarget(dir)
+        if err != nil {
+            return nil, err
+        }
+        return t, nil
+    }
+    return nil, errors.New("Unknown backup target " + name + ", expected none or dir")
+}
@@ -0,0 +1,311 @@
+package daemon
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// --------------------------------------------------------------------------
+// Storage classes
+//
+// A storage class maps to a volume group, optionally to a thin pool in it,
+// and carries the defaults and limits of the volumes created in it, so that
+// one daemon serves hosts with several kinds of storage, e.g. an SSD and an
+// HDD volume group. A volume selects its class on create with -o class=ssd
+// or a name suffix -oCssd (in front of a size suffix: data-oCssd-oS10G),
+// otherwise it is created in the default class. The class and the volume
+// group of a volume are recorded in its metadata. Volume names are unique
+// across all classes, as docker knows the volumes by name only.
+//
+// Without a configuration file there is a single class "default" for the
+// volume group given on the command line.
+// --------------------------------------------------------------------------
+
+const (
+    ClassOption = "class"
+    DefaultClassName = "default"
+)
+
+var (
+    classNamePattern = regexp.MustCompile("^[a-zA-Z0-9_]{1,32}$")
+    classSuffixPattern = regexp.MustCompile("-oC([a-zA-Z0-9_]+)(-oS[0-9]+[MG]?)?$")
+)
+
+// filesystems volumes can be created with; lost+found is created by mkfs
+var supportedFilesystems = map[string]bool{"ext4": true, "xfs": true}
+var fsLostFound = map[string]bool{"ext4": true}
+
+type StorageClass struct {
+    Name string `json:"name"`
+    VolumeGroup string `json:"volume_group"`
+    // volumes are thin volumes of this pool in the volume group if set
+    ThinPool string `json:"thin_pool,omitempty"`
+    // filesystem of new volumes, ext4 if empty
+    Filesystem string `json:"filesystem,omitempty"`
+    // size of volumes created without a size, the daemon default if zero
+    DefaultSizeMB int `json:"default_size_mb,omitempty"`
+    // limits of the class, unlimited if zero
+    MaxSizeMB int `json:"max_size_mb,omitempty"`
+    MaxVolumes int `json:"max_volumes,omitempty"`
+}
+
+type StorageClasses struct {
+    // name of the class of volumes created without a class, may be left
+    // out if there is only one class
+    Default string `json:"default"`
+    Classes []*StorageClass `json:"classes"`
+}
+
+type ClassInfo struct {
+    StorageClass
+    Default bool `json:"default"`
+    Volumes int `json:"volumes"`
+    // sum of the sizes of the volumes of the class
+    AllocatedMB int64 `json:"allocated_mb"`
+    VolumeGroupInfo *VolumeGroupInfo `json:"volume_group_info"`
+}
+
+// SingleStorageClass returns the configuration of a daemon serving a single
+// volume group
+func SingleStorageClass(volumeGroup string, defaultSizeMB int) (*StorageClasses) {
+    return &StorageClasses{
+        Default: DefaultClassName,
+        Classes: []*StorageClass{{Name: DefaultClassName, VolumeGroup: volumeGroup, Filesystem: DEFAULT_FILESYSTEM, DefaultSizeMB: defaultSizeMB}},
+    }
+}
+
+// LoadStorageClasses reads the storage classes from a JSON file. Classes
+// without a default size get defaultSizeMB.
+func LoadStorageClasses(file string, defaultSizeMB int) (*StorageClasses, error) {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    var c StorageClasses
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&c); err != nil {
+        return nil, errors.New("Illegal storage classes in " + file + ": " + err.Error())
+    }
+    for _, class := range c.Classes {
+        if class != nil && class.DefaultSizeMB == 0 {
+            class.DefaultSizeMB = defaultSizeMB
+        }
+    }
+    if err := c.validate(); err != nil {
+        return nil, errors.New("Illegal storage classes in " + file + ": " + err.Error())
+    }
+    return &c, nil
+}
+
+func (c *StorageClasses) validate() (error) {
+    if len(c.Classes) == 0 {
+        return errors.New("no storage class defined")
+    }
+    names := make(map[string]bool)
+    pools := make(map[string]bool)
+    for _, class := range c.Classes {
+        if class == nil || !classNamePattern.MatchString(class.Name) {
+            return errors.New("storage classes need a name of letters, digits and underscores")
+        }
+        if names[class.Name] {
+            return errors.New("storage class " + class.Name + " is defined twice")
+        }
+        names[class.Name] = true
+        if class.VolumeGroup == "" {
+            return errors.New("storage class " + class.Name + " has no volume group")
+        }
+        // the class of a volume found in LVM is derived from its volume
+        // group and thin pool
+        key := class.VolumeGroup + "/" + class.ThinPool
+        if pools[key] {
+            return errors.New("storage class " + class.Name + " uses the same volume group and thin pool as another class")
+        }
+        pools[key] = true
+        if class.Filesystem == "" {
+            class.Filesystem = DEFAULT_FILESYSTEM
+        }
+        if !supportedFilesystems[class.Filesystem] {
+            return errors.New("storage class " + class.Name + " has unsupported filesystem " + class.Filesystem + ", expected ext4 or xfs")
+        }
+        if class.DefaultSizeMB < 0 || class.MaxSizeMB < 0 || class.MaxVolumes < 0 {
+            return errors.New("storage class " + class.Name + " has a negative size or limit")
+        }
+        if class.MaxSizeMB > 0 && class.DefaultSizeMB > class.MaxSizeMB {
+            return errors.New("storage class " + class.Name + " has a default size above its maximum size")
+        }
+    }
+    if c.Default == "" && len(c.Classes) == 1 {
+        c.Default = c.Classes[0].Name
+    }
+    if c.Default == "" {
+        return errors.New("no default storage class given")
+    }
+    if !names[c.Default] {
+        return errors.New("default storage class " + c.Default + " is not defined")
+    }
+    return nil
+}
+
+// Get returns the class of the given name, nil if there is none
+func (c *StorageClasses) Get(name string) (*StorageClass) {
+    for _, class := range c.Classes {
+        if class.Name == name {
+            return class
+        }
+    }
+    return nil
+}
+
+func (c *StorageClasses) DefaultClass() (*StorageClass) {
+    return c.Get(c.Default)
+}
+
+// VolumeGroups returns the volume groups of all classes, the one of the
+// default class first
+func (c *StorageClasses) VolumeGroups() ([]string) {
+    vgs := []string{c.DefaultClass().VolumeGroup}
+    for _, class := range c.Classes {
+        if !stringInList(class.VolumeGroup, vgs) {
+            vgs = append(vgs, class.VolumeGroup)
+        }
+    }
+    return vgs
+}
+
+// classFor returns the class of a logical volume in the volume group and
+// thin pool, nil if no class matches
+func (c *StorageClasses) classFor(vg string, pool string) (*StorageClass) {
+    for _, class := range c.Classes {
+        if class.VolumeGroup == vg && class.ThinPool == pool {
+            return class
+        }
+    }
+    return nil
+}
+
+// getClassFromName returns the class given by the name suffix -oC<class>,
+// empty if there is none
+func getClassFromName(name string) (string) {
+    if m := classSuffixPattern.FindStringSubmatch(name); m != nil {
+        return m[1]
+    }
+    return ""
+}
+
+// selectClass returns the class a new volume is created in
+func (d *VolumeDriver) selectClass(name string, options map[string]string) (*StorageClass, error) {
+    className, ok := options[ClassOption]
+    if !ok {
+        className = getClassFromName(name)
+    }
+    if className == "" {
+        return d.Classes.DefaultClass(), nil
+    }
+    class := d.Classes.Get(className)
+    if class == nil {
+        return nil, InvalidArgument("Unknown storage class " + className)
+    }
+    return class, nil
+}
+
+// checkClassLimits refuses a new volume of the given size if it exceeds the
+// limits of its class
+func (d *VolumeDriver) checkClassLimits(ctx context.Context, class *StorageClass, sizeMB int) (error) {
+    if class.MaxSizeMB > 0 && sizeMB > class.MaxSizeMB {
+        return InvalidArgument("Volumes of storage class " + class.Name + " are limited to " + strconv.Itoa(class.MaxSizeMB) + "MB")
+    }
+    if class.MaxVolumes == 0 {
+        return nil
+    }
+    infos, err := d.volumeInfos(ctx)
+    if err != nil {
+        return err
+    }
+    n := 0
+    for _, info := range infos {
+        if info.Class == class.Name {
+            n++
+        }
+    }
+    if n >= class.MaxVolumes {
+        return InsufficientCapacity("Storage class " + class.Name + " is limited to " + strconv.Itoa(class.MaxVolumes) + " volumes")
+    }
+    return nil
+}
+
+// volumeGroupOf returns the volume group of a volume. Volumes without a
+// recorded volume group were created before storage classes and are in the
+// volume group of the default class.
+func (d *VolumeDriver) volumeGroupOf(name string) (string) {
+    if meta, err := d.loadMetadata(name); err == nil && meta.VolumeGroup != "" {
+        return meta.VolumeGroup
+    }
+    return d.Classes.DefaultClass().VolumeGroup
+}
+
+// filesystemOf returns the filesystem of a volume
+func filesystemOf(meta *VolumeMetadata) (string) {
+    if meta.Filesystem == "" {
+        return DEFAULT_FILESYSTEM
+    }
+    return meta.Filesystem
+}
+
+// ListClasses returns the storage classes with their usage
+func (d *VolumeDriver) ListClasses(ctx context.Context) ([]ClassInfo, error) {
+    infos, err := d.volumeInfos(ctx)
+    if err != nil {
+        return nil, err
+    }
+    groups := make(map[string]*VolumeGroupInfo)
+    classes := []ClassInfo{}
+    for _, class := range d.Classes.Classes {
+        vg, ok := groups[class.VolumeGroup]
+        if !ok {
+            if vg, err = d.VolumeGroupInfo(ctx, class.VolumeGroup); err != nil {
+                return nil, err
+            }
+            groups[class.VolumeGroup] = vg
+        }
+        ci := ClassInfo{StorageClass: *class, Default: class.Name == d.Classes.Default, VolumeGroupInfo: vg}
+        for _, info := range infos {
+            if info.Class == class.Name {
+                ci.Volumes++
+                ci.AllocatedMB += info.SizeMB
+            }
+        }
+        classes = append(classes, ci)
+    }
+    return classes, nil
+}
+
+// ensureThinPools checks that the thin pools of all classes exist
+func (d *VolumeDriver) ensureThinPools(ctx context.Context) (error) {
+    for _, class := range d.Classes.Classes {
+        if class.ThinPool == "" {
+            continue
+        }
+        status := d.runCommand(ctx, "lvs", []string{"--noheadings", "--separator", lvsSeparator, "-o", "lv_name,segtype", class.VolumeGroup})
+        if status.status != 0 {
+            return commandError(status, status.String())
+        }
+        found := false
+        for _, line := range strings.Split(status.stdout, "\n") {
+            values := strings.Split(strings.TrimSpace(line), lvsSeparator)
+            if len(values) == 2 && values[0] == class.ThinPool && values[1] == segtypeThinPool {
+                found = true
+            }
+        }
+        if !found {
+            return NotFound("No thin pool " + class.ThinPool + " in volume group " + class.VolumeGroup + " of storage class " + class.Name)
+        }
+    }
+    return nil
+}
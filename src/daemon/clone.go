@@ -0,0 +1,659 @@
+package daemon
+
+import (
+    "context"
+    "io"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Volume cloning
+//
+// A volume created with -o clone-from=<volume> is a full copy of an existing
+// volume, e.g. for blue/green updates of a service. A clone of a thin volume
+// in the same thin pool is a thin snapshot, which is instant and shares the
+// unchanged blocks with its source; a mounted source is quiesced for the
+// snapshot like for any other (see quiesce.go). Any other clone is a new
+// logical volume of the size of the source, to which the source is copied
+// block by block in the background; create returns at once. The source has
+// to be unmounted for the copy, or with -o clone-freeze=true it may be
+// mounted: it is frozen (fsfreeze) only while lvcreate takes a hidden
+// snapshot of it like for an export, the snapshot is copied and removed
+// afterwards. Source and clone cannot be resized or removed while the copy
+// runs, and the clone cannot be mounted. A source copied directly cannot be
+// mounted either; one copied from its snapshot can be mounted and unmounted
+// meanwhile, e.g. to stop its service. Progress is reported and the copy can be
+// canceled through the admin API; a failed or canceled clone cannot be
+// mounted and has to be removed.
+//
+// Clones get a new filesystem UUID, so that source and clone can be mounted
+// at the same time; xfs refuses to mount two filesystems with the same UUID.
+// A copy interrupted by a restart of the daemon fails.
+// --------------------------------------------------------------------------
+
+const (
+    CloneFromOption = "clone-from"
+    CloneFreezeOption = "clone-freeze"
+
+    CloneMethodThinSnapshot = "thin-snapshot"
+    CloneMethodCopy = "copy"
+
+    CloneCopying = "copying"
+    CloneCompleted = "completed"
+    CloneFailed = "failed"
+    CloneCanceled = "canceled"
+
+    cloneBlockSize = 4 * 1024 * 1024
+    // percentage steps in which progress is logged
+    cloneProgressStep = 10
+)
+
+type CloneStatus struct {
+    Source string `json:"source"`
+    // thin-snapshot or copy
+    Method string `json:"method"`
+    // copying, completed, failed or canceled
+    State string `json:"state"`
+    SizeMB int64 `json:"size_mb"`
+    CopiedMB int64 `json:"copied_mb"`
+    Percent int `json:"percent"`
+    // the mounted source was frozen for the snapshot that is copied
+    Frozen bool `json:"frozen,omitempty"`
+    Started time.Time `json:"started"`
+    Finished *time.Time `json:"finished,omitempty"`
+    Error string `json:"error,omitempty"`
+}
+
+type cloneJob struct {
+    name string
+    source string
+    // hidden snapshot of the source which is copied, empty if the source
+    // is copied directly
+    snapshot string
+    // live progress, guarded by the lock of the cloner
+    status CloneStatus
+    // stopped by the shutdown of the daemon, guarded by the lock of the cloner
+    interrupted bool
+    cancel context.CancelFunc
+    done chan struct{}
+}
+
+type cloner struct {
+    m sync.Mutex
+    // running copies by the name of the clone
+    jobs map[string]*cloneJob
+}
+
+func (c *cloner) add(job *cloneJob) {
+    c.m.Lock()
+    c.jobs[job.name] = job
+    c.m.Unlock()
+}
+
+func (c *cloner) remove(job *cloneJob) {
+    c.m.Lock()
+    delete(c.jobs, job.name)
+    c.m.Unlock()
+}
+
+func (c *cloner) get(name string) (*cloneJob) {
+    c.m.Lock()
+    defer c.m.Unlock()
+    return c.jobs[name]
+}
+
+// progress records the bytes copied and returns the percentage done
+func (c *cloner) progress(job *cloneJob, copied int64) (int) {
+    c.m.Lock()
+    defer c.m.Unlock()
+    job.status.CopiedMB = copied / (1024 * 1024)
+    if size := job.status.SizeMB * 1024 * 1024; size > 0 {
+        job.status.Percent = int(copied * 100 / size)
+    }
+    return job.status.Percent
+}
+
+// StartCloner sets up the bookkeeping of running copies and fails the
+// copies interrupted by a restart. Their snapshots are removed with those of
+// the exports, see StartTransfers.
+func (d *VolumeDriver) StartCloner(ctx context.Context) (error) {
+    d.cloner = &cloner{jobs: make(map[string]*cloneJob)}
+    if d.State == nil {
+        return nil
+    }
+    names, err := d.State.Names()
+    if err != nil {
+        return err
+    }
+    for _, name := range names {
+        meta, err := d.State.Load(name)
+        if err != nil || meta == nil || meta.Clone == nil || meta.Clone.State != CloneCopying {
+            continue
+        }
+        l := DefaultLogger().With("volume", name, "source", meta.Clone.Source)
+        l.Warn("Copy of clone was interrupted by a restart, the clone has to be removed")
+        d.finishClone(meta, meta.Clone, CloneFailed, "Copy interrupted by a restart of the daemon")
+    }
+    return nil
+}
+
+// stopClones cancels the running copies at the shutdown of the daemon and
+// waits until they have stopped; the clones are kept in state failed like
+// after a restart
+func (d *VolumeDriver) stopClones() {
+    if d.cloner == nil {
+        return
+    }
+    d.cloner.m.Lock()
+    jobs := make([]*cloneJob, 0, len(d.cloner.jobs))
+    for _, job := range d.cloner.jobs {
+        job.interrupted = true
+        jobs = append(jobs, job)
+    }
+    d.cloner.m.Unlock()
+    for _, job := range jobs {
+        job.cancel()
+        <-job.done
+    }
+}
+
+// cloneBusy refuses changes of the source and the clone of a running copy
+func (d *VolumeDriver) cloneBusy(name string) (error) {
+    if d.cloner == nil {
+        return nil
+    }
+    d.cloner.m.Lock()
+    defer d.cloner.m.Unlock()
+    for _, job := range d.cloner.jobs {
+        switch name {
+        case job.name:
+            return InUse("Volume " + name + " is being copied from " + job.source + ", " + strconv.Itoa(job.status.Percent) + "% done")
+        case job.source:
+            return InUse("Volume " + name + " is being copied to clone " + job.name)
+        }
+    }
+    return nil
+}
+
+// cloneMountBusy refuses the mount and unmount of the clone of a running
+// copy and of a source which is copied directly
+func (d *VolumeDriver) cloneMountBusy(name string) (error) {
+    if d.cloner == nil {
+        return nil
+    }
+    d.cloner.m.Lock()
+    defer d.cloner.m.Unlock()
+    for _, job := range d.cloner.jobs {
+        switch {
+        case name == job.name:
+            return InUse("Volume " + name + " is being copied from " + job.source + ", " + strconv.Itoa(job.status.Percent) + "% done")
+        case name == job.source && job.snapshot == "":
+            return InUse("Volume " + name + " is being copied to clone " + job.name)
+        }
+    }
+    return nil
+}
+
+// checkCloneComplete refuses the mount of a clone whose copy failed or was
+// canceled
+func checkCloneComplete(meta *VolumeMetadata) (error) {
+    if meta.Clone == nil || meta.Clone.State == CloneCompleted {
+        return nil
+    }
+    return InvalidArgument("Volume " + meta.Name + " is an incomplete clone of " + meta.Clone.Source +
+        " (" + meta.Clone.State + "), it has to be removed")
+}
+
+// cloneStatus returns the status of a clone with the progress of a running
+// copy, nil for volumes which are no clones
+func (d *VolumeDriver) cloneStatus(meta *VolumeMetadata) (*CloneStatus) {
+    if meta.Clone == nil {
+        return nil
+    }
+    if d.cloner != nil {
+        d.cloner.m.Lock()
+        defer d.cloner.m.Unlock()
+        if job, ok := d.cloner.jobs[meta.Name]; ok {
+            status := job.status
+            return &status
+        }
+    }
+    status := *meta.Clone
+    return &status
+}
+
+// CloneStatus returns the status of a clone
+func (d *VolumeDriver) CloneStatus(ctx context.Context, name string) (*CloneStatus, error) {
+    if _, err := d.InspectVolume(ctx, name); err != nil {
+        return nil, err
+    }
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return nil, Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    status := d.cloneStatus(meta)
+    if status == nil {
+        return nil, NotFound("Volume " + name + " is not a clone")
+    }
+    return status, nil
+}
+
+// CancelClone stops the running copy of a clone and waits until it has
+// stopped. The clone is kept in state canceled.
+func (d *VolumeDriver) CancelClone(ctx context.Context, name string) (*CloneStatus, error) {
+    status, err := d.CloneStatus(ctx, name)
+    if err != nil {
+        return nil, err
+    }
+    job := d.cloner.get(name)
+    if job == nil {
+        return nil, InvalidArgument("Clone " + name + " is " + status.State + ", only running copies can be canceled")
+    }
+    LoggerFrom(ctx).Info("Canceling copy of clone", "volume", name, "source", job.source)
+    job.cancel()
+    select {
+    case <-job.done:
+    case <-ctx.Done():
+        return nil, newError(CodeCanceled, "Request canceled while waiting for the copy of " + name + " to stop")
+    }
+    return d.CloneStatus(ctx, name)
+}
+
+func parseCloneFreeze(options map[string]string) (bool, error) {
+    val, ok := options[CloneFreezeOption]
+    if !ok {
+        return false, nil
+    }
+    freeze, err := strconv.ParseBool(val)
+    if err != nil {
+        return false, InvalidArgument("Illegal value " + val + " for option " + CloneFreezeOption + ", expected true or false")
+    }
+    return freeze, nil
+}
+
+// createClone creates the volume name as a clone of source. The clone is in
+// the class of its source unless a class is given, has the size, filesystem
+// and encryption of its source and by default also its mount options.
+func (d *VolumeDriver) createClone(ctx context.Context, name string, source string, options map[string]string) (error) {
+    l := LoggerFrom(ctx).With("volume", name, "source", source)
+    for _, o := range []string{UidOption, GidOption, ModeOption, LostFoundOption} {
+        if _, ok := options[o]; ok {
+            return InvalidArgument("Option " + o + " is not supported for clones, they have the root directory of their source")
+        }
+    }
+    freeze, err := parseCloneFreeze(options)
+    if err != nil {
+        return err
+    }
+    info, err := d.InspectVolume(ctx, source)
+    if err != nil {
+        return err
+    }
+    sourceMeta, err := d.loadMetadata(source)
+    if err != nil {
+        return Internal("Cannot read metadata of volume " + source + ": " + err.Error())
+    }
+    if err := checkCloneComplete(sourceMeta); err != nil {
+        return err
+    }
+    if err := d.cloneBusy(source); err != nil {
+        return err
+    }
+    if err := d.mergeBusy(source); err != nil {
+        return err
+    }
+    if err := d.transferBusy(source); err != nil {
+        return err
+    }
+    var class *StorageClass
+    if _, ok := options[ClassOption]; ok || getClassFromName(name) != "" {
+        if class, err = d.selectClass(name, options); err != nil {
+            return err
+        }
+    } else if class = d.Classes.Get(info.Class); class == nil {
+        class = d.Classes.DefaultClass()
+    }
+    size := int(info.SizeMB)
+    requested := getSizeFromName(name)
+    if val, ok := options["size"]; ok {
+        if requested, err = parseSize(val); err != nil {
+            return err
+        }
+    }
+    if requested != 0 && requested != size {
+        return InvalidArgument("Clones have the size of their source, " + strconv.Itoa(size) + "MB; resize the clone afterwards")
+    }
+    if _, ok := options[EncryptedOption]; ok {
+        if encrypted, err := parseEncrypted(options); err != nil {
+            return err
+        } else if encrypted != info.Encrypted {
+            return InvalidArgument("Clones are encrypted like their source")
+        }
+    }
+    if info.Encrypted {
+        if err := d.requireKeyProvider(); err != nil {
+            return err
+        }
+    }
+    mountOptions, readOnly := sourceMeta.MountOptions, sourceMeta.ReadOnly
+    _, hasMountOptions := options[MountOptionsOption]
+    if _, ok := options[ReadOnlyOption]; ok || hasMountOptions {
+        if mountOptions, readOnly, err = d.volumeMountOptions(options, info.Filesystem); err != nil {
+            return err
+        }
+    }
+    autoGrow, err := parseAutoGrow(options, size)
+    if err != nil {
+        return err
+    }
+    if autoGrow != nil && info.Encrypted {
+        return InvalidArgument("Encrypted volumes cannot be resized, option " + AutoGrowOption + " is not supported")
+    }
+    if autoGrow != nil && class.MaxSizeMB > 0 && autoGrow.MaxMB > class.MaxSizeMB {
+        return InvalidArgument("Option " + AutoGrowMaxOption + " exceeds the maximum size of storage class " + class.Name)
+    }
+    backup, err := parseBackupPolicy(options)
+    if err != nil {
+        return err
+    }
+    if err := checkIncrementalBackup(backup, class, info.Encrypted); err != nil {
+        return err
+    }
+    if backup != nil {
+        if err := d.requireBackupTarget(); err != nil {
+            return err
+        }
+    }
+    quiesce, err := d.parseQuiesce(options)
+    if err != nil {
+        return err
+    }
+    ioLimits, err := parseIOLimits(options)
+    if err != nil {
+        return err
+    }
+    raid, err := parseRaid(options)
+    if err != nil {
+        return err
+    }
+    if exists, err := d.existsVolume(ctx, name); err != nil {
+        return err
+    } else if exists {
+        return AlreadyExists("Volume " + name + " already exists")
+    }
+    if err := d.checkClassLimits(ctx, class, size); err != nil {
+        return err
+    }
+    if err := d.checkRaid(ctx, class, raid); err != nil {
+        return err
+    }
+    thin := info.ThinPool != "" && class.VolumeGroup == info.VolumeGroup && class.ThinPool == info.ThinPool
+    if !thin && info.Mounted && !freeze {
+        return InUse("Volume " + source + " is mounted, unmount it or freeze it for a snapshot with -o " + CloneFreezeOption + "=true")
+    }
+    if !thin && info.Mounted && info.ThinPool == "" && info.Origin != "" {
+        return InUse("Snapshot " + source + " is mounted, LVM cannot take a snapshot of it; unmount it for the clone")
+    }
+    status := &CloneStatus{Source: source, Method: CloneMethodCopy, State: CloneCopying, SizeMB: info.SizeMB,
+        Frozen: !thin && info.Mounted, Started: time.Now().UTC()}
+    if thin {
+        status.Method = CloneMethodThinSnapshot
+    }
+    meta := &VolumeMetadata{
+        Name: name,
+        Created: status.Started,
+        Options: options,
+        Encrypted: info.Encrypted,
+        MountOptions: mountOptions,
+        ReadOnly: readOnly,
+        AutoGrow: autoGrow,
+        Backup: backup,
+        Quiesce: quiesce,
+        IOLimits: ioLimits,
+        Raid: raid,
+        Class: class.Name,
+        VolumeGroup: class.VolumeGroup,
+        ThinPool: class.ThinPool,
+        Filesystem: info.Filesystem,
+        Clone: status,
+    }
+    l.Info("Creating clone", "method", status.Method, "size_mb", size, "class", class.Name, "frozen", status.Frozen)
+    if info.Encrypted {
+        // the clone has the LUKS header of its source and needs its key
+        if err := d.KeyProvider.CopyKey(ctx, source, name); err != nil {
+            return err
+        }
+    }
+    if thin {
+        err = d.quiesced(ctx, info, sourceMeta, func(ctx context.Context) (error) {
+            // -kn: thin snapshots are skipped on activation by default
+            status := d.runCommand(ctx, "lvcreate", []string{"-s", "-kn", "-n", name, info.VolumeGroup + "/" + source})
+            if status.status != 0 {
+                return commandError(status, "Cannot create thin snapshot " + name + " of volume " + source + ": " + status.stderr)
+            }
+            return nil
+        })
+    } else {
+        err = d.createVolume(ctx, class, name, size, raid)
+    }
+    if err != nil {
+        d.deleteCloneKey(ctx, meta)
+        return err
+    }
+    // the device of the clone is found through its metadata
+    if err := d.saveMetadata(meta); err != nil {
+        d.discardClone(ctx, meta)
+        return err
+    }
+    if thin {
+        if err := d.newFilesystemUUID(ctx, meta); err != nil {
+            d.discardClone(ctx, meta)
+            return err
+        }
+        d.finishClone(meta, status, CloneCompleted, "")
+        l.Info("Clone created")
+        return nil
+    }
+    from, snapshot := info.Device, ""
+    if status.Frozen {
+        // the freeze lasts only as long as lvcreate, the copy reads the
+        // snapshot
+        frozen := *sourceMeta
+        frozen.Quiesce = &QuiescePolicy{Freeze: true}
+        if sourceMeta.Quiesce != nil {
+            frozen.Quiesce.Hook = sourceMeta.Quiesce.Hook
+        }
+        if snapshot, err = d.exportSnapshot(ctx, info, &frozen); err != nil {
+            d.discardClone(ctx, meta)
+            return err
+        }
+        from = d.devicePath(info.VolumeGroup, snapshot)
+        l = l.With("snapshot", snapshot)
+    }
+    // the copy outlives the request
+    jobCtx, cancel := context.WithCancel(WithLogger(context.Background(), l))
+    job := &cloneJob{name: name, source: source, snapshot: snapshot, status: *status, cancel: cancel, done: make(chan struct{})}
+    d.cloner.add(job)
+    go d.copyClone(jobCtx, job, meta, from, snapshot)
+    return nil
+}
+
+// copyClone copies the source or its snapshot to the clone, gives the clone
+// a new filesystem UUID and records the result. The snapshot is removed.
+func (d *VolumeDriver) copyClone(ctx context.Context, job *cloneJob, meta *VolumeMetadata, from string, snapshot string) {
+    defer close(job.done)
+    defer job.cancel()
+    l := LoggerFrom(ctx)
+    start := time.Now()
+    nextStep := cloneProgressStep
+    err := d.copyDevice(ctx, from, d.devicePath(meta.VolumeGroup, meta.Name), func(copied int64) {
+        if percent := d.cloner.progress(job, copied); percent >= nextStep {
+            l.Info("Clone progress", "percent", percent, "copied_mb", copied / (1024 * 1024), "size_mb", job.status.SizeMB)
+            nextStep = (percent / cloneProgressStep + 1) * cloneProgressStep
+        }
+    })
+    canceled := ctx.Err() != nil
+    // the remaining steps must not be skipped because of a cancel
+    bg := WithLogger(context.Background(), l)
+    if snapshot != "" {
+        if serr := d.releaseTransfer(bg, &transferJob{export: true, snapshot: snapshot}); serr != nil {
+            l.Error("Cannot remove snapshot of clone, it is removed at the next start", "error", serr)
+        }
+    }
+    if err == nil && !canceled {
+        err = d.newFilesystemUUID(bg, meta)
+    }
+    d.cloner.m.Lock()
+    status := job.status
+    interrupted := job.interrupted
+    d.cloner.m.Unlock()
+    switch {
+    case canceled && interrupted:
+        l.Warn("Copy of clone was interrupted by a shutdown, the clone has to be removed", "percent", status.Percent)
+        d.finishClone(meta, &status, CloneFailed, "Copy interrupted by a shutdown of the daemon")
+    case canceled:
+        l.Warn("Copy of clone canceled, the clone has to be removed", "percent", status.Percent)
+        d.finishClone(meta, &status, CloneCanceled, "Copy canceled")
+    case err != nil:
+        l.Error("Copy of clone failed, the clone has to be removed", "error", err)
+        d.finishClone(meta, &status, CloneFailed, err.Error())
+    default:
+        l.Info("Clone copied", "size_mb", status.SizeMB, "duration", time.Since(start).Round(time.Millisecond).String())
+        d.finishClone(meta, &status, CloneCompleted, "")
+    }
+    d.cloner.remove(job)
+}
+
+// finishClone records the final state of a clone
+func (d *VolumeDriver) finishClone(meta *VolumeMetadata, status *CloneStatus, state string, msg string) {
+    now := time.Now().UTC()
+    status.State = state
+    status.Finished = &now
+    status.Error = msg
+    if state == CloneCompleted {
+        status.CopiedMB = status.SizeMB
+        status.Percent = 100
+    }
+    meta.Clone = status
+    if err := d.saveMetadata(meta); err != nil {
+        DefaultLogger().Error("Cannot record state of clone", "volume", meta.Name, "state", state, "error", err)
+    }
+}
+
+// discardClone removes a clone which could not be set up
+func (d *VolumeDriver) discardClone(ctx context.Context, meta *VolumeMetadata) {
+    device := d.devicePath(meta.VolumeGroup, meta.Name)
+    if status := d.runCommand(ctx, "lvremove", []string{"-f", device}); status.status != 0 {
+        LoggerFrom(ctx).Warn("Cannot remove failed clone", "volume", meta.Name, "error", status.String())
+    }
+    d.deleteCloneKey(ctx, meta)
+    if d.State != nil {
+        d.State.Delete(meta.Name)
+    }
+}
+
+func (d *VolumeDriver) deleteCloneKey(ctx context.Context, meta *VolumeMetadata) {
+    if meta.Encrypted {
+        if err := d.KeyProvider.DeleteKey(ctx, meta.Name); err != nil {
+            LoggerFrom(ctx).Warn("Cannot delete key of volume", "volume", meta.Name, "error", err)
+        }
+    }
+}
+
+// freeze suspends writes to a mounted volume until it is thawed
+func (d *VolumeDriver) freeze(ctx context.Context, name string) (error) {
+    if status := d.runCommand(ctx, "fsfreeze", []string{"-f", d.getMountpoint(name)}); status.status != 0 {
+        return commandError(status, "Cannot freeze volume " + name + ": " + status.stderr)
+    }
+    return nil
+}
+
+func (d *VolumeDriver) thaw(ctx context.Context, name string) (error) {
+    if status := d.runCommand(ctx, "fsfreeze", []string{"-u", d.getMountpoint(name)}); status.status != 0 {
+        return commandError(status, "Cannot thaw volume " + name + ": " + status.stderr)
+    }
+    return nil
+}
+
+// programs giving a filesystem a new UUID
+var newUUIDCommands = map[string]func(device string) ([]string){
+    "ext4": func(device string) ([]string) { return []string{"tune2fs", "-U", "random", device} },
+    "xfs": func(device string) ([]string) { return []string{"xfs_admin", "-U", "generate", device} },
+}
+
+// newFilesystemUUID gives the filesystem of a clone or of a raw import a new
+// UUID. An ext4 filesystem is checked first, tune2fs requires a freshly
+// checked one and a copy of a mounted source has a journal to replay.
+func (d *VolumeDriver) newFilesystemUUID(ctx context.Context, meta *VolumeMetadata) (error) {
+    device := d.devicePath(meta.VolumeGroup, meta.Name)
+    if meta.Encrypted {
+        var err error
+        if device, err = d.openEncrypted(ctx, meta.Name); err != nil {
+            return err
+        }
+        defer func() {
+            if err := d.closeEncrypted(ctx, meta.Name); err != nil {
+                LoggerFrom(ctx).Warn("Cannot close encrypted volume", "volume", meta.Name, "error", err)
+            }
+        }()
+    }
+    fs := filesystemOf(meta)
+    if fs == "ext4" {
+        tool := fsckTools[fs]
+        cmd := tool.repair(device)
+        status := d.runCommand(ctx, cmd[0], cmd[1:])
+        if result := tool.result(status.status); result == "" || result == FsckResultErrors {
+            return commandError(status, "Filesystem of volume " + meta.Name + " has errors: " + status.String())
+        }
+    }
+    cmd := newUUIDCommands[fs](device)
+    if status := d.runCommand(ctx, cmd[0], cmd[1:]); status.status != 0 {
+        return commandError(status, "Cannot change the filesystem UUID of volume " + meta.Name + ": " + status.stderr)
+    }
+    return nil
+}
+
+// copyDevice copies the device from to the device to and reports the bytes
+// copied after every block
+func (d *VolumeDriver) copyDevice(ctx context.Context, from string, to string, progress func(copied int64)) (error) {
+    if d.CopyDevice != nil {
+        return d.CopyDevice(ctx, from, to, progress)
+    }
+    in, err := os.Open(from)
+    if err != nil {
+        return Internal("Cannot open " + from + ": " + err.Error())
+    }
+    defer in.Close()
+    out, err := os.OpenFile(to, os.O_WRONLY, 0)
+    if err != nil {
+        return Internal("Cannot open " + to + ": " + err.Error())
+    }
+    defer out.Close()
+    buf := make([]byte, cloneBlockSize)
+    var copied int64
+    for {
+        if ctx.Err() != nil {
+            return newError(CodeCanceled, "Copy of " + from + " canceled at " + strconv.FormatInt(copied, 10) + " bytes")
+        }
+        n, err := in.Read(buf)
+        if n > 0 {
+            if _, err := out.Write(buf[:n]); err != nil {
+                return Internal("Cannot write to " + to + ": " + err.Error())
+            }
+            copied += int64(n)
+            progress(copied)
+        }
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return Internal("Cannot read from " + from + ": " + err.Error())
+        }
+    }
+    if err := out.Sync(); err != nil {
+        return Internal("Cannot sync " + to + ": " + err.Error())
+    }
+    return nil
+}
@@ -0,0 +1,87 @@
+package daemon
+
+import (
+    "errors"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Timeouts for external programs
+//
+// Every external program runs with a deadline. A program which does not
+// finish in time is killed together with all processes it started, so that
+// a hanging lvcreate cannot block all volume operations on the host.
+// --------------------------------------------------------------------------
+
+const (
+    DefaultCommandTimeout = 2 * time.Minute
+    // time to wait for the output pipes after the process group was killed
+    commandWaitDelay = 5 * time.Second
+)
+
+type CommandTimeouts struct {
+    Default time.Duration
+    // per program, e.g. "lvcreate" or "mkfs.ext4"
+    Commands map[string]time.Duration
+}
+
+var insufficientSpacePattern = regexp.MustCompile("(?i)insufficient (free space|suitable allocatable extents)|not enough free space")
+
+var (
+    timeoutsLock sync.RWMutex
+    commandTimeouts = CommandTimeouts{Default: DefaultCommandTimeout}
+)
+
+func SetCommandTimeouts(t CommandTimeouts) {
+    timeoutsLock.Lock()
+    defer timeoutsLock.Unlock()
+    commandTimeouts = t
+}
+
+func commandTimeout(cmdName string) (time.Duration) {
+    timeoutsLock.RLock()
+    defer timeoutsLock.RUnlock()
+    if t, ok := commandTimeouts.Commands[cmdName]; ok {
+        return t
+    }
+    return commandTimeouts.Default
+}
+
+// ParseCommandTimeouts parses a list of program=duration pairs, e.g.
+// "lvcreate=5m,mkfs.ext4=10m".
+func ParseCommandTimeouts(spec string) (map[string]time.Duration, error) {
+    m := make(map[string]time.Duration)
+    if spec == "" {
+        return m, nil
+    }
+    for _, item := range strings.Split(spec, ",") {
+        kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+        if len(kv) != 2 || kv[0] == "" {
+            return nil, errors.New("Illegal command timeout " + item + ", expected <program>=<duration>")
+        }
+        d, err := time.ParseDuration(kv[1])
+        if err != nil || d <= 0 {
+            return nil, errors.New("Illegal duration for command " + kv[0] + ": " + kv[1])
+        }
+        m[kv[0]] = d
+    }
+    return m, nil
+}
+
+// commandError returns the error for a failed command: a Timeout or Canceled
+// error if the command was killed, InsufficientCapacity if LVM ran out of
+// space, otherwise ExternalCommandFailed with the given message.
+func commandError(status ExecStatus, msg string) (error) {
+    if status.err != nil {
+        return status.err
+    }
+    if insufficientSpacePattern.MatchString(status.stderr) {
+        e := InsufficientCapacity(msg)
+        e.Exec = &status
+        return e
+    }
+    return ExternalCommandFailed(status, msg)
+}
@@ -1,14 +1,17 @@
 package daemon
 
 import (
-      "fmt"
+      "context"
+      "errors"
+      "net"
       "net/http"
-      "log"
       "encoding/json"
       "strconv"
       "os"
       "path/filepath"
-      "sync"
+      "regexp"
+      "strings"
+      "time"
 )
 
 const (
@@ -19,8 +22,6 @@ const (
     DefaultVolumeSize = 512
 )
 
-var volumeDriver VolumeDriver
-
 type CapabilitiesResp struct {
     Capabilities VolumeDriverCapabilities
 }
@@ -29,15 +30,13 @@ type VolumeDriverCapabilities struct {
     Scope string
 }
 
-func writeJson(jsonObject interface{}, code int, w http.ResponseWriter, debug bool) {
+func writeJson(jsonObject interface{}, code int, w http.ResponseWriter, r *http.Request) {
 
     msg, _ := json.Marshal(jsonObject)
     w.Header().Set("Content-Type", DefaultContentTypeV1_1)
     w.WriteHeader(code)
     w.Write(msg)
-    if debug {
-        log.Printf("%d: %s", code, msg)
-    }
+    LoggerFrom(r.Context()).Debug("Response sent", "status", code, "body", string(msg))
 }
 
 
@@ -51,21 +50,35 @@ func ensureContentType(r *http.Request) (error) {
     }
 }
 
-func logRequest(r *http.Request, body string) {
-
-    log.Printf("Request: %s %s, body: %s", r.Method, r.URL, body)
+var requestIdPattern = regexp.MustCompile("^[A-Za-z0-9._-]{1,64}$")
+
+// withRequestLogger assigns a request id to every incoming request (or takes
+// the one passed by the caller) and attaches a logger carrying that id to the
+// request context. Everything logged on behalf of the request, including the
+// external commands executed, can be correlated by this id. The commands are
+// also recorded for the audit log.
+func withRequestLogger(h http.HandlerFunc) (http.HandlerFunc) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(RequestIdHeader)
+        if !requestIdPattern.MatchString(id) {
+            id = NewRequestId()
+        }
+        w.Header().Set(RequestIdHeader, id)
+        l := DefaultLogger().With("request_id", id)
+        l.Debug("Request received", "method", r.Method, "url", r.URL.String())
+        ctx := WithCommandRecorder(WithRequestId(WithLogger(r.Context(), l), id))
+        h(w, r.WithContext(ctx))
+    }
 }
 
-func decodeRequest(r *http.Request, debug bool) (map[string]interface{}, error) {
+func decodeRequest(r *http.Request) (map[string]interface{}, error) {
 
     if err := ensureContentType(r); err == nil {
         dec := json.NewDecoder(r.Body)
         var m map[string]interface{}
         if err2 := dec.Decode(&m); err2 == nil {
             msg, _ := json.Marshal(m)
-            if debug {
-                logRequest(r, string(msg))
-            }
+            LoggerFrom(r.Context()).Debug("Request body decoded", "body", string(msg))
             return m, nil
         } else {
             return nil, err2
@@ -95,32 +108,46 @@ func getMap(doc map[string]interface{}, key string) (map[string]interface{}) {
     return nil
 }
 
-func getOptions(r *http.Request, debug bool) (map[string]string) {
-    if doc, err := decodeRequest(r, debug); err == nil {
-        if opts := getMap(doc, "Opts"); opts != nil {
-            options := make(map[string]string)
-            if size := getValue(opts, "Size"); size != nil {
-                options["size"] = *size
+// getOptions returns the string valued options passed by docker (docker
+// volume create -o key=value). Keys are converted to lower case.
+func getOptions(doc map[string]interface{}) (map[string]string) {
+    if opts := getMap(doc, "Opts"); opts != nil {
+        options := make(map[string]string)
+        for k := range opts {
+            if value := getValue(opts, k); value != nil {
+                options[strings.ToLower(k)] = *value
             }
-            return options
         }
+        return options
     }
     return nil
 }
 
-func getName(w http.ResponseWriter, r *http.Request, debug bool) (*string) {
+// getNameAndOptions decodes the request body and returns the volume name and
+// options. In case of an error, the error response is written and a nil name
+// is returned.
+func getNameAndOptions(w http.ResponseWriter, r *http.Request) (*string, map[string]string) {
 
     var name *string = nil
+    var options map[string]string = nil
     msg := make(map[string]interface{})
-    if m, err := decodeRequest(r, debug); err != nil {
-        msg["Err"] = err.Error()
-        writeJson(msg, http.StatusOK, w, debug)
+    if m, err := decodeRequest(r); err != nil {
+        msg["Err"] = dockerErr(InvalidArgument("Illegal request: " + err.Error()))
+        writeJson(msg, http.StatusOK, w, r)
     } else {
         if name = getValue(m, "Name"); name == nil {
-            msg["Err"] = "Illegal request"
-            writeJson(msg, http.StatusOK, w, debug)
+            msg["Err"] = dockerErr(InvalidArgument("Illegal request: missing volume name"))
+            writeJson(msg, http.StatusOK, w, r)
+        } else {
+            options = getOptions(m)
         }
     }
+    return name, options
+}
+
+func getName(w http.ResponseWriter, r *http.Request) (*string) {
+
+    name, _ := getNameAndOptions(w, r)
     return name
 }
 
@@ -134,160 +161,233 @@ type Daemon struct {
     MountRoot string
     VolumeGroupName string
     DefaultLogicalVolumeSize int
+    // volume groups served, a single class for VolumeGroupName if nil
+    StorageClasses *StorageClasses
     SocketSpecLocation string
     JsonLocation string
     Host string
     Port int
-    Debug bool
+    StateDir string
+    AuditLog *AuditLog
+    // requests holding the request lock for longer are reported by /health
+    LockThreshold time.Duration
+    // external programs are executed by this executor if set, used to run
+    // the daemon against a fake LVM
+    Executor CommandExecutor
+    DevDir string
+    // admin API, disabled if AdminListener is empty or "none"
+    AdminListener string
+    AdminSocket string
+    AdminHost string
+    AdminPort int
+    AdminTLSCert string
+    AdminTLSKey string
+    AdminTLSClientCA string
+    AdminToken string
+    // recent log lines served by the admin API
+    LogBuffer *LogBuffer
+    // wipe of removed volumes and lvcreate options, see VolumeDriver
+    WipePolicy WipePolicy
+    WipePasses int
+    WipeSignatures string
+    Zero string
+    // keys of encrypted volumes, encryption is disabled if nil
+    KeyProvider KeyProvider
+    // options for mounts of new volumes, DefaultMountOptions if nil
+    MountOptions []string
+    // check of the filesystem before mount
+    FsckPolicy FsckPolicy
+    FsckRepair bool
+    // usage monitor and auto-grow, disabled if MonitorInterval is zero
+    MonitorInterval time.Duration
+    AutoGrowReserveMB int
+    // usage of mounted filesystems, used to run against the fake LVM
+    Statfs func(path string) (FsUsage, error)
+    // block copy of clones, used to run against the fake LVM
+    CopyDevice func(ctx context.Context, from string, to string, progress func(copied int64)) (error)
+    // served on /metrics, created by Init if nil
+    Metrics *Metrics
+    // garbage collection of orphaned volumes, see gc.go
+    GCPolicy GCPolicy
+    GCInterval time.Duration
+    GCGrace time.Duration
+    // docker on DefaultDockerSocket if nil
+    DockerEngine DockerEngine
+    // backups are disabled if BackupTarget is nil, the scheduler if
+    // BackupCheckInterval is zero; see backup.go
+    BackupTarget BackupTarget
+    BackupCheckInterval time.Duration
+    // hooks and freeze around snapshots, see quiesce.go
+    SnapshotHooks *SnapshotHooks
+    FreezeTimeout time.Duration
+    // applies the I/O limits of volumes, see iolimits.go
+    IOController IOController
+    driver *VolumeDriver
+    gc *collector
+    backups *backupScheduler
+    // stops the background tasks, see Close
+    cancel context.CancelFunc
     // need to ensure that we don't handle concurrent calls
-    m *sync.Mutex
+    m *requestLock
 }
 
 // Handler methods invoked by Docker
 
 func (d *Daemon) pluginActivate(w http.ResponseWriter, r *http.Request) {
 
-    d.m.Lock()
+    d.m.Lock(r.URL.Path)
     defer d.m.Unlock()
 
-    if d.Debug {
-        logRequest(r, "")
-    }
     type response struct {
         Implements []string
     }
 
     resp := response{
-        Implements: volumeDriver.DockerActivate(),
+        Implements: d.driver.DockerActivate(),
     }
-    writeJson(resp, http.StatusOK, w, d.Debug)
+    writeJson(resp, http.StatusOK, w, r)
 }
 
 func (d *Daemon) volumeDriverCreate(w http.ResponseWriter, r *http.Request) {
 
-    d.m.Lock()
-    defer d.m.Unlock()
-
-    if name := getName(w, r, d.Debug); name != nil {
+    if name, options := getNameAndOptions(w, r); name != nil {
         msg := make(map[string]interface{})
-        options := getOptions(r, d.Debug)
-        if err := volumeDriver.DockerCreateVolume(*name, options); err != nil {
-            msg["Err"] = err.Error()
-            writeJson(msg, http.StatusOK, w, d.Debug)
-            log.Print(err.Error())
+        err := d.createVolume(r.Context(), r.URL.Path, *name, options)
+        d.audit(r, "create", *name, options, err)
+        if err != nil {
+            msg["Err"] = dockerErr(err)
+            writeJson(msg, http.StatusOK, w, r)
+            LoggerFrom(r.Context()).Error(err.Error())
         } else {
             msg["Err"] = ""
-            writeJson(msg, http.StatusOK, w, d.Debug)
+            writeJson(msg, http.StatusOK, w, r)
         }
     }
 }
 
+// createVolume creates a volume, a restore from a backup without holding
+// the request lock while the data is restored
+func (d *Daemon) createVolume(ctx context.Context, holder string, name string, options map[string]string) (error) {
+    if _, ok := options[RestoreFromOption]; ok {
+        return d.Restore(ctx, name, options)
+    }
+    d.m.Lock(holder)
+    defer d.m.Unlock()
+    return d.driver.DockerCreateVolume(ctx, name, options)
+}
+
 // Remove logical volume
 // pre: - volume must exist
 //      - volume must not be mounted
 func (d *Daemon) volumeDriverRemove(w http.ResponseWriter, r *http.Request) {
 
-    d.m.Lock()
+    d.m.Lock(r.URL.Path)
     defer d.m.Unlock()
 
-    if name := getName(w, r, d.Debug); name != nil {
+    if name := getName(w, r); name != nil {
         msg := make(map[string]interface{})
-        if err := volumeDriver.DockerRemoveVolume(*name); err != nil {
-            msg["Err"] = err.Error()
-            writeJson(msg, http.StatusOK, w, d.Debug)
-            log.Print(err.Error())
+        err := d.driver.DockerRemoveVolume(r.Context(), *name)
+        d.audit(r, "remove", *name, nil, err)
+        if err != nil {
+            msg["Err"] = dockerErr(err)
+            writeJson(msg, http.StatusOK, w, r)
+            LoggerFrom(r.Context()).Error(err.Error())
         } else {
             msg["Err"] = ""
-            writeJson(msg, http.StatusOK, w, d.Debug)
+            writeJson(msg, http.StatusOK, w, r)
         }
     }
 }
 
 func (d *Daemon) volumeDriverMount(w http.ResponseWriter, r *http.Request) {
 
-    d.m.Lock()
+    d.m.Lock(r.URL.Path)
     defer d.m.Unlock()
 
-    if name := getName(w, r, d.Debug); name != nil {
+    if name := getName(w, r); name != nil {
         msg := make(map[string]interface{})
-        if mountpoint, err := volumeDriver.DockerMountVolume(*name); err != nil {
-            msg["Err"] = err.Error()
-            writeJson(msg, http.StatusOK, w, d.Debug)
-            log.Print(err.Error())
+        mountpoint, err := d.driver.DockerMountVolume(r.Context(), *name)
+        d.audit(r, "mount", *name, nil, err)
+        if err != nil {
+            msg["Err"] = dockerErr(err)
+            writeJson(msg, http.StatusOK, w, r)
+            LoggerFrom(r.Context()).Error(err.Error())
         } else {
             msg["Mountpoint"] = mountpoint
             msg["Err"] = ""
-            writeJson(msg, http.StatusOK, w, d.Debug)
+            writeJson(msg, http.StatusOK, w, r)
         }
     }
 }
 
 func (d *Daemon) volumeDriverPath(w http.ResponseWriter, r *http.Request) {
 
-    d.m.Lock()
+    d.m.Lock(r.URL.Path)
     defer d.m.Unlock()
 
-    if name := getName(w, r, d.Debug); name != nil {
+    if name := getName(w, r); name != nil {
         msg := make(map[string]interface{})
-        if mountpoint, err := volumeDriver.DockerVolumePath(*name); err != nil {
-            msg["Err"] = err.Error()
-            writeJson(msg, http.StatusOK, w, d.Debug)
-            if d.Debug { log.Print(err.Error())}
+        if mountpoint, err := d.driver.DockerVolumePath(r.Context(), *name); err != nil {
+            msg["Err"] = dockerErr(err)
+            writeJson(msg, http.StatusOK, w, r)
+            LoggerFrom(r.Context()).Debug(err.Error())
         } else {
             msg["Mountpoint"] = mountpoint
             msg["Err"] = ""
-            writeJson(msg, http.StatusOK, w, d.Debug)
+            writeJson(msg, http.StatusOK, w, r)
         }
     }
 }
 
 func (d *Daemon) volumeDriverUnmount(w http.ResponseWriter, r *http.Request) {
 
-    d.m.Lock()
+    d.m.Lock(r.URL.Path)
     defer d.m.Unlock()
 
-    if name := getName(w, r, d.Debug); name != nil {
+    if name := getName(w, r); name != nil {
         msg := make(map[string]interface{})
-        if err := volumeDriver.DockerUnmountVolume(*name); err != nil {
-            msg["Err"] = err.Error()
-            writeJson(msg, http.StatusOK, w, d.Debug)
-            log.Print(err.Error())
+        err := d.driver.DockerUnmountVolume(r.Context(), *name)
+        d.audit(r, "unmount", *name, nil, err)
+        if err != nil {
+            msg["Err"] = dockerErr(err)
+            writeJson(msg, http.StatusOK, w, r)
+            LoggerFrom(r.Context()).Error(err.Error())
         } else {
             msg["Err"] = ""
-            writeJson(msg, http.StatusOK, w, d.Debug)
+            writeJson(msg, http.StatusOK, w, r)
         }
     }
 }
 
 func (d *Daemon) volumeDriverGet(w http.ResponseWriter, r *http.Request) {
 
-    d.m.Lock()
+    d.m.Lock(r.URL.Path)
     defer d.m.Unlock()
 
-    if name := getName(w, r, d.Debug); name != nil {
+    if name := getName(w, r); name != nil {
         msg := make(map[string]interface{})
-        if volume, err := volumeDriver.dockerGetVolume(*name); err != nil {
-            msg["Err"] = err.Error()
-            writeJson(msg, http.StatusOK, w, d.Debug)
-            if d.Debug { log.Print(err.Error())}
+        if volume, err := d.driver.dockerGetVolume(r.Context(), *name); err != nil {
+            msg["Err"] = dockerErr(err)
+            writeJson(msg, http.StatusOK, w, r)
+            LoggerFrom(r.Context()).Debug(err.Error())
         } else {
             msg["Volume"] = volume
             msg["Err"] = ""
-            writeJson(msg, http.StatusOK, w, d.Debug)
+            writeJson(msg, http.StatusOK, w, r)
         }
     }
 }
 
 func (d *Daemon) volumeDriverList(w http.ResponseWriter, r *http.Request) {
 
-    d.m.Lock()
+    d.m.Lock(r.URL.Path)
     defer d.m.Unlock()
     // no message expected
-    if msg, err := volumeDriver.dockerListVolume(); err == nil {
-        writeJson(msg, http.StatusOK, w, d.Debug)
+    if msg, err := d.driver.dockerListVolume(r.Context()); err == nil {
+        writeJson(msg, http.StatusOK, w, r)
     } else {
         // error already part of message
-        writeJson(msg, http.StatusOK, w, d.Debug)
+        writeJson(msg, http.StatusOK, w, r)
     }
 }
 
@@ -298,64 +398,177 @@ func (d *Daemon) volumeCapabilities(w http.ResponseWriter, r *http.Request) {
             Scope: "local",
         },
     }
-     writeJson(capabilitiesResp, http.StatusOK, w, d.Debug)
+     writeJson(capabilitiesResp, http.StatusOK, w, r)
 }
 
 
-func (s *Daemon) StartServer() {
+// connContext records the peer credentials of unix socket connections so that
+// the caller can be written to the audit log.
+func connContext(ctx context.Context, c net.Conn) (context.Context) {
+    if uc, ok := c.(*net.UnixConn); ok {
+        return withCaller(ctx, peerCaller(uc))
+    }
+    return ctx
+}
+
+// fatal logs a startup error and terminates the daemon
+func fatal(msg string, kv ...interface{}) {
+    DefaultLogger().Error(msg, kv...)
+    os.Exit(1)
+}
+
+// Init checks the environment and sets up the volume driver. It must be
+// called before any of the handlers is used.
+func (s *Daemon) Init() (error) {
+
+    s.m = new(requestLock)
+    if s.Metrics == nil {
+        s.Metrics = NewMetrics()
+    }
+    if s.LockThreshold == 0 {
+        s.LockThreshold = DefaultLockThreshold
+    }
 
-    s.m = new(sync.Mutex)
+    // only the fake LVM of builds for tests does without root, see
+    // fake_backends.go
+    if !fakeExecutor(s.Executor) {
+        if err := RootCheck(); err != nil {
+            return err
+        }
+    }
 
-    if err := RootCheck(); err != nil {
-        fmt.Fprintf(os.Stderr, err.Error() + "\n")
-        os.Exit(1)
+    if s.StorageClasses == nil {
+        s.StorageClasses = SingleStorageClass(s.VolumeGroupName, s.DefaultLogicalVolumeSize)
+    }
+    if err := s.StorageClasses.validate(); err != nil {
+        return errors.New("Illegal storage classes: " + err.Error())
     }
 
-    volumeDriver = VolumeDriver{
+    s.driver = &VolumeDriver{
         MountRoot: s.MountRoot,
         LvmDevice: s.LvmDevice,
-        VolumeGroupName: s.VolumeGroupName,
-        DefaultLogicalVolumeSize: s.DefaultLogicalVolumeSize,
-        Debug: s.Debug,
+        Classes: s.StorageClasses,
+        Executor: s.Executor,
+        DevDir: s.DevDir,
+        WipePolicy: s.WipePolicy,
+        WipePasses: s.WipePasses,
+        WipeSignatures: s.WipeSignatures,
+        Zero: s.Zero,
+        KeyProvider: s.KeyProvider,
+        BackupTarget: s.BackupTarget,
+        SnapshotHooks: s.SnapshotHooks,
+        FreezeTimeout: s.FreezeTimeout,
+        IOController: s.IOController,
+        DefaultMountOptions: s.MountOptions,
+        FsckPolicy: s.FsckPolicy,
+        FsckRepair: s.FsckRepair,
+        AutoGrowReserveMB: s.AutoGrowReserveMB,
+        Statfs: s.Statfs,
+        CopyDevice: s.CopyDevice,
+        Metrics: s.Metrics,
+    }
+    if s.MountOptions == nil {
+        s.driver.DefaultMountOptions = DefaultMountOptions
+    }
+
+    if state, err := NewStateStore(s.StateDir); err != nil {
+        return errors.New("Cannot open state directory " + s.StateDir + ": " + err.Error())
+    } else {
+        s.driver.State = state
+    }
+
+    // the background tasks run until Close
+    ctx, cancel := context.WithCancel(context.Background())
+    s.cancel = cancel
+
+    if err := s.driver.EnsureVGExists(ctx); err != nil {
+        return err
+    }
+    s.driver.ThawStale(ctx)
+
+    // also without a wipe policy, volumes left over from a run with a policy
+    // are removed then instead of being kept forever
+    if err := s.driver.StartWiper(ctx); err != nil {
+        return err
     }
+    if err := s.driver.StartCloner(ctx); err != nil {
+        return err
+    }
+    if err := s.driver.StartMerges(ctx); err != nil {
+        return err
+    }
+    if err := s.driver.StartTransfers(ctx); err != nil {
+        return err
+    }
+    s.startMergeWatcher(ctx)
+    s.startMonitor(ctx)
+    s.startCollector(ctx)
+    s.startBackups(ctx)
 
-    if err := volumeDriver.EnsureVGExists(); err != nil {
-        fmt.Fprintf(os.Stderr, err.Error() + "\n")
-        os.Exit(1)
+    return s.driver.EnsureMountpointExists()
+}
+
+// Close stops the background tasks started by Init and cancels the running
+// copies of clones, and waits until they have stopped. Running snapshots of
+// frozen volumes are waited for, so that the volumes are thawed, and no new
+// ones are started. The handlers must not be used afterwards.
+func (s *Daemon) Close() {
+    if s.cancel == nil {
+        return
     }
+    s.cancel()
+    s.driver.closeQuiesces()
+    s.driver.stopClones()
+    s.driver.tasks.Wait()
+}
+
+// DockerHandler returns the handler for the volume plugin protocol
+func (s *Daemon) DockerHandler() (http.Handler) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/Plugin.Activate", withRequestLogger(s.pluginActivate))
+    mux.HandleFunc("/VolumeDriver.Create", withRequestLogger(s.volumeDriverCreate))
+    mux.HandleFunc("/VolumeDriver.Remove", withRequestLogger(s.volumeDriverRemove))
+    mux.HandleFunc("/VolumeDriver.Mount", withRequestLogger(s.volumeDriverMount))
+    mux.HandleFunc("/VolumeDriver.Path", withRequestLogger(s.volumeDriverPath))
+    mux.HandleFunc("/VolumeDriver.Unmount", withRequestLogger(s.volumeDriverUnmount))
+    mux.HandleFunc("/VolumeDriver.Get", withRequestLogger(s.volumeDriverGet))
+    mux.HandleFunc("/VolumeDriver.List", withRequestLogger(s.volumeDriverList))
+    mux.HandleFunc("/VolumeDriver.Capabilities", withRequestLogger(s.volumeCapabilities))
+    mux.HandleFunc("/health", withRequestLogger(s.health))
+    mux.HandleFunc("/ready", withRequestLogger(s.ready))
+    mux.HandleFunc("/metrics", s.metrics)
+    return mux
+}
+
+func (s *Daemon) StartServer() {
 
-    if err := volumeDriver.EnsureMountpointExists(); err != nil {
-        fmt.Fprintf(os.Stderr, err.Error() + "\n")
-        os.Exit(1)
+    if err := s.Init(); err != nil {
+        fatal(err.Error())
     }
 
-    http.HandleFunc("/Plugin.Activate", s.pluginActivate)
-    http.HandleFunc("/VolumeDriver.Create", s.volumeDriverCreate)
-    http.HandleFunc("/VolumeDriver.Remove", s.volumeDriverRemove)
-    http.HandleFunc("/VolumeDriver.Mount", s.volumeDriverMount)
-    http.HandleFunc("/VolumeDriver.Path", s.volumeDriverPath)
-    http.HandleFunc("/VolumeDriver.Unmount", s.volumeDriverUnmount)
-    http.HandleFunc("/VolumeDriver.Get", s.volumeDriverGet)
-    http.HandleFunc("/VolumeDriver.List", s.volumeDriverList)
-    http.HandleFunc("/VolumeDriver.Capabilities", s.volumeCapabilities)
+    if s.AdminListener != "" && s.AdminListener != "none" {
+        go func() {
+            if err := s.ServeAdmin(); err != nil {
+                fatal("Admin API failed: " + err.Error())
+            }
+        }()
+    }
 
     switch s.Listener {
     case "unix":
         socketDir := filepath.Dir(s.SocketSpecLocation)
         if err := Mkdir(socketDir, 0750, "docker"); err != nil {
-            fmt.Fprint(os.Stderr, err.Error() + "\n")
-            os.Exit(1)
+            fatal(err.Error())
         }
         if listener, err := NewUnixSocket(s.SocketSpecLocation, "docker"); err != nil {
-            fmt.Fprintf(os.Stderr, "Cannot create socket file: %s\n", err.Error())
-            os.Exit(1)
+            fatal("Cannot create socket file: " + err.Error())
         } else {
-            s := &http.Server{}
-            s.SetKeepAlivesEnabled(false)
-            err := s.Serve(listener)
+            DefaultLogger().Info("Start listening", "socket", s.SocketSpecLocation)
+            srv := &http.Server{Handler: s.DockerHandler(), ConnContext: connContext}
+            srv.SetKeepAlivesEnabled(false)
+            err := srv.Serve(listener)
             if err != nil {
-                fmt.Fprintf(os.Stderr, "%s\n" + err.Error())
-                os.Exit(1)
+                fatal(err.Error())
             }
         }
 
@@ -366,20 +579,15 @@ func (s *Daemon) StartServer() {
      "Name": "lvm-volume-driver",
      "Addr": "http://` + s.Host + ":" + strconv.Itoa(s.Port) + `"
 }`); err != nil {
-            fmt.Fprintf(os.Stderr, err.Error() + "\n")
-            os.Exit(1)
+            fatal(err.Error())
         }
 
-
-
-        log.Printf("Start listening on %s:%d\n", s.Host, s.Port)
-        err := http.ListenAndServe(s.Host + ":" + strconv.Itoa(s.Port), nil)
+        DefaultLogger().Info("Start listening", "host", s.Host, "port", s.Port)
+        err := http.ListenAndServe(s.Host + ":" + strconv.Itoa(s.Port), s.DockerHandler())
         if err != nil {
-            fmt.Fprintf(os.Stderr, err.Error() + "\n")
-            os.Exit(1)
+            fatal(err.Error())
         }
     default:
-        fmt.Fprintf(os.Stderr, "unrecognized listener " + s.Listener)
-        os.Exit(1)
+        fatal("unrecognized listener " + s.Listener)
     }
 }
@@ -0,0 +1,91 @@
+package daemon
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Docker engine
+//
+// The garbage collector asks the docker engine which volumes of this driver
+// are still referenced. Docker lists the volumes of a plugin by asking the
+// plugin, so its volume list includes every logical volume and cannot tell
+// orphans apart; a volume therefore counts as referenced if a container,
+// running or stopped, uses it. This only narrows down the candidates, an
+// unreferenced volume may still be known to docker.
+// --------------------------------------------------------------------------
+
+const (
+    DefaultDockerSocket = "/var/run/docker.sock"
+    dockerEngineTimeout = 30 * time.Second
+)
+
+type DockerEngine interface {
+    // ReferencedVolumes returns the names of the volumes of the driver used
+    // by containers
+    ReferencedVolumes(ctx context.Context, driver string) (map[string]bool, error)
+}
+
+// SocketDockerEngine talks to the docker engine API on a unix socket
+type SocketDockerEngine struct {
+    Socket string
+}
+
+func (e *SocketDockerEngine) client() (*http.Client) {
+    return &http.Client{
+        Timeout: dockerEngineTimeout,
+        Transport: &http.Transport{
+            DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+                var d net.Dialer
+                return d.DialContext(ctx, "unix", e.Socket)
+            },
+        },
+    }
+}
+
+type dockerContainer struct {
+    Id string
+    Mounts []struct {
+        Type string
+        Name string
+        Driver string
+    }
+}
+
+func (e *SocketDockerEngine) ReferencedVolumes(ctx context.Context, driver string) (map[string]bool, error) {
+    req, err := http.NewRequest("GET", "http://docker/containers/json?all=true", nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := e.client().Do(req.WithContext(ctx))
+    if err != nil {
+        return nil, errors.New("Cannot reach docker on " + e.Socket + ": " + err.Error())
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        body, _ := ioutil.ReadAll(resp.Body)
+        return nil, errors.New("Docker returned status " + strconv.Itoa(resp.StatusCode) + " for the container list: " + strings.TrimSpace(string(body)))
+    }
+    var containers []dockerContainer
+    if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+        return nil, errors.New("Cannot decode container list of docker: " + err.Error())
+    }
+    volumes := make(map[string]bool)
+    for _, c := range containers {
+        for _, m := range c.Mounts {
+            // managed plugins are reported with their tag
+            if m.Type == "volume" && (m.Driver == driver || strings.HasPrefix(m.Driver, driver + ":")) {
+                volumes[m.Name] = true
+            }
+        }
+    }
+    return volumes, nil
+}
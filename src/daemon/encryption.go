@@ -0,0 +1,172 @@
+package daemon
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "path/filepath"
+    "strconv"
+)
+
+// --------------------------------------------------------------------------
+// Encrypted volumes
+//
+// A volume created with the option encrypted=true is formatted with LUKS2.
+// The filesystem lives inside the LUKS container and is only accessible
+// while the container is opened as device mapper target, which is done on
+// mount and undone on unmount. The keys are passed to cryptsetup on stdin
+// and never touch the command line or the logs.
+// --------------------------------------------------------------------------
+
+const (
+    EncryptedOption = "encrypted"
+    mapperPrefix = "lvmvd-crypt-"
+    // maximum length of a device mapper name
+    maxMapperName = 127
+)
+
+// parseEncrypted returns whether the options request an encrypted volume
+func parseEncrypted(options map[string]string) (bool, error) {
+    val, ok := options[EncryptedOption]
+    if !ok {
+        return false, nil
+    }
+    encrypted, err := strconv.ParseBool(val)
+    if err != nil {
+        return false, InvalidArgument("Illegal value " + val + " for option " + EncryptedOption + ", expected true or false")
+    }
+    return encrypted, nil
+}
+
+// mapperName returns the name of the device mapper target of an encrypted
+// volume. Names too long for device mapper are replaced by a hash.
+func (d *VolumeDriver) mapperName(name string) (string) {
+    vg := d.volumeGroupOf(name)
+    mapper := mapperPrefix + vg + "-" + name
+    if len(mapper) > maxMapperName {
+        sum := sha256.Sum256([]byte(vg + "/" + name))
+        mapper = mapperPrefix + hex.EncodeToString(sum[:16])
+    }
+    return mapper
+}
+
+func (d *VolumeDriver) mapperDevice(name string) (string) {
+    devDir := d.DevDir
+    if devDir == "" {
+        devDir = "/dev"
+    }
+    return filepath.Join(devDir, "mapper", d.mapperName(name))
+}
+
+func (d *VolumeDriver) isEncrypted(name string) (bool, error) {
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return false, Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    return meta.Encrypted, nil
+}
+
+// filesystemDevice returns the device holding the filesystem of a volume,
+// the device mapper target for encrypted volumes
+func (d *VolumeDriver) filesystemDevice(name string, encrypted bool) (string) {
+    if encrypted {
+        return d.mapperDevice(name)
+    }
+    return d.getDeviceName(name)
+}
+
+func (d *VolumeDriver) requireKeyProvider() (error) {
+    if d.KeyProvider == nil {
+        return InvalidArgument("Encryption is not enabled, the daemon has to be started with a key provider")
+    }
+    return nil
+}
+
+// formatEncrypted generates a key for the volume and formats its logical
+// volume with LUKS2. The key is deleted again if formatting fails.
+func (d *VolumeDriver) formatEncrypted(ctx context.Context, name string) (error) {
+    if err := d.requireKeyProvider(); err != nil {
+        return err
+    }
+    key, err := d.KeyProvider.NewKey(ctx, name)
+    if err != nil {
+        return err
+    }
+    device := d.getDeviceName(name)
+    args := []string{"luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "-", device}
+    if status := d.runCommandInput(ctx, "cryptsetup", args, key); status.status != 0 {
+        if err := d.KeyProvider.DeleteKey(ctx, name); err != nil {
+            LoggerFrom(ctx).Warn("Cannot delete key of volume", "volume", name, "error", err)
+        }
+        return commandError(status, "Cannot format volume " + name + " with LUKS: " + status.stderr)
+    }
+    return nil
+}
+
+// isOpen reports whether the device mapper target of a volume is active
+func (d *VolumeDriver) isOpen(ctx context.Context, name string) (bool, error) {
+    status := d.runCommand(ctx, "cryptsetup", []string{"status", d.mapperName(name)})
+    switch {
+    case status.err != nil:
+        return false, commandError(status, status.String())
+    case status.status == 0:
+        return true, nil
+    case status.status == 4:
+        // inactive
+        return false, nil
+    }
+    return false, commandError(status, "Cannot determine state of encrypted volume " + name + ": " + status.stderr)
+}
+
+// openEncrypted opens the LUKS container of a volume unless it is open
+// already and returns the device mapper device
+func (d *VolumeDriver) openEncrypted(ctx context.Context, name string) (string, error) {
+    if err := d.requireKeyProvider(); err != nil {
+        return "", err
+    }
+    if open, err := d.isOpen(ctx, name); err != nil {
+        return "", err
+    } else if open {
+        return d.mapperDevice(name), nil
+    }
+    key, err := d.KeyProvider.Key(ctx, name)
+    if err != nil {
+        return "", err
+    }
+    args := []string{"open", "--type", "luks2", "--key-file", "-", d.getDeviceName(name), d.mapperName(name)}
+    if status := d.runCommandInput(ctx, "cryptsetup", args, key); status.status != 0 {
+        return "", commandError(status, "Cannot open encrypted volume " + name + ": " + status.stderr)
+    }
+    LoggerFrom(ctx).Info("Encrypted volume opened", "volume", name, "mapper", d.mapperName(name))
+    return d.mapperDevice(name), nil
+}
+
+// closeEncrypted closes the LUKS container of a volume if it is open
+func (d *VolumeDriver) closeEncrypted(ctx context.Context, name string) (error) {
+    if open, err := d.isOpen(ctx, name); err != nil || !open {
+        return err
+    }
+    if status := d.runCommand(ctx, "cryptsetup", []string{"close", d.mapperName(name)}); status.status != 0 {
+        return commandError(status, "Cannot close encrypted volume " + name + ": " + status.stderr)
+    }
+    LoggerFrom(ctx).Info("Encrypted volume closed", "volume", name, "mapper", d.mapperName(name))
+    return nil
+}
+
+// encryptionStatus adds the encryption state of a volume to the Status of
+// the docker Get response
+func (d *VolumeDriver) encryptionStatus(ctx context.Context, meta *VolumeMetadata, status map[string]interface{}) (error) {
+    status[EncryptedOption] = meta.Encrypted
+    if meta.Encrypted {
+        open, err := d.isOpen(ctx, meta.Name)
+        if err != nil {
+            return err
+        }
+        status["format"] = "luks2"
+        status["opened"] = open
+        if open {
+            status["mapper"] = d.mapperDevice(meta.Name)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,133 @@
+package daemon
+
+import (
+    "errors"
+    "net/http"
+    "strings"
+)
+
+// --------------------------------------------------------------------------
+// Error model
+//
+// All errors returned by the Docker* methods are of type *Error. The code
+// identifies the kind of failure so that clients do not have to parse the
+// message. Docker receives "<code>: <message>" in the Err field, the admin
+// API the code and message as separate fields.
+// --------------------------------------------------------------------------
+
+type ErrorCode string
+
+const (
+    CodeNotFound ErrorCode = "NotFound"
+    CodeAlreadyExists ErrorCode = "AlreadyExists"
+    CodeInUse ErrorCode = "InUse"
+    CodeInsufficientCapacity ErrorCode = "InsufficientCapacity"
+    CodeInvalidArgument ErrorCode = "InvalidArgument"
+    CodeTimeout ErrorCode = "Timeout"
+    CodeCanceled ErrorCode = "Canceled"
+    CodeExternalCommandFailed ErrorCode = "ExternalCommandFailed"
+    CodeInternal ErrorCode = "Internal"
+    CodeFilesystemCorrupt ErrorCode = "FilesystemCorrupt"
+    // only used by the admin API
+    CodeUnauthorized ErrorCode = "Unauthorized"
+)
+
+type Error struct {
+    Code ErrorCode
+    Message string
+    // the failed command for ExternalCommandFailed, Timeout and Canceled
+    Exec *ExecStatus
+}
+
+func (e *Error) Error() (string) {
+    return string(e.Code) + ": " + e.Message
+}
+
+func newError(code ErrorCode, msg string) (*Error) {
+    return &Error{Code: code, Message: msg}
+}
+
+func NotFound(msg string) (*Error) { return newError(CodeNotFound, msg) }
+func AlreadyExists(msg string) (*Error) { return newError(CodeAlreadyExists, msg) }
+func InUse(msg string) (*Error) { return newError(CodeInUse, msg) }
+func InsufficientCapacity(msg string) (*Error) { return newError(CodeInsufficientCapacity, msg) }
+func InvalidArgument(msg string) (*Error) { return newError(CodeInvalidArgument, msg) }
+func Internal(msg string) (*Error) { return newError(CodeInternal, msg) }
+func Unauthorized(msg string) (*Error) { return newError(CodeUnauthorized, msg) }
+func FilesystemCorrupt(msg string) (*Error) { return newError(CodeFilesystemCorrupt, msg) }
+
+func ExternalCommandFailed(status ExecStatus, msg string) (*Error) {
+    return &Error{Code: CodeExternalCommandFailed, Message: msg, Exec: &status}
+}
+
+// AsError converts any error into an *Error. Errors which are not part of
+// the error model are reported as internal errors.
+func AsError(err error) (*Error) {
+    if err == nil {
+        return nil
+    }
+    var e *Error
+    if errors.As(err, &e) {
+        return e
+    }
+    return Internal(err.Error())
+}
+
+func ErrorCodeOf(err error) (ErrorCode) {
+    if err == nil {
+        return ""
+    }
+    return AsError(err).Code
+}
+
+func HasCode(err error, code ErrorCode) (bool) {
+    return err != nil && ErrorCodeOf(err) == code
+}
+
+var httpStatusCodes = map[ErrorCode]int{
+    CodeNotFound: http.StatusNotFound,
+    CodeAlreadyExists: http.StatusConflict,
+    CodeInUse: http.StatusConflict,
+    CodeInsufficientCapacity: http.StatusInsufficientStorage,
+    CodeInvalidArgument: http.StatusBadRequest,
+    CodeTimeout: http.StatusGatewayTimeout,
+    CodeCanceled: http.StatusServiceUnavailable,
+    CodeExternalCommandFailed: http.StatusBadGateway,
+    CodeInternal: http.StatusInternalServerError,
+    CodeFilesystemCorrupt: http.StatusConflict,
+    CodeUnauthorized: http.StatusUnauthorized,
+}
+
+// HTTPStatus returns the status code used for the error by the admin API
+func HTTPStatus(err error) (int) {
+    if code, ok := httpStatusCodes[ErrorCodeOf(err)]; ok {
+        return code
+    }
+    return http.StatusInternalServerError
+}
+
+var knownCodes = map[ErrorCode]bool{
+    CodeNotFound: true, CodeAlreadyExists: true, CodeInUse: true, CodeInsufficientCapacity: true,
+    CodeInvalidArgument: true, CodeTimeout: true, CodeCanceled: true, CodeExternalCommandFailed: true,
+    CodeInternal: true, CodeFilesystemCorrupt: true, CodeUnauthorized: true,
+}
+
+// ParseError parses the Err field of a docker response. Messages without a
+// known code, e.g. from older versions of the driver, become internal errors.
+func ParseError(s string) (*Error) {
+    if s == "" {
+        return nil
+    }
+    if kv := strings.SplitN(s, ": ", 2); len(kv) == 2 && knownCodes[ErrorCode(kv[0])] {
+        return newError(ErrorCode(kv[0]), kv[1])
+    }
+    return Internal(s)
+}
+
+// dockerErr returns the text for the Err field of a response to docker
+func dockerErr(err error) (string) {
+    if err == nil {
+        return ""
+    }
+    return AsError(err).Error()
+}
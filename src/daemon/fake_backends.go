@@ -0,0 +1,204 @@
+//go:build fake
+
+package daemon
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "flag"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// --------------------------------------------------------------------------
+// Fake backends
+//
+// Builds with the tag fake (go build -tags fake) can run the daemon against
+// the fake LVM (see fake_lvm.go), a fake docker engine and a fake cgroup,
+// selected with the --fake-* options of lvmvd. The tests in test/ and
+// client.TestServer need them. Production builds contain none of this code,
+// so nothing can make them run without root against emulated volumes, see
+// fake_other.go.
+// --------------------------------------------------------------------------
+
+// size of the volume groups and thin pools of the fake LVM in megabytes
+const (
+    fakeVolumeGroupSize = 10240
+    fakeThinPoolSize = 4096
+)
+
+// FakeUsage describes the options of FakeOptions for the usage of lvmvd
+const FakeUsage =
+`  --fake-lvm-dir=<directory> emulate LVM, mkfs and mount with files in this
+                             directory, for tests only (optional)
+  --fake-docker-engine=<file>
+                             read the volumes in use from this file instead of
+                             asking docker, for tests only (optional)
+  --fake-copy-rate=<MB/s>    throttle the copies of clones on the fake LVM,
+                             for tests only (optional)
+  --fake-io-cgroup=<directory>
+                             write the I/O limits into a plain io.max file in
+                             this directory, for tests only (optional)
+  --fake-pvs=<n>             number of physical volumes of the volume groups
+                             of the fake LVM, for tests only (default 1)
+`
+
+// FakeOptions select the fake backends of a daemon
+type FakeOptions struct {
+    LvmDir string
+    DockerEngine string
+    CopyRateMB int
+    IOCgroup string
+    Pvs int
+}
+
+// RegisterFakeFlags registers the --fake-* options
+func RegisterFakeFlags(fs *flag.FlagSet) (*FakeOptions) {
+    o := &FakeOptions{}
+    fs.StringVar(&o.LvmDir, "fake-lvm-dir", "", "emulate LVM with files in this directory (tests only)")
+    fs.StringVar(&o.DockerEngine, "fake-docker-engine", "", "file with the volumes in use (tests only)")
+    fs.IntVar(&o.CopyRateMB, "fake-copy-rate", 0, "throttle copies of the fake LVM to this many MB/s (tests only)")
+    fs.StringVar(&o.IOCgroup, "fake-io-cgroup", "", "directory with a plain io.max file (tests only)")
+    fs.IntVar(&o.Pvs, "fake-pvs", 1, "physical volumes of the volume groups of the fake LVM (tests only)")
+    return o
+}
+
+// Validate checks the options
+func (o *FakeOptions) Validate() (error) {
+    if o.Pvs < 1 {
+        return errors.New("fake volume groups need at least one physical volume")
+    }
+    return nil
+}
+
+// Apply sets up the selected fake backends for the daemon; the fake LVM gets
+// the volume groups and thin pools of the storage classes
+func (o *FakeOptions) Apply(d *Daemon) (error) {
+    if o.LvmDir != "" {
+        fake, err := NewFakeLvm(o.LvmDir)
+        for _, vg := range d.StorageClasses.VolumeGroups() {
+            if err == nil {
+                err = fake.AddVolumeGroup(vg, fakeVolumeGroupSize, o.Pvs)
+            }
+        }
+        for _, class := range d.StorageClasses.Classes {
+            if err == nil && class.ThinPool != "" {
+                err = fake.AddThinPool(class.VolumeGroup, class.ThinPool, fakeThinPoolSize)
+            }
+        }
+        if err != nil {
+            return errors.New("Cannot set up fake LVM: " + err.Error())
+        }
+        DefaultLogger().Warn("Using fake LVM backend, volumes are not real", "dir", o.LvmDir)
+        d.Executor = fake
+        d.DevDir = fake.DevDir()
+        d.Statfs = fake.Statfs
+        fake.CopyRateMB = o.CopyRateMB
+        d.CopyDevice = fake.CopyDevice
+    }
+    if o.DockerEngine != "" {
+        d.DockerEngine = &FakeDockerEngine{File: o.DockerEngine}
+    }
+    if o.IOCgroup != "" {
+        d.IOController = &FakeCgroupIOController{Dir: o.IOCgroup}
+    }
+    return nil
+}
+
+// fakeExecutor tells whether the executor is the fake LVM, which needs no
+// root privileges
+func fakeExecutor(e CommandExecutor) (bool) {
+    _, ok := e.(*FakeLvm)
+    return ok
+}
+
+// FakeDockerEngine reads the referenced volumes from a file, one name per
+// line, for tests only. A missing file behaves like an unreachable docker.
+type FakeDockerEngine struct {
+    File string
+}
+
+func (e *FakeDockerEngine) ReferencedVolumes(ctx context.Context, driver string) (map[string]bool, error) {
+    f, err := os.Open(e.File)
+    if err != nil {
+        return nil, errors.New("Cannot reach fake docker: " + err.Error())
+    }
+    defer f.Close()
+    volumes := make(map[string]bool)
+    in := bufio.NewScanner(f)
+    for in.Scan() {
+        if name := strings.TrimSpace(in.Text()); name != "" {
+            volumes[name] = true
+        }
+    }
+    return volumes, in.Err()
+}
+
+// FakeCgroupIOController keeps io.max as a plain file in a directory and
+// merges the entries written like the kernel does, for tests only
+type FakeCgroupIOController struct {
+    Dir string
+}
+
+func (c *FakeCgroupIOController) SetIOMax(ctx context.Context, entry string) (error) {
+    file := filepath.Join(c.Dir, ioMaxFile)
+    data, err := ioutil.ReadFile(file)
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    devices := make(map[string]map[string]string)
+    for _, line := range strings.Split(string(data), "\n") {
+        if fields := strings.Fields(line); len(fields) > 0 {
+            devices[fields[0]] = ioMaxKeys(fields[1:])
+        }
+    }
+    fields := strings.Fields(entry)
+    if len(fields) < 2 || !deviceNumberPattern.MatchString(fields[0]) {
+        return errors.New("Illegal io.max entry " + entry)
+    }
+    keys := devices[fields[0]]
+    if keys == nil {
+        keys = ioMaxKeys(nil)
+    }
+    for _, f := range fields[1:] {
+        kv := strings.SplitN(f, "=", 2)
+        if _, ok := keys[kv[0]]; !ok || len(kv) != 2 {
+            return errors.New("Illegal io.max entry " + entry)
+        }
+        keys[kv[0]] = kv[1]
+    }
+    devices[fields[0]] = keys
+    names := []string{}
+    for dev, keys := range devices {
+        for _, v := range keys {
+            if v != ioMaxUnlimited {
+                names = append(names, dev)
+                break
+            }
+        }
+    }
+    sort.Strings(names)
+    var out strings.Builder
+    for _, dev := range names {
+        keys := devices[dev]
+        out.WriteString(dev + " rbps=" + keys["rbps"] + " wbps=" + keys["wbps"] + " riops=" + keys["riops"] + " wiops=" + keys["wiops"] + "\n")
+    }
+    return ioutil.WriteFile(file, []byte(out.String()), 0644)
+}
+
+// ioMaxKeys parses the keys of an io.max entry, keys not given are max
+func ioMaxKeys(fields []string) (map[string]string) {
+    keys := map[string]string{"rbps": ioMaxUnlimited, "wbps": ioMaxUnlimited, "riops": ioMaxUnlimited, "wiops": ioMaxUnlimited}
+    for _, f := range fields {
+        if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+            if _, ok := keys[kv[0]]; ok {
+                keys[kv[0]] = kv[1]
+            }
+        }
+    }
+    return keys
+}
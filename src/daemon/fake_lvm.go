@@ -0,0 +1,1951 @@
+//go:build fake
+
+package daemon
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Fake LVM
+//
+// FakeLvm emulates the LVM tools, mkfs and mount so that the daemon can be
+// run and tested without root privileges, device mapper or loop devices.
+// Logical volumes are sparse files <dir>/<vg>/<lv>, so data written to the
+// "device" is real. Tags are kept in <dir>/.tags/<vg>/<lv> so that they
+// survive a restart, as are the hash of the key of LUKS formatted volumes in
+// <dir>/.luks/<vg>/<lv>, the pool of thin volumes and filesystems other than
+// ext4, the UUID of the filesystem, the origin of snapshots and merges
+// waiting for the next activation of the origin. Thin volumes take no space in the
+// volume group, their pool does, and have a device id in their pool like
+// real thin volumes, which thin_delta takes; it compares the data of two
+// thin volumes in blocks of 64KiB. Opened LUKS containers are symlinks
+// <dir>/mapper/<name> to the logical volume; they are recorded in
+// <dir>/.mapper and stay open over a restart, like device mapper targets do.
+// Mounting only records the mount and its options and makes sure the
+// mountpoint directory exists. The root directory of the filesystem is
+// emulated on the mountpoint while mounted: its mode, and lost+found if
+// present; the owner is only recorded, so that no privileges are needed.
+// The files of a filesystem are kept in <dir>/.files/<vg>/<lv> and moved to
+// the mountpoint while mounted; snapshots and copies get them as well.
+// Programs given with an absolute path, the commands of snapshot hooks, are
+// executed for real.
+// RAID and striped volumes need as many physical volumes as they have legs
+// and take the space of all of them; their layout is kept in
+// <dir>/.raid/<vg>/<lv>. They are always in sync and healthy unless a test
+// writes sync=<percent> and health=<lv_health_status> lines into
+// <dir>/.raidstate/<vg>/<lv>, e.g. health=partial for a lost leg.
+// --------------------------------------------------------------------------
+
+type fakeLogicalVolume struct {
+    name string
+    sizeMB int64
+    origin string
+    // snapshot to be merged into its origin on the next activation
+    merging bool
+    // thin pool and device id in the pool of a thin volume
+    pool string
+    thinId int
+    isPool bool
+    // filesystem, inside the LUKS container if formatted with LUKS
+    fs string
+    uuid string
+    tags []string
+    // hash of the LUKS key, empty if not formatted with LUKS
+    luks string
+    root fakeRoot
+    // empty if the filesystem is clean, fakeDirty, fakeCorrupt or
+    // fakeBroken
+    fsState string
+    // segment type, mirrors and stripes of RAID and striped volumes
+    raid string
+    mirrors int
+    stripes int
+}
+
+// fakeRoot is the root directory of the filesystem of a logical volume
+type fakeRoot struct {
+    owner string
+    mode os.FileMode
+    lostFound bool
+}
+
+var newFakeRoot = fakeRoot{owner: "0:0", mode: 0755, lostFound: true}
+
+type fakeVolumeGroup struct {
+    name string
+    sizeMB int64
+    pvCount int
+    lvs map[string]*fakeLogicalVolume
+}
+
+type FakeLvm struct {
+    Dir string
+    m sync.Mutex
+    groups map[string]*fakeVolumeGroup
+    // mountpoint -> device
+    mounts map[string]string
+    // mountpoint -> options given with -o
+    mountOptions map[string]string
+    // opened LUKS containers, mapper name -> device of the logical volume
+    opened map[string]string
+    // mountpoints frozen with fsfreeze
+    frozen map[string]bool
+    // thin pools, vg/pool, with a reserved metadata snapshot
+    metadataSnaps map[string]bool
+    // copies by CopyDevice are throttled to this rate if set, so that tests
+    // can watch and cancel them
+    CopyRateMB int
+}
+
+// NewFakeLvm creates a fake LVM keeping its devices below dir
+func NewFakeLvm(dir string) (*FakeLvm, error) {
+    if err := os.MkdirAll(dir, 0750); err != nil {
+        return nil, err
+    }
+    f := &FakeLvm{
+        Dir: dir,
+        groups: make(map[string]*fakeVolumeGroup),
+        mounts: make(map[string]string),
+        mountOptions: make(map[string]string),
+        opened: make(map[string]string),
+        frozen: make(map[string]bool),
+        metadataSnaps: make(map[string]bool),
+    }
+    // like device mapper targets, opened containers survive a restart
+    entries, err := ioutil.ReadDir(filepath.Join(dir, fakeMappers))
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    for _, e := range entries {
+        if dev, err := ioutil.ReadFile(filepath.Join(dir, fakeMappers, e.Name())); err == nil {
+            f.opened[e.Name()] = string(dev)
+        }
+    }
+    return f, nil
+}
+
+// DevDir returns the directory to be used as device directory by the driver
+func (f *FakeLvm) DevDir() (string) {
+    return f.Dir
+}
+
+// AddVolumeGroup creates a volume group. Logical volumes left over in the
+// directory of the volume group from an earlier run are picked up again
+// (with an ext4 filesystem).
+func (f *FakeLvm) AddVolumeGroup(name string, sizeMB int64, pvCount int) (error) {
+    f.m.Lock()
+    defer f.m.Unlock()
+    dir := filepath.Join(f.Dir, name)
+    if err := os.MkdirAll(dir, 0750); err != nil {
+        return err
+    }
+    vg := &fakeVolumeGroup{name: name, sizeMB: sizeMB, pvCount: pvCount, lvs: make(map[string]*fakeLogicalVolume)}
+    entries, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return err
+    }
+    for _, e := range entries {
+        if e.Mode().IsRegular() {
+            lv := &fakeLogicalVolume{name: e.Name(), sizeMB: e.Size() / (1024 * 1024), fs: DEFAULT_FILESYSTEM, root: newFakeRoot}
+            if tags, err := ioutil.ReadFile(f.tagFile(name, e.Name())); err == nil && len(tags) > 0 {
+                lv.tags = strings.Split(string(tags), ",")
+            }
+            if luks, err := ioutil.ReadFile(f.luksFile(name, e.Name())); err == nil {
+                lv.luks = string(luks)
+            }
+            if state, err := ioutil.ReadFile(f.stateFile(fakeFsState, name, e.Name())); err == nil {
+                lv.fsState = strings.TrimSpace(string(state))
+            }
+            if pool, err := ioutil.ReadFile(f.stateFile(fakeThin, name, e.Name())); err == nil {
+                lv.pool = string(pool)
+            }
+            if id, err := ioutil.ReadFile(f.stateFile(fakeThinId, name, e.Name())); err == nil {
+                lv.thinId, _ = strconv.Atoi(string(id))
+            }
+            if fs, err := ioutil.ReadFile(f.stateFile(fakeFs, name, e.Name())); err == nil {
+                lv.fs = string(fs)
+                lv.root.lostFound = fsLostFound[lv.fs]
+            }
+            if uuid, err := ioutil.ReadFile(f.stateFile(fakeUuid, name, e.Name())); err == nil {
+                lv.uuid = string(uuid)
+            }
+            if origin, err := ioutil.ReadFile(f.stateFile(fakeOrigin, name, e.Name())); err == nil {
+                lv.origin = string(origin)
+            }
+            if _, err := os.Stat(f.stateFile(fakeMerging, name, e.Name())); err == nil {
+                lv.merging = true
+            }
+            if raid, err := ioutil.ReadFile(f.stateFile(fakeRaid, name, e.Name())); err == nil {
+                fmt.Sscan(string(raid), &lv.raid, &lv.mirrors, &lv.stripes)
+            }
+            vg.lvs[e.Name()] = lv
+        }
+    }
+    f.groups[name] = vg
+    return nil
+}
+
+// AddThinPool makes a thin pool of the given size in a volume group added
+// before, unless it exists from an earlier run
+func (f *FakeLvm) AddThinPool(vgName string, name string, sizeMB int64) (error) {
+    f.m.Lock()
+    defer f.m.Unlock()
+    vg, ok := f.groups[vgName]
+    if !ok {
+        return errors.New("No volume group " + vgName)
+    }
+    lv, ok := vg.lvs[name]
+    if !ok {
+        if sizeMB > vg.freeMB() {
+            return errors.New("Volume group " + vgName + " has insufficient free space for thin pool " + name)
+        }
+        if err := createSparseFile(f.devicePath(vgName, name), sizeMB); err != nil {
+            return err
+        }
+        lv = &fakeLogicalVolume{name: name, sizeMB: sizeMB}
+        vg.lvs[name] = lv
+    }
+    lv.isPool = true
+    lv.fs = ""
+    return nil
+}
+
+func (vg *fakeVolumeGroup) freeMB() (int64) {
+    free := vg.sizeMB
+    for _, lv := range vg.lvs {
+        if lv.pool == "" {
+            free -= lv.allocatedMB(lv.sizeMB)
+        }
+    }
+    return free
+}
+
+// allocatedMB returns the space the logical volume takes in its volume group
+// with the given size, the copies and parity of RAID volumes included
+func (lv *fakeLogicalVolume) allocatedMB(sizeMB int64) (int64) {
+    switch lv.raid {
+    case RaidLevel1, RaidLevel10:
+        return sizeMB * int64(lv.mirrors + 1)
+    case RaidLevel5:
+        return sizeMB * int64(lv.stripes + 1) / int64(lv.stripes)
+    case RaidLevel6:
+        return sizeMB * int64(lv.stripes + 2) / int64(lv.stripes)
+    }
+    return sizeMB
+}
+
+// legs returns the number of physical volumes the logical volume needs
+func (lv *fakeLogicalVolume) legs() (int) {
+    switch lv.raid {
+    case RaidLevel1:
+        return lv.mirrors + 1
+    case RaidLevel5:
+        return lv.stripes + 1
+    case RaidLevel6:
+        return lv.stripes + 2
+    case RaidLevel10:
+        return lv.stripes * (lv.mirrors + 1)
+    case segtypeStriped:
+        return lv.stripes
+    }
+    return 1
+}
+
+func (lv *fakeLogicalVolume) segtype() (string) {
+    switch {
+    case lv.isPool:
+        return segtypeThinPool
+    case lv.pool != "":
+        return "thin"
+    case lv.raid != "":
+        return lv.raid
+    }
+    return "linear"
+}
+
+// raidState returns sync_percent and lv_health_status of a logical volume,
+// as written by a test into its .raidstate file
+func (f *FakeLvm) raidState(vg string, lv *fakeLogicalVolume) (string, string) {
+    if !strings.HasPrefix(lv.raid, "raid") {
+        return "", ""
+    }
+    sync, health := "100.00", ""
+    data, _ := ioutil.ReadFile(f.stateFile(fakeRaidState, vg, lv.name))
+    for _, line := range strings.Split(string(data), "\n") {
+        kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+        if len(kv) != 2 {
+            continue
+        }
+        switch kv[0] {
+        case "sync":
+            sync = kv[1]
+        case "health":
+            health = kv[1]
+        }
+    }
+    return sync, health
+}
+
+// nextThinId returns the device id for a new thin volume in a pool
+func (vg *fakeVolumeGroup) nextThinId(pool string) (int) {
+    id := 1
+    for _, lv := range vg.lvs {
+        if lv.pool == pool && lv.thinId >= id {
+            id = lv.thinId + 1
+        }
+    }
+    return id
+}
+
+func (vg *fakeVolumeGroup) sortedNames() ([]string) {
+    names := []string{}
+    for n := range vg.lvs {
+        names = append(names, n)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// fakeArgs holds parsed command line arguments
+type fakeArgs struct {
+    flags map[string]string
+    positional []string
+}
+
+// options of the emulated programs which take a value
+var fakeValueFlags = map[string]bool{
+    "-L": true, "-n": true, "-o": true, "--units": true, "--separator": true,
+    "-t": true, "-T": true, "-V": true, "--addtag": true, "--deltag": true,
+    "--size": true, "--name": true, "--type": true, "-m": true, "-i": true, "-I": true,
+    "--wipesignatures": true, "--zero": true, "-W": true, "-Z": true, "--thinpool": true,
+    "--key-file": true, "-U": true, "--snap1": true, "--snap2": true, "-E": true,
+}
+
+func parseFakeArgs(args []string) (fakeArgs) {
+    a := fakeArgs{flags: make(map[string]string)}
+    for i := 0; i < len(args); i++ {
+        arg := args[i]
+        if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+            if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 && strings.HasPrefix(arg, "--") {
+                a.flags[kv[0]] = kv[1]
+            } else if fakeValueFlags[arg] && i + 1 < len(args) {
+                a.flags[arg] = args[i+1]
+                i++
+            } else {
+                a.flags[arg] = ""
+            }
+        } else {
+            a.positional = append(a.positional, arg)
+        }
+    }
+    return a
+}
+
+func (a fakeArgs) has(flag string) (bool) {
+    _, ok := a.flags[flag]
+    return ok
+}
+
+var fakeSizePattern = regexp.MustCompile("^([+]?)([0-9.]+)([mMgGtT]?)$")
+
+// fakeSize parses an LVM size argument; relative reports a leading "+"
+func fakeSize(s string) (sizeMB int64, relative bool, err error) {
+    m := fakeSizePattern.FindStringSubmatch(s)
+    if m == nil {
+        return 0, false, errors.New("Invalid size " + s)
+    }
+    v, err := strconv.ParseFloat(m[2], 64)
+    if err != nil {
+        return 0, false, err
+    }
+    switch strings.ToLower(m[3]) {
+    case "g":
+        v *= 1024
+    case "t":
+        v *= 1024 * 1024
+    }
+    return int64(v), m[1] == "+", nil
+}
+
+func fakeStatus(cmd string, status int, stdout string, stderr string) (ExecStatus) {
+    return ExecStatus{cmd: cmd, status: status, stdout: stdout, stderr: stderr}
+}
+
+// resolve finds the logical volume for a device path (<dir>/vg/lv or
+// /dev/vg/lv), a vg/lv name or the device of an opened LUKS container
+// (<dir>/mapper/name)
+func (f *FakeLvm) resolve(arg string) (*fakeVolumeGroup, *fakeLogicalVolume) {
+    path := strings.TrimPrefix(strings.TrimPrefix(arg, f.Dir), "/dev")
+    parts := strings.Split(strings.Trim(path, "/"), "/")
+    if len(parts) != 2 {
+        return nil, nil
+    }
+    if parts[0] == "mapper" {
+        if dev, ok := f.opened[parts[1]]; ok {
+            return f.resolve(dev)
+        }
+        return nil, nil
+    }
+    if vg, ok := f.groups[parts[0]]; ok {
+        return vg, vg.lvs[parts[1]]
+    }
+    return nil, nil
+}
+
+func (f *FakeLvm) devicePath(vg string, lv string) (string) {
+    return filepath.Join(f.Dir, vg, lv)
+}
+
+// state of logical volumes kept in files to survive a restart
+const (
+    fakeTags = ".tags"
+    fakeLuks = ".luks"
+    fakeFsState = ".fsstate"
+    fakeThin = ".thin"
+    fakeThinId = ".thinid"
+    fakeFs = ".fs"
+    fakeUuid = ".uuid"
+    fakeOrigin = ".origin"
+    fakeMerging = ".merging"
+    fakeRaid = ".raid"
+    // sync and health of RAID volumes, written by tests only
+    fakeRaidState = ".raidstate"
+    // files of the filesystem while not mounted, one directory per volume
+    fakeFiles = ".files"
+    // opened LUKS containers, one file per mapper name with the device
+    fakeMappers = ".mapper"
+)
+
+var fakeStateKinds = []string{fakeTags, fakeLuks, fakeFsState, fakeThin, fakeThinId, fakeFs, fakeUuid, fakeOrigin, fakeMerging, fakeRaid, fakeRaidState}
+
+func (f *FakeLvm) stateFile(kind string, vg string, lv string) (string) {
+    return filepath.Join(f.Dir, kind, vg, lv)
+}
+
+func (f *FakeLvm) tagFile(vg string, lv string) (string) {
+    return f.stateFile(fakeTags, vg, lv)
+}
+
+func (f *FakeLvm) luksFile(vg string, lv string) (string) {
+    return f.stateFile(fakeLuks, vg, lv)
+}
+
+// writeState stores a value of a logical volume, an empty value removes the
+// file
+func writeState(path string, value string) (error) {
+    if value == "" {
+        if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        return nil
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, []byte(value), 0600)
+}
+
+func (f *FakeLvm) saveLuks(vg string, lv *fakeLogicalVolume) (error) {
+    return writeState(f.luksFile(vg, lv.name), lv.luks)
+}
+
+func (f *FakeLvm) saveFsState(vg string, lv *fakeLogicalVolume) (error) {
+    if err := writeState(f.stateFile(fakeFsState, vg, lv.name), lv.fsState); err != nil {
+        return err
+    }
+    fs := lv.fs
+    if fs == DEFAULT_FILESYSTEM {
+        fs = ""
+    }
+    if err := writeState(f.stateFile(fakeFs, vg, lv.name), fs); err != nil {
+        return err
+    }
+    return writeState(f.stateFile(fakeUuid, vg, lv.name), lv.uuid)
+}
+
+// saveState stores all state of a logical volume
+func (f *FakeLvm) saveState(vg string, lv *fakeLogicalVolume) (error) {
+    if err := f.saveTags(vg, lv); err != nil {
+        return err
+    }
+    if err := f.saveLuks(vg, lv); err != nil {
+        return err
+    }
+    if err := writeState(f.stateFile(fakeThin, vg, lv.name), lv.pool); err != nil {
+        return err
+    }
+    thinId := ""
+    if lv.thinId > 0 {
+        thinId = strconv.Itoa(lv.thinId)
+    }
+    if err := writeState(f.stateFile(fakeThinId, vg, lv.name), thinId); err != nil {
+        return err
+    }
+    if err := writeState(f.stateFile(fakeOrigin, vg, lv.name), lv.origin); err != nil {
+        return err
+    }
+    merging := ""
+    if lv.merging {
+        merging = "1"
+    }
+    if err := writeState(f.stateFile(fakeMerging, vg, lv.name), merging); err != nil {
+        return err
+    }
+    if err := f.saveRaid(vg, lv); err != nil {
+        return err
+    }
+    return f.saveFsState(vg, lv)
+}
+
+func (f *FakeLvm) saveRaid(vg string, lv *fakeLogicalVolume) (error) {
+    raid := ""
+    if lv.raid != "" {
+        raid = fmt.Sprintf("%s %d %d", lv.raid, lv.mirrors, lv.stripes)
+    }
+    return writeState(f.stateFile(fakeRaid, vg, lv.name), raid)
+}
+
+func (f *FakeLvm) removeState(vg string, lv string) {
+    for _, kind := range fakeStateKinds {
+        os.Remove(f.stateFile(kind, vg, lv))
+    }
+    os.RemoveAll(f.stateFile(fakeFiles, vg, lv))
+}
+
+// mountpointOf returns where the filesystem of a logical volume is mounted,
+// directly or through its LUKS container, empty if it is not mounted
+func (f *FakeLvm) mountpointOf(lv *fakeLogicalVolume) (string) {
+    for mp, d := range f.mounts {
+        if _, m := f.resolve(d); m == lv {
+            return mp
+        }
+    }
+    return ""
+}
+
+// copyFiles replaces the files of the filesystem of to by those of from,
+// which are taken from the mountpoint if from is mounted
+func (f *FakeLvm) copyFiles(vg string, from *fakeLogicalVolume, to *fakeLogicalVolume) (error) {
+    dst := f.stateFile(fakeFiles, vg, to.name)
+    if err := os.RemoveAll(dst); err != nil {
+        return err
+    }
+    src := f.mountpointOf(from)
+    if src == "" {
+        src = f.stateFile(fakeFiles, vg, from.name)
+    }
+    if _, err := os.Stat(src); os.IsNotExist(err) {
+        return nil
+    }
+    return copyTree(src, dst)
+}
+
+// copyTree copies a directory tree with the modes of files and directories;
+// the emulated lost+found of a mountpoint is left out
+func copyTree(from string, to string) (error) {
+    return filepath.Walk(from, func(p string, fi os.FileInfo, err error) (error) {
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(from, p)
+        if err != nil {
+            return err
+        }
+        if rel == lostFoundDir {
+            return filepath.SkipDir
+        }
+        target := filepath.Join(to, rel)
+        switch {
+        case fi.IsDir():
+            if err := os.MkdirAll(target, 0700); err != nil {
+                return err
+            }
+            return os.Chmod(target, fi.Mode() & os.ModePerm)
+        case fi.Mode() & os.ModeSymlink != 0:
+            link, err := os.Readlink(p)
+            if err != nil {
+                return err
+            }
+            return os.Symlink(link, target)
+        case fi.Mode().IsRegular():
+            if err := copyFile(p, target); err != nil {
+                return err
+            }
+            return os.Chmod(target, fi.Mode() & os.ModePerm)
+        }
+        return nil
+    })
+}
+
+// moveEntries moves the content of directory from into directory to
+func moveEntries(from string, to string) (error) {
+    entries, err := ioutil.ReadDir(from)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+    if err := os.MkdirAll(to, 0700); err != nil {
+        return err
+    }
+    for _, e := range entries {
+        src, dst := filepath.Join(from, e.Name()), filepath.Join(to, e.Name())
+        if err := os.RemoveAll(dst); err != nil {
+            return err
+        }
+        if err := os.Rename(src, dst); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// isOpen reports whether a LUKS container of the device is open
+func (f *FakeLvm) isOpen(dev string) (bool) {
+    for _, d := range f.opened {
+        if d == dev {
+            return true
+        }
+    }
+    return false
+}
+
+// inUse reports whether the device is mounted or has an open LUKS container
+func (f *FakeLvm) inUse(dev string) (bool) {
+    for _, d := range f.mounts {
+        if d == dev {
+            return true
+        }
+    }
+    return f.isOpen(dev)
+}
+
+func (f *FakeLvm) saveTags(vg string, lv *fakeLogicalVolume) (error) {
+    return writeState(f.tagFile(vg, lv.name), strings.Join(lv.tags, ","))
+}
+
+func (f *FakeLvm) Run(ctx context.Context, cmdName string, args []string, stdin []byte) (ExecStatus) {
+    cmd := commandLine(cmdName, args)
+    if ctx.Err() != nil {
+        e := newError(CodeCanceled, "command \"" + cmd + "\" was killed because the request was canceled")
+        status := fakeStatus(cmd, -1, "", "")
+        e.Exec = &ExecStatus{cmd: cmd, status: -1}
+        status.err = e
+        return status
+    }
+    if filepath.IsAbs(cmdName) {
+        // commands of snapshot hooks are run for real
+        return osExecutor{}.Run(ctx, cmdName, args, stdin)
+    }
+    f.m.Lock()
+    defer f.m.Unlock()
+    a := parseFakeArgs(args)
+    if strings.HasPrefix(cmdName, "mkfs.") {
+        return f.mkfs(cmd, strings.TrimPrefix(cmdName, "mkfs."), a)
+    }
+    switch cmdName {
+    case "vgdisplay":
+        return f.vgdisplay(cmd)
+    case "vgs":
+        return f.vgs(cmd, a)
+    case "lvs":
+        return f.lvs(cmd, a)
+    case "lvcreate":
+        return f.lvcreate(cmd, a)
+    case "lvremove":
+        return f.lvremove(cmd, a)
+    case "lvextend":
+        return f.lvextend(cmd, a)
+    case "lvchange":
+        return f.lvchange(cmd, a)
+    case "lvrename":
+        return f.lvrename(cmd, a)
+    case "lvconvert":
+        return f.lvconvert(cmd, a)
+    case "blkdiscard":
+        return f.blkdiscard(cmd, a)
+    case "cryptsetup":
+        return f.cryptsetup(cmd, a, stdin)
+    case "mount":
+        return f.mount(cmd, a)
+    case "umount":
+        return f.umount(cmd, a)
+    case "rmdir":
+        if len(a.positional) != 1 {
+            return fakeStatus(cmd, 1, "", "rmdir: missing operand\n")
+        }
+        if err := os.Remove(a.positional[0]); err != nil {
+            return fakeStatus(cmd, 1, "", "rmdir: " + err.Error() + "\n")
+        }
+        if filepath.Base(a.positional[0]) == lostFoundDir {
+            if lv := f.mountedVolume(filepath.Dir(a.positional[0])); lv != nil {
+                lv.root.lostFound = false
+            }
+        }
+        return fakeStatus(cmd, 0, "", "")
+    case "chown", "chmod":
+        return f.changeRoot(cmd, cmdName, a)
+    case "dmsetup":
+        return f.dmsetup(cmd, a)
+    case "thin_delta":
+        return f.thinDelta(cmd, a)
+    case "dumpe2fs":
+        return f.dumpe2fs(cmd, a)
+    case "e2fsck":
+        return f.e2fsck(cmd, a)
+    case "xfs_repair":
+        return f.xfsRepair(cmd, a)
+    case "tune2fs", "xfs_admin":
+        return f.newUuid(cmd, cmdName, a)
+    case "fsfreeze":
+        return f.fsfreeze(cmd, a)
+    case "lsblk":
+        return f.lsblk(cmd, a)
+    }
+    return fakeStatus(cmd, 127, "", cmdName + ": command not found\n")
+}
+
+func (f *FakeLvm) vgdisplay(cmd string) (ExecStatus) {
+    var out strings.Builder
+    for _, vg := range f.groups {
+        used := vg.sizeMB - vg.freeMB()
+        fmt.Fprintf(&out, "  \"%s\" %d.00 MiB [%d.00 MiB used / %d.00 MiB free]\n", vg.name, vg.sizeMB, used, vg.freeMB())
+    }
+    return fakeStatus(cmd, 0, out.String(), "")
+}
+
+func fakeSeparator(a fakeArgs) (string) {
+    if sep, ok := a.flags["--separator"]; ok {
+        return sep
+    }
+    return " "
+}
+
+func fakeMegabytes(a fakeArgs, mb int64) (string) {
+    if a.flags["--units"] == "m" && a.has("--nosuffix") {
+        return strconv.FormatInt(mb, 10) + ".00"
+    }
+    return strconv.FormatInt(mb, 10) + ".00m"
+}
+
+func (f *FakeLvm) vgs(cmd string, a fakeArgs) (ExecStatus) {
+    fields := strings.Split(a.flags["-o"], ",")
+    var out strings.Builder
+    for _, vg := range f.groups {
+        if len(a.positional) > 0 && a.positional[0] != vg.name {
+            continue
+        }
+        values := []string{}
+        for _, field := range fields {
+            switch field {
+            case "vg_name":
+                values = append(values, vg.name)
+            case "vg_size":
+                values = append(values, fakeMegabytes(a, vg.sizeMB))
+            case "vg_free":
+                values = append(values, fakeMegabytes(a, vg.freeMB()))
+            case "pv_count":
+                values = append(values, strconv.Itoa(vg.pvCount))
+            case "lv_count":
+                values = append(values, strconv.Itoa(len(vg.lvs)))
+            default:
+                values = append(values, "")
+            }
+        }
+        out.WriteString("  " + strings.Join(values, fakeSeparator(a)) + "\n")
+    }
+    return fakeStatus(cmd, 0, out.String(), "")
+}
+
+func (f *FakeLvm) lvs(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 {
+        return fakeStatus(cmd, 5, "", "  Volume group name expected\n")
+    }
+    vg, ok := f.groups[a.positional[0]]
+    if !ok {
+        return fakeStatus(cmd, 5, "", "  Volume group \"" + a.positional[0] + "\" not found\n")
+    }
+    fields := []string{"lv_name"}
+    if o, ok := a.flags["-o"]; ok {
+        fields = strings.Split(o, ",")
+    }
+    var out strings.Builder
+    for _, name := range vg.sortedNames() {
+        lv := vg.lvs[name]
+        values := []string{}
+        for _, field := range fields {
+            switch field {
+            case "lv_name":
+                values = append(values, lv.name)
+            case "lv_size":
+                values = append(values, fakeMegabytes(a, lv.sizeMB))
+            case "origin":
+                values = append(values, lv.origin)
+            case "lv_merging":
+                if lv.merging {
+                    values = append(values, "merging")
+                } else {
+                    values = append(values, "")
+                }
+            case "lv_tags":
+                values = append(values, strings.Join(lv.tags, ","))
+            case "vg_name":
+                values = append(values, vg.name)
+            case "pool_lv":
+                values = append(values, lv.pool)
+            case "thin_id":
+                if lv.thinId > 0 {
+                    values = append(values, strconv.Itoa(lv.thinId))
+                } else {
+                    values = append(values, "")
+                }
+            case "segtype":
+                values = append(values, lv.segtype())
+            case "lv_path":
+                values = append(values, f.devicePath(vg.name, lv.name))
+            case "sync_percent":
+                sync, _ := f.raidState(vg.name, lv)
+                values = append(values, sync)
+            case "lv_health_status":
+                _, health := f.raidState(vg.name, lv)
+                values = append(values, health)
+            default:
+                values = append(values, "")
+            }
+        }
+        out.WriteString("  " + strings.Join(values, fakeSeparator(a)) + "\n")
+    }
+    return fakeStatus(cmd, 0, out.String(), "")
+}
+
+// lvcreate supports thick volumes (-L), RAID and striped ones (--type
+// raid1|raid5|raid6|raid10|striped with -m, -i and -I), snapshots (-s -L),
+// thin snapshots of thin volumes (-s without size), thin pools (--type
+// thin-pool -L) and thin volumes (-V -T vg/pool)
+func (f *FakeLvm) lvcreate(cmd string, a fakeArgs) (ExecStatus) {
+    name, ok := a.flags["-n"]
+    thin := a.has("-T")
+    if !ok || (!thin && len(a.positional) != 1) {
+        return fakeStatus(cmd, 3, "", "  Please specify a logical volume name and a volume group\n")
+    }
+    sizeFlag := a.flags["-L"]
+    if thin {
+        sizeFlag = a.flags["-V"]
+    }
+    // thin snapshots have the size of their origin
+    thinSnapshot := a.has("-s") && sizeFlag == ""
+    var size int64
+    if !thinSnapshot {
+        var err error
+        if size, _, err = fakeSize(sizeFlag); err != nil || size <= 0 {
+            return fakeStatus(cmd, 3, "", "  Invalid argument for --size\n")
+        }
+    }
+    var target []string
+    if thin {
+        target = strings.SplitN(a.flags["-T"], "/", 2)
+    } else {
+        target = strings.SplitN(a.positional[0], "/", 2)
+    }
+    vg, ok := f.groups[target[0]]
+    if !ok {
+        return fakeStatus(cmd, 5, "", "  Volume group \"" + target[0] + "\" not found\n")
+    }
+    if _, exists := vg.lvs[name]; exists {
+        return fakeStatus(cmd, 5, "", "  Logical Volume \"" + name + "\" already exists in volume group \"" + vg.name + "\"\n")
+    }
+    lv := &fakeLogicalVolume{name: name, sizeMB: size}
+    switch segtype := a.flags["--type"]; segtype {
+    case RaidLevel1, RaidLevel5, RaidLevel6, RaidLevel10, segtypeStriped:
+        lv.raid = segtype
+        lv.mirrors, _ = strconv.Atoi(a.flags["-m"])
+        lv.stripes, _ = strconv.Atoi(a.flags["-i"])
+        // the defaults of lvcreate
+        if lv.mirrors == 0 && (segtype == RaidLevel1 || segtype == RaidLevel10) {
+            lv.mirrors = 1
+        }
+        if lv.stripes == 0 && segtype != RaidLevel1 {
+            lv.stripes = map[string]int{RaidLevel5: 2, RaidLevel6: 3, RaidLevel10: 2, segtypeStriped: 1}[segtype]
+        }
+        if n := lv.legs(); n > vg.pvCount {
+            return fakeStatus(cmd, 5, "", fmt.Sprintf("  Insufficient suitable allocatable extents for logical volume %s: %d physical volumes needed, %d available\n", name, n, vg.pvCount))
+        }
+    }
+    if !thin && lv.allocatedMB(size) > vg.freeMB() {
+        return fakeStatus(cmd, 5, "", "  Volume group \"" + vg.name + "\" has insufficient free space\n")
+    }
+    if tag, ok := a.flags["--addtag"]; ok {
+        lv.tags = []string{tag}
+    }
+    if thin {
+        if len(target) != 2 || vg.lvs[target[1]] == nil || !vg.lvs[target[1]].isPool {
+            return fakeStatus(cmd, 5, "", "  Thin pool " + a.flags["-T"] + " not found\n")
+        }
+        lv.pool = target[1]
+        lv.thinId = vg.nextThinId(lv.pool)
+        if err := createSparseFile(f.devicePath(vg.name, name), size); err != nil {
+            return fakeStatus(cmd, 5, "", err.Error() + "\n")
+        }
+        if err := f.saveState(vg.name, lv); err != nil {
+            return fakeStatus(cmd, 5, "", err.Error() + "\n")
+        }
+    } else if a.has("-s") {
+        if len(target) != 2 || vg.lvs[target[1]] == nil {
+            return fakeStatus(cmd, 5, "", "  Snapshot origin not found\n")
+        }
+        origin := vg.lvs[target[1]]
+        if thinSnapshot && origin.pool == "" {
+            return fakeStatus(cmd, 3, "", "  Please specify either size or extents.\n")
+        }
+        if thinSnapshot {
+            lv.pool = origin.pool
+            lv.thinId = vg.nextThinId(lv.pool)
+        }
+        lv.origin = origin.name
+        lv.fs = origin.fs
+        lv.uuid = origin.uuid
+        lv.root = origin.root
+        lv.luks = origin.luks
+        lv.fsState = origin.fsState
+        lv.sizeMB = origin.sizeMB
+        if err := copyFile(f.devicePath(vg.name, origin.name), f.devicePath(vg.name, name)); err != nil {
+            return fakeStatus(cmd, 5, "", err.Error() + "\n")
+        }
+        if err := f.copyFiles(vg.name, origin, lv); err != nil {
+            return fakeStatus(cmd, 5, "", err.Error() + "\n")
+        }
+        if err := f.saveState(vg.name, lv); err != nil {
+            return fakeStatus(cmd, 5, "", err.Error() + "\n")
+        }
+    } else {
+        if err := createSparseFile(f.devicePath(vg.name, name), size); err != nil {
+            return fakeStatus(cmd, 5, "", err.Error() + "\n")
+        }
+        lv.isPool = a.flags["--type"] == segtypeThinPool
+        if err := f.saveTags(vg.name, lv); err != nil {
+            return fakeStatus(cmd, 5, "", err.Error() + "\n")
+        }
+        if err := f.saveRaid(vg.name, lv); err != nil {
+            return fakeStatus(cmd, 5, "", err.Error() + "\n")
+        }
+    }
+    vg.lvs[name] = lv
+    return fakeStatus(cmd, 0, "  Logical volume \"" + name + "\" created.\n", "")
+}
+
+func createSparseFile(path string, sizeMB int64) (error) {
+    f, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return f.Truncate(sizeMB * 1024 * 1024)
+}
+
+// copyFile copies a device file keeping it sparse
+func copyFile(from string, to string) (error) {
+    in, err := os.Open(from)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    fi, err := in.Stat()
+    if err != nil {
+        return err
+    }
+    out, err := os.OpenFile(to, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    defer out.Close()
+    buf := make([]byte, 1024 * 1024)
+    var offset int64
+    for {
+        n, err := in.Read(buf)
+        if n > 0 {
+            if !isZero(buf[:n]) {
+                if _, err := out.WriteAt(buf[:n], offset); err != nil {
+                    return err
+                }
+            }
+            offset += int64(n)
+        }
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return err
+        }
+    }
+    return out.Truncate(fi.Size())
+}
+
+func isZero(b []byte) (bool) {
+    for _, v := range b {
+        if v != 0 {
+            return false
+        }
+    }
+    return true
+}
+
+func (f *FakeLvm) lvremove(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 {
+        return fakeStatus(cmd, 3, "", "  Please specify a logical volume path\n")
+    }
+    vg, lv := f.resolve(a.positional[0])
+    if lv == nil {
+        return fakeStatus(cmd, 5, "", "  Failed to find logical volume \"" + a.positional[0] + "\"\n")
+    }
+    dev := f.devicePath(vg.name, lv.name)
+    for _, d := range f.mounts {
+        if d == dev {
+            return fakeStatus(cmd, 5, "", "  Logical volume " + vg.name + "/" + lv.name + " contains a filesystem in use.\n")
+        }
+    }
+    if f.isOpen(dev) {
+        return fakeStatus(cmd, 5, "", "  Logical volume " + vg.name + "/" + lv.name + " in use.\n")
+    }
+    for _, other := range vg.lvs {
+        if lv.isPool && other.pool == lv.name {
+            return fakeStatus(cmd, 5, "", "  Thin pool " + vg.name + "/" + lv.name + " still has thin volumes.\n")
+        }
+    }
+    os.Remove(dev)
+    f.removeState(vg.name, lv.name)
+    delete(vg.lvs, lv.name)
+    return fakeStatus(cmd, 0, "  Logical volume \"" + lv.name + "\" successfully removed\n", "")
+}
+
+func (f *FakeLvm) lvextend(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 {
+        return fakeStatus(cmd, 3, "", "  Please specify a logical volume path\n")
+    }
+    vg, lv := f.resolve(a.positional[0])
+    if lv == nil {
+        return fakeStatus(cmd, 5, "", "  Failed to find logical volume \"" + a.positional[0] + "\"\n")
+    }
+    size, relative, err := fakeSize(a.flags["-L"])
+    if err != nil {
+        return fakeStatus(cmd, 3, "", "  Invalid argument for --size\n")
+    }
+    if relative {
+        size += lv.sizeMB
+    }
+    if size < lv.sizeMB {
+        return fakeStatus(cmd, 5, "", "  New size given is smaller than the current size\n")
+    }
+    if lv.pool == "" && lv.allocatedMB(size) - lv.allocatedMB(lv.sizeMB) > vg.freeMB() {
+        return fakeStatus(cmd, 5, "", "  Insufficient free space\n")
+    }
+    if err := os.Truncate(f.devicePath(vg.name, lv.name), size * 1024 * 1024); err != nil {
+        return fakeStatus(cmd, 5, "", err.Error() + "\n")
+    }
+    lv.sizeMB = size
+    return fakeStatus(cmd, 0, "  Logical volume " + vg.name + "/" + lv.name + " successfully resized.\n", "")
+}
+
+// lvchange supports --addtag, --deltag, -an and -ay. Volumes are always
+// active; -ay starts the merge of a snapshot waiting for the activation of
+// its origin.
+func (f *FakeLvm) lvchange(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 {
+        return fakeStatus(cmd, 3, "", "  Please specify a logical volume path\n")
+    }
+    vg, lv := f.resolve(a.positional[0])
+    if lv == nil {
+        return fakeStatus(cmd, 5, "", "  Failed to find logical volume \"" + a.positional[0] + "\"\n")
+    }
+    if a.has("-an") && f.inUse(f.devicePath(vg.name, lv.name)) {
+        return fakeStatus(cmd, 5, "", "  Logical volume " + vg.name + "/" + lv.name + " in use.\n")
+    }
+    if a.has("-ay") {
+        for _, name := range vg.sortedNames() {
+            if snapshot := vg.lvs[name]; snapshot.origin == lv.name && snapshot.merging {
+                if err := f.merge(vg, snapshot); err != nil {
+                    return fakeStatus(cmd, 5, "", err.Error() + "\n")
+                }
+            }
+        }
+        return fakeStatus(cmd, 0, "", "")
+    }
+    if a.has("-an") {
+        return fakeStatus(cmd, 0, "", "")
+    }
+    if tag, ok := a.flags["--addtag"]; ok && !stringInList(tag, lv.tags) {
+        lv.tags = append(lv.tags, tag)
+    }
+    if tag, ok := a.flags["--deltag"]; ok {
+        tags := []string{}
+        for _, t := range lv.tags {
+            if t != tag {
+                tags = append(tags, t)
+            }
+        }
+        lv.tags = tags
+    }
+    if err := f.saveTags(vg.name, lv); err != nil {
+        return fakeStatus(cmd, 5, "", err.Error() + "\n")
+    }
+    return fakeStatus(cmd, 0, "  Logical volume " + vg.name + "/" + lv.name + " changed.\n", "")
+}
+
+// lvconvert supports --merge of snapshots only. The merge is done at once
+// unless the origin or the snapshot is in use; then it is deferred to the
+// next activation of the origin like LVM does.
+func (f *FakeLvm) lvconvert(cmd string, a fakeArgs) (ExecStatus) {
+    if a.has("--merge") == a.has("--splitsnapshot") || len(a.positional) != 1 {
+        return fakeStatus(cmd, 3, "", "  Only --merge and --splitsnapshot of a snapshot are supported\n")
+    }
+    vg, lv := f.resolve(a.positional[0])
+    if lv == nil {
+        return fakeStatus(cmd, 5, "", "  Failed to find logical volume \"" + a.positional[0] + "\"\n")
+    }
+    origin := vg.lvs[lv.origin]
+    if origin == nil || (a.has("--splitsnapshot") && lv.pool != "") {
+        return fakeStatus(cmd, 5, "", "  Command on LV " + vg.name + "/" + lv.name + " uses options that require LV types snapshot.\n")
+    }
+    if a.has("--splitsnapshot") {
+        return f.splitSnapshot(cmd, vg, lv)
+    }
+    if lv.merging {
+        return fakeStatus(cmd, 5, "", "  Snapshot " + vg.name + "/" + lv.name + " is already merging.\n")
+    }
+    if f.inUse(f.devicePath(vg.name, origin.name)) || f.inUse(f.devicePath(vg.name, lv.name)) {
+        lv.merging = true
+        if err := f.saveState(vg.name, lv); err != nil {
+            return fakeStatus(cmd, 5, "", err.Error() + "\n")
+        }
+        return fakeStatus(cmd, 0, "  Delaying merge since origin is open.\n  Merging of snapshot " + vg.name + "/" + lv.name +
+            " will occur on next activation of " + vg.name + "/" + origin.name + ".\n", "")
+    }
+    if err := f.merge(vg, lv); err != nil {
+        return fakeStatus(cmd, 5, "", err.Error() + "\n")
+    }
+    return fakeStatus(cmd, 0, "  Merging of volume " + vg.name + "/" + lv.name + " started.\n  " +
+        vg.name + "/" + origin.name + ": Merged: 100.00%\n", "")
+}
+
+// splitSnapshot separates a snapshot from its origin, leaving a plain
+// volume which holds the copy-on-write area of the snapshot
+func (f *FakeLvm) splitSnapshot(cmd string, vg *fakeVolumeGroup, lv *fakeLogicalVolume) (ExecStatus) {
+    if f.inUse(f.devicePath(vg.name, lv.name)) {
+        return fakeStatus(cmd, 5, "", "  Unable to split off snapshot " + vg.name + "/" + lv.name + " while it is open.\n")
+    }
+    if lv.merging {
+        return fakeStatus(cmd, 5, "", "  Unable to split off snapshot " + vg.name + "/" + lv.name + " being merged into its origin.\n")
+    }
+    lv.origin = ""
+    if err := f.saveState(vg.name, lv); err != nil {
+        return fakeStatus(cmd, 5, "", err.Error() + "\n")
+    }
+    return fakeStatus(cmd, 0, "  Logical Volume " + vg.name + "/" + lv.name + " split from its origin.\n", "")
+}
+
+// merge copies the data and filesystem of a snapshot to its origin and
+// removes the snapshot
+func (f *FakeLvm) merge(vg *fakeVolumeGroup, snapshot *fakeLogicalVolume) (error) {
+    origin := vg.lvs[snapshot.origin]
+    if err := copyFile(f.devicePath(vg.name, snapshot.name), f.devicePath(vg.name, origin.name)); err != nil {
+        return err
+    }
+    origin.fs = snapshot.fs
+    origin.uuid = snapshot.uuid
+    origin.root = snapshot.root
+    origin.luks = snapshot.luks
+    origin.fsState = snapshot.fsState
+    if err := f.saveState(vg.name, origin); err != nil {
+        return err
+    }
+    if err := f.copyFiles(vg.name, snapshot, origin); err != nil {
+        return err
+    }
+    os.Remove(f.devicePath(vg.name, snapshot.name))
+    f.removeState(vg.name, snapshot.name)
+    delete(vg.lvs, snapshot.name)
+    return nil
+}
+
+// lvrename supports the form lvrename <vg> <old> <new>
+func (f *FakeLvm) lvrename(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 3 {
+        return fakeStatus(cmd, 3, "", "  Old and new logical volume names required\n")
+    }
+    vg, ok := f.groups[a.positional[0]]
+    if !ok {
+        return fakeStatus(cmd, 5, "", "  Volume group \"" + a.positional[0] + "\" not found\n")
+    }
+    lv := vg.lvs[a.positional[1]]
+    if lv == nil {
+        return fakeStatus(cmd, 5, "", "  Existing logical volume \"" + a.positional[1] + "\" not found in volume group \"" + vg.name + "\"\n")
+    }
+    newName := a.positional[2]
+    if _, exists := vg.lvs[newName]; exists {
+        return fakeStatus(cmd, 5, "", "  Logical Volume \"" + newName + "\" already exists in volume group \"" + vg.name + "\"\n")
+    }
+    oldDev, newDev := f.devicePath(vg.name, lv.name), f.devicePath(vg.name, newName)
+    for _, d := range f.mounts {
+        if d == oldDev {
+            return fakeStatus(cmd, 5, "", "  Cannot rename open logical volume " + vg.name + "/" + lv.name + "\n")
+        }
+    }
+    if f.isOpen(oldDev) {
+        return fakeStatus(cmd, 5, "", "  Cannot rename open logical volume " + vg.name + "/" + lv.name + "\n")
+    }
+    if err := os.Rename(oldDev, newDev); err != nil {
+        return fakeStatus(cmd, 5, "", err.Error() + "\n")
+    }
+    if err := moveEntries(f.stateFile(fakeFiles, vg.name, lv.name), f.stateFile(fakeFiles, vg.name, newName)); err != nil {
+        return fakeStatus(cmd, 5, "", err.Error() + "\n")
+    }
+    f.removeState(vg.name, lv.name)
+    delete(vg.lvs, lv.name)
+    lv.name = newName
+    vg.lvs[newName] = lv
+    if err := f.saveState(vg.name, lv); err != nil {
+        return fakeStatus(cmd, 5, "", err.Error() + "\n")
+    }
+    return fakeStatus(cmd, 0, "  Renamed \"" + a.positional[1] + "\" to \"" + newName + "\" in volume group \"" + vg.name + "\"\n", "")
+}
+
+// blkdiscard drops all data of the device, reads return zeros afterwards
+func (f *FakeLvm) blkdiscard(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 {
+        return fakeStatus(cmd, 1, "", "blkdiscard: no device specified\n")
+    }
+    vg, lv := f.resolve(a.positional[0])
+    if lv == nil {
+        return fakeStatus(cmd, 1, "", "blkdiscard: cannot open " + a.positional[0] + ": No such file or directory\n")
+    }
+    if err := createSparseFile(f.devicePath(vg.name, lv.name), lv.sizeMB); err != nil {
+        return fakeStatus(cmd, 1, "", "blkdiscard: " + err.Error() + "\n")
+    }
+    lv.fs = ""
+    lv.luks = ""
+    f.saveLuks(vg.name, lv)
+    os.RemoveAll(f.stateFile(fakeFiles, vg.name, lv.name))
+    return fakeStatus(cmd, 0, "", "")
+}
+
+func (f *FakeLvm) mkfs(cmd string, fs string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) == 0 {
+        return fakeStatus(cmd, 1, "", "mkfs: no device specified\n")
+    }
+    vg, lv := f.resolve(a.positional[len(a.positional) - 1])
+    if lv == nil {
+        return fakeStatus(cmd, 1, "", "mkfs: " + a.positional[0] + ": No such file or directory\n")
+    }
+    lv.fs = fs
+    lv.uuid = newFakeUuid()
+    lv.root = newFakeRoot
+    lv.root.lostFound = fsLostFound[fs]
+    lv.fsState = ""
+    if err := f.saveFsState(vg.name, lv); err != nil {
+        return fakeStatus(cmd, 1, "", "mkfs: " + err.Error() + "\n")
+    }
+    if err := os.RemoveAll(f.stateFile(fakeFiles, vg.name, lv.name)); err != nil {
+        return fakeStatus(cmd, 1, "", "mkfs: " + err.Error() + "\n")
+    }
+    return fakeStatus(cmd, 0, "", "")
+}
+
+// mountedVolume returns the logical volume mounted on mountpoint
+func (f *FakeLvm) mountedVolume(mountpoint string) (*fakeLogicalVolume) {
+    if dev, ok := f.mounts[filepath.Clean(mountpoint)]; ok {
+        _, lv := f.resolve(dev)
+        return lv
+    }
+    return nil
+}
+
+// Statfs emulates statfs on the mountpoint of a fake logical volume: the
+// size is the size of the logical volume, used is the size of all files
+// below the mountpoint
+func (f *FakeLvm) Statfs(path string) (FsUsage, error) {
+    f.m.Lock()
+    var sizeMB int64 = -1
+    if lv := f.mountedVolume(path); lv != nil {
+        sizeMB = lv.sizeMB
+    }
+    f.m.Unlock()
+    if sizeMB < 0 {
+        return FsUsage{}, errors.New(path + " is not a mountpoint of a fake volume")
+    }
+    var used uint64
+    err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) (error) {
+        if err != nil {
+            return err
+        }
+        if fi.Mode().IsRegular() {
+            used += uint64(fi.Size())
+        }
+        return nil
+    })
+    if err != nil {
+        return FsUsage{}, err
+    }
+    usage := FsUsage{SizeBytes: uint64(sizeMB) * 1024 * 1024, UsedBytes: used}
+    if used < usage.SizeBytes {
+        usage.AvailBytes = usage.SizeBytes - used
+    }
+    return usage, nil
+}
+
+// changeRoot emulates chown and chmod of the root directory of a mounted
+// filesystem
+func (f *FakeLvm) changeRoot(cmd string, cmdName string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 2 {
+        return fakeStatus(cmd, 1, "", cmdName + ": missing operand\n")
+    }
+    value, path := a.positional[0], a.positional[1]
+    lv := f.mountedVolume(path)
+    if lv == nil {
+        return fakeStatus(cmd, 1, "", cmdName + ": " + path + " is not the root of a fake filesystem\n")
+    }
+    if cmdName == "chmod" {
+        mode, err := strconv.ParseUint(value, 8, 32)
+        if err != nil {
+            return fakeStatus(cmd, 1, "", "chmod: invalid mode: '" + value + "'\n")
+        }
+        if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+            return fakeStatus(cmd, 1, "", "chmod: " + err.Error() + "\n")
+        }
+        lv.root.mode = os.FileMode(mode)
+        return fakeStatus(cmd, 0, "", "")
+    }
+    owner := strings.SplitN(lv.root.owner, ":", 2)
+    change := strings.SplitN(value, ":", 2)
+    if change[0] != "" {
+        owner[0] = change[0]
+    }
+    if len(change) == 2 && change[1] != "" {
+        owner[1] = change[1]
+    }
+    lv.root.owner = owner[0] + ":" + owner[1]
+    return fakeStatus(cmd, 0, "", "")
+}
+
+func (f *FakeLvm) mount(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) == 0 {
+        mountpoints := []string{}
+        for mp := range f.mounts {
+            mountpoints = append(mountpoints, mp)
+        }
+        sort.Strings(mountpoints)
+        var out strings.Builder
+        for _, mp := range mountpoints {
+            dev := f.mounts[mp]
+            fs := DEFAULT_FILESYSTEM
+            if _, lv := f.resolve(dev); lv != nil {
+                fs = lv.fs
+            }
+            opts := "rw"
+            if o := f.mountOptions[mp]; o != "" {
+                opts += "," + o
+            }
+            out.WriteString(dev + " on " + mp + " type " + fs + " (" + opts + ")\n")
+        }
+        return fakeStatus(cmd, 0, out.String(), "")
+    }
+    if len(a.positional) != 2 {
+        return fakeStatus(cmd, 1, "", "mount: bad usage\n")
+    }
+    dev, mp := a.positional[0], a.positional[1]
+    vg, lv := f.resolve(dev)
+    if lv == nil {
+        return fakeStatus(cmd, 32, "", "mount: " + dev + ": special device does not exist.\n")
+    }
+    // the filesystem of a LUKS formatted volume is only visible through
+    // the opened container
+    if lv.fs == "" || (lv.luks != "" && !strings.Contains(dev, "/mapper/")) {
+        return fakeStatus(cmd, 32, "", "mount: " + mp + ": wrong fs type, bad option, bad superblock on " + dev + ".\n")
+    }
+    if fi, err := os.Stat(mp); err != nil || !fi.IsDir() {
+        return fakeStatus(cmd, 32, "", "mount: " + mp + ": mount point does not exist.\n")
+    }
+    for m, d := range f.mounts {
+        if m == mp || d == dev {
+            return fakeStatus(cmd, 32, "", "mount: " + mp + ": " + dev + " already mounted or mount point busy.\n")
+        }
+        // xfs refuses a second filesystem with the same UUID
+        if _, other := f.resolve(d); lv.fs == "xfs" && other != nil && other.fs == "xfs" && lv.uuid != "" &&
+            other.uuid == lv.uuid && !stringInList("nouuid", strings.Split(a.flags["-o"], ",")) {
+            return fakeStatus(cmd, 32, "", "mount: " + mp + ": wrong fs type, bad option, bad superblock on " + dev + ".\n" +
+                "XFS (" + dev + "): Filesystem has duplicate UUID " + lv.uuid + " - can't mount\n")
+        }
+    }
+    if err := os.Chmod(mp, lv.root.mode); err != nil {
+        return fakeStatus(cmd, 32, "", "mount: " + err.Error() + "\n")
+    }
+    if lv.root.lostFound {
+        if err := os.Mkdir(filepath.Join(mp, lostFoundDir), 0700); err != nil && !os.IsExist(err) {
+            return fakeStatus(cmd, 32, "", "mount: " + err.Error() + "\n")
+        }
+    }
+    if err := moveEntries(f.stateFile(fakeFiles, vg.name, lv.name), mp); err != nil {
+        return fakeStatus(cmd, 32, "", "mount: " + err.Error() + "\n")
+    }
+    // a mounted filesystem is not clean, it stays so if the host crashes
+    if lv.fsState == "" {
+        lv.fsState = fakeDirty
+        if err := f.saveFsState(vg.name, lv); err != nil {
+            return fakeStatus(cmd, 32, "", "mount: " + err.Error() + "\n")
+        }
+    }
+    f.mounts[mp] = dev
+    f.mountOptions[mp] = a.flags["-o"]
+    return fakeStatus(cmd, 0, "", "")
+}
+
+func (f *FakeLvm) umount(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 {
+        return fakeStatus(cmd, 1, "", "umount: bad usage\n")
+    }
+    target := a.positional[0]
+    for mp, dev := range f.mounts {
+        if mp == target || dev == target {
+            if f.frozen[mp] {
+                // the real umount blocks until the filesystem is thawed
+                return fakeStatus(cmd, 32, "", "umount: " + mp + ": target is busy.\n")
+            }
+            // the emulated root and the files disappear with the
+            // filesystem
+            os.Remove(filepath.Join(mp, lostFoundDir))
+            if vg, lv := f.resolve(dev); lv != nil {
+                if fi, err := os.Stat(mp); err == nil {
+                    lv.root.mode = fi.Mode() & os.ModePerm
+                }
+                if err := moveEntries(mp, f.stateFile(fakeFiles, vg.name, lv.name)); err != nil {
+                    return fakeStatus(cmd, 32, "", "umount: " + err.Error() + "\n")
+                }
+                if lv.fsState == fakeDirty {
+                    lv.fsState = ""
+                    f.saveFsState(vg.name, lv)
+                }
+            }
+            delete(f.mounts, mp)
+            delete(f.mountOptions, mp)
+            return fakeStatus(cmd, 0, "", "")
+        }
+    }
+    return fakeStatus(cmd, 32, "", "umount: " + target + ": not mounted.\n")
+}
+
+// cryptsetup supports luksFormat, open, close and status. The key is read
+// from stdin (--key-file -).
+func (f *FakeLvm) cryptsetup(cmd string, a fakeArgs, stdin []byte) (ExecStatus) {
+    if len(a.positional) == 0 {
+        return fakeStatus(cmd, 1, "", "cryptsetup: Argument <action> missing.\n")
+    }
+    action, args := a.positional[0], a.positional[1:]
+    keyHash := func() (string) {
+        sum := sha256.Sum256(stdin)
+        return hex.EncodeToString(sum[:])
+    }
+    switch action {
+    case "luksFormat":
+        if len(args) != 1 || a.flags["--key-file"] != "-" || len(stdin) == 0 {
+            return fakeStatus(cmd, 1, "", "cryptsetup: device and key on stdin expected\n")
+        }
+        vg, lv := f.resolve(args[0])
+        if lv == nil {
+            return fakeStatus(cmd, 4, "", "Device " + args[0] + " does not exist or access denied.\n")
+        }
+        if f.isOpen(f.devicePath(vg.name, lv.name)) {
+            return fakeStatus(cmd, 5, "", "Cannot format device " + args[0] + " in use.\n")
+        }
+        lv.luks = keyHash()
+        lv.fs = ""
+        if err := f.saveLuks(vg.name, lv); err != nil {
+            return fakeStatus(cmd, 1, "", err.Error() + "\n")
+        }
+        os.RemoveAll(f.stateFile(fakeFiles, vg.name, lv.name))
+        return fakeStatus(cmd, 0, "", "")
+    case "open":
+        if len(args) != 2 || a.flags["--key-file"] != "-" {
+            return fakeStatus(cmd, 1, "", "cryptsetup: device, name and key on stdin expected\n")
+        }
+        vg, lv := f.resolve(args[0])
+        if lv == nil {
+            return fakeStatus(cmd, 4, "", "Device " + args[0] + " does not exist or access denied.\n")
+        }
+        if lv.luks == "" {
+            return fakeStatus(cmd, 1, "", "Device " + args[0] + " is not a valid LUKS device.\n")
+        }
+        if lv.luks != keyHash() {
+            return fakeStatus(cmd, 2, "", "No key available with this passphrase.\n")
+        }
+        if _, ok := f.opened[args[1]]; ok {
+            return fakeStatus(cmd, 5, "", "Device " + args[1] + " already exists.\n")
+        }
+        f.opened[args[1]] = f.devicePath(vg.name, lv.name)
+        if err := writeState(filepath.Join(f.Dir, fakeMappers, args[1]), f.opened[args[1]]); err != nil {
+            return fakeStatus(cmd, 1, "", err.Error() + "\n")
+        }
+        // the container reads and writes the logical volume unencrypted
+        mapper := filepath.Join(f.Dir, "mapper", args[1])
+        if err := os.MkdirAll(filepath.Dir(mapper), 0750); err != nil {
+            return fakeStatus(cmd, 1, "", err.Error() + "\n")
+        }
+        os.Remove(mapper)
+        if err := os.Symlink(f.opened[args[1]], mapper); err != nil {
+            return fakeStatus(cmd, 1, "", err.Error() + "\n")
+        }
+        return fakeStatus(cmd, 0, "", "")
+    case "close":
+        if len(args) != 1 {
+            return fakeStatus(cmd, 1, "", "cryptsetup: name expected\n")
+        }
+        if _, ok := f.opened[args[0]]; !ok {
+            return fakeStatus(cmd, 4, "", "Device " + args[0] + " is not active.\n")
+        }
+        mapper := filepath.Join(f.Dir, "mapper", args[0])
+        for _, d := range f.mounts {
+            if d == mapper {
+                return fakeStatus(cmd, 5, "", "Device " + args[0] + " is still in use.\n")
+            }
+        }
+        delete(f.opened, args[0])
+        os.Remove(mapper)
+        if err := writeState(filepath.Join(f.Dir, fakeMappers, args[0]), ""); err != nil {
+            return fakeStatus(cmd, 1, "", err.Error() + "\n")
+        }
+        return fakeStatus(cmd, 0, "", "")
+    case "status":
+        if len(args) != 1 {
+            return fakeStatus(cmd, 1, "", "cryptsetup: name expected\n")
+        }
+        mapper := "/dev/mapper/" + args[0]
+        if dev, ok := f.opened[args[0]]; ok {
+            return fakeStatus(cmd, 0, mapper + " is active.\n  type:    LUKS2\n  device:  " + dev + "\n", "")
+        }
+        return fakeStatus(cmd, 4, mapper + " is inactive.\n", "")
+    }
+    return fakeStatus(cmd, 1, "", "cryptsetup: Unknown action " + action + ".\n")
+}
+
+// dmsetup supports ls, which lists the opened LUKS containers, and the
+// messages reserving and releasing the metadata snapshot of a thin pool
+func (f *FakeLvm) dmsetup(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) == 4 && a.positional[0] == "message" {
+        return f.poolMessage(cmd, a.positional[1], a.positional[3])
+    }
+    if len(a.positional) != 1 || a.positional[0] != "ls" {
+        return fakeStatus(cmd, 1, "", "dmsetup: only ls and message are supported\n")
+    }
+    if len(f.opened) == 0 {
+        return fakeStatus(cmd, 0, "No devices found\n", "")
+    }
+    names := []string{}
+    for name := range f.opened {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var out strings.Builder
+    for i, name := range names {
+        fmt.Fprintf(&out, "%s\t(253:%d)\n", name, i)
+    }
+    return fakeStatus(cmd, 0, out.String(), "")
+}
+
+// findPool returns the thin pool whose device mapper name, as built by
+// lvmDmName, is name with suffix
+func (f *FakeLvm) findPool(name string, suffix string) (*fakeVolumeGroup, *fakeLogicalVolume) {
+    for _, vg := range f.groups {
+        for _, lv := range vg.lvs {
+            if lv.isPool && lvmDmName(vg.name, lv.name) + suffix == name {
+                return vg, lv
+            }
+        }
+    }
+    return nil, nil
+}
+
+func (f *FakeLvm) poolMessage(cmd string, target string, message string) (ExecStatus) {
+    vg, pool := f.findPool(target, "-tpool")
+    if pool == nil {
+        return fakeStatus(cmd, 1, "", "Device " + target + " not found\nCommand failed.\n")
+    }
+    key := vg.name + "/" + pool.name
+    failed := fakeStatus(cmd, 1, "", "device-mapper: message ioctl on " + target + " failed: Invalid argument\nCommand failed.\n")
+    switch message {
+    case "reserve_metadata_snap":
+        if f.metadataSnaps[key] {
+            return failed
+        }
+        f.metadataSnaps[key] = true
+    case "release_metadata_snap":
+        if !f.metadataSnaps[key] {
+            return failed
+        }
+        delete(f.metadataSnaps, key)
+    default:
+        return failed
+    }
+    return fakeStatus(cmd, 0, "", "")
+}
+
+// fakeDeltaBlock is the data block size of the fake thin pools, 64KiB
+const fakeDeltaBlock = 64 * 1024
+
+// thinDelta compares two thin volumes of a pool given by their device ids
+// block by block. Blocks of zeros count as not provisioned.
+func (f *FakeLvm) thinDelta(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 || a.flags["--snap1"] == "" || a.flags["--snap2"] == "" {
+        return fakeStatus(cmd, 1, "", "Usage: thin_delta [--metadata-snap] --snap1 <id> --snap2 <id> <metadata device>\n")
+    }
+    dev := a.positional[0]
+    var vg *fakeVolumeGroup
+    var pool *fakeLogicalVolume
+    if filepath.Dir(dev) == filepath.Join(f.Dir, "mapper") {
+        vg, pool = f.findPool(filepath.Base(dev), "_tmeta")
+    }
+    if pool == nil {
+        return fakeStatus(cmd, 1, "", "Couldn't stat path " + dev + "\n")
+    }
+    if a.has("--metadata-snap") && !f.metadataSnaps[vg.name + "/" + pool.name] {
+        return fakeStatus(cmd, 1, "", "no current metadata snap\n")
+    }
+    var snaps [2]*fakeLogicalVolume
+    for i, flag := range []string{"--snap1", "--snap2"} {
+        id, err := strconv.Atoi(a.flags[flag])
+        for _, lv := range vg.lvs {
+            if err == nil && lv.pool == pool.name && lv.thinId == id {
+                snaps[i] = lv
+            }
+        }
+        if snaps[i] == nil {
+            return fakeStatus(cmd, 1, "", "Unable to find mapping for snap" + strconv.Itoa(i + 1) + " (" + a.flags[flag] + ")\n")
+        }
+    }
+    var files [2]*os.File
+    for i, lv := range snaps {
+        file, err := os.Open(f.devicePath(vg.name, lv.name))
+        if err != nil {
+            return fakeStatus(cmd, 1, "", err.Error() + "\n")
+        }
+        defer file.Close()
+        files[i] = file
+    }
+    blocks := (snaps[0].sizeMB * 1024 * 1024 + fakeDeltaBlock - 1) / fakeDeltaBlock
+    if b := (snaps[1].sizeMB * 1024 * 1024 + fakeDeltaBlock - 1) / fakeDeltaBlock; b > blocks {
+        blocks = b
+    }
+    var out strings.Builder
+    fmt.Fprintf(&out, "<superblock uuid=\"\" time=\"0\" transaction=\"1\" data_block_size=\"%d\" nr_data_blocks=\"%d\">\n",
+        fakeDeltaBlock / 512, pool.sizeMB * 1024 * 1024 / fakeDeltaBlock)
+    fmt.Fprintf(&out, "  <diff left=\"%s\" right=\"%s\">\n", a.flags["--snap1"], a.flags["--snap2"])
+    kind, begin := "", int64(0)
+    flush := func(next string, block int64) {
+        if kind != "" && kind != next {
+            fmt.Fprintf(&out, "    <%s begin=\"%d\" length=\"%d\"/>\n", kind, begin, block - begin)
+        }
+        if kind != next {
+            kind, begin = next, block
+        }
+    }
+    var bufs [2][]byte
+    bufs[0], bufs[1] = make([]byte, fakeDeltaBlock), make([]byte, fakeDeltaBlock)
+    for block := int64(0); block < blocks; block++ {
+        var mapped [2]bool
+        for i := range files {
+            n, err := files[i].ReadAt(bufs[i], block * fakeDeltaBlock)
+            if err != nil && err != io.EOF {
+                return fakeStatus(cmd, 1, "", err.Error() + "\n")
+            }
+            // past the end of the smaller volume
+            for j := n; j < len(bufs[i]); j++ {
+                bufs[i][j] = 0
+            }
+            mapped[i] = !isZero(bufs[i])
+        }
+        next := ""
+        switch {
+        case mapped[0] && mapped[1] && bytes.Equal(bufs[0], bufs[1]):
+            next = "same"
+        case mapped[0] && mapped[1]:
+            next = "different"
+        case mapped[0]:
+            next = "left_only"
+        case mapped[1]:
+            next = "right_only"
+        }
+        flush(next, block)
+    }
+    flush("", blocks)
+    out.WriteString("  </diff>\n</superblock>\n")
+    return fakeStatus(cmd, 0, out.String(), "")
+}
+
+// states of a fake filesystem
+const (
+    // not unmounted cleanly, e2fsck -p and -E journal_only replay the
+    // journal and e2fsck -n reports errors as it skips it, xfs_repair
+    // refuses to run until a mount replayed the log
+    fakeDirty = "dirty"
+    // has errors which e2fsck -p and xfs_repair repair
+    fakeCorrupt = "corrupt"
+    // has errors which e2fsck -p and xfs_repair cannot repair
+    fakeBroken = "broken"
+)
+
+// dumpe2fs supports -h and prints the filesystem state only
+func (f *FakeLvm) dumpe2fs(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 {
+        return fakeStatus(cmd, 1, "", "Usage: dumpe2fs [-h] device\n")
+    }
+    _, lv := f.resolve(a.positional[0])
+    if lv == nil || lv.fs != "ext4" {
+        return fakeStatus(cmd, 1, "", "dumpe2fs: Bad magic number in super-block while trying to open " + a.positional[0] + "\n")
+    }
+    // like the real ext4, the state stays clean while mounted and a
+    // filesystem not unmounted cleanly needs recovery of its journal
+    state, features := "clean", "has_journal ext_attr resize_inode dir_index filetype extent 64bit flex_bg sparse_super large_file huge_file dir_nlink extra_isize metadata_csum"
+    switch lv.fsState {
+    case fakeDirty:
+        features = "has_journal ext_attr resize_inode dir_index filetype needs_recovery extent 64bit flex_bg sparse_super large_file huge_file dir_nlink extra_isize metadata_csum"
+    case fakeCorrupt, fakeBroken:
+        state = "clean with errors"
+    }
+    return fakeStatus(cmd, 0, "Filesystem volume name:   <none>\nFilesystem features:      " + features + "\nFilesystem state:         " + state + "\n", "")
+}
+
+// xfsRepair supports -n (check only) and repair. Like the real one, it
+// refuses a log which needs replay with exit status 2; a mount replays it.
+func (f *FakeLvm) xfsRepair(cmd string, a fakeArgs) (ExecStatus) {
+    // -n takes the name with lvcreate
+    if dev := a.flags["-n"]; dev != "" {
+        a.positional = append([]string{dev}, a.positional...)
+    }
+    if len(a.positional) != 1 {
+        return fakeStatus(cmd, 1, "", "Usage: xfs_repair [-n] device\n")
+    }
+    dev := a.positional[0]
+    vg, lv := f.resolve(dev)
+    if lv == nil || lv.fs != "xfs" {
+        return fakeStatus(cmd, 1, "", "Phase 1 - find and verify superblock...\nbad primary superblock - bad magic number !!!\n")
+    }
+    for _, d := range f.mounts {
+        if d == dev {
+            return fakeStatus(cmd, 1, "", "xfs_repair: " + dev + " contains a mounted filesystem\n\nfatal error -- couldn't initialize XFS library\n")
+        }
+    }
+    switch {
+    case lv.fsState == "":
+        return fakeStatus(cmd, 0, "Phase 1 - find and verify superblock...\nPhase 7 - verify and correct link counts...\ndone\n", "")
+    case lv.fsState == fakeDirty:
+        return fakeStatus(cmd, 2, "", "ERROR: The filesystem has valuable metadata changes in a log which needs to\nbe replayed.  Mount the filesystem to replay the log, and unmount it before\nre-running xfs_repair.\n")
+    case a.has("-n") || lv.fsState == fakeBroken:
+        return fakeStatus(cmd, 1, "", "agi unlinked bucket 12 is 140 in ag 0 (inode=140)\n")
+    }
+    lv.fsState = ""
+    if err := f.saveFsState(vg.name, lv); err != nil {
+        return fakeStatus(cmd, 1, "", err.Error() + "\n")
+    }
+    return fakeStatus(cmd, 0, "Phase 1 - find and verify superblock...\nclearing agi unlinked bucket 12\ndone\n", "")
+}
+
+// e2fsck supports -n (check only), -p (preen) and -E journal_only
+func (f *FakeLvm) e2fsck(cmd string, a fakeArgs) (ExecStatus) {
+    modes := 0
+    for _, mode := range []string{"-n", "-p", "-E"} {
+        if a.has(mode) {
+            modes++
+        }
+    }
+    if len(a.positional) != 1 || modes != 1 || (a.has("-E") && a.flags["-E"] != "journal_only") {
+        return fakeStatus(cmd, 16, "", "Usage: e2fsck -n|-p|-E journal_only [-f] device\n")
+    }
+    dev := a.positional[0]
+    vg, lv := f.resolve(dev)
+    if lv == nil || lv.fs != "ext4" {
+        return fakeStatus(cmd, 8, "", "e2fsck: Bad magic number in super-block while trying to open " + dev + "\n")
+    }
+    for _, d := range f.mounts {
+        if d == dev {
+            return fakeStatus(cmd, 8, "", dev + " is mounted.\ne2fsck: Cannot continue, aborting.\n")
+        }
+    }
+    switch {
+    case lv.fsState == "":
+        return fakeStatus(cmd, 0, dev + ": clean\n", "")
+    case a.has("-E") && lv.fsState != fakeDirty:
+        return fakeStatus(cmd, 0, "", "")
+    case a.has("-n") && lv.fsState == fakeDirty:
+        // the changes in the journal look like errors
+        return fakeStatus(cmd, 4, "Warning: skipping journal recovery because doing a read-only filesystem check.\n" +
+            "Free blocks count wrong for group #0 (1234, counted=1230).\n\n" +
+            dev + ": ********** WARNING: Filesystem still has errors **********\n", "")
+    case a.has("-n"):
+        return fakeStatus(cmd, 4, "Inode 12 has illegal block(s).\n\n" + dev + ": ********** WARNING: Filesystem still has errors **********\n", "")
+    case lv.fsState == fakeBroken:
+        return fakeStatus(cmd, 4, "", dev + ": UNEXPECTED INCONSISTENCY; RUN fsck MANUALLY.\n")
+    }
+    repaired := dev + ": recovering journal\n"
+    if lv.fsState == fakeCorrupt {
+        repaired += dev + ": Inode 12 has illegal block(s), CLEARED.\n"
+    }
+    lv.fsState = ""
+    if err := f.saveFsState(vg.name, lv); err != nil {
+        return fakeStatus(cmd, 8, "", err.Error() + "\n")
+    }
+    return fakeStatus(cmd, 1, repaired, "")
+}
+
+func newFakeUuid() (string) {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// newUuid emulates tune2fs -U random (ext4) and xfs_admin -U generate (xfs).
+// Like the real tune2fs, it requires a freshly checked ext4 filesystem.
+func (f *FakeLvm) newUuid(cmd string, cmdName string, a fakeArgs) (ExecStatus) {
+    fs, value := "ext4", "random"
+    if cmdName == "xfs_admin" {
+        fs, value = "xfs", "generate"
+    }
+    if len(a.positional) != 1 || a.flags["-U"] != value {
+        return fakeStatus(cmd, 1, "", "Usage: " + cmdName + " -U " + value + " device\n")
+    }
+    dev := a.positional[0]
+    vg, lv := f.resolve(dev)
+    if lv == nil || lv.fs != fs {
+        return fakeStatus(cmd, 1, "", cmdName + ": Bad magic number in super-block while trying to open " + dev + "\n")
+    }
+    for _, d := range f.mounts {
+        if d == dev {
+            return fakeStatus(cmd, 1, "", cmdName + ": " + dev + " is mounted.\n")
+        }
+    }
+    if fs == "ext4" && lv.fsState != "" {
+        return fakeStatus(cmd, 1, "", "\nThis operation requires a freshly checked filesystem.\n\nPlease run e2fsck -fD on the filesystem.\n")
+    }
+    lv.uuid = newFakeUuid()
+    if err := f.saveFsState(vg.name, lv); err != nil {
+        return fakeStatus(cmd, 1, "", err.Error() + "\n")
+    }
+    return fakeStatus(cmd, 0, "", "")
+}
+
+// fsfreeze supports -f and -u of a mountpoint
+func (f *FakeLvm) fsfreeze(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 || a.has("-f") == a.has("-u") {
+        return fakeStatus(cmd, 1, "", "Usage: fsfreeze --freeze|--unfreeze <mountpoint>\n")
+    }
+    mp := filepath.Clean(a.positional[0])
+    if _, ok := f.mounts[mp]; !ok {
+        return fakeStatus(cmd, 1, "", "fsfreeze: " + mp + ": not a mountpoint\n")
+    }
+    if a.has("-f") == f.frozen[mp] {
+        if a.has("-f") {
+            return fakeStatus(cmd, 1, "", "fsfreeze: " + mp + ": freeze failed: Device or resource busy\n")
+        }
+        return fakeStatus(cmd, 1, "", "fsfreeze: " + mp + ": unfreeze failed: Invalid argument\n")
+    }
+    if a.has("-f") {
+        f.frozen[mp] = true
+    } else {
+        delete(f.frozen, mp)
+    }
+    return fakeStatus(cmd, 0, "", "")
+}
+
+// lsblk supports --output=MAJ:MIN of a logical volume or an opened LUKS
+// container. The fake devices get device mapper numbers derived from their
+// path.
+func (f *FakeLvm) lsblk(cmd string, a fakeArgs) (ExecStatus) {
+    if len(a.positional) != 1 || a.flags["--output"] != "MAJ:MIN" {
+        return fakeStatus(cmd, 1, "", "lsblk: only --output=MAJ:MIN of a device is supported\n")
+    }
+    dev := a.positional[0]
+    if _, lv := f.resolve(dev); lv == nil {
+        return fakeStatus(cmd, 32, "", "lsblk: " + dev + ": not a block device\n")
+    }
+    h := fnv.New32a()
+    h.Write([]byte(strings.TrimPrefix(dev, f.Dir)))
+    return fakeStatus(cmd, 0, fmt.Sprintf("253:%d\n", h.Sum32() % (1 << 20)), "")
+}
+
+// CopyDevice emulates the block copy of a clone: the data of the logical
+// volume is copied and the emulated filesystem or LUKS container on it
+// with it. The copy runs without holding the lock of the fake, so that other
+// commands are served meanwhile.
+func (f *FakeLvm) CopyDevice(ctx context.Context, from string, to string, progress func(copied int64)) (error) {
+    f.m.Lock()
+    _, src := f.resolve(from)
+    vg, dst := f.resolve(to)
+    var state fakeLogicalVolume
+    if src != nil {
+        state = *src
+    }
+    f.m.Unlock()
+    if src == nil || dst == nil {
+        return errors.New("No logical volume " + from + " or " + to)
+    }
+    in, err := os.Open(from)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := os.OpenFile(to, os.O_WRONLY, 0)
+    if err != nil {
+        return err
+    }
+    defer out.Close()
+    buf := make([]byte, 1024 * 1024)
+    var copied int64
+    start := time.Now()
+    for {
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        n, err := in.Read(buf)
+        if n > 0 {
+            if !isZero(buf[:n]) {
+                if _, err := out.WriteAt(buf[:n], copied); err != nil {
+                    return err
+                }
+            }
+            copied += int64(n)
+            progress(copied)
+        }
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return err
+        }
+        if f.CopyRateMB > 0 {
+            due := time.Duration(copied / 1024 / 1024) * time.Second / time.Duration(f.CopyRateMB)
+            select {
+            case <-ctx.Done():
+            case <-time.After(due - time.Since(start)):
+            }
+        }
+    }
+    f.m.Lock()
+    defer f.m.Unlock()
+    dst.fs, dst.uuid, dst.root, dst.luks, dst.fsState = state.fs, state.uuid, state.root, state.luks, state.fsState
+    if err := f.copyFiles(vg.name, src, dst); err != nil {
+        return err
+    }
+    return f.saveState(vg.name, dst)
+}
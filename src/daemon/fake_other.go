@@ -0,0 +1,30 @@
+//go:build !fake
+
+package daemon
+
+import (
+    "flag"
+)
+
+// Production builds have no fake backends, see fake_backends.go. The
+// --fake-* options do not exist and the daemon always requires root.
+
+const FakeUsage = ""
+
+type FakeOptions struct{}
+
+func RegisterFakeFlags(fs *flag.FlagSet) (*FakeOptions) {
+    return &FakeOptions{}
+}
+
+func (o *FakeOptions) Validate() (error) {
+    return nil
+}
+
+func (o *FakeOptions) Apply(d *Daemon) (error) {
+    return nil
+}
+
+func fakeExecutor(e CommandExecutor) (bool) {
+    return false
+}
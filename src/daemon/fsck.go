@@ -0,0 +1,280 @@
+package daemon
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Filesystem check before mount
+//
+// After a crash of the host a volume may be mounted with a filesystem which
+// was not unmounted cleanly or has errors. Depending on the policy the
+// filesystem is checked before every mount (always), only if it is marked
+// as not clean (dirty), or never. Without repair the check does not modify
+// the filesystem and a mount of a filesystem with errors is refused; with
+// repair, errors are fixed automatically as far as that is safe and the
+// mount is only refused if errors remain. The result of the last check is
+// stored with the volume.
+//
+// ext4 keeps the state clean while mounted and marks a filesystem that was
+// not unmounted with the needs_recovery feature, so both are looked at.
+// The read-only check skips the journal and would report the changes not
+// yet replayed as errors, so the journal is replayed by e2fsck first; a
+// repair replays it itself. xfs has no such state and is checked on every
+// mount with dirty as well; xfs_repair refuses to work on a log that needs
+// replay, which is done by mounting and unmounting the filesystem before
+// checking it again.
+// --------------------------------------------------------------------------
+
+type FsckPolicy string
+
+const (
+    FsckNever FsckPolicy = "never"
+    FsckDirty FsckPolicy = "dirty"
+    FsckAlways FsckPolicy = "always"
+
+    FsckResultClean = "clean"
+    FsckResultRepaired = "repaired"
+    FsckResultErrors = "errors"
+    // tail of the output of the check kept with the result
+    fsckOutputMax = 4096
+)
+
+var fsckPolicies = []FsckPolicy{FsckNever, FsckDirty, FsckAlways}
+
+func ParseFsckPolicy(s string) (FsckPolicy, error) {
+    for _, p := range fsckPolicies {
+        if string(p) == s {
+            return p, nil
+        }
+    }
+    return FsckNever, errors.New("Unknown fsck policy " + s + ", expected never, dirty or always")
+}
+
+type FsckResult struct {
+    Time time.Time `json:"time"`
+    // check or repair
+    Mode string `json:"mode"`
+    // clean, repaired or errors
+    Result string `json:"result"`
+    Output string `json:"output,omitempty"`
+}
+
+// fsckTool describes how to check a filesystem type
+type fsckTool struct {
+    // returns the program and arguments printing the state of the
+    // filesystem; empty if the state cannot be determined
+    state func(device string) ([]string)
+    clean func(output string) (bool)
+    // tells from the state whether the journal has to be replayed before
+    // the check
+    recovery func(output string) (bool)
+    // replays the journal only, its exit status is mapped by result
+    replay func(device string) ([]string)
+    check func(device string) ([]string)
+    repair func(device string) ([]string)
+    // maps the exit status of check or repair to a result, an empty
+    // result marks a failure of the tool itself
+    result func(status int) (string)
+    // tells from the exit status of check or repair whether the log has to
+    // be replayed first; nil if the tool replays it itself
+    needsReplay func(status int) (bool)
+}
+
+// ext4Header returns a field of the output of dumpe2fs -h
+func ext4Header(output string, field string) (string) {
+    for _, line := range strings.Split(output, "\n") {
+        kv := strings.SplitN(line, ":", 2)
+        if len(kv) == 2 && strings.TrimSpace(kv[0]) == field {
+            return strings.TrimSpace(kv[1])
+        }
+    }
+    return ""
+}
+
+// ext4Recovery tells from the output of dumpe2fs -h whether the journal
+// needs recovery, i.e. the filesystem was not unmounted
+func ext4Recovery(output string) (bool) {
+    for _, feature := range strings.Fields(ext4Header(output, "Filesystem features")) {
+        if feature == "needs_recovery" {
+            return true
+        }
+    }
+    return false
+}
+
+// ext4Clean tells from the output of dumpe2fs -h whether the filesystem was
+// unmounted cleanly and has no errors
+func ext4Clean(output string) (bool) {
+    return ext4Header(output, "Filesystem state") == "clean" && !ext4Recovery(output)
+}
+
+var fsckTools = map[string]fsckTool{
+    "ext4": {
+        state: func(device string) ([]string) { return []string{"dumpe2fs", "-h", device} },
+        clean: ext4Clean,
+        recovery: ext4Recovery,
+        replay: func(device string) ([]string) { return []string{"e2fsck", "-E", "journal_only", device} },
+        check: func(device string) ([]string) { return []string{"e2fsck", "-n", "-f", device} },
+        // preen mode only fixes what can be fixed without questions
+        repair: func(device string) ([]string) { return []string{"e2fsck", "-p", "-f", device} },
+        // e2fsck exit status is a bit mask: 1 and 2 errors corrected, 4
+        // errors left, 8 and above operational errors
+        result: func(status int) (string) {
+            switch {
+            case status >= 8:
+                return ""
+            case status & 4 != 0:
+                return FsckResultErrors
+            case status & 3 != 0:
+                return FsckResultRepaired
+            }
+            return FsckResultClean
+        },
+    },
+    "xfs": {
+        check: func(device string) ([]string) { return []string{"xfs_repair", "-n", device} },
+        repair: func(device string) ([]string) { return []string{"xfs_repair", device} },
+        result: func(status int) (string) {
+            switch status {
+            case 0:
+                return FsckResultClean
+            case 1:
+                return FsckResultErrors
+            }
+            return ""
+        },
+        // the log has to be replayed by a mount
+        needsReplay: func(status int) (bool) { return status == 2 },
+    },
+}
+
+// fsckBinaries returns the programs needed to check the filesystem
+func fsckBinaries(fs string) ([]string) {
+    tool, ok := fsckTools[fs]
+    if !ok {
+        return nil
+    }
+    binaries := []string{tool.check("")[0]}
+    if tool.state != nil {
+        binaries = append(binaries, tool.state("")[0])
+    }
+    return binaries
+}
+
+func tail(s string, max int) (string) {
+    if len(s) > max {
+        return s[len(s) - max:]
+    }
+    return s
+}
+
+// fsState reports whether the filesystem is marked clean and whether its
+// journal needs recovery; filesystems without a state are never considered
+// clean
+func (d *VolumeDriver) fsState(ctx context.Context, tool fsckTool, device string) (bool, bool, error) {
+    if tool.state == nil {
+        return false, false, nil
+    }
+    cmd := tool.state(device)
+    status := d.runCommand(ctx, cmd[0], cmd[1:])
+    if status.status != 0 {
+        return false, false, commandError(status, "Cannot read state of filesystem on " + device + ": " + status.stderr)
+    }
+    return tool.clean(status.stdout), tool.recovery(status.stdout), nil
+}
+
+// replayJournal replays the journal of the filesystem without checking it
+func (d *VolumeDriver) replayJournal(ctx context.Context, tool fsckTool, meta *VolumeMetadata, device string) (error) {
+    cmd := tool.replay(device)
+    status := d.runCommand(ctx, cmd[0], cmd[1:])
+    if status.err != nil {
+        return status.err
+    }
+    if result := tool.result(status.status); result != FsckResultClean && result != FsckResultRepaired {
+        return commandError(status, "Cannot replay journal of volume " + meta.Name + ": " + status.stdout + status.stderr)
+    }
+    return nil
+}
+
+// checkFilesystem checks the filesystem on device according to the policy
+// and refuses the mount if it has errors
+func (d *VolumeDriver) checkFilesystem(ctx context.Context, meta *VolumeMetadata, device string) (error) {
+    if d.FsckPolicy == "" || d.FsckPolicy == FsckNever {
+        return nil
+    }
+    tool, ok := fsckTools[filesystemOf(meta)]
+    if !ok {
+        return nil
+    }
+    l := LoggerFrom(ctx).With("volume", meta.Name)
+    clean, recovery, err := d.fsState(ctx, tool, device)
+    if err != nil {
+        return err
+    }
+    if d.FsckPolicy == FsckDirty {
+        if clean {
+            return nil
+        }
+        l.Warn("Filesystem was not unmounted cleanly")
+    }
+    mode, cmd := "check", tool.check(device)
+    if d.FsckRepair {
+        mode, cmd = "repair", tool.repair(device)
+    }
+    start := time.Now()
+    if recovery && !d.FsckRepair {
+        l.Warn("Filesystem journal needs recovery before the check")
+        if err := d.replayJournal(ctx, tool, meta, device); err != nil {
+            return err
+        }
+    }
+    status := d.runCommand(ctx, cmd[0], cmd[1:])
+    if status.err == nil && tool.needsReplay != nil && tool.needsReplay(status.status) {
+        l.Warn("Filesystem log needs replay before the check")
+        if err := d.replayLog(ctx, meta, device); err != nil {
+            return err
+        }
+        status = d.runCommand(ctx, cmd[0], cmd[1:])
+    }
+    if status.err != nil {
+        return status.err
+    }
+    result := tool.result(status.status)
+    if result == "" {
+        return commandError(status, "Cannot check filesystem of volume " + meta.Name + ": " + status.stderr)
+    }
+    l.Info("Filesystem checked", "mode", mode, "result", result, "duration", time.Since(start).Round(time.Millisecond).String())
+    meta.Fsck = &FsckResult{
+        Time: time.Now().UTC(),
+        Mode: mode,
+        Result: result,
+        Output: tail(strings.TrimSpace(status.stdout + status.stderr), fsckOutputMax),
+    }
+    if err := d.saveMetadata(meta); err != nil {
+        return err
+    }
+    if result == FsckResultErrors {
+        msg := "Filesystem of volume " + meta.Name + " has errors"
+        if d.FsckRepair {
+            msg += " which cannot be repaired automatically"
+        } else {
+            msg += ", automatic repair is disabled"
+        }
+        return FilesystemCorrupt(msg)
+    }
+    return nil
+}
+
+// replayLog replays the log of a filesystem by mounting it on the mountpoint
+// of the volume and unmounting it again; like the mount for the
+// initialization of the root, it gives no access to anything on the volume
+func (d *VolumeDriver) replayLog(ctx context.Context, meta *VolumeMetadata, device string) (error) {
+    if err := d.mount(ctx, device, d.getMountpoint(meta.Name), []string{"-o", initMountOptions}); err != nil {
+        return err
+    }
+    return d.unmount(ctx, device)
+}
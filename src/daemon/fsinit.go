@@ -0,0 +1,129 @@
+package daemon
+
+import (
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+)
+
+// --------------------------------------------------------------------------
+// Initialization of the filesystem root
+//
+// mkfs creates a root directory owned by root with mode 0755 and, for ext4,
+// a lost+found directory. Containers running as another user cannot write
+// to such a volume, so the owner and mode of the root can be given on
+// create (-o uid=999 -o gid=999 -o mode=0750) and lost+found can be removed
+// (-o lostfound=false). The new filesystem is mounted on a temporary
+// directory for that.
+// --------------------------------------------------------------------------
+
+const (
+    UidOption = "uid"
+    GidOption = "gid"
+    ModeOption = "mode"
+    LostFoundOption = "lostfound"
+    lostFoundDir = "lost+found"
+    // the temporary mount must not give access to anything on the volume
+    initMountOptions = "nodev,nosuid,noexec"
+)
+
+var modePattern = regexp.MustCompile("^0?[0-7]{3,4}$")
+
+type rootInit struct {
+    // empty if unchanged
+    uid string
+    gid string
+    mode string
+    removeLostFound bool
+}
+
+func (r rootInit) needed() (bool) {
+    return r.uid != "" || r.gid != "" || r.mode != "" || r.removeLostFound
+}
+
+func parseId(options map[string]string, key string) (string, error) {
+    val, ok := options[key]
+    if !ok {
+        return "", nil
+    }
+    id, err := strconv.ParseUint(val, 10, 32)
+    if err != nil {
+        return "", InvalidArgument("Illegal value " + val + " for option " + key + ", expected a numeric id")
+    }
+    return strconv.FormatUint(id, 10), nil
+}
+
+// parseRootInit returns the initialization of the filesystem root requested
+// by the options
+func parseRootInit(options map[string]string) (rootInit, error) {
+    var r rootInit
+    var err error
+    if r.uid, err = parseId(options, UidOption); err != nil {
+        return r, err
+    }
+    if r.gid, err = parseId(options, GidOption); err != nil {
+        return r, err
+    }
+    if val, ok := options[ModeOption]; ok {
+        if !modePattern.MatchString(val) {
+            return r, InvalidArgument("Illegal value " + val + " for option " + ModeOption + ", expected an octal mode like 0750")
+        }
+        r.mode = val
+    }
+    if val, ok := options[LostFoundOption]; ok {
+        keep, err := strconv.ParseBool(val)
+        if err != nil {
+            return r, InvalidArgument("Illegal value " + val + " for option " + LostFoundOption + ", expected true or false")
+        }
+        r.removeLostFound = !keep
+    }
+    return r, nil
+}
+
+// initRoot applies the initialization to the filesystem on device
+func (d *VolumeDriver) initRoot(ctx context.Context, device string, r rootInit) (error) {
+    if !r.needed() {
+        return nil
+    }
+    dir, err := ioutil.TempDir("", "lvmvd-init-")
+    if err != nil {
+        return Internal("Cannot create temporary mountpoint: " + err.Error())
+    }
+    defer os.Remove(dir)
+    if err := d.mount(ctx, device, dir, []string{"-o", initMountOptions}); err != nil {
+        return err
+    }
+    err = d.changeRoot(ctx, dir, r)
+    if uerr := d.unmount(ctx, dir); err == nil {
+        err = uerr
+    }
+    return err
+}
+
+func (d *VolumeDriver) changeRoot(ctx context.Context, dir string, r rootInit) (error) {
+    l := LoggerFrom(ctx)
+    if r.uid != "" || r.gid != "" {
+        owner := r.uid
+        if r.gid != "" {
+            owner += ":" + r.gid
+        }
+        if status := d.runCommand(ctx, "chown", []string{owner, dir}); status.status != 0 {
+            return commandError(status, "Cannot change owner of the volume: " + status.stderr)
+        }
+    }
+    if r.mode != "" {
+        if status := d.runCommand(ctx, "chmod", []string{r.mode, dir}); status.status != 0 {
+            return commandError(status, "Cannot change mode of the volume: " + status.stderr)
+        }
+    }
+    if r.removeLostFound {
+        if status := d.runCommand(ctx, "rmdir", []string{filepath.Join(dir, lostFoundDir)}); status.status != 0 {
+            return commandError(status, "Cannot remove " + lostFoundDir + ": " + status.stderr)
+        }
+    }
+    l.Info("Filesystem root initialized", "uid", r.uid, "gid", r.gid, "mode", r.mode, "lost_found_removed", r.removeLostFound)
+    return nil
+}
@@ -0,0 +1,377 @@
+package daemon
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Garbage collector
+//
+// Logical volumes whose docker volumes were removed while the daemon was
+// down, mountpoint directories left behind by failed unmounts and device
+// mapper targets of encrypted volumes which were not closed accumulate over
+// time. The collector finds them on a schedule or when triggered by the
+// admin API and, depending on the policy, only reports them or removes those
+// which have been orphaned for longer than the grace period. When an orphan
+// was first seen is kept in the state directory, so that restarts do not
+// extend the grace period.
+//
+// Only volumes with metadata, i.e. created by the driver, are collected;
+// snapshots and mounted volumes never are. A volume no container uses is
+// not necessarily unwanted: it may have just been created, imported or
+// restored, or be kept while its container is recreated, and docker cannot
+// tell whether it still knows the volume (see dockerengine.go). Such volumes
+// are therefore only reported; the collector removes a volume only if docker
+// asked for its removal and the removal failed, e.g. because it was still
+// mounted, which docker ignores with docker volume rm --force. A mount
+// withdraws the request. Logical volumes whose docker volumes were removed
+// while the daemon was down are never removed: docker sent no request, so
+// they are reported like any other unused volume.
+// --------------------------------------------------------------------------
+
+type GCPolicy string
+
+const (
+    GCPolicyOff GCPolicy = "off"
+    // orphans are logged and reported only
+    GCPolicyReport GCPolicy = "report"
+    // orphans are removed after the grace period
+    GCPolicyRemove GCPolicy = "remove"
+
+    DefaultGCInterval = time.Hour
+    DefaultGCGrace = 24 * time.Hour
+
+    GCKindVolume = "volume"
+    GCKindMountpoint = "mountpoint"
+    GCKindMapper = "mapper"
+
+    // actions taken for an orphan
+    GCFound = "found"
+    GCPending = "pending"
+    GCRemoved = "removed"
+    GCFailed = "failed"
+
+    gcStateFile = "gc.json"
+    metricGCOrphans = "lvmvd_gc_orphans"
+    metricGCRemoved = "lvmvd_gc_removed_total"
+)
+
+var gcPolicies = []GCPolicy{GCPolicyOff, GCPolicyReport, GCPolicyRemove}
+
+func ParseGCPolicy(s string) (GCPolicy, error) {
+    for _, p := range gcPolicies {
+        if string(p) == s {
+            return p, nil
+        }
+    }
+    return GCPolicyOff, errors.New("Unknown gc policy " + s + ", expected off, report or remove")
+}
+
+type GCItem struct {
+    Kind string `json:"kind"`
+    Name string `json:"name"`
+    FirstSeen time.Time `json:"first_seen"`
+    // docker asked to remove the volume, only such volumes are removed
+    RemoveRequested bool `json:"remove_requested,omitempty"`
+    // found, pending (within the grace period), removed or failed
+    Action string `json:"action"`
+    Error string `json:"error,omitempty"`
+}
+
+type GCReport struct {
+    Time time.Time `json:"time"`
+    Policy GCPolicy `json:"policy"`
+    DryRun bool `json:"dry_run"`
+    Grace string `json:"grace"`
+    Items []GCItem `json:"items"`
+}
+
+type gcOrphan struct {
+    kind string
+    name string
+    // creation of the volume, zero for other kinds
+    created time.Time
+    // docker asked to remove the volume
+    removeRequested bool
+}
+
+// removable tells whether the policy remove may remove the orphan; volumes
+// only if docker asked for their removal
+func (o gcOrphan) removable() (bool) {
+    return o.kind != GCKindVolume || o.removeRequested
+}
+
+// recordRemoveRequest notes in the metadata of a volume that docker asked to
+// remove it, so that the collector removes it if the removal fails. Volumes
+// without metadata are not collected anyway.
+func (d *VolumeDriver) recordRemoveRequest(ctx context.Context, name string) {
+    if d.State == nil {
+        return
+    }
+    meta, err := d.State.Load(name)
+    if err != nil || meta == nil || meta.RemoveRequested != nil {
+        return
+    }
+    now := time.Now().UTC()
+    meta.RemoveRequested = &now
+    if err := d.saveMetadata(meta); err != nil {
+        LoggerFrom(ctx).Warn("Cannot record the removal request of volume", "volume", name, "error", err)
+    }
+}
+
+// clearRemoveRequest withdraws the removal request of a volume being used
+func (d *VolumeDriver) clearRemoveRequest(ctx context.Context, meta *VolumeMetadata) {
+    if meta.RemoveRequested == nil {
+        return
+    }
+    meta.RemoveRequested = nil
+    if err := d.saveMetadata(meta); err != nil {
+        LoggerFrom(ctx).Warn("Cannot save metadata of volume", "volume", meta.Name, "error", err)
+    }
+}
+
+func (o gcOrphan) key() (string) {
+    return o.kind + "/" + o.name
+}
+
+// findOrphans returns the volumes not referenced by docker, the mountpoint
+// directories of volumes which are not mounted and the opened LUKS
+// containers of volumes which are not mounted
+func (d *VolumeDriver) findOrphans(ctx context.Context, referenced map[string]bool) ([]gcOrphan, error) {
+    infos, err := d.volumeInfos(ctx)
+    if err != nil {
+        return nil, err
+    }
+    orphans := []gcOrphan{}
+    existing := make(map[string]VolumeInfo)
+    orphaned := make(map[string]bool)
+    for _, info := range infos {
+        existing[info.Name] = info
+        if info.Mounted || info.Origin != "" || referenced[info.Name] || d.State == nil || d.transferring(info.Name) {
+            continue
+        }
+        meta, err := d.State.Load(info.Name)
+        if err != nil {
+            return nil, Internal("Cannot read metadata of volume " + info.Name + ": " + err.Error())
+        }
+        // snapshots are made and removed by operators, not by docker
+        if meta != nil && meta.Origin == "" {
+            orphans = append(orphans, gcOrphan{kind: GCKindVolume, name: info.Name, created: meta.Created, removeRequested: meta.RemoveRequested != nil})
+            orphaned[info.Name] = meta.RemoveRequested != nil
+        }
+    }
+
+    entries, err := ioutil.ReadDir(d.MountRoot)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, Internal("Cannot read mount root: " + err.Error())
+    }
+    for _, e := range entries {
+        // the mountpoint of a removable volume goes with the volume
+        if !e.IsDir() || existing[e.Name()].Mounted || orphaned[e.Name()] {
+            continue
+        }
+        orphans = append(orphans, gcOrphan{kind: GCKindMountpoint, name: e.Name()})
+    }
+
+    mappers := make(map[string]VolumeInfo)
+    for _, info := range infos {
+        mappers[d.mapperName(info.Name)] = info
+    }
+    // containers opened for exports and imports are in use
+    for _, name := range d.transfers.names() {
+        mappers[d.mapperName(name)] = VolumeInfo{Name: name, Mounted: true}
+    }
+    status := d.runCommand(ctx, "dmsetup", []string{"ls"})
+    if status.status != 0 {
+        return nil, commandError(status, "Cannot list device mapper targets: " + status.stderr)
+    }
+    for _, line := range strings.Split(status.stdout, "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 0 || !strings.HasPrefix(fields[0], mapperPrefix) {
+            continue
+        }
+        if info, ok := mappers[fields[0]]; !ok || !info.Mounted {
+            orphans = append(orphans, gcOrphan{kind: GCKindMapper, name: fields[0]})
+        }
+    }
+    return orphans, nil
+}
+
+func (d *VolumeDriver) removeOrphan(ctx context.Context, o gcOrphan) (error) {
+    switch o.kind {
+    case GCKindVolume:
+        if err := d.removeLogicalVolume(ctx, o.name); err != nil {
+            return err
+        }
+        if _, err := os.Stat(d.getMountpoint(o.name)); err == nil {
+            return d.removeMountpoint(ctx, o.name)
+        }
+    case GCKindMountpoint:
+        return d.removeMountpoint(ctx, o.name)
+    case GCKindMapper:
+        if status := d.runCommand(ctx, "cryptsetup", []string{"close", o.name}); status.status != 0 {
+            return commandError(status, "Cannot close device mapper target " + o.name + ": " + status.stderr)
+        }
+    }
+    return nil
+}
+
+type collector struct {
+    d *VolumeDriver
+    // the collector works under the request lock like the docker requests
+    lock *requestLock
+    engine DockerEngine
+    policy GCPolicy
+    grace time.Duration
+    // serializes scheduled and triggered runs
+    m sync.Mutex
+}
+
+func (c *collector) stateFile() (string) {
+    return filepath.Join(c.d.State.Dir, gcStateFile)
+}
+
+// loadSeen returns when the orphans were first seen
+func (c *collector) loadSeen() (map[string]time.Time) {
+    seen := make(map[string]time.Time)
+    if c.d.State == nil {
+        return seen
+    }
+    if data, err := ioutil.ReadFile(c.stateFile()); err == nil {
+        if err := json.Unmarshal(data, &seen); err != nil {
+            DefaultLogger().Warn("Ignoring corrupt garbage collector state", "path", c.stateFile(), "error", err)
+        }
+    }
+    return seen
+}
+
+func (c *collector) saveSeen(seen map[string]time.Time) (error) {
+    if c.d.State == nil {
+        return nil
+    }
+    data, err := json.MarshalIndent(seen, "", "  ")
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(c.stateFile(), data, 0600)
+}
+
+// collect runs the garbage collector once. A dry run only reports and does
+// not record the orphans.
+func (c *collector) collect(ctx context.Context, dryRun bool) (*GCReport, error) {
+    c.m.Lock()
+    defer c.m.Unlock()
+    l := LoggerFrom(ctx)
+    // docker is asked without holding the request lock, it may send
+    // requests to the driver meanwhile. A volume created in between is
+    // protected by the grace period.
+    referenced, err := c.engine.ReferencedVolumes(ctx, VolumeDriverName)
+    if err != nil {
+        return nil, Internal("Cannot determine the volumes used by docker: " + err.Error())
+    }
+    c.lock.Lock("garbage collector")
+    defer c.lock.Unlock()
+    orphans, err := c.d.findOrphans(ctx, referenced)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now().UTC()
+    report := &GCReport{Time: now, Policy: c.policy, DryRun: dryRun, Grace: c.grace.String(), Items: []GCItem{}}
+    remove := c.policy == GCPolicyRemove && !dryRun
+    seen := c.loadSeen()
+    stillSeen := make(map[string]time.Time)
+    counts := map[string]int{GCKindVolume: 0, GCKindMountpoint: 0, GCKindMapper: 0}
+    for _, o := range orphans {
+        first, ok := seen[o.key()]
+        if !ok {
+            first = now
+        }
+        item := GCItem{Kind: o.kind, Name: o.name, FirstSeen: first, RemoveRequested: o.removeRequested, Action: GCFound}
+        if remove && o.removable() {
+            if now.Sub(first) < c.grace || now.Sub(o.created) < c.grace {
+                item.Action = GCPending
+            } else if err := c.d.removeOrphan(ctx, o); err != nil {
+                item.Action = GCFailed
+                item.Error = err.Error()
+            } else {
+                item.Action = GCRemoved
+            }
+        }
+        if item.Action == GCRemoved {
+            l.Info("Orphan removed", "kind", o.kind, "name", o.name, "first_seen", first)
+            c.d.Metrics.Inc(metricGCRemoved, "Orphans removed by the garbage collector.", "kind", o.kind)
+        } else {
+            stillSeen[o.key()] = first
+            counts[o.kind]++
+            if item.Action == GCFailed {
+                l.Error("Cannot remove orphan", "kind", o.kind, "name", o.name, "error", item.Error)
+            } else {
+                l.Warn("Orphan found", "kind", o.kind, "name", o.name, "first_seen", first, "action", item.Action)
+            }
+        }
+        report.Items = append(report.Items, item)
+    }
+    sort.Slice(report.Items, func(i, j int) (bool) {
+        if report.Items[i].Kind != report.Items[j].Kind {
+            return report.Items[i].Kind < report.Items[j].Kind
+        }
+        return report.Items[i].Name < report.Items[j].Name
+    })
+    if !dryRun {
+        if err := c.saveSeen(stillSeen); err != nil {
+            return nil, Internal("Cannot store garbage collector state: " + err.Error())
+        }
+        for kind, n := range counts {
+            c.d.Metrics.Set(metricGCOrphans, "Orphans found by the last run of the garbage collector.", float64(n), "kind", kind)
+        }
+    }
+    return report, nil
+}
+
+func (c *collector) run(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            l := DefaultLogger().With("component", "gc")
+            if _, err := c.collect(WithLogger(ctx, l), false); err != nil {
+                l.Error("Garbage collection failed", "error", err)
+            }
+        }
+    }
+}
+
+// startCollector sets up the garbage collector and schedules it unless the
+// policy is off. It returns immediately.
+func (s *Daemon) startCollector(ctx context.Context) {
+    engine := s.DockerEngine
+    if engine == nil {
+        engine = &SocketDockerEngine{Socket: DefaultDockerSocket}
+    }
+    policy := s.GCPolicy
+    if policy == "" {
+        policy = GCPolicyOff
+    }
+    s.gc = &collector{d: s.driver, lock: s.m, engine: engine, policy: policy, grace: s.GCGrace}
+    if policy != GCPolicyOff && s.GCInterval > 0 {
+        s.driver.background(func() { s.gc.run(ctx, s.GCInterval) })
+    }
+}
+
+// CollectGarbage runs the garbage collector once; with policy off it only
+// reports
+func (s *Daemon) CollectGarbage(ctx context.Context, dryRun bool) (*GCReport, error) {
+    return s.gc.collect(ctx, dryRun)
+}
@@ -0,0 +1,226 @@
+package daemon
+
+import (
+    "context"
+    "errors"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "os/exec"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Health and readiness checks
+//
+// /health reports whether the daemon itself is alive, i.e. it is still able
+// to process requests. /ready additionally checks that everything needed to
+// serve volumes is in place. Both return a JSON document with the result of
+// every check and respond with 503 if a relevant check fails.
+// --------------------------------------------------------------------------
+
+const (
+    DefaultLockThreshold = 5 * time.Minute
+    checkStatusOk = "ok"
+    checkStatusFailed = "failed"
+)
+
+var RequiredBinaries = []string{
+    "lvcreate", "lvremove", "lvs", "vgdisplay", "mkfs." + DEFAULT_FILESYSTEM, "mount", "umount", "rmdir",
+    "chown", "chmod",
+}
+
+// requestLock serializes the requests from docker and remembers for how long
+// and by which request it is held, so that a stuck request can be detected.
+type requestLock struct {
+    m sync.Mutex
+    info sync.Mutex
+    heldSince time.Time
+    holder string
+}
+
+func (l *requestLock) Lock(holder string) {
+    l.m.Lock()
+    l.info.Lock()
+    l.heldSince = time.Now()
+    l.holder = holder
+    l.info.Unlock()
+}
+
+func (l *requestLock) Unlock() {
+    l.info.Lock()
+    l.heldSince = time.Time{}
+    l.holder = ""
+    l.info.Unlock()
+    l.m.Unlock()
+}
+
+// HeldFor returns how long the lock has been held and by whom. The duration
+// is zero if the lock is free.
+func (l *requestLock) HeldFor() (time.Duration, string) {
+    l.info.Lock()
+    defer l.info.Unlock()
+    if l.heldSince.IsZero() {
+        return 0, ""
+    }
+    return time.Since(l.heldSince), l.holder
+}
+
+type CheckResult struct {
+    Status string `json:"status"`
+    Error string `json:"error,omitempty"`
+    Duration string `json:"duration"`
+}
+
+type HealthReport struct {
+    Status string `json:"status"`
+    Checks map[string]CheckResult `json:"checks"`
+}
+
+type healthCheck struct {
+    name string
+    // liveness checks fail /health, all checks fail /ready
+    liveness bool
+    check func(ctx context.Context) (error)
+}
+
+// requiredBinaries returns the programs needed with the configured options
+func (d *Daemon) requiredBinaries() ([]string) {
+    binaries := append([]string{}, RequiredBinaries...)
+    filesystems := []string{}
+    for _, class := range d.StorageClasses.Classes {
+        if !stringInList(class.Filesystem, filesystems) {
+            filesystems = append(filesystems, class.Filesystem)
+        }
+    }
+    for _, fs := range filesystems {
+        if fs != DEFAULT_FILESYSTEM {
+            binaries = append(binaries, "mkfs." + fs)
+        }
+    }
+    if d.WipePolicy != "" && d.WipePolicy != WipeNone {
+        binaries = append(binaries, "lvchange", "lvrename")
+    }
+    if d.WipePolicy == WipeDiscard {
+        binaries = append(binaries, "blkdiscard")
+    }
+    if d.KeyProvider != nil {
+        binaries = append(binaries, "cryptsetup")
+    }
+    if d.FsckPolicy != "" && d.FsckPolicy != FsckNever {
+        for _, fs := range filesystems {
+            binaries = append(binaries, fsckBinaries(fs)...)
+        }
+    }
+    if d.GCPolicy != "" && d.GCPolicy != GCPolicyOff {
+        binaries = append(binaries, "dmsetup")
+    }
+    return binaries
+}
+
+func checkBinaries(binaries []string) (error) {
+    missing := []string{}
+    for _, b := range binaries {
+        if _, err := exec.LookPath(b); err != nil {
+            missing = append(missing, b)
+        }
+    }
+    if len(missing) > 0 {
+        return errors.New("Required programs not found on PATH: " + strings.Join(missing, ", "))
+    }
+    return nil
+}
+
+func checkWritable(dir string) (error) {
+    f, err := ioutil.TempFile(dir, ".lvmvd-health")
+    if err != nil {
+        return err
+    }
+    f.Close()
+    return os.Remove(f.Name())
+}
+
+func (d *Daemon) healthChecks() ([]healthCheck) {
+    checks := []healthCheck{
+        {"request_lock", true, func(ctx context.Context) (error) {
+            if held, holder := d.m.HeldFor(); held > d.LockThreshold {
+                return errors.New("Request lock held by " + holder + " for " + held.String())
+            }
+            return nil
+        }},
+        {"volume_group", false, func(ctx context.Context) (error) {
+            return d.driver.EnsureVGExists(ctx)
+        }},
+        {"mount_root", false, func(ctx context.Context) (error) {
+            return checkWritable(d.MountRoot)
+        }},
+        {"binaries", false, func(ctx context.Context) (error) {
+            return checkBinaries(d.requiredBinaries())
+        }},
+        {"state_store", true, func(ctx context.Context) (error) {
+            if d.driver.State == nil {
+                return errors.New("State store not initialized")
+            }
+            return d.driver.State.Check()
+        }},
+        {"raid", false, func(ctx context.Context) (error) {
+            return d.driver.checkRaidHealth(ctx)
+        }},
+    }
+    // key providers may offer a check, e.g. for the reachability of a KMS
+    if c, ok := d.KeyProvider.(interface{ Check() (error) }); ok {
+        checks = append(checks, healthCheck{"key_provider", false, func(ctx context.Context) (error) {
+            return c.Check()
+        }})
+    }
+    if c, ok := d.BackupTarget.(interface{ Check() (error) }); ok {
+        checks = append(checks, healthCheck{"backup_target", false, func(ctx context.Context) (error) {
+            return c.Check()
+        }})
+    }
+    return checks
+}
+
+// runHealthChecks executes the checks without taking the request lock so that
+// a hanging request does not block the health endpoints as well.
+func (d *Daemon) runHealthChecks(ctx context.Context, livenessOnly bool) (HealthReport, bool) {
+    report := HealthReport{Status: checkStatusOk, Checks: make(map[string]CheckResult)}
+    healthy := true
+    for _, c := range d.healthChecks() {
+        start := time.Now()
+        err := c.check(ctx)
+        result := CheckResult{Status: checkStatusOk, Duration: time.Since(start).String()}
+        if err != nil {
+            result.Status = checkStatusFailed
+            result.Error = err.Error()
+            if c.liveness || !livenessOnly {
+                healthy = false
+            }
+        }
+        report.Checks[c.name] = result
+    }
+    if !healthy {
+        report.Status = checkStatusFailed
+    }
+    return report, healthy
+}
+
+func (d *Daemon) writeHealthReport(w http.ResponseWriter, r *http.Request, livenessOnly bool) {
+    report, healthy := d.runHealthChecks(r.Context(), livenessOnly)
+    code := http.StatusOK
+    if !healthy {
+        code = http.StatusServiceUnavailable
+        LoggerFrom(r.Context()).Warn("Health check failed", "path", r.URL.Path, "checks", report.Checks)
+    }
+    writeJson(report, code, w, r)
+}
+
+func (d *Daemon) health(w http.ResponseWriter, r *http.Request) {
+    d.writeHealthReport(w, r, true)
+}
+
+func (d *Daemon) ready(w http.ResponseWriter, r *http.Request) {
+    d.writeHealthReport(w, r, false)
+}
@@ -0,0 +1,560 @@
+package daemon
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "encoding/xml"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// --------------------------------------------------------------------------
+// Incremental backups
+//
+// Thin volumes created with -o backup-incremental=true are backed up with
+// only the blocks changed since their last backup. The snapshot a backup
+// was read from is kept, tagged and hidden, as base of the next backup;
+// thin_delta compares it with the snapshot of the next backup in a
+// metadata snapshot of the pool and reports the changed ranges. Every
+// backup-full-every backups, after a resize or if the base is gone, a full
+// backup is taken instead.
+//
+// An incremental backup is stored as an export stream of format delta,
+// whose payload is a sequence of records:
+//
+//   'D' <8 byte offset> <8 byte length> <data>   data at the offset
+//   'Z' <8 byte offset> <8 byte length>          zeros, unmapped blocks
+//   'E' <8 byte zero> <8 byte size of the volume>
+//
+// numbers are big endian. Its header names the backup it applies to as
+// base. A raw backup imports into a new volume, which remembers the backup;
+// a delta stream is imported into that volume again, which has to be
+// unmounted and remembers the new backup afterwards. The volume must not
+// be mounted in between, a mount changes its blocks: the first mount gets
+// the filesystem a new UUID and ends the chain. A delta import which fails
+// removes the volume, its data is inconsistent.
+//
+// The catalog record of an incremental backup has the id of its base,
+// retention keeps the bases of all backups kept and a backup cannot be
+// deleted while another one is based on it. The chain of a backup lists
+// the backups to import from the full one on and verifies that they are
+// all stored.
+// --------------------------------------------------------------------------
+
+const (
+    BackupIncrementalOption = "backup-incremental"
+    BackupFullEveryOption = "backup-full-every"
+    defaultBackupFullEvery = 7
+
+    // snapshots kept as base of the next incremental backup
+    backupBaseTag = "lvmvd_backup_base"
+
+    deltaData = 'D'
+    deltaZero = 'Z'
+    deltaEnd = 'E'
+    deltaRecordHeader = 17
+    sectorSize = 512
+)
+
+// BackupBase is the snapshot the last backup of a volume was read from
+type BackupBase struct {
+    Snapshot string `json:"snapshot"`
+    Backup string `json:"backup"`
+    SizeMB int64 `json:"size_mb"`
+    // incremental backups since the last full one
+    Increments int `json:"increments"`
+}
+
+// deltaExtent is a range of a volume in bytes to be written by an
+// incremental backup, with zeros if zero is set
+type deltaExtent struct {
+    offset int64
+    length int64
+    zero bool
+}
+
+// checkIncrementalBackup verifies that a volume of the class can be backed
+// up incrementally if the policy asks for it
+func checkIncrementalBackup(p *BackupPolicy, class *StorageClass, encrypted bool) (error) {
+    if p == nil || !p.Incremental {
+        return nil
+    }
+    if class.ThinPool == "" {
+        return InvalidArgument("Option " + BackupIncrementalOption + " requires a thin volume, storage class " + class.Name + " has no thin pool")
+    }
+    if encrypted {
+        return InvalidArgument("Option " + BackupIncrementalOption + " is not supported for encrypted volumes")
+    }
+    return nil
+}
+
+// lvmDmName returns the device mapper name LVM gives a logical volume,
+// with the dashes in the names doubled
+func lvmDmName(vg string, lv string) (string) {
+    return strings.Replace(vg, "-", "--", -1) + "-" + strings.Replace(lv, "-", "--", -1)
+}
+
+func (d *VolumeDriver) dmDevice(name string) (string) {
+    devDir := d.DevDir
+    if devDir == "" {
+        devDir = "/dev"
+    }
+    return filepath.Join(devDir, "mapper", name)
+}
+
+// thinIds returns the device ids in their pools of the thin volumes of a
+// volume group
+func (d *VolumeDriver) thinIds(ctx context.Context, vg string) (map[string]string, error) {
+    status := d.runCommand(ctx, "lvs", []string{"--noheadings", "--separator", lvsSeparator, "-o", "lv_name,thin_id", vg})
+    if status.status != 0 {
+        return nil, commandError(status, status.String())
+    }
+    ids := make(map[string]string)
+    for _, line := range strings.Split(status.stdout, "\n") {
+        values := strings.SplitN(strings.TrimSpace(line), lvsSeparator, 2)
+        if len(values) == 2 && strings.TrimSpace(values[1]) != "" {
+            ids[strings.TrimSpace(values[0])] = strings.TrimSpace(values[1])
+        }
+    }
+    return ids, nil
+}
+
+// thinDelta returns the ranges in which the thin volume snapshot differs
+// from base, both in the pool of the volume group vg. The pool metadata is
+// read from a metadata snapshot, as the pool is in use.
+func (d *VolumeDriver) thinDelta(ctx context.Context, vg string, pool string, base string, snapshot string, size int64) ([]deltaExtent, error) {
+    ids, err := d.thinIds(ctx, vg)
+    if err != nil {
+        return nil, err
+    }
+    if ids[base] == "" || ids[snapshot] == "" {
+        return nil, Internal("Cannot find the thin device ids of " + base + " and " + snapshot)
+    }
+    tpool := lvmDmName(vg, pool) + "-tpool"
+    reserve := []string{"message", tpool, "0", "reserve_metadata_snap"}
+    release := []string{"message", tpool, "0", "release_metadata_snap"}
+    status := d.runCommand(ctx, "dmsetup", reserve)
+    if status.status != 0 {
+        // a metadata snapshot left over by a crash, deltas are computed
+        // under the request lock only
+        d.runCommand(ctx, "dmsetup", release)
+        status = d.runCommand(ctx, "dmsetup", reserve)
+    }
+    if status.status != 0 {
+        return nil, commandError(status, "Cannot reserve metadata snapshot of thin pool " + vg + "/" + pool + ": " + status.stderr)
+    }
+    defer func() {
+        if status := d.runCommand(ctx, "dmsetup", release); status.status != 0 {
+            LoggerFrom(ctx).Warn("Cannot release metadata snapshot of thin pool", "pool", vg + "/" + pool, "error", status.String())
+        }
+    }()
+    args := []string{"--metadata-snap", "--snap1", ids[base], "--snap2", ids[snapshot], d.dmDevice(lvmDmName(vg, pool + "_tmeta"))}
+    status = d.runCommand(ctx, "thin_delta", args)
+    if status.status != 0 {
+        return nil, commandError(status, "Cannot compare " + base + " and " + snapshot + ": " + status.stderr)
+    }
+    return parseThinDelta(status.stdout, size)
+}
+
+type thinDeltaRange struct {
+    XMLName xml.Name
+    Begin int64 `xml:"begin,attr"`
+    Length int64 `xml:"length,attr"`
+}
+
+// parseThinDelta converts the output of thin_delta into the ranges to be
+// written, clipped to the size of the volume. Data is written where the
+// blocks differ or are new, zeros where they were unmapped.
+func parseThinDelta(out string, size int64) ([]deltaExtent, error) {
+    var report struct {
+        DataBlockSize int64 `xml:"data_block_size,attr"`
+        Diff struct {
+            Ranges []thinDeltaRange `xml:",any"`
+        } `xml:"diff"`
+    }
+    if err := xml.Unmarshal([]byte(out), &report); err != nil {
+        return nil, Internal("Cannot parse output of thin_delta: " + err.Error())
+    }
+    if report.DataBlockSize <= 0 {
+        return nil, Internal("Output of thin_delta has no data block size")
+    }
+    block := report.DataBlockSize * sectorSize
+    extents := []deltaExtent{}
+    for _, r := range report.Diff.Ranges {
+        var zero bool
+        switch r.XMLName.Local {
+        case "different", "right_only":
+        case "left_only":
+            zero = true
+        case "same":
+            continue
+        default:
+            return nil, Internal("Unexpected range " + r.XMLName.Local + " in output of thin_delta")
+        }
+        e := deltaExtent{offset: r.Begin * block, length: r.Length * block, zero: zero}
+        if e.offset >= size {
+            continue
+        }
+        if e.offset + e.length > size {
+            e.length = size - e.offset
+        }
+        // adjacent ranges of different and right_only
+        if n := len(extents); n > 0 && extents[n-1].zero == e.zero && extents[n-1].offset + extents[n-1].length == e.offset {
+            extents[n-1].length += e.length
+            continue
+        }
+        extents = append(extents, e)
+    }
+    return extents, nil
+}
+
+// prepareIncremental turns the export of a backup into an incremental one
+// if the volume has a base which can be used; otherwise the backup stays
+// full
+func (d *VolumeDriver) prepareIncremental(ctx context.Context, job *transferJob, info *VolumeInfo, meta *VolumeMetadata) {
+    l := LoggerFrom(ctx).With("volume", job.name)
+    base := meta.BackupBase
+    switch {
+    case base == nil:
+        return
+    case base.Increments + 1 >= meta.Backup.FullEvery:
+        l.Info("Full backup due", "increments", base.Increments)
+        return
+    case base.SizeMB != info.SizeMB:
+        l.Info("Volume was resized, taking a full backup", "base_size_mb", base.SizeMB)
+        return
+    }
+    if _, err := d.GetBackup(ctx, job.name, base.Backup); err != nil {
+        l.Warn("Base backup is not available, taking a full backup", "backup", base.Backup, "error", err)
+        return
+    }
+    delta, err := d.thinDelta(ctx, info.VolumeGroup, info.ThinPool, base.Snapshot, job.snapshot, info.SizeMB * 1024 * 1024)
+    if err != nil {
+        l.Warn("Cannot compute changed blocks, taking a full backup", "error", err)
+        return
+    }
+    job.delta = delta
+    job.header.Format, job.header.Base = TransferFormatDelta, base.Backup
+}
+
+// keepBackupBase keeps the snapshot of a successful backup as base of the
+// next one and removes the previous base
+func (d *VolumeDriver) keepBackupBase(ctx context.Context, job *transferJob, record *BackupRecord) (error) {
+    meta, err := d.loadMetadata(job.name)
+    if err != nil {
+        return Internal("Cannot read metadata of volume " + job.name + ": " + err.Error())
+    }
+    args := []string{"--deltag", exportTag, "--addtag", backupBaseTag, d.getDeviceName(job.snapshot)}
+    if status := d.runCommand(ctx, "lvchange", args); status.status != 0 {
+        return commandError(status, "Cannot keep snapshot " + job.snapshot + " as base of the next backup: " + status.stderr)
+    }
+    previous := meta.BackupBase
+    meta.BackupBase = &BackupBase{Snapshot: job.snapshot, Backup: record.Id, SizeMB: record.SizeMB}
+    if record.Base != "" && previous != nil {
+        meta.BackupBase.Increments = previous.Increments + 1
+    }
+    if err := d.saveMetadata(meta); err != nil {
+        // still tagged for export, removed with the export
+        d.runCommand(ctx, "lvchange", []string{"--deltag", backupBaseTag, "--addtag", exportTag, d.getDeviceName(job.snapshot)})
+        return err
+    }
+    if d.State != nil {
+        if err := d.State.Delete(job.snapshot); err != nil {
+            LoggerFrom(ctx).Warn("Cannot delete metadata of backup base", "snapshot", job.snapshot, "error", err)
+        }
+    }
+    job.snapshot = ""
+    if previous != nil {
+        d.removeBaseSnapshot(ctx, meta.VolumeGroup, previous.Snapshot)
+    }
+    return nil
+}
+
+// removeBackupBase removes the base snapshot of a volume being removed
+func (d *VolumeDriver) removeBackupBase(ctx context.Context, volume string) {
+    if meta, err := d.loadMetadata(volume); err == nil && meta.BackupBase != nil {
+        d.removeBaseSnapshot(ctx, d.volumeGroupOf(volume), meta.BackupBase.Snapshot)
+    }
+}
+
+// removeBaseSnapshot removes a base snapshot; one left over is removed at
+// the next start
+func (d *VolumeDriver) removeBaseSnapshot(ctx context.Context, vg string, snapshot string) {
+    if vg == "" {
+        vg = d.Classes.DefaultClass().VolumeGroup
+    }
+    if status := d.runCommand(ctx, "lvremove", []string{"-f", d.devicePath(vg, snapshot)}); status.status != 0 {
+        LoggerFrom(ctx).Warn("Cannot remove base snapshot of backups", "snapshot", snapshot, "error", status.String())
+    }
+}
+
+// removeOrphanedBases removes the base snapshots, name -> volume group, no
+// volume refers to, e.g. of volumes removed while the daemon was down
+func (d *VolumeDriver) removeOrphanedBases(ctx context.Context, bases map[string]string) {
+    if len(bases) == 0 {
+        return
+    }
+    if d.State != nil {
+        names, err := d.State.Names()
+        if err != nil {
+            LoggerFrom(ctx).Warn("Cannot list volumes, keeping the base snapshots of backups", "error", err)
+            return
+        }
+        for _, name := range names {
+            if meta, err := d.State.Load(name); err == nil && meta != nil && meta.BackupBase != nil {
+                delete(bases, meta.BackupBase.Snapshot)
+            }
+        }
+    }
+    for snapshot, vg := range bases {
+        LoggerFrom(ctx).Warn("Removing base snapshot of backups of a removed volume", "snapshot", snapshot)
+        d.removeBaseSnapshot(ctx, vg, snapshot)
+    }
+}
+
+// writeDelta writes the records of an incremental backup, the data is read
+// from device
+func writeDelta(ctx context.Context, device string, extents []deltaExtent, size int64, out io.Writer) (error) {
+    in, err := os.Open(device)
+    if err != nil {
+        return Internal("Cannot open " + device + ": " + err.Error())
+    }
+    defer in.Close()
+    buf := make([]byte, deltaRecordHeader + transferFrameSize)
+    record := func(kind byte, offset int64, length int64) ([]byte) {
+        buf[0] = kind
+        binary.BigEndian.PutUint64(buf[1:9], uint64(offset))
+        binary.BigEndian.PutUint64(buf[9:deltaRecordHeader], uint64(length))
+        return buf[:deltaRecordHeader]
+    }
+    for _, e := range extents {
+        if ctx.Err() != nil {
+            return newError(CodeCanceled, "Export of " + device + " canceled")
+        }
+        if e.zero {
+            if _, err := out.Write(record(deltaZero, e.offset, e.length)); err != nil {
+                return transferWriteError(err)
+            }
+            continue
+        }
+        for done := int64(0); done < e.length; {
+            n := e.length - done
+            if n > transferFrameSize {
+                n = transferFrameSize
+            }
+            record(deltaData, e.offset + done, n)
+            if _, err := in.ReadAt(buf[deltaRecordHeader:deltaRecordHeader + n], e.offset + done); err != nil {
+                return Internal("Cannot read from " + device + ": " + err.Error())
+            }
+            if _, err := out.Write(buf[:deltaRecordHeader + n]); err != nil {
+                return transferWriteError(err)
+            }
+            done += n
+        }
+    }
+    if _, err := out.Write(record(deltaEnd, 0, size)); err != nil {
+        return transferWriteError(err)
+    }
+    return nil
+}
+
+// applyDelta writes the records of an incremental backup to device
+func applyDelta(ctx context.Context, in io.Reader, device string, size int64) (error) {
+    out, err := os.OpenFile(device, os.O_WRONLY, 0)
+    if err != nil {
+        return Internal("Cannot open " + device + ": " + err.Error())
+    }
+    defer out.Close()
+    header := make([]byte, deltaRecordHeader)
+    buf := make([]byte, transferFrameSize)
+    for {
+        if ctx.Err() != nil {
+            return newError(CodeCanceled, "Import into " + device + " canceled")
+        }
+        if _, err := io.ReadFull(in, header); err != nil {
+            if err == io.EOF {
+                err = io.ErrUnexpectedEOF
+            }
+            return err
+        }
+        offset, length := int64(binary.BigEndian.Uint64(header[1:9])), int64(binary.BigEndian.Uint64(header[9:]))
+        if header[0] == deltaEnd {
+            if length != size {
+                return InvalidArgument("Incremental backup is of a volume of " + strconv.FormatInt(length, 10) + " bytes, not " + strconv.FormatInt(size, 10))
+            }
+            break
+        }
+        if offset < 0 || length < 0 || offset + length > size || offset + length < offset {
+            return InvalidArgument("Corrupt incremental backup, range beyond the end of the volume")
+        }
+        switch header[0] {
+        case deltaData:
+            if length > transferFrameSize {
+                return InvalidArgument("Corrupt incremental backup, record of " + strconv.FormatInt(length, 10) + " bytes")
+            }
+            if _, err := io.ReadFull(in, buf[:length]); err != nil {
+                return err
+            }
+            if _, err := out.WriteAt(buf[:length], offset); err != nil {
+                return Internal("Cannot write to " + device + ": " + err.Error())
+            }
+        case deltaZero:
+            for i := range buf {
+                buf[i] = 0
+            }
+            for done := int64(0); done < length; {
+                n := length - done
+                if n > transferFrameSize {
+                    n = transferFrameSize
+                }
+                if _, err := out.WriteAt(buf[:n], offset + done); err != nil {
+                    return Internal("Cannot write to " + device + ": " + err.Error())
+                }
+                done += n
+            }
+        default:
+            return InvalidArgument("Corrupt incremental backup, unknown record " + strconv.Quote(string(header[:1])))
+        }
+    }
+    if err := out.Sync(); err != nil {
+        return Internal("Cannot sync " + device + ": " + err.Error())
+    }
+    return nil
+}
+
+// startDeltaImport prepares applying an incremental backup to the volume
+// its base backup was imported into
+func (d *VolumeDriver) startDeltaImport(ctx context.Context, name string, options map[string]string, header *ExportHeader) (*transferJob, error) {
+    if len(options) > 0 {
+        return nil, InvalidArgument("Incremental backups are applied to an existing volume, options are not supported")
+    }
+    info, err := d.InspectVolume(ctx, name)
+    if HasCode(err, CodeNotFound) {
+        return nil, NotFound("Volume " + name + " does not exist, import backup " + header.Base + " first")
+    } else if err != nil {
+        return nil, err
+    }
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return nil, Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    if err := checkCloneComplete(meta); err != nil {
+        return nil, err
+    }
+    for _, busy := range []func(string) (error){d.cloneBusy, d.mergeBusy, d.transferBusy} {
+        if err := busy(name); err != nil {
+            return nil, err
+        }
+    }
+    switch {
+    case info.Mounted:
+        return nil, InUse("Volume " + name + " is mounted")
+    case meta.ImportedBackup == "":
+        return nil, InvalidArgument("Incremental backup " + header.Backup + " applies to backup " + header.Base +
+            ", volume " + name + " was not imported from a backup or was mounted since")
+    case meta.ImportedBackup != header.Base:
+        return nil, InvalidArgument("Incremental backup " + header.Backup + " applies to backup " + header.Base +
+            ", volume " + name + " has backup " + meta.ImportedBackup)
+    case info.Encrypted || info.SizeMB != header.SizeMB || info.Filesystem != header.Filesystem:
+        return nil, InvalidArgument("Volume " + name + " does not match the volume of the incremental backup")
+    }
+    meta.Importing = true
+    if err := d.saveMetadata(meta); err != nil {
+        return nil, err
+    }
+    job := &transferJob{name: name, header: *header}
+    d.transfers.add(job)
+    if err := d.openTransfer(ctx, job, false); err != nil {
+        return nil, d.FinishImport(ctx, job, err)
+    }
+    LoggerFrom(ctx).Info("Import of incremental backup started", "volume", name, "backup", header.Backup, "base", header.Base)
+    return job, nil
+}
+
+// leaveBackupChain gives a volume imported from a backup a new filesystem
+// UUID before its first mount, after which no incremental backups can be
+// applied anymore
+func (d *VolumeDriver) leaveBackupChain(ctx context.Context, meta *VolumeMetadata) (error) {
+    if meta.RenewUUID {
+        if err := d.newFilesystemUUID(ctx, meta); err != nil {
+            return err
+        }
+    }
+    meta.RenewUUID, meta.ImportedBackup = false, ""
+    return d.saveMetadata(meta)
+}
+
+// --------------------------------------------------------------------------
+// Backup chains
+// --------------------------------------------------------------------------
+
+// BackupChain lists the backups to import to restore a backup, from the
+// full backup on
+type BackupChain struct {
+    Backups []BackupRecord `json:"backups"`
+    // all backups of the chain are stored
+    Complete bool `json:"complete"`
+    // why the chain is not complete
+    Error string `json:"error,omitempty"`
+}
+
+// BackupChain returns the chain of a backup and verifies that the streams
+// of all its backups are stored and belong to their records
+func (d *VolumeDriver) BackupChain(ctx context.Context, volume string, id string) (*BackupChain, error) {
+    record, err := d.GetBackup(ctx, volume, id)
+    if err != nil {
+        return nil, err
+    }
+    chain := &BackupChain{Backups: []BackupRecord{}}
+    for {
+        chain.Backups = append([]BackupRecord{*record}, chain.Backups...)
+        if err := d.verifyBackupStream(ctx, record); err != nil {
+            chain.Error = err.Error()
+            return chain, nil
+        }
+        if record.Base == "" {
+            chain.Complete = true
+            return chain, nil
+        }
+        base, err := d.GetBackup(ctx, volume, record.Base)
+        if HasCode(err, CodeNotFound) {
+            chain.Error = "Base backup " + record.Base + " of backup " + record.Id + " is missing"
+            return chain, nil
+        } else if err != nil {
+            return nil, err
+        }
+        if !base.Created.Before(record.Created) || base.SizeMB != record.SizeMB {
+            chain.Error = "Backup " + base.Id + " cannot be the base of backup " + record.Id
+            return chain, nil
+        }
+        record = base
+    }
+}
+
+// verifyBackupStream reads the header of the stream of a backup
+func (d *VolumeDriver) verifyBackupStream(ctx context.Context, record *BackupRecord) (error) {
+    key := backupKey(record.Volume, record.Id, backupStreamSuffix)
+    r, err := d.BackupTarget.Get(ctx, key)
+    if HasCode(err, CodeNotFound) {
+        return NotFound("Stream of backup " + record.Id + " is missing")
+    } else if err != nil {
+        return err
+    }
+    defer r.Close()
+    header, err := ReadExportHeader(bufio.NewReader(r))
+    if err != nil {
+        return InvalidArgument("Stream of backup " + record.Id + " is corrupt: " + err.Error())
+    }
+    // streams of backups taken before they had ids in the header
+    if header.Backup == "" && record.Base == "" {
+        return nil
+    }
+    if header.Backup != record.Id || header.Base != record.Base || header.Format != record.Format {
+        return InvalidArgument("Stream of backup " + record.Id + " does not match its record")
+    }
+    return nil
+}
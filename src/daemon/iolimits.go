@@ -0,0 +1,220 @@
+package daemon
+
+import (
+    "context"
+    "errors"
+    "math"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// --------------------------------------------------------------------------
+// I/O limits
+//
+// A volume created with -o read-bps, write-bps, read-iops or write-iops has
+// its bandwidth (bytes per second, e.g. 50M) or operations per second
+// limited, so that a busy volume does not starve the other volumes on the
+// same disks. The limits are cgroup v2 io.max limits of the device holding
+// the filesystem, the device mapper target of encrypted volumes.
+//
+// With --io-cgroup the driver writes the entry of the device into io.max of
+// that cgroup when the volume is mounted and removes it when the volume is
+// unmounted; the cgroup has to contain the containers using the volumes,
+// e.g. /sys/fs/cgroup/system.slice for docker with the systemd cgroup
+// driver, and its parent has to enable the io controller. Without
+// --io-cgroup the entry is only reported in Status while the volume is
+// mounted, for the container runtime to apply, e.g. with docker run
+// --device-read-bps. Device numbers change with every activation, so the
+// entry is built at mount.
+// --------------------------------------------------------------------------
+
+const (
+    ReadBPSOption = "read-bps"
+    WriteBPSOption = "write-bps"
+    ReadIOPSOption = "read-iops"
+    WriteIOPSOption = "write-iops"
+
+    ioMaxFile = "io.max"
+    // value of io.max without limit
+    ioMaxUnlimited = "max"
+)
+
+// IOLimits are the limits of the I/O of a volume per second, 0 is unlimited
+type IOLimits struct {
+    ReadBPS int64 `json:"read_bps,omitempty"`
+    WriteBPS int64 `json:"write_bps,omitempty"`
+    ReadIOPS int64 `json:"read_iops,omitempty"`
+    WriteIOPS int64 `json:"write_iops,omitempty"`
+}
+
+// IOController applies io.max entries, "<major>:<minor> rbps=<n> ...", like
+// the io.max file of a cgroup v2: keys not given keep their value, and an
+// entry with all keys max removes the limits of the device.
+type IOController interface {
+    SetIOMax(ctx context.Context, entry string) (error)
+}
+
+// CgroupIOController writes io.max of a cgroup v2 directory
+type CgroupIOController struct {
+    Dir string
+}
+
+// NewCgroupIOController checks that the io controller is enabled for the
+// cgroup directory
+func NewCgroupIOController(dir string) (*CgroupIOController, error) {
+    if _, err := os.Stat(filepath.Join(dir, ioMaxFile)); err != nil {
+        return nil, errors.New("Cgroup " + dir + " has no " + ioMaxFile + ", is it a cgroup v2 directory whose parent enables the io controller? " + err.Error())
+    }
+    return &CgroupIOController{Dir: dir}, nil
+}
+
+func (c *CgroupIOController) SetIOMax(ctx context.Context, entry string) (error) {
+    // the kernel takes one entry per write
+    f, err := os.OpenFile(filepath.Join(c.Dir, ioMaxFile), os.O_WRONLY, 0)
+    if err != nil {
+        return err
+    }
+    if _, err := f.WriteString(entry); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+var bandwidthPattern = regexp.MustCompile("(?i)^([0-9]+)\\s*([KMG])?B?(/s)?$")
+
+var deviceNumberPattern = regexp.MustCompile("^[0-9]+:[0-9]+$")
+
+// parseBandwidth converts a bandwidth given as option (e.g. "1048576",
+// "512K", "50M") into bytes per second
+func parseBandwidth(option string, s string) (int64, error) {
+    m := bandwidthPattern.FindStringSubmatch(strings.TrimSpace(s))
+    if m == nil {
+        return 0, InvalidArgument("Illegal value " + s + " for option " + option + ", expected <number>[K|M|G] bytes per second")
+    }
+    v, err := strconv.ParseInt(m[1], 10, 64)
+    if err != nil || v <= 0 {
+        return 0, InvalidArgument("Illegal value " + s + " for option " + option + ", expected <number>[K|M|G] bytes per second")
+    }
+    multiplier := int64(1)
+    switch strings.ToUpper(m[2]) {
+    case "K":
+        multiplier = 1024
+    case "M":
+        multiplier = 1024 * 1024
+    case "G":
+        multiplier = 1024 * 1024 * 1024
+    }
+    if v > math.MaxInt64 / multiplier {
+        return 0, InvalidArgument("Value " + s + " for option " + option + " is too large")
+    }
+    return v * multiplier, nil
+}
+
+// parseIOLimits returns the I/O limits given by the options, nil if the
+// volume is not limited
+func parseIOLimits(options map[string]string) (*IOLimits, error) {
+    l := &IOLimits{}
+    for _, o := range []struct {
+        name string
+        value *int64
+    }{{ReadBPSOption, &l.ReadBPS}, {WriteBPSOption, &l.WriteBPS}} {
+        if val, ok := options[o.name]; ok {
+            v, err := parseBandwidth(o.name, val)
+            if err != nil {
+                return nil, err
+            }
+            *o.value = v
+        }
+    }
+    for _, o := range []struct {
+        name string
+        value *int64
+    }{{ReadIOPSOption, &l.ReadIOPS}, {WriteIOPSOption, &l.WriteIOPS}} {
+        if val, ok := options[o.name]; ok {
+            v, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+            if err != nil || v <= 0 {
+                return nil, InvalidArgument("Illegal value " + val + " for option " + o.name + ", expected a positive number of operations per second")
+            }
+            *o.value = v
+        }
+    }
+    if *l == (IOLimits{}) {
+        return nil, nil
+    }
+    return l, nil
+}
+
+// ioMaxValue returns a limit as value of io.max
+func ioMaxValue(v int64) (string) {
+    if v == 0 {
+        return ioMaxUnlimited
+    }
+    return strconv.FormatInt(v, 10)
+}
+
+// ioMaxEntry returns the io.max entry of the limits of a device
+func ioMaxEntry(device string, l *IOLimits) (string) {
+    return device + " rbps=" + ioMaxValue(l.ReadBPS) + " wbps=" + ioMaxValue(l.WriteBPS) +
+        " riops=" + ioMaxValue(l.ReadIOPS) + " wiops=" + ioMaxValue(l.WriteIOPS)
+}
+
+// deviceNumber returns major:minor of a block device
+func (d *VolumeDriver) deviceNumber(ctx context.Context, device string) (string, error) {
+    status := d.runCommand(ctx, "lsblk", []string{"--nodeps", "--noheadings", "--output=MAJ:MIN", device})
+    if status.status != 0 {
+        return "", commandError(status, "Cannot get the device number of " + device + ": " + status.stderr)
+    }
+    number := strings.TrimSpace(status.stdout)
+    if !deviceNumberPattern.MatchString(number) {
+        return "", Internal("Unexpected device number " + number + " of " + device)
+    }
+    return number, nil
+}
+
+// applyIOLimits builds the io.max entry of a volume about to be mounted on
+// device, applies it if the driver has an I/O controller and records it in
+// the metadata
+func (d *VolumeDriver) applyIOLimits(ctx context.Context, meta *VolumeMetadata, device string) (error) {
+    if meta.IOLimits == nil {
+        return nil
+    }
+    number, err := d.deviceNumber(ctx, device)
+    if err != nil {
+        return err
+    }
+    entry := ioMaxEntry(number, meta.IOLimits)
+    if d.IOController != nil {
+        if err := d.IOController.SetIOMax(ctx, entry); err != nil {
+            return Internal("Cannot limit the I/O of volume " + meta.Name + ": " + err.Error())
+        }
+        LoggerFrom(ctx).Info("I/O of volume limited", "volume", meta.Name, "io_max", entry)
+    }
+    meta.IOMax = entry
+    if err := d.saveMetadata(meta); err != nil {
+        d.clearIOLimits(ctx, meta)
+        return err
+    }
+    return nil
+}
+
+// clearIOLimits removes the io.max entry of a volume, whose device has to
+// exist still. Failures are logged only, the entry goes with the device.
+func (d *VolumeDriver) clearIOLimits(ctx context.Context, meta *VolumeMetadata) {
+    if meta.IOMax == "" {
+        return
+    }
+    if d.IOController != nil {
+        number := strings.Fields(meta.IOMax)[0]
+        if err := d.IOController.SetIOMax(ctx, ioMaxEntry(number, &IOLimits{})); err != nil {
+            LoggerFrom(ctx).Warn("Cannot remove the I/O limits of volume", "volume", meta.Name, "error", err)
+        }
+    }
+    meta.IOMax = ""
+    if err := d.saveMetadata(meta); err != nil {
+        LoggerFrom(ctx).Warn("Cannot save metadata of volume", "volume", meta.Name, "error", err)
+    }
+}
@@ -0,0 +1,162 @@
+package daemon
+
+import (
+    "context"
+    "crypto/rand"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+// --------------------------------------------------------------------------
+// Key providers
+//
+// The keys of encrypted volumes are not kept by the driver itself but by a
+// KeyProvider, so that they can live in an external key management system.
+// A key is identified by the name of the volume it belongs to. The keys are
+// used as LUKS key files, i.e. they are raw bytes and not passphrases.
+// --------------------------------------------------------------------------
+
+const (
+    KeyProviderNone = "none"
+    KeyProviderFile = "file"
+    // size of generated keys in bytes, the maximum of a LUKS2 volume key
+    keySize = 64
+    keyFileSuffix = ".key"
+)
+
+type KeyProvider interface {
+    // NewKey generates and stores a key for a new volume; it fails if the
+    // volume has a key already
+    NewKey(ctx context.Context, name string) ([]byte, error)
+    // Key returns the key of a volume
+    Key(ctx context.Context, name string) ([]byte, error)
+    // CopyKey stores the key of volume from for volume to as well, e.g. for
+    // a snapshot, which has the LUKS header of its origin
+    CopyKey(ctx context.Context, from string, to string) (error)
+    // DeleteKey destroys the key of a volume; deleting a missing key is no
+    // error
+    DeleteKey(ctx context.Context, name string) (error)
+}
+
+// FileKeyProvider keeps every key in a file <dir>/<volume>.key which is only
+// accessible by root
+type FileKeyProvider struct {
+    Dir string
+}
+
+func NewFileKeyProvider(dir string) (*FileKeyProvider, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    // the directory may have been created by hand with a wider mode
+    if err := os.Chmod(dir, 0700); err != nil {
+        return nil, err
+    }
+    return &FileKeyProvider{Dir: dir}, nil
+}
+
+func (p *FileKeyProvider) keyFile(name string) (string) {
+    return filepath.Join(p.Dir, name + keyFileSuffix)
+}
+
+// storeKey writes a key which must not exist yet
+func (p *FileKeyProvider) storeKey(name string, key []byte) (error) {
+    f, err := os.OpenFile(p.keyFile(name), os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+    if err != nil {
+        if os.IsExist(err) {
+            return AlreadyExists("Key of volume " + name + " exists already")
+        }
+        return Internal("Cannot store key of volume " + name + ": " + err.Error())
+    }
+    if _, err := f.Write(key); err == nil {
+        err = f.Sync()
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        os.Remove(p.keyFile(name))
+        return Internal("Cannot store key of volume " + name + ": " + err.Error())
+    }
+    return nil
+}
+
+func (p *FileKeyProvider) NewKey(ctx context.Context, name string) ([]byte, error) {
+    key := make([]byte, keySize)
+    if _, err := rand.Read(key); err != nil {
+        return nil, Internal("Cannot generate key: " + err.Error())
+    }
+    if err := p.storeKey(name, key); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+func (p *FileKeyProvider) Key(ctx context.Context, name string) ([]byte, error) {
+    key, err := ioutil.ReadFile(p.keyFile(name))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, NotFound("No key for volume " + name)
+        }
+        return nil, Internal("Cannot read key of volume " + name + ": " + err.Error())
+    }
+    return key, nil
+}
+
+func (p *FileKeyProvider) CopyKey(ctx context.Context, from string, to string) (error) {
+    key, err := p.Key(ctx, from)
+    if err != nil {
+        return err
+    }
+    return p.storeKey(to, key)
+}
+
+// DeleteKey overwrites the key file before removing it, so that the key
+// cannot be recovered from the file system
+func (p *FileKeyProvider) DeleteKey(ctx context.Context, name string) (error) {
+    path := p.keyFile(name)
+    fi, err := os.Stat(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return Internal("Cannot delete key of volume " + name + ": " + err.Error())
+    }
+    if err := ioutil.WriteFile(path, make([]byte, fi.Size()), 0600); err != nil {
+        return Internal("Cannot delete key of volume " + name + ": " + err.Error())
+    }
+    if err := os.Remove(path); err != nil {
+        return Internal("Cannot delete key of volume " + name + ": " + err.Error())
+    }
+    return nil
+}
+
+// Check verifies that the key directory is accessible
+func (p *FileKeyProvider) Check() (error) {
+    fi, err := os.Stat(p.Dir)
+    if err != nil {
+        return err
+    }
+    if !fi.IsDir() {
+        return errors.New(p.Dir + " is not a directory")
+    }
+    return checkWritable(p.Dir)
+}
+
+// NewKeyProvider creates the key provider selected by name; nil is returned
+// for "none", which disables encryption
+func NewKeyProvider(name string, dir string) (KeyProvider, error) {
+    switch name {
+    case "", KeyProviderNone:
+        return nil, nil
+    case KeyProviderFile:
+        p, err := NewFileKeyProvider(dir)
+        if err != nil {
+            return nil, err
+        }
+        return p, nil
+    }
+    return nil, errors.New("Unknown key provider " + name + ", expected none or file")
+}
@@ -0,0 +1,79 @@
+package daemon
+
+import (
+    "bytes"
+    "strings"
+    "sync"
+)
+
+// --------------------------------------------------------------------------
+// Log buffer
+//
+// LogBuffer keeps the most recent log lines in memory so that operators can
+// read them through the admin API without access to the journal of the host.
+// It is used as an additional output of the logger.
+// --------------------------------------------------------------------------
+
+const DefaultLogBufferLines = 1000
+
+type LogBuffer struct {
+    m sync.Mutex
+    lines []string
+    // index of the oldest line once the buffer is full
+    next int
+    full bool
+    // incomplete line of the last write
+    partial []byte
+}
+
+func NewLogBuffer(size int) (*LogBuffer) {
+    if size <= 0 {
+        size = DefaultLogBufferLines
+    }
+    return &LogBuffer{lines: make([]string, size)}
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+    b.m.Lock()
+    defer b.m.Unlock()
+    data := append(b.partial, p...)
+    for {
+        i := bytes.IndexByte(data, '\n')
+        if i < 0 {
+            break
+        }
+        b.add(string(data[:i]))
+        data = data[i+1:]
+    }
+    b.partial = append([]byte(nil), data...)
+    return len(p), nil
+}
+
+func (b *LogBuffer) add(line string) {
+    b.lines[b.next] = line
+    b.next = (b.next + 1) % len(b.lines)
+    if b.next == 0 {
+        b.full = true
+    }
+}
+
+// Lines returns up to n of the most recent lines containing filter, oldest
+// first. n <= 0 returns all matching lines.
+func (b *LogBuffer) Lines(n int, filter string) ([]string) {
+    b.m.Lock()
+    defer b.m.Unlock()
+    all := b.lines[:b.next]
+    if b.full {
+        all = append(append([]string{}, b.lines[b.next:]...), b.lines[:b.next]...)
+    }
+    result := []string{}
+    for _, line := range all {
+        if filter == "" || strings.Contains(line, filter) {
+            result = append(result, line)
+        }
+    }
+    if n > 0 && len(result) > n {
+        result = result[len(result)-n:]
+    }
+    return result
+}
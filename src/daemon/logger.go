@@ -0,0 +1,221 @@
+package daemon
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Structured logger
+//
+// Every log line is a message plus a set of key/value fields. Lines are
+// written either as JSON objects (one per line) or in logfmt. Loggers derived
+// with With() share the output and the level of their parent.
+// --------------------------------------------------------------------------
+
+type LogLevel int
+
+const (
+    LevelDebug LogLevel = iota
+    LevelInfo
+    LevelWarn
+    LevelError
+)
+
+const (
+    LogFormatJson = "json"
+    LogFormatLogfmt = "logfmt"
+    RequestIdHeader = "X-Request-Id"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() (string) {
+    if l >= LevelDebug && l <= LevelError {
+        return levelNames[l]
+    }
+    return "level" + strconv.Itoa(int(l))
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+    for i, v := range levelNames {
+        if strings.EqualFold(s, v) {
+            return LogLevel(i), nil
+        }
+    }
+    return LevelInfo, errors.New("Unknown log level " + s + ", expected one of " + strings.Join(levelNames, ", "))
+}
+
+type loggerOutput struct {
+    m sync.Mutex
+    out io.Writer
+    format string
+    level LogLevel
+}
+
+type Logger struct {
+    output *loggerOutput
+    fields []interface{}
+}
+
+func NewLogger(out io.Writer, format string, level LogLevel) (*Logger, error) {
+    if format != LogFormatJson && format != LogFormatLogfmt {
+        return nil, errors.New("Unknown log format " + format + ", expected json or logfmt")
+    }
+    return &Logger{output: &loggerOutput{out: out, format: format, level: level}}, nil
+}
+
+// With returns a logger which adds the given key/value pairs to every line.
+func (l *Logger) With(kv ...interface{}) (*Logger) {
+    fields := make([]interface{}, 0, len(l.fields) + len(kv))
+    fields = append(fields, l.fields...)
+    fields = append(fields, kv...)
+    return &Logger{output: l.output, fields: fields}
+}
+
+func (l *Logger) Enabled(level LogLevel) (bool) {
+    return level >= l.output.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level LogLevel, msg string, kv []interface{}) {
+    if !l.Enabled(level) {
+        return
+    }
+    all := make([]interface{}, 0, 6 + len(l.fields) + len(kv))
+    all = append(all, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+    all = append(all, l.fields...)
+    all = append(all, kv...)
+
+    var line string
+    if l.output.format == LogFormatJson {
+        line = formatJson(all)
+    } else {
+        line = formatLogfmt(all)
+    }
+    l.output.m.Lock()
+    defer l.output.m.Unlock()
+    io.WriteString(l.output.out, line + "\n")
+}
+
+func fieldValue(v interface{}) (interface{}) {
+    switch t := v.(type) {
+    case error:
+        return t.Error()
+    case fmt.Stringer:
+        return t.String()
+    case time.Duration:
+        return t.String()
+    }
+    return v
+}
+
+func formatJson(kv []interface{}) (string) {
+    var b strings.Builder
+    b.WriteString("{")
+    for i := 0; i < len(kv); i += 2 {
+        if i > 0 {
+            b.WriteString(",")
+        }
+        key, _ := json.Marshal(fmt.Sprint(kv[i]))
+        var value interface{} = "(missing)"
+        if i + 1 < len(kv) {
+            value = fieldValue(kv[i+1])
+        }
+        val, err := json.Marshal(value)
+        if err != nil {
+            val, _ = json.Marshal(fmt.Sprint(value))
+        }
+        b.Write(key)
+        b.WriteString(":")
+        b.Write(val)
+    }
+    b.WriteString("}")
+    return b.String()
+}
+
+func formatLogfmt(kv []interface{}) (string) {
+    parts := make([]string, 0, len(kv) / 2 + 1)
+    for i := 0; i < len(kv); i += 2 {
+        var value interface{} = "(missing)"
+        if i + 1 < len(kv) {
+            value = fieldValue(kv[i+1])
+        }
+        parts = append(parts, fmt.Sprint(kv[i]) + "=" + logfmtQuote(fmt.Sprint(value)))
+    }
+    return strings.Join(parts, " ")
+}
+
+func logfmtQuote(s string) (string) {
+    if s == "" || strings.ContainsAny(s, " =\"\t\r\n\\") {
+        return strconv.Quote(s)
+    }
+    return s
+}
+
+// --------------------------------------------------------------------------
+// Default logger and request scoped loggers
+// --------------------------------------------------------------------------
+
+var defaultLogger, _ = NewLogger(os.Stderr, LogFormatLogfmt, LevelInfo)
+
+func SetDefaultLogger(l *Logger) {
+    defaultLogger = l
+}
+
+func DefaultLogger() (*Logger) {
+    return defaultLogger
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying the given logger.
+func WithLogger(ctx context.Context, l *Logger) (context.Context) {
+    return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the logger attached to the context or the default
+// logger if there is none.
+func LoggerFrom(ctx context.Context) (*Logger) {
+    if ctx != nil {
+        if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+            return l
+        }
+    }
+    return defaultLogger
+}
+
+type requestIdKey struct{}
+
+func WithRequestId(ctx context.Context, id string) (context.Context) {
+    return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+func RequestIdFrom(ctx context.Context) (string) {
+    if id, ok := ctx.Value(requestIdKey{}).(string); ok {
+        return id
+    }
+    return ""
+}
+
+func NewRequestId() (string) {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return strconv.FormatInt(time.Now().UnixNano(), 16)
+    }
+    return hex.EncodeToString(b)
+}
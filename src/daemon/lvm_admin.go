@@ -0,0 +1,446 @@
+package daemon
+
+import (
+    "bufio"
+    "context"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Volume operations beyond the docker volume plugin protocol, used by the
+// admin API
+// --------------------------------------------------------------------------
+
+const (
+    lvsSeparator = "|"
+    // segment type of thin pools, which are no volumes
+    segtypeThinPool = "thin-pool"
+)
+
+type VolumeInfo struct {
+    Name string `json:"name"`
+    SizeMB int64 `json:"size_mb"`
+    Mounted bool `json:"mounted"`
+    Mountpoint string `json:"mountpoint,omitempty"`
+    Device string `json:"device"`
+    // name of the origin volume for snapshots
+    Origin string `json:"origin,omitempty"`
+    Created *time.Time `json:"created,omitempty"`
+    Options map[string]string `json:"options,omitempty"`
+    Encrypted bool `json:"encrypted"`
+    MountOptions []string `json:"mount_options"`
+    ReadOnly bool `json:"readonly"`
+    // result of the last filesystem check
+    Fsck *FsckResult `json:"fsck,omitempty"`
+    AutoGrow *AutoGrowPolicy `json:"autogrow,omitempty"`
+    // empty for logical volumes in no class
+    Class string `json:"class,omitempty"`
+    VolumeGroup string `json:"volume_group"`
+    ThinPool string `json:"thin_pool,omitempty"`
+    Filesystem string `json:"filesystem"`
+    // source and progress of clones
+    Clone *CloneStatus `json:"clone,omitempty"`
+    // snapshot being merged into this volume
+    Merge *MergeStatus `json:"merge,omitempty"`
+    // set for snapshots being merged into their origin
+    Merging bool `json:"merging,omitempty"`
+    // set while the volume is being imported
+    Importing bool `json:"importing,omitempty"`
+    Backup *BackupPolicy `json:"backup,omitempty"`
+    LastBackup *BackupStatus `json:"last_backup,omitempty"`
+    // backup the volume was restored to, incremental backups based on it
+    // can be imported until the volume is mounted
+    ImportedBackup string `json:"imported_backup,omitempty"`
+    // freeze and hook around snapshots
+    Quiesce *QuiescePolicy `json:"quiesce,omitempty"`
+    // limits of the I/O, and the io.max entry of the device while mounted
+    IOLimits *IOLimits `json:"io_limits,omitempty"`
+    IOMax string `json:"io_max,omitempty"`
+    // layout, sync and health of RAID and striped volumes
+    Raid *RaidStatus `json:"raid,omitempty"`
+    // backup from the catalog the volume was restored from
+    RestoredFrom *RestoreInfo `json:"restored_from,omitempty"`
+}
+
+type VolumeGroupInfo struct {
+    Name string `json:"name"`
+    SizeMB int64 `json:"size_mb"`
+    FreeMB int64 `json:"free_mb"`
+    PvCount int `json:"pv_count"`
+    LvCount int `json:"lv_count"`
+    // removed volumes whose extents are released once they are wiped
+    PendingWipes int `json:"pending_wipes"`
+}
+
+type ReconcileReport struct {
+    DryRun bool `json:"dry_run"`
+    // metadata of volumes which do not exist anymore
+    MetadataRemoved []string `json:"metadata_removed"`
+    // volumes without metadata, e.g. created by hand or by older versions
+    MetadataCreated []string `json:"metadata_created"`
+    // mountpoint directories of volumes which are not mounted
+    MountpointsRemoved []string `json:"mountpoints_removed"`
+}
+
+// parseMegabytes parses a size reported by LVM with --units m --nosuffix
+func parseMegabytes(s string) (int64) {
+    f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+    if err != nil {
+        return 0
+    }
+    return int64(f + 0.5)
+}
+
+// lvsReport runs lvs for the volume groups of all storage classes and
+// returns one map per logical volume with the requested fields and vg_name
+// and pool_lv. Sizes are reported in megabytes. Volumes waiting to be wiped,
+// snapshots of running exports, bases of incremental backups and thin pools
+// are left out. Names are unique across volume groups; of
+// logical volumes with the same name in several volume groups, e.g. created
+// by hand, only the first is reported.
+func (d *VolumeDriver) lvsReport(ctx context.Context, fields []string) ([]map[string]string, error) {
+    fields = append(fields, "vg_name", "pool_lv", "segtype", "lv_tags")
+    report := []map[string]string{}
+    seen := make(map[string]string)
+    for _, vg := range d.Classes.VolumeGroups() {
+        args := []string{"--noheadings", "--units", "m", "--nosuffix", "--separator", lvsSeparator, "-o", strings.Join(fields, ","), vg}
+        status := d.runCommand(ctx, "lvs", args)
+        if status.status != 0 {
+            return nil, commandError(status, status.String())
+        }
+        in := bufio.NewScanner(strings.NewReader(status.stdout))
+        for in.Scan() {
+            line := strings.TrimSpace(in.Text())
+            if line == "" {
+                continue
+            }
+            values := strings.Split(line, lvsSeparator)
+            row := make(map[string]string)
+            for i, f := range fields {
+                if i < len(values) {
+                    row[f] = strings.TrimSpace(values[i])
+                }
+            }
+            if hasWipeTag(row["lv_tags"]) || hasTag(row["lv_tags"], exportTag) || hasTag(row["lv_tags"], backupBaseTag) ||
+                row["segtype"] == segtypeThinPool {
+                continue
+            }
+            if other, ok := seen[row["lv_name"]]; ok {
+                LoggerFrom(ctx).Warn("Ignoring logical volume with the name of a volume in another volume group",
+                    "volume", row["lv_name"], "vg", vg, "other_vg", other)
+                continue
+            }
+            seen[row["lv_name"]] = vg
+            report = append(report, row)
+        }
+    }
+    return report, nil
+}
+
+func (d *VolumeDriver) volumeInfos(ctx context.Context) ([]VolumeInfo, error) {
+    mounted, err := d.getMountedVolumes(ctx)
+    if err != nil {
+        return nil, err
+    }
+    mmap := arrayToMap(*mounted)
+    report, err := d.lvsReport(ctx, append([]string{"lv_name", "lv_size", "origin", "lv_merging"}, raidReportFields...))
+    if err != nil {
+        return nil, err
+    }
+    infos := []VolumeInfo{}
+    for _, row := range report {
+        name := row["lv_name"]
+        info := VolumeInfo{
+            Name: name,
+            SizeMB: parseMegabytes(row["lv_size"]),
+            Device: d.devicePath(row["vg_name"], name),
+            Origin: row["origin"],
+            Merging: row["lv_merging"] != "",
+            VolumeGroup: row["vg_name"],
+            ThinPool: row["pool_lv"],
+            Filesystem: DEFAULT_FILESYSTEM,
+        }
+        if class := d.Classes.classFor(info.VolumeGroup, info.ThinPool); class != nil {
+            info.Class = class.Name
+        }
+        if mmap[name] {
+            info.Mounted = true
+            info.Mountpoint = d.getMountpoint(name)
+        }
+        if meta, err := d.loadMetadata(name); err == nil && meta != nil {
+            if !meta.Created.IsZero() {
+                created := meta.Created
+                info.Created = &created
+            }
+            info.Options = meta.Options
+            info.Encrypted = meta.Encrypted
+            info.MountOptions = d.mountOptions(meta)
+            info.ReadOnly = meta.ReadOnly
+            info.Fsck = meta.Fsck
+            info.AutoGrow = meta.AutoGrow
+            info.Filesystem = filesystemOf(meta)
+            info.Clone = d.cloneStatus(meta)
+            info.Merge = meta.Merge
+            info.Importing = meta.Importing
+            info.Backup = meta.Backup
+            info.LastBackup = meta.LastBackup
+            info.ImportedBackup = meta.ImportedBackup
+            info.RestoredFrom = meta.RestoredFrom
+            info.Quiesce = meta.Quiesce
+            info.IOLimits = meta.IOLimits
+            info.IOMax = meta.IOMax
+            if meta.Raid != nil {
+                info.Raid = newRaidStatus(meta.Raid, row)
+            }
+            if meta.Class != "" {
+                info.Class = meta.Class
+            }
+        }
+        infos = append(infos, info)
+    }
+    sort.Slice(infos, func(i, j int) (bool) { return infos[i].Name < infos[j].Name })
+    return infos, nil
+}
+
+func (d *VolumeDriver) ListVolumeInfos(ctx context.Context) ([]VolumeInfo, error) {
+    return d.volumeInfos(ctx)
+}
+
+func (d *VolumeDriver) InspectVolume(ctx context.Context, name string) (*VolumeInfo, error) {
+    if err := validateName(name); err != nil {
+        return nil, err
+    }
+    infos, err := d.volumeInfos(ctx)
+    if err != nil {
+        return nil, err
+    }
+    for _, info := range infos {
+        if info.Name == name {
+            return &info, nil
+        }
+    }
+    return nil, NotFound("Volume " + name + " does not exist")
+}
+
+// ResizeVolume grows the volume and its filesystem to the given size in
+// megabytes. Shrinking is not supported.
+func (d *VolumeDriver) ResizeVolume(ctx context.Context, name string, size int) (error) {
+    info, err := d.InspectVolume(ctx, name)
+    if err != nil {
+        return err
+    }
+    if int64(size) < info.SizeMB {
+        return InvalidArgument("Volume " + name + " has " + strconv.FormatInt(info.SizeMB, 10) + "MB, shrinking is not supported")
+    }
+    if int64(size) == info.SizeMB {
+        return nil
+    }
+    if err := d.cloneBusy(name); err != nil {
+        return err
+    }
+    if err := d.mergeBusy(name); err != nil {
+        return err
+    }
+    if err := d.transferBusy(name); err != nil {
+        return err
+    }
+    if info.Encrypted {
+        return InvalidArgument("Volume " + name + " is encrypted, resizing encrypted volumes is not supported")
+    }
+    if class := d.Classes.Get(info.Class); class != nil && class.MaxSizeMB > 0 && size > class.MaxSizeMB {
+        return InvalidArgument("Volumes of storage class " + class.Name + " are limited to " + strconv.Itoa(class.MaxSizeMB) + "MB")
+    }
+    LoggerFrom(ctx).Info("Resizing volume", "volume", name, "from_mb", info.SizeMB, "to_mb", size)
+    status := d.runCommand(ctx, "lvextend", []string{"-r", "-L", strconv.Itoa(size) + "M", d.getDeviceName(name)})
+    if status.status != 0 {
+        return commandError(status, "Cannot resize volume " + name + ": " + status.stderr)
+    }
+    return nil
+}
+
+// CreateSnapshot creates a copy-on-write snapshot of a volume. The snapshot
+// can hold sizeMB megabytes of changes; if zero the size of the origin is
+// used, so that the snapshot can never overflow.
+func (d *VolumeDriver) CreateSnapshot(ctx context.Context, origin string, name string, sizeMB int) (error) {
+    if err := validateName(name); err != nil {
+        return err
+    }
+    info, err := d.InspectVolume(ctx, origin)
+    if err != nil {
+        return err
+    }
+    if err := d.cloneBusy(origin); err != nil {
+        return err
+    }
+    if err := d.mergeBusy(origin); err != nil {
+        return err
+    }
+    if err := d.transferBusy(origin); err != nil {
+        return err
+    }
+    if exists, err := d.existsVolume(ctx, name); err != nil {
+        return err
+    } else if exists {
+        return AlreadyExists("Volume " + name + " already exists")
+    }
+    if sizeMB == 0 {
+        sizeMB = int(info.SizeMB)
+    }
+    originMeta, err := d.loadMetadata(origin)
+    if err != nil {
+        return Internal("Cannot read metadata of volume " + origin + ": " + err.Error())
+    }
+    if info.Encrypted {
+        // the snapshot has the LUKS header of its origin and needs its key
+        if err := d.requireKeyProvider(); err != nil {
+            return err
+        }
+        if err := d.KeyProvider.CopyKey(ctx, origin, name); err != nil {
+            return err
+        }
+    }
+    LoggerFrom(ctx).Info("Creating snapshot", "volume", origin, "snapshot", name, "size_mb", sizeMB)
+    err = d.quiesced(ctx, info, originMeta, func(ctx context.Context) (error) {
+        status := d.runCommand(ctx, "lvcreate", []string{"-s", "-L", strconv.Itoa(sizeMB) + "M", "-n", name, info.VolumeGroup + "/" + origin})
+        if status.status != 0 {
+            return commandError(status, "Cannot create snapshot " + name + " of volume " + origin + ": " + status.stderr)
+        }
+        return nil
+    })
+    if err != nil {
+        if info.Encrypted {
+            if err := d.KeyProvider.DeleteKey(ctx, name); err != nil {
+                LoggerFrom(ctx).Warn("Cannot delete key of volume", "volume", name, "error", err)
+            }
+        }
+        return err
+    }
+    // the snapshot is mounted like its origin
+    return d.saveMetadata(&VolumeMetadata{
+        Name: name,
+        Created: time.Now().UTC(),
+        Origin: origin,
+        Encrypted: info.Encrypted,
+        MountOptions: originMeta.MountOptions,
+        ReadOnly: originMeta.ReadOnly,
+        // a snapshot takes space in the volume group, not in a thin pool
+        Class: info.Class,
+        VolumeGroup: info.VolumeGroup,
+        Filesystem: originMeta.Filesystem,
+    })
+}
+
+func (d *VolumeDriver) ListSnapshots(ctx context.Context, origin string) ([]VolumeInfo, error) {
+    if _, err := d.InspectVolume(ctx, origin); err != nil {
+        return nil, err
+    }
+    infos, err := d.volumeInfos(ctx)
+    if err != nil {
+        return nil, err
+    }
+    snapshots := []VolumeInfo{}
+    for _, info := range infos {
+        if info.Origin == origin {
+            snapshots = append(snapshots, info)
+        }
+    }
+    return snapshots, nil
+}
+
+func (d *VolumeDriver) VolumeGroupInfo(ctx context.Context, vg string) (*VolumeGroupInfo, error) {
+    args := []string{"--noheadings", "--units", "m", "--nosuffix", "--separator", lvsSeparator,
+        "-o", "vg_name,vg_size,vg_free,pv_count,lv_count", vg}
+    status := d.runCommand(ctx, "vgs", args)
+    if status.status != 0 {
+        return nil, commandError(status, status.String())
+    }
+    values := strings.Split(strings.TrimSpace(status.stdout), lvsSeparator)
+    if len(values) < 5 {
+        return nil, Internal("Unexpected output of vgs: " + status.stdout)
+    }
+    pvs, _ := strconv.Atoi(strings.TrimSpace(values[3]))
+    lvs, _ := strconv.Atoi(strings.TrimSpace(values[4]))
+    return &VolumeGroupInfo{
+        Name: strings.TrimSpace(values[0]),
+        SizeMB: parseMegabytes(values[1]),
+        FreeMB: parseMegabytes(values[2]),
+        PvCount: pvs,
+        LvCount: lvs,
+        PendingWipes: d.PendingWipes(vg),
+    }, nil
+}
+
+// Reconcile brings the metadata of the driver in line with the logical
+// volumes and removes mountpoint directories left behind.
+func (d *VolumeDriver) Reconcile(ctx context.Context, dryRun bool) (*ReconcileReport, error) {
+    l := LoggerFrom(ctx)
+    report := &ReconcileReport{DryRun: dryRun, MetadataRemoved: []string{}, MetadataCreated: []string{}, MountpointsRemoved: []string{}}
+    infos, err := d.volumeInfos(ctx)
+    if err != nil {
+        return nil, err
+    }
+    existing := make(map[string]VolumeInfo)
+    for _, info := range infos {
+        existing[info.Name] = info
+    }
+
+    if d.State != nil {
+        names, err := d.State.Names()
+        if err != nil {
+            return nil, Internal("Cannot read state directory: " + err.Error())
+        }
+        known := arrayToMap(names)
+        for _, name := range names {
+            // export snapshots are hidden, but have metadata
+            if _, ok := existing[name]; !ok && !d.transferring(name) {
+                report.MetadataRemoved = append(report.MetadataRemoved, name)
+                if !dryRun {
+                    l.Info("Removing metadata of missing volume", "volume", name)
+                    if err := d.State.Delete(name); err != nil {
+                        return nil, Internal("Cannot remove metadata of volume " + name + ": " + err.Error())
+                    }
+                }
+            }
+        }
+        for _, info := range infos {
+            if !known[info.Name] {
+                report.MetadataCreated = append(report.MetadataCreated, info.Name)
+                if !dryRun {
+                    l.Info("Creating metadata for volume", "volume", info.Name)
+                    meta := &VolumeMetadata{Name: info.Name, Created: time.Now().UTC(), Origin: info.Origin,
+                        Class: info.Class, VolumeGroup: info.VolumeGroup, ThinPool: info.ThinPool}
+                    if err := d.saveMetadata(meta); err != nil {
+                        return nil, err
+                    }
+                }
+            }
+        }
+    }
+
+    entries, err := ioutil.ReadDir(d.MountRoot)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, Internal("Cannot read mount root: " + err.Error())
+    }
+    for _, e := range entries {
+        if !e.IsDir() {
+            continue
+        }
+        if info, ok := existing[e.Name()]; ok && info.Mounted {
+            continue
+        }
+        if !dryRun {
+            // directories which are not empty are left alone
+            if err := d.removeMountpoint(ctx, e.Name()); err != nil {
+                l.Warn("Cannot remove stale mountpoint", "mountpoint", d.getMountpoint(e.Name()), "error", err)
+                continue
+            }
+        }
+        report.MountpointsRemoved = append(report.MountpointsRemoved, e.Name())
+    }
+    return report, nil
+}
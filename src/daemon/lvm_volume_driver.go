@@ -2,8 +2,8 @@ package daemon
 
 import (
       "bytes"
-      "fmt"
-      "log"
+      "context"
+      "io"
       "os"
       "os/exec"
       "path/filepath"
@@ -13,6 +13,8 @@ import (
       "strconv"
       "errors"
       "regexp"
+      "sync"
+      "time"
 )
 
 const (
@@ -25,6 +27,8 @@ const (
 type Volume struct {
     Name string
     Mountpoint string
+    // driver specific state reported by Get, e.g. encryption
+    Status map[string]interface{} `json:",omitempty"`
 }
 
 type Volumes struct {
@@ -63,13 +67,42 @@ func getSizeFromName(name string) (int) {
             factor = 1024
         }
         v, _ := strconv.Atoi(m[1])
-        fmt.Printf("Creating %d mb file system.", (v*factor))
         return v * factor
     } else {
         return 0
     }
 }
 
+var sizePattern = regexp.MustCompile("(?i)^([0-9]+)\\s*([MG])?B?$")
+
+// parseSize converts a size given as option (e.g. "512", "200M", "4G") into
+// megabytes
+func parseSize(s string) (int, error) {
+    m := sizePattern.FindStringSubmatch(strings.TrimSpace(s))
+    if m == nil {
+        return 0, InvalidArgument("Illegal size " + s + ", expected <number>[M|G]")
+    }
+    v, err := strconv.Atoi(m[1])
+    if err != nil || v <= 0 {
+        return 0, InvalidArgument("Illegal size " + s + ", expected <number>[M|G]")
+    }
+    if strings.EqualFold(m[2], "G") {
+        v *= 1024
+    }
+    return v, nil
+}
+
+var volumeNamePattern = regexp.MustCompile("^[a-zA-Z0-9+_.][a-zA-Z0-9+_.-]*$")
+
+// validateName ensures that a volume name is a valid LVM name and cannot
+// escape the mount root
+func validateName(name string) (error) {
+    if name == "." || name == ".." || len(name) > 127 || !volumeNamePattern.MatchString(name) {
+        return InvalidArgument("Illegal volume name \"" + name + "\"")
+    }
+    return nil
+}
+
 // --------------------------------------------------------------------------
 // Wrapper for execution of external programs
 // --------------------------------------------------------------------------
@@ -79,23 +112,68 @@ type ExecStatus struct {
     stdout string
     stderr string
     status int
+    // set if the command has been killed on timeout or cancellation
+    err error
 }
 
+func (e ExecStatus) Command() (string) { return e.cmd }
+func (e ExecStatus) ExitStatus() (int) { return e.status }
+func (e ExecStatus) Stdout() (string) { return e.stdout }
+func (e ExecStatus) Stderr() (string) { return e.stderr }
+
 func (e ExecStatus) String() (string) {
+    if e.err != nil {
+        return e.err.Error()
+    }
     return "Command \"" + e.cmd + "\" failed with status: " + strconv.Itoa(e.status) + ": " + e.stdout + e.stderr
 }
 
-func runCommand(cmdName string, args []string) (execStatus ExecStatus) {
+// CommandExecutor runs external programs. The default executor runs the real
+// programs, FakeLvm emulates them for tests. stdin is passed to the program
+// if not nil, e.g. keys which must not appear on the command line.
+type CommandExecutor interface {
+    Run(ctx context.Context, cmdName string, args []string, stdin []byte) (ExecStatus)
+}
 
-    vcmd := cmdName
-    for _,v := range args {
-        vcmd += " " + v
+// osExecutor executes programs with a timeout. The program is killed with
+// its whole process group when its timeout expires or the context is
+// canceled.
+type osExecutor struct{}
+
+func (osExecutor) Run(ctx context.Context, cmdName string, args []string, stdin []byte) (ExecStatus) {
+
+    vcmd := commandLine(cmdName, args)
+    timeout := commandTimeout(cmdName)
+    cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(cmdCtx, cmdName, args...)
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() (error) {
+        return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+    cmd.WaitDelay = commandWaitDelay
+    if stdin != nil {
+        cmd.Stdin = bytes.NewReader(stdin)
     }
-    cmd := exec.Command(cmdName, args...)
     var stdout, stderr bytes.Buffer
     cmd.Stdout = &stdout
     cmd.Stderr = &stderr
-    if execError := cmd.Run(); execError != nil {
+    execError := cmd.Run()
+    // a program that finished just before the deadline was not killed
+    if execError != nil && cmdCtx.Err() != nil {
+        status := ExecStatus{cmd: vcmd, stdout: stdout.String(), stderr: stderr.String(), status: -1}
+        var e *Error
+        if ctx.Err() != nil {
+            e = newError(CodeCanceled, "command \"" + vcmd + "\" was killed because the request was canceled")
+        } else {
+            e = newError(CodeTimeout, "command \"" + vcmd + "\" did not finish within " + timeout.String() + " and was killed")
+        }
+        e.Exec = &ExecStatus{cmd: status.cmd, stdout: status.stdout, stderr: status.stderr, status: status.status}
+        status.err = e
+        return status
+    }
+    if execError != nil {
         if exitError, ok := execError.(*exec.ExitError); ok {
             waitStatus := exitError.Sys().(syscall.WaitStatus)
             return ExecStatus{
@@ -105,13 +183,115 @@ func runCommand(cmdName string, args []string) (execStatus ExecStatus) {
                        status: waitStatus.ExitStatus(),
                    }
         } else {
-            return ExecStatus{cmd: vcmd, stdout: stdout.String(), stderr: stderr.String(), status: 1 }
+            return ExecStatus{cmd: vcmd, stdout: stdout.String(), stderr: stderr.String() + execError.Error(), status: 1 }
         }
     } else {
         return ExecStatus{cmd: vcmd, stdout: stdout.String(), status: 0}
     }
 }
 
+// StreamExecutor runs programs whose input and output are streams of
+// unknown length, e.g. tar or zstd for exports. An executor which does not
+// implement it gets the real programs for streams.
+type StreamExecutor interface {
+    RunStream(ctx context.Context, cmdName string, args []string, stdin io.Reader, stdout io.Writer) (ExecStatus)
+}
+
+// RunStream executes a program without timeout, its runtime depends on the
+// size of the stream. The program is killed with its whole process group
+// when the context is canceled. The output is collected in the status if
+// stdout is nil.
+func (osExecutor) RunStream(ctx context.Context, cmdName string, args []string, stdin io.Reader, stdout io.Writer) (ExecStatus) {
+
+    vcmd := commandLine(cmdName, args)
+    cmd := exec.CommandContext(ctx, cmdName, args...)
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() (error) {
+        return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+    cmd.WaitDelay = commandWaitDelay
+    cmd.Stdin = stdin
+    var out, stderr bytes.Buffer
+    cmd.Stdout = stdout
+    if stdout == nil {
+        cmd.Stdout = &out
+    }
+    cmd.Stderr = &stderr
+    execError := cmd.Run()
+    status := ExecStatus{cmd: vcmd, stdout: out.String(), stderr: stderr.String()}
+    switch {
+    case execError != nil && ctx.Err() != nil:
+        e := newError(CodeCanceled, "command \"" + vcmd + "\" was killed because the request was canceled")
+        status.status = -1
+        e.Exec = &ExecStatus{cmd: status.cmd, stdout: status.stdout, stderr: status.stderr, status: status.status}
+        status.err = e
+    case execError != nil:
+        if exitError, ok := execError.(*exec.ExitError); ok {
+            status.status = exitError.Sys().(syscall.WaitStatus).ExitStatus()
+        } else {
+            status.status = 1
+            status.stderr += execError.Error()
+        }
+    }
+    return status
+}
+
+func commandLine(cmdName string, args []string) (string) {
+    vcmd := cmdName
+    for _,v := range args {
+        vcmd += " " + v
+    }
+    return vcmd
+}
+
+// runCommand executes an external program. The command line and its outcome
+// are logged with the logger of the request the command is executed for.
+func (d *VolumeDriver) runCommand(ctx context.Context, cmdName string, args []string) (ExecStatus) {
+    return d.runCommandInput(ctx, cmdName, args, nil)
+}
+
+// runCommandInput executes an external program with the given input. The
+// input is neither logged nor recorded.
+func (d *VolumeDriver) runCommandInput(ctx context.Context, cmdName string, args []string, stdin []byte) (execStatus ExecStatus) {
+
+    vcmd := commandLine(cmdName, args)
+    l := LoggerFrom(ctx)
+    l.Debug("Executing command", "cmd", vcmd)
+    recordCommand(ctx, vcmd)
+    start := time.Now()
+    defer func() {
+        l.Debug("Command finished", "cmd", vcmd, "status", execStatus.status, "duration", time.Since(start), "stderr", execStatus.stderr)
+        if execStatus.err != nil {
+            l.Error(execStatus.err.Error())
+        }
+    }()
+    if d.Executor == nil {
+        return osExecutor{}.Run(ctx, cmdName, args, stdin)
+    }
+    return d.Executor.Run(ctx, cmdName, args, stdin)
+}
+
+// runStream executes an external program reading stdin and writing stdout
+// as streams, which are not logged
+func (d *VolumeDriver) runStream(ctx context.Context, cmdName string, args []string, stdin io.Reader, stdout io.Writer) (execStatus ExecStatus) {
+
+    vcmd := commandLine(cmdName, args)
+    l := LoggerFrom(ctx)
+    l.Debug("Executing command", "cmd", vcmd)
+    recordCommand(ctx, vcmd)
+    start := time.Now()
+    defer func() {
+        l.Debug("Command finished", "cmd", vcmd, "status", execStatus.status, "duration", time.Since(start), "stderr", execStatus.stderr)
+        if execStatus.err != nil {
+            l.Error(execStatus.err.Error())
+        }
+    }()
+    if e, ok := d.Executor.(StreamExecutor); ok {
+        return e.RunStream(ctx, cmdName, args, stdin, stdout)
+    }
+    return osExecutor{}.RunStream(ctx, cmdName, args, stdin, stdout)
+}
+
 // --------------------------------------------------------------------------
 // Volume Driver Implementation
 // --------------------------------------------------------------------------
@@ -119,27 +299,105 @@ func runCommand(cmdName string, args []string) (execStatus ExecStatus) {
 type VolumeDriver struct {
     MountRoot string
     LvmDevice string
-    VolumeGroupName string
-    DefaultLogicalVolumeSize int
-    Debug bool
+    // volume groups and defaults of the volumes, see classes.go
+    Classes *StorageClasses
+    State *StateStore
+    // executor for external programs, the real programs are run if unset
+    Executor CommandExecutor
+    // directory containing the device nodes, /dev if unset
+    DevDir string
+    // how removed volumes are wiped, see wipe.go
+    WipePolicy WipePolicy
+    WipePasses int
+    // values for lvcreate --wipesignatures and --zero (y or n), the LVM
+    // defaults apply if empty
+    WipeSignatures string
+    Zero string
+    // keys of encrypted volumes, encryption is disabled if nil
+    KeyProvider KeyProvider
+    // backups are disabled if nil, see backup.go
+    BackupTarget BackupTarget
+    // hooks volumes run around snapshots and the longest time a volume is
+    // frozen for a snapshot, see quiesce.go
+    SnapshotHooks *SnapshotHooks
+    FreezeTimeout time.Duration
+    // applies the I/O limits of volumes, which are only reported if nil;
+    // see iolimits.go
+    IOController IOController
+    // options for mounts of new volumes, see mountopts.go
+    DefaultMountOptions []string
+    // check of the filesystem before mount, see fsck.go
+    FsckPolicy FsckPolicy
+    FsckRepair bool
+    // free space the volume group keeps when volumes grow, see autogrow.go
+    AutoGrowReserveMB int
+    // returns the usage of a mounted filesystem, statfs if nil
+    Statfs func(path string) (FsUsage, error)
+    // copies the data of a volume to a clone, see clone.go; copyDevice if
+    // nil
+    CopyDevice func(ctx context.Context, from string, to string, progress func(copied int64)) (error)
+    Metrics *Metrics
+    wiper *wiper
+    cloner *cloner
+    merger *merger
+    transfers *transfers
+    // background tasks, which stop when the context they were started with
+    // is canceled
+    tasks sync.WaitGroup
+    // snapshots of frozen volumes, see quiesce.go
+    quiesces quiesces
 }
 
-func makefs(device string) (error) {
-    cmd := "mkfs." + DEFAULT_FILESYSTEM
-    if status := runCommand(cmd,[]string{device}); status.status != 0 {
-        return errors.New("Cannot create filesystem on volume " + strconv.Itoa(status.status) + ": " + status.stderr)
+// background runs a task in a goroutine of its own, see Daemon.Close
+func (d *VolumeDriver) background(task func()) {
+    d.tasks.Add(1)
+    go func() {
+        defer d.tasks.Done()
+        task()
+    }()
+}
+
+func (d *VolumeDriver) makefs(ctx context.Context, device string, fs string) (error) {
+    cmd := "mkfs." + fs
+    if status := d.runCommand(ctx, cmd,[]string{device}); status.status != 0 {
+        return commandError(status, "Cannot create filesystem on volume " + strconv.Itoa(status.status) + ": " + status.stderr)
     } else {
         return nil
     }
 }
 
-func mount(device string, dir string, options []string) (error) {
+// makeEncryptedfs formats the logical volume with LUKS and creates and
+// initializes the filesystem inside. The container is closed again
+// afterwards. The key is deleted on failure, the volume is unusable then
+// anyway.
+func (d *VolumeDriver) makeEncryptedfs(ctx context.Context, name string, fs string, r rootInit) (error) {
+    if err := d.formatEncrypted(ctx, name); err != nil {
+        return err
+    }
+    device, err := d.openEncrypted(ctx, name)
+    if err == nil {
+        if err = d.makefs(ctx, device, fs); err == nil {
+            err = d.initRoot(ctx, device, r)
+        }
+        if cerr := d.closeEncrypted(ctx, name); err == nil {
+            err = cerr
+        }
+    }
+    if err != nil {
+        if derr := d.KeyProvider.DeleteKey(ctx, name); derr != nil {
+            LoggerFrom(ctx).Warn("Cannot delete key of volume", "volume", name, "error", derr)
+        }
+    }
+    return err
+}
+
+func (d *VolumeDriver) mount(ctx context.Context, device string, dir string, options []string) (error) {
 
     allOptions := append(options, device, dir)
 
-    if status := runCommand("mount",allOptions); status.status != 0 {
+    if status := d.runCommand(ctx, "mount",allOptions); status.status != 0 {
         msg := "Cannot mount device " + device + ": " + status.stderr
-        return errors.New(msg)
+        return commandError(status, msg)
     } else {
         return nil
     }
@@ -150,78 +408,219 @@ func (d* VolumeDriver) getMountpoint(name string) (string) {
 }
 
 func (d* VolumeDriver) getDeviceName(name string) (string) {
-    return filepath.Join("/dev", d.VolumeGroupName, name)
+    return d.devicePath(d.volumeGroupOf(name), name)
+}
+
+// devicePath returns the device of a logical volume in a volume group
+func (d* VolumeDriver) devicePath(vg string, name string) (string) {
+    devDir := d.DevDir
+    if devDir == "" {
+        devDir = "/dev"
+    }
+    return filepath.Join(devDir, vg, name)
 }
 
-func (d *VolumeDriver) createVolume(name string, size int) (error) {
+func (d *VolumeDriver) createVolume(ctx context.Context, class *StorageClass, name string, size int, raid *RaidLayout) (error) {
 
     sizeStr := strconv.Itoa(size) + "M"
-    if status := runCommand("lvcreate",[]string{"-L", sizeStr, "-n", name, d.VolumeGroupName}); status.status != 0 {
+    var args []string
+    if class.ThinPool != "" {
+        // zeroing of thin volumes is a property of the pool
+        args = []string{"-V", sizeStr, "-T", class.VolumeGroup + "/" + class.ThinPool, "-n", name}
+    } else {
+        args = []string{"-L", sizeStr, "-n", name}
+        if raid != nil {
+            args = append(args, raid.lvcreateArgs()...)
+        }
+        if d.Zero != "" {
+            args = append(args, "--zero", d.Zero)
+        }
+    }
+    if d.WipeSignatures != "" {
+        args = append(args, "--wipesignatures", d.WipeSignatures)
+    }
+    if class.ThinPool == "" {
+        args = append(args, class.VolumeGroup)
+    }
+    if status := d.runCommand(ctx, "lvcreate", args); status.status != 0 {
         msg := "Cannot create volume, return code is " + strconv.Itoa(status.status) + ": " + status.stderr
-        return errors.New(msg)
+        return commandError(status, msg)
     } else {
         return nil
     }
 }
 
-func (d *VolumeDriver) removeMountpoint(volume string) (error) {
+func (d *VolumeDriver) removeMountpoint(ctx context.Context, volume string) (error) {
     // must remove mount point
     mp := d.getMountpoint(volume)
 
-    if status := runCommand("rmdir", []string{mp}); status.status != 0 {
-        return errors.New("Volume " + volume + " removed but deletion of mountpoint failed: " + status.String())
+    if status := d.runCommand(ctx, "rmdir", []string{mp}); status.status != 0 {
+        return commandError(status, "Volume " + volume + " removed but deletion of mountpoint failed: " + status.String())
     }
-    log.Println("Volume " + volume + " removed and mountpoint " + mp + " deleted.")
+    LoggerFrom(ctx).Info("Mountpoint deleted", "volume", volume, "mountpoint", mp)
     return nil
 
 }
 
-func (d *VolumeDriver) removeLogicalVolume(volume string) (error) {
+func (d *VolumeDriver) removeLogicalVolume(ctx context.Context, volume string) (error) {
+    if err := d.cloneBusy(volume); err != nil {
+        return err
+    }
+    if err := d.transferBusy(volume); err != nil {
+        return err
+    }
+    if err := d.exportBusy(volume); err != nil {
+        return err
+    }
+    // removing the origin would remove the snapshot being merged as well
+    if err := d.mergeBusy(volume); err != nil {
+        return err
+    }
     device := d.getDeviceName(volume)
-    if mounted, err := d.isMounted(volume); mounted {
-        return errors.New("Volume " + volume + " is still mounted")
+    if mounted, err := d.isMounted(ctx, volume); mounted {
+        return InUse("Volume " + volume + " is still mounted")
     } else if err != nil {
         return err
     }
-    if status := runCommand("lvremove",[]string{"-f", device}); status.status != 0 {
-        return errors.New(status.String())
+    encrypted, err := d.isEncrypted(volume)
+    if err != nil {
+        return err
+    }
+    if encrypted {
+        // an open container keeps the logical volume busy
+        if err := d.closeEncrypted(ctx, volume); err != nil {
+            return err
+        }
+    }
+    if d.WipePolicy != "" && d.WipePolicy != WipeNone && d.wiper != nil {
+        if err := d.scheduleWipe(ctx, volume); err != nil {
+            return err
+        }
+    } else if status := d.runCommand(ctx, "lvremove",[]string{"-f", device}); status.status != 0 {
+        return commandError(status, status.String())
+    }
+    d.removeBackupBase(ctx, volume)
+    // without its key the data cannot be decrypted anymore, even before a
+    // wipe has finished
+    if encrypted && d.KeyProvider != nil {
+        if err := d.KeyProvider.DeleteKey(ctx, volume); err != nil {
+            LoggerFrom(ctx).Warn("Cannot delete key of removed volume", "volume", volume, "error", err)
+        }
     }
     // mountpoint should not exist anymore - so errors will be 
     // ignored, just in case
-    d.removeMountpoint(volume)
+    d.removeMountpoint(ctx, volume)
+    if d.State != nil {
+        if err := d.State.Delete(volume); err != nil {
+            LoggerFrom(ctx).Warn("Cannot delete metadata of removed volume", "volume", volume, "error", err)
+        }
+    }
     return nil
 }
 
+func (d *VolumeDriver) saveMetadata(meta *VolumeMetadata) (error) {
+    if d.State == nil {
+        return nil
+    }
+    if err := d.State.Save(meta); err != nil {
+        return Internal("Cannot store metadata of volume " + meta.Name + ": " + err.Error())
+    }
+    return nil
+}
+
+// loadMetadata returns the metadata of a volume. Volumes without metadata get
+// an empty record.
+func (d *VolumeDriver) loadMetadata(name string) (*VolumeMetadata, error) {
+    if d.State != nil {
+        if meta, err := d.State.Load(name); err != nil || meta != nil {
+            return meta, err
+        }
+    }
+    return &VolumeMetadata{Name: name}, nil
+}
+
+
+// volumeStatus returns the driver specific state of a volume reported as
+// Status by the docker Get response
+func (d *VolumeDriver) volumeStatus(ctx context.Context, name string) (map[string]interface{}, error) {
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return nil, Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    status := map[string]interface{}{
+        "mount_options": d.mountOptions(meta),
+        ReadOnlyOption: meta.ReadOnly,
+    }
+    if meta.Fsck != nil {
+        status["fsck"] = meta.Fsck
+    }
+    if meta.AutoGrow != nil {
+        status[AutoGrowOption] = meta.AutoGrow
+    }
+    if meta.LastBackup != nil {
+        status["last_backup"] = meta.LastBackup
+    }
+    if meta.Class != "" {
+        status[ClassOption] = meta.Class
+    }
+    if clone := d.cloneStatus(meta); clone != nil {
+        status["clone"] = clone
+    }
+    if meta.Merge != nil {
+        status["merge"] = meta.Merge
+    }
+    if meta.Quiesce != nil {
+        status["quiesce"] = meta.Quiesce
+    }
+    if meta.IOLimits != nil {
+        status["io_limits"] = meta.IOLimits
+    }
+    if meta.IOMax != "" {
+        status["io_max"] = meta.IOMax
+    }
+    if raid, err := d.raidStatus(ctx, meta); err != nil {
+        return nil, err
+    } else if raid != nil {
+        status[RaidOption] = raid
+    }
+    if err := d.encryptionStatus(ctx, meta, status); err != nil {
+        return nil, err
+    }
+    return status, nil
+}
 
-func (d *VolumeDriver) listVolumes() (*[]Volume, error) {
+func (d *VolumeDriver) listVolumes(ctx context.Context) (*[]Volume, error) {
 
-    volumes, err1 := d.getMountedVolumes()
+    volumes, err1 := d.getMountedVolumes(ctx)
     if err1 != nil {
         return nil, err1
     }
     vmap := arrayToMap(*volumes)
 
-    status := runCommand("lvs", []string{"--noheadings", "-o", "lv_name", "-v", d.VolumeGroupName})
-    if status.status != 0 {
-        return nil, errors.New(status.String())
-    } else {
-        in := bufio.NewScanner(strings.NewReader(status.stdout))
-        var volumes []Volume = make([]Volume, 0)
-        for in.Scan() {
-            s := strings.Trim(in.Text(), "\n ")
-            volume := Volume{Name:s}
-            if _, ok := vmap[s]; ok {
-                volume.Mountpoint = d.getMountpoint(s)
-            }
-            volumes = append(volumes, volume)
+    // volumes waiting to be wiped and snapshots being merged are gone for
+    // the user
+    report, err := d.lvsReport(ctx, []string{"lv_name", "lv_merging"})
+    if err != nil {
+        return nil, err
+    }
+    var list []Volume = make([]Volume, 0)
+    for _, row := range report {
+        if row["lv_merging"] != "" {
+            continue
         }
-        return &volumes, nil
+        s := row["lv_name"]
+        volume := Volume{Name:s}
+        if _, ok := vmap[s]; ok {
+            volume.Mountpoint = d.getMountpoint(s)
+        }
+        list = append(list, volume)
     }
+    return &list, nil
 }
 
-func (d *VolumeDriver) existsVolume(name string) (bool, error) {
+func (d *VolumeDriver) existsVolume(ctx context.Context, name string) (bool, error) {
     
-    if vols, err := d.listVolumes(); err == nil {
+    if vols, err := d.listVolumes(ctx); err == nil {
         return stringInSlice(name, *vols), nil
     } else {
         return false, err
@@ -229,9 +628,9 @@ func (d *VolumeDriver) existsVolume(name string) (bool, error) {
 
 }
 
-func (d *VolumeDriver) getMountedVolumes() (*[]string, error) {
+func (d *VolumeDriver) getMountedVolumes(ctx context.Context) (*[]string, error) {
 
-    if result := runCommand("mount", []string{}); result.status == 0 {
+    if result := d.runCommand(ctx, "mount", []string{}); result.status == 0 {
         in := bufio.NewScanner(strings.NewReader(result.stdout))
         var volumes []string
         for in.Scan() {
@@ -244,12 +643,12 @@ func (d *VolumeDriver) getMountedVolumes() (*[]string, error) {
         }
         return &volumes, nil
     } else {
-        return nil, errors.New("Unable to retrieve mountpoints. Return code: " + strconv.Itoa(result.status) + ": " + result.stderr)
+        return nil, commandError(result, "Unable to retrieve mountpoints. Return code: " + strconv.Itoa(result.status) + ": " + result.stderr)
     }
 }
 
-func (d *VolumeDriver) isMounted(volume string) (bool, error) {
-    vols, err := d.getMountedVolumes()
+func (d *VolumeDriver) isMounted(ctx context.Context, volume string) (bool, error) {
+    vols, err := d.getMountedVolumes(ctx)
     if err != nil {
         return false, err
     }
@@ -261,10 +660,10 @@ func (d *VolumeDriver) isMounted(volume string) (bool, error) {
     return false, nil
 }
 
-func (d *VolumeDriver) unmount(device string) (error) {
+func (d *VolumeDriver) unmount(ctx context.Context, device string) (error) {
 
-    if status := runCommand("umount",[]string{device}); status.status != 0 {
-        return errors.New("Cannot unmount device " + device + ": " + status.stderr)
+    if status := d.runCommand(ctx, "umount",[]string{device}); status.status != 0 {
+        return commandError(status, "Cannot unmount device " + device + ": " + status.stderr)
     } else {
         return nil
     }
@@ -279,131 +678,324 @@ func (d *VolumeDriver) DockerActivate() (implements []string) {
 
 // Create new logical volume and create an ext4 filesystem
 // 
-func (d *VolumeDriver) DockerCreateVolume(name string, options map[string]string) (error) {
+func (d *VolumeDriver) DockerCreateVolume(ctx context.Context, name string, options map[string]string) (error) {
 
-    log.Print("/VolumeDriver.Create called for volume " + name)
+    l := LoggerFrom(ctx).With("volume", name)
+    l.Info("/VolumeDriver.Create called")
+    if err := validateName(name); err != nil {
+        return err
+    }
+    if source, ok := options[CloneFromOption]; ok {
+        return d.createClone(ctx, name, source, options)
+    }
+    if _, ok := options[CloneFreezeOption]; ok {
+        return InvalidArgument("Option " + CloneFreezeOption + " requires option " + CloneFromOption)
+    }
+    class, err := d.selectClass(name, options)
+    if err != nil {
+        return err
+    }
     var size int
     sizeFromName := getSizeFromName(name)
     if val, ok := options["size"]; ok {
-        size,_ = strconv.Atoi(val)
+        var err error
+        if size, err = parseSize(val); err != nil {
+            return err
+        }
     } else if sizeFromName != 0 {
         size = sizeFromName
     } else {
-        size = d.DefaultLogicalVolumeSize
+        size = class.DefaultSizeMB
     }
-    if exists, err := d.existsVolume(name); !exists && err == nil {
+    encrypted, err := parseEncrypted(options)
+    if err != nil {
+        return err
+    }
+    mountOptions, readOnly, err := d.volumeMountOptions(options, class.Filesystem)
+    if err != nil {
+        return err
+    }
+    r, err := parseRootInit(options)
+    if err != nil {
+        return err
+    }
+    if !fsLostFound[class.Filesystem] {
+        r.removeLostFound = false
+    }
+    autoGrow, err := parseAutoGrow(options, size)
+    if err != nil {
+        return err
+    }
+    if autoGrow != nil && class.MaxSizeMB > 0 && autoGrow.MaxMB > class.MaxSizeMB {
+        return InvalidArgument("Option " + AutoGrowMaxOption + " exceeds the maximum size of storage class " + class.Name)
+    }
+    if encrypted {
+        if err := d.requireKeyProvider(); err != nil {
+            return err
+        }
+        if autoGrow != nil {
+            return InvalidArgument("Encrypted volumes cannot be resized, option " + AutoGrowOption + " is not supported")
+        }
+    }
+    backup, err := parseBackupPolicy(options)
+    if err != nil {
+        return err
+    }
+    if err := checkIncrementalBackup(backup, class, encrypted); err != nil {
+        return err
+    }
+    if backup != nil {
+        if err := d.requireBackupTarget(); err != nil {
+            return err
+        }
+    }
+    quiesce, err := d.parseQuiesce(options)
+    if err != nil {
+        return err
+    }
+    ioLimits, err := parseIOLimits(options)
+    if err != nil {
+        return err
+    }
+    raid, err := parseRaid(options)
+    if err != nil {
+        return err
+    }
+    if exists, err := d.existsVolume(ctx, name); !exists && err == nil {
 
-        log.Print("Creating volume " + name + " with size " + strconv.Itoa(size) + "MB")
-        if err := d.createVolume(name, size) ; err != nil {
+        if err := d.checkClassLimits(ctx, class, size); err != nil {
             return err
-        } else {
-            return makefs(d.getDeviceName(name))
         }
+        if err := d.checkRaid(ctx, class, raid); err != nil {
+            return err
+        }
+        l.Info("Creating volume", "size_mb", size, "encrypted", encrypted, "class", class.Name)
+        meta := &VolumeMetadata{
+            Name: name,
+            Created: time.Now().UTC(),
+            Options: options,
+            Encrypted: encrypted,
+            MountOptions: mountOptions,
+            ReadOnly: readOnly,
+            AutoGrow: autoGrow,
+            Backup: backup,
+            Quiesce: quiesce,
+            IOLimits: ioLimits,
+            Raid: raid,
+            Class: class.Name,
+            VolumeGroup: class.VolumeGroup,
+            ThinPool: class.ThinPool,
+            Filesystem: class.Filesystem,
+        }
+        device := d.devicePath(class.VolumeGroup, name)
+        if err := d.createVolume(ctx, class, name, size, raid) ; err != nil {
+            return err
+        }
+        // the device of the volume is found through its metadata
+        if err := d.saveMetadata(meta); err != nil {
+            return err
+        }
+        if encrypted {
+            err = d.makeEncryptedfs(ctx, name, class.Filesystem, r)
+        } else if err = d.makefs(ctx, device, class.Filesystem); err == nil {
+            err = d.initRoot(ctx, device, r)
+        }
+        return err
     } else {
         if err != nil {
             return err
         } else {
-            return errors.New("Volume " + name + " already exists")
+            return AlreadyExists("Volume " + name + " already exists")
         }
     }
 }
 
-func (d *VolumeDriver) DockerRemoveVolume(name string) (error) {
-    log.Print("/VolumeDriver.Remove called for volume " + name)
-    if yes, err := d.existsVolume(name); yes {
-        log.Print("Volume " + name + " exists, deleting")
-        if mounted, err2 := d.isMounted(name); mounted && err2 == nil {
-            return errors.New("Volume " + name + " is still mounted")
+func (d *VolumeDriver) DockerRemoveVolume(ctx context.Context, name string) (error) {
+    l := LoggerFrom(ctx).With("volume", name)
+    l.Info("/VolumeDriver.Remove called")
+    if err := validateName(name); err != nil {
+        return err
+    }
+    if yes, err := d.existsVolume(ctx, name); yes {
+        l.Info("Volume exists, deleting")
+        // docker forgets the volume if it is removed with force, whether
+        // the removal below succeeds or not
+        d.recordRemoveRequest(ctx, name)
+        if mounted, err2 := d.isMounted(ctx, name); mounted && err2 == nil {
+            return InUse("Volume " + name + " is still mounted")
         } else if err2 != nil {
             return  err2
         } else {
-            return d.removeLogicalVolume(name)
+            return d.removeLogicalVolume(ctx, name)
         }
     } else {
         if err != nil {
             return err 
         } else {
-            msg := "Cannot delete volume " + name + ": it does not exist"
-            log.Print(msg)
-            return errors.New(msg)
+            msg := "Volume " + name + " does not exist"
+            l.Warn(msg)
+            return NotFound(msg)
         }
     }
 }
 
-func (d *VolumeDriver) DockerMountVolume(name string) (*string, error) {
+func (d *VolumeDriver) DockerMountVolume(ctx context.Context, name string) (*string, error) {
 
-    log.Print("/VolumeDriver.Mount called for volume " + name)
+    l := LoggerFrom(ctx).With("volume", name)
+    l.Info("/VolumeDriver.Mount called")
+    if err := validateName(name); err != nil {
+        return nil, err
+    }
     mountpoint := d.getMountpoint(name)
     device := d.getDeviceName(name)
 
-    if mounted, error := d.isMounted(name); mounted && error == nil {
-        log.Print("Remounting already mounted volume " + name)
+    if mounted, error := d.isMounted(ctx, name); mounted && error == nil {
+        l.Info("Remounting already mounted volume")
         return &mountpoint, nil
     } else if error != nil {
         return nil, error
     }
 
+    if err := d.cloneMountBusy(name); err != nil {
+        return nil, err
+    }
+    if err := d.transferBusy(name); err != nil {
+        return nil, err
+    }
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return nil, Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    if err := checkCloneComplete(meta); err != nil {
+        return nil, err
+    }
+    if meta.Origin != "" {
+        if err := d.mergeBusy(name); err != nil {
+            return nil, err
+        }
+    }
+    d.clearRemoveRequest(ctx, meta)
+    if meta.ImportedBackup != "" || meta.RenewUUID {
+        if err := d.leaveBackupChain(ctx, meta); err != nil {
+            return nil, err
+        }
+    }
     if error := os.MkdirAll(mountpoint, 0750); error != nil {
-        return nil, error
-    } else {
-        if error := mount(device, mountpoint, []string{}); error != nil {
-            return nil, error
-        } else {
-            return &mountpoint, nil
+        return nil, Internal("Cannot create mountpoint: " + error.Error())
+    }
+    if meta.Encrypted {
+        if device, err = d.openEncrypted(ctx, name); err != nil {
+            return nil, err
         }
     }
+    err = d.checkFilesystem(ctx, meta, device)
+    if err == nil {
+        err = d.applyIOLimits(ctx, meta, device)
+    }
+    if err == nil {
+        err = d.mount(ctx, device, mountpoint, mountArgs(d.mountOptions(meta)))
+    }
+    if err != nil {
+        d.clearIOLimits(ctx, meta)
+        if meta.Encrypted {
+            if cerr := d.closeEncrypted(ctx, name); cerr != nil {
+                l.Warn("Cannot close encrypted volume after failed mount", "error", cerr)
+            }
+        }
+        return nil, err
+    }
+    return &mountpoint, nil
 
 }
 
-func (d *VolumeDriver) DockerUnmountVolume(name string) (error) {
+func (d *VolumeDriver) DockerUnmountVolume(ctx context.Context, name string) (error) {
 
-    log.Print("/VolumeDriver.Unmount called for volume " + name)
-    var err error
-    device := d.getDeviceName(name)
-    if err = d.unmount(device); err != nil {
+    l := LoggerFrom(ctx).With("volume", name)
+    l.Info("/VolumeDriver.Unmount called")
+    if err := validateName(name); err != nil {
+        return err
+    }
+    // a source copied from its snapshot may be unmounted
+    if err := d.cloneMountBusy(name); err != nil {
+        return err
+    }
+    if err := d.transferBusy(name); err != nil {
+        return err
+    }
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    encrypted := meta.Encrypted
+    device := d.filesystemDevice(name, encrypted)
+    if err = d.unmount(ctx, device); err != nil {
+        if HasCode(err, CodeTimeout) || HasCode(err, CodeCanceled) {
+            // the device may still be mounted
+            return err
+        }
         if err != nil {
-            log.Print("Ignoring unmount error " + err.Error())
+            l.Warn("Ignoring unmount error", "error", err)
         }
         // mountpoint has most likely been deleted before, therefore 
         // ignoring possible errors here
-        d.removeMountpoint(name)
+        d.removeMountpoint(ctx, name)
+        d.clearIOLimits(ctx, meta)
+        if encrypted {
+            return d.closeEncrypted(ctx, name)
+        }
         return nil
-    } else {
-        return d.removeMountpoint(name)
     }
+    d.clearIOLimits(ctx, meta)
+    if encrypted {
+        if err := d.closeEncrypted(ctx, name); err != nil {
+            return err
+        }
+    }
+    if err := d.removeMountpoint(ctx, name); err != nil {
+        return err
+    }
+    d.startDeferredMerge(ctx, name)
+    return nil
 }
 
-func (d *VolumeDriver) DockerVolumePath(name string) (*string, error) {
+func (d *VolumeDriver) DockerVolumePath(ctx context.Context, name string) (*string, error) {
 
-    if d.Debug {
-        log.Print("/VolumeDriver.Path called for volume " + name)
+    LoggerFrom(ctx).Debug("/VolumeDriver.Path called", "volume", name)
+    if err := validateName(name); err != nil {
+        return nil, err
     }
-    if mounted, err := d.isMounted(name); mounted {
+    if mounted, err := d.isMounted(ctx, name); mounted {
         mountpoint := d.getMountpoint(name)
         return &mountpoint, nil
     } else {
         if err != nil {
             return nil, err
         } else {
-            return nil, errors.New("Volume " + name + " not mounted")
+            return nil, NotFound("Volume " + name + " not mounted")
         }
     }
 }
 
-func (d *VolumeDriver) dockerGetVolume(name string) (*Volume, error) {
+func (d *VolumeDriver) dockerGetVolume(ctx context.Context, name string) (*Volume, error) {
 
-    if d.Debug {
-        log.Print("/VolumeDriver.Get called for volume " + name)
+    LoggerFrom(ctx).Debug("/VolumeDriver.Get called", "volume", name)
+    if err := validateName(name); err != nil {
+        return nil, err
     }
-    if exists, err := d.existsVolume(name); !exists {
-        return nil, errors.New("Volume " + name + " does not exist")
-    } else if err != nil {
+    if exists, err := d.existsVolume(ctx, name); err != nil {
         return nil, err
+    } else if !exists {
+        return nil, NotFound("Volume " + name + " does not exist")
     } else {
         vol := Volume{
             Name: name,
         }
-        if mounted, err := d.isMounted(name); mounted && err == nil {
+        if status, err := d.volumeStatus(ctx, name); err != nil {
+            return nil, err
+        } else {
+            vol.Status = status
+        }
+        if mounted, err := d.isMounted(ctx, name); mounted && err == nil {
             mountpoint := d.getMountpoint(name)
             vol.Mountpoint = mountpoint
             return &vol, nil
@@ -413,15 +1005,13 @@ func (d *VolumeDriver) dockerGetVolume(name string) (*Volume, error) {
     }
 }
 
-func (d *VolumeDriver) dockerListVolume() (map[string]interface{}, error) {
+func (d *VolumeDriver) dockerListVolume(ctx context.Context) (map[string]interface{}, error) {
 
-    if d.Debug {
-        log.Print("/VolumeDriver.List called")
-    }
+    LoggerFrom(ctx).Debug("/VolumeDriver.List called")
     vs := make(map[string]interface{})
-    if list, err := d.listVolumes(); err != nil {
+    if list, err := d.listVolumes(ctx); err != nil {
 
-        vs["Err"] = err.Error()
+        vs["Err"] = dockerErr(err)
         return vs, err
     } else {
         vs["Volumes"] = *list
@@ -430,21 +1020,27 @@ func (d *VolumeDriver) dockerListVolume() (map[string]interface{}, error) {
     }
 }
 
-func (d *VolumeDriver) EnsureVGExists() (error) {
-
-    pattern := "\"" + d.VolumeGroupName + "\"" 
-    var nameRegex = regexp.MustCompile(pattern)
-    if result := runCommand("vgdisplay", []string{"-s"}); result.status == 0 {
-        in := bufio.NewScanner(strings.NewReader(result.stdout))
-        for in.Scan() {
-            line := in.Text()
-            if nameRegex.MatchString(line) {
-                return nil
+func (d *VolumeDriver) EnsureVGExists(ctx context.Context) (error) {
+
+    if result := d.runCommand(ctx, "vgdisplay", []string{"-s"}); result.status == 0 {
+        for _, vg := range d.Classes.VolumeGroups() {
+            pattern := "\"" + regexp.QuoteMeta(vg) + "\""
+            var nameRegex = regexp.MustCompile(pattern)
+            found := false
+            in := bufio.NewScanner(strings.NewReader(result.stdout))
+            for in.Scan() {
+                line := in.Text()
+                if nameRegex.MatchString(line) {
+                    found = true
+                }
+            }
+            if !found {
+                return NotFound("No such volume group: " + vg)
             }
         }
-        return errors.New("No such volume group: " + d.VolumeGroupName)
+        return d.ensureThinPools(ctx)
     } else {
-        return errors.New("Cannot run program pvdisplay: " + result.String())
+        return commandError(result, "Cannot run program vgdisplay: " + result.String())
     }
 }
 
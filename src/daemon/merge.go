@@ -0,0 +1,312 @@
+package daemon
+
+import (
+    "context"
+    "sort"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Snapshot merge
+//
+// Merging a snapshot into its origin (lvconvert --merge) rolls the origin
+// back to the state of the snapshot, e.g. after a failed upgrade of a
+// service; the snapshot is gone afterwards. LVM cannot merge into an origin
+// which is in use: the merge is deferred until the origin is activated the
+// next time. The driver therefore refuses to merge into a mounted origin
+// unless forced, and reactivates the origin when it is unmounted to start a
+// deferred merge. Merges run in the background; a merging snapshot is not
+// listed to docker anymore and its metadata and key are removed once LVM
+// has dropped it. The pending merge is recorded in the metadata of the
+// origin, so that it is picked up again after a restart.
+// --------------------------------------------------------------------------
+
+const (
+    MergePending = "pending"
+    MergeMerging = "merging"
+    MergeMerged = "merged"
+
+    // interval in which running merges are checked for completion
+    mergePollInterval = 5 * time.Second
+)
+
+type MergeStatus struct {
+    Snapshot string `json:"snapshot"`
+    Origin string `json:"origin"`
+    // pending until the origin is unmounted, merging or merged
+    State string `json:"state"`
+    Requested time.Time `json:"requested"`
+    Finished *time.Time `json:"finished,omitempty"`
+}
+
+// merger keeps the origins with merges which are not finished
+type merger struct {
+    m sync.Mutex
+    origins map[string]bool
+}
+
+func (m *merger) add(origin string) {
+    if m == nil {
+        return
+    }
+    m.m.Lock()
+    m.origins[origin] = true
+    m.m.Unlock()
+}
+
+func (m *merger) remove(origin string) {
+    if m == nil {
+        return
+    }
+    m.m.Lock()
+    delete(m.origins, origin)
+    m.m.Unlock()
+}
+
+func (m *merger) list() ([]string) {
+    origins := []string{}
+    if m == nil {
+        return origins
+    }
+    m.m.Lock()
+    defer m.m.Unlock()
+    for o := range m.origins {
+        origins = append(origins, o)
+    }
+    sort.Strings(origins)
+    return origins
+}
+
+// StartMerges picks up the merges which were not finished before a restart.
+// Deferred merges into origins which are not mounted are started.
+func (d *VolumeDriver) StartMerges(ctx context.Context) (error) {
+    d.merger = &merger{origins: make(map[string]bool)}
+    if d.State == nil {
+        return nil
+    }
+    names, err := d.State.Names()
+    if err != nil {
+        return err
+    }
+    for _, name := range names {
+        meta, err := d.State.Load(name)
+        if err != nil || meta == nil || meta.Merge == nil {
+            continue
+        }
+        d.merger.add(name)
+        l := DefaultLogger().With("volume", name, "snapshot", meta.Merge.Snapshot)
+        lctx := WithLogger(ctx, l)
+        if meta.Merge.State == MergePending {
+            if mounted, err := d.isMounted(lctx, name); err == nil && !mounted {
+                d.startDeferredMerge(lctx, name)
+                continue
+            }
+        }
+        if _, err := d.finishMerge(lctx, name); err != nil {
+            l.Warn("Cannot check merge of snapshot", "error", err)
+        }
+    }
+    return nil
+}
+
+// startMergeWatcher checks the running merges for completion. It returns
+// immediately.
+func (s *Daemon) startMergeWatcher(ctx context.Context) {
+    s.driver.background(func() {
+        ticker := time.NewTicker(mergePollInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                s.driver.pollMerges(ctx, s.m)
+            }
+        }
+    })
+}
+
+func (d *VolumeDriver) pollMerges(ctx context.Context, lock *requestLock) {
+    origins := d.merger.list()
+    if len(origins) == 0 {
+        return
+    }
+    l := DefaultLogger().With("component", "merge-watcher")
+    ctx = WithLogger(ctx, l)
+    lock.Lock("merge watcher")
+    defer lock.Unlock()
+    for _, origin := range origins {
+        if _, err := d.finishMerge(ctx, origin); err != nil {
+            l.Warn("Cannot check merge of snapshot", "volume", origin, "error", err)
+        }
+    }
+}
+
+// mergeBusy refuses changes of an origin with a merge which is not finished
+// and of the snapshot being merged
+func (d *VolumeDriver) mergeBusy(name string) (error) {
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    if meta.Merge != nil {
+        return InUse("Snapshot " + meta.Merge.Snapshot + " is being merged into volume " + name + " (" + meta.Merge.State + ")")
+    }
+    if meta.Origin == "" {
+        return nil
+    }
+    originMeta, err := d.loadMetadata(meta.Origin)
+    if err != nil {
+        return Internal("Cannot read metadata of volume " + meta.Origin + ": " + err.Error())
+    }
+    if originMeta.Merge != nil && originMeta.Merge.Snapshot == name {
+        return InUse("Snapshot " + name + " is being merged into volume " + meta.Origin + " (" + originMeta.Merge.State + ")")
+    }
+    return nil
+}
+
+// MergeSnapshot merges a snapshot into its origin. A mounted origin is only
+// accepted with force; the merge then starts when the origin is unmounted.
+func (d *VolumeDriver) MergeSnapshot(ctx context.Context, name string, force bool) (*MergeStatus, error) {
+    info, err := d.InspectVolume(ctx, name)
+    if err != nil {
+        return nil, err
+    }
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return nil, Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    // thin clones are thin snapshots for LVM, but independent volumes
+    if info.Origin == "" || meta.Clone != nil {
+        return nil, InvalidArgument("Volume " + name + " is not a snapshot")
+    }
+    origin := info.Origin
+    if info.Merging {
+        return nil, InvalidArgument("Snapshot " + name + " is already being merged into volume " + origin)
+    }
+    if info.Mounted {
+        return nil, InUse("Snapshot " + name + " is mounted")
+    }
+    if err := d.mergeBusy(origin); err != nil {
+        return nil, err
+    }
+    if err := d.cloneBusy(origin); err != nil {
+        return nil, err
+    }
+    if err := d.transferBusy(origin); err != nil {
+        return nil, err
+    }
+    if err := d.transferBusy(name); err != nil {
+        return nil, err
+    }
+    originMeta, err := d.loadMetadata(origin)
+    if err != nil {
+        return nil, Internal("Cannot read metadata of volume " + origin + ": " + err.Error())
+    }
+    mounted, err := d.isMounted(ctx, origin)
+    if err != nil {
+        return nil, err
+    }
+    if mounted && !force {
+        return nil, InUse("Volume " + origin + " is mounted; unmount it or force the merge, which then starts when " + origin + " is unmounted")
+    }
+    // an open LUKS container of the snapshot would defer the merge as well
+    if info.Encrypted {
+        if err := d.closeEncrypted(ctx, name); err != nil {
+            return nil, err
+        }
+    }
+    l := LoggerFrom(ctx).With("volume", origin, "snapshot", name)
+    l.Info("Merging snapshot into its origin", "deferred", mounted)
+    // -b: LVM copies the snapshot back in the background, which takes as
+    // long as writing the changes since the snapshot was taken
+    status := d.runCommand(ctx, "lvconvert", []string{"--merge", "-b", info.VolumeGroup + "/" + name})
+    if status.status != 0 {
+        return nil, commandError(status, "Cannot merge snapshot " + name + " into volume " + origin + ": " + status.stderr)
+    }
+    merge := &MergeStatus{Snapshot: name, Origin: origin, State: MergeMerging, Requested: time.Now().UTC()}
+    if mounted {
+        merge.State = MergePending
+    }
+    originMeta.Merge = merge
+    if err := d.saveMetadata(originMeta); err != nil {
+        return nil, err
+    }
+    d.merger.add(origin)
+    return d.finishMerge(ctx, origin)
+}
+
+// startDeferredMerge reactivates an origin after it has been unmounted, which
+// starts a merge deferred because the origin was in use
+func (d *VolumeDriver) startDeferredMerge(ctx context.Context, origin string) {
+    meta, err := d.loadMetadata(origin)
+    if err != nil || meta.Merge == nil || meta.Merge.State != MergePending {
+        return
+    }
+    l := LoggerFrom(ctx).With("volume", origin, "snapshot", meta.Merge.Snapshot)
+    l.Info("Reactivating volume to start the deferred merge of its snapshot")
+    device := d.getDeviceName(origin)
+    if status := d.runCommand(ctx, "lvchange", []string{"-an", device}); status.status != 0 {
+        l.Warn("Cannot deactivate volume, the merge starts on its next activation", "error", status.String())
+        return
+    }
+    if status := d.runCommand(ctx, "lvchange", []string{"-ay", device}); status.status != 0 {
+        l.Error("Cannot activate volume after deactivation", "error", status.String())
+        return
+    }
+    meta.Merge.State = MergeMerging
+    if err := d.saveMetadata(meta); err != nil {
+        l.Warn("Cannot record start of merge", "error", err)
+    }
+    if _, err := d.finishMerge(ctx, origin); err != nil {
+        l.Warn("Cannot check merge of snapshot", "error", err)
+    }
+}
+
+// finishMerge returns the state of the merge into an origin, nil if there
+// is none. Once LVM has dropped the snapshot, its metadata and key are
+// removed and the merge is done.
+func (d *VolumeDriver) finishMerge(ctx context.Context, origin string) (*MergeStatus, error) {
+    meta, err := d.loadMetadata(origin)
+    if err != nil {
+        return nil, Internal("Cannot read metadata of volume " + origin + ": " + err.Error())
+    }
+    if meta.Merge == nil {
+        d.merger.remove(origin)
+        return nil, nil
+    }
+    merge := *meta.Merge
+    report, err := d.lvsReport(ctx, []string{"lv_name"})
+    if err != nil {
+        return nil, err
+    }
+    for _, row := range report {
+        if row["lv_name"] == merge.Snapshot {
+            return &merge, nil
+        }
+    }
+    l := LoggerFrom(ctx).With("volume", origin, "snapshot", merge.Snapshot)
+    if snapshotMeta, err := d.loadMetadata(merge.Snapshot); err == nil && snapshotMeta.Encrypted && d.KeyProvider != nil {
+        if err := d.KeyProvider.DeleteKey(ctx, merge.Snapshot); err != nil {
+            l.Warn("Cannot delete key of merged snapshot", "error", err)
+        }
+    }
+    if d.State != nil {
+        if err := d.State.Delete(merge.Snapshot); err != nil {
+            l.Warn("Cannot delete metadata of merged snapshot", "error", err)
+        }
+    }
+    meta.Merge = nil
+    // the check was of the filesystem before the rollback
+    meta.Fsck = nil
+    if err := d.saveMetadata(meta); err != nil {
+        return nil, err
+    }
+    d.merger.remove(origin)
+    l.Info("Snapshot merged into its origin")
+    now := time.Now().UTC()
+    merge.State = MergeMerged
+    merge.Finished = &now
+    return &merge, nil
+}
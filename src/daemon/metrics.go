@@ -0,0 +1,143 @@
+package daemon
+
+import (
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// --------------------------------------------------------------------------
+// Metrics
+//
+// A minimal registry of counters and gauges served in the Prometheus text
+// format on /metrics. Every sample is identified by the metric name and its
+// labels; labels are given as name, value pairs.
+// --------------------------------------------------------------------------
+
+const (
+    metricCounter = "counter"
+    metricGauge = "gauge"
+)
+
+type metricFamily struct {
+    kind string
+    help string
+    // rendered labels -> value
+    samples map[string]float64
+}
+
+type Metrics struct {
+    m sync.Mutex
+    families map[string]*metricFamily
+}
+
+func NewMetrics() (*Metrics) {
+    return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+func escapeLabel(value string) (string) {
+    return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+func renderLabels(labels []string) (string) {
+    if len(labels) == 0 {
+        return ""
+    }
+    pairs := []string{}
+    for i := 0; i + 1 < len(labels); i += 2 {
+        pairs = append(pairs, labels[i] + "=\"" + escapeLabel(labels[i + 1]) + "\"")
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Metrics) family(name string, kind string, help string) (*metricFamily) {
+    f, ok := m.families[name]
+    if !ok {
+        f = &metricFamily{kind: kind, help: help, samples: make(map[string]float64)}
+        m.families[name] = f
+    }
+    return f
+}
+
+// Describe registers a metric without samples, so that it is listed before
+// the first sample is recorded
+func (m *Metrics) Describe(name string, kind string, help string) {
+    if m == nil {
+        return
+    }
+    m.m.Lock()
+    m.family(name, kind, help)
+    m.m.Unlock()
+}
+
+// Add increments a counter
+func (m *Metrics) Add(name string, help string, value float64, labels ...string) {
+    if m == nil {
+        return
+    }
+    m.m.Lock()
+    m.family(name, metricCounter, help).samples[renderLabels(labels)] += value
+    m.m.Unlock()
+}
+
+func (m *Metrics) Inc(name string, help string, labels ...string) {
+    m.Add(name, help, 1, labels...)
+}
+
+// Set sets the value of a gauge
+func (m *Metrics) Set(name string, help string, value float64, labels ...string) {
+    if m == nil {
+        return
+    }
+    m.m.Lock()
+    m.family(name, metricGauge, help).samples[renderLabels(labels)] = value
+    m.m.Unlock()
+}
+
+// Replace replaces all samples of gauges at once, given by metric name and
+// rendered labels; used for gauges of objects which may disappear, so that
+// a scrape never sees them half updated
+func (m *Metrics) Replace(help map[string]string, samples map[string]map[string]float64) {
+    if m == nil {
+        return
+    }
+    m.m.Lock()
+    for name, s := range samples {
+        m.family(name, metricGauge, help[name]).samples = s
+    }
+    m.m.Unlock()
+}
+
+// Text returns all metrics in the Prometheus text format
+func (m *Metrics) Text() (string) {
+    m.m.Lock()
+    defer m.m.Unlock()
+    names := []string{}
+    for name := range m.families {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var out strings.Builder
+    for _, name := range names {
+        f := m.families[name]
+        fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind)
+        labels := []string{}
+        for l := range f.samples {
+            labels = append(labels, l)
+        }
+        sort.Strings(labels)
+        for _, l := range labels {
+            fmt.Fprintf(&out, "%s%s %s\n", name, l, strconv.FormatFloat(f.samples[l], 'f', -1, 64))
+        }
+    }
+    return out.String()
+}
+
+func (s *Daemon) metrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte(s.Metrics.Text()))
+}
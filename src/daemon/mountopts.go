@@ -0,0 +1,168 @@
+package daemon
+
+import (
+    "errors"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// --------------------------------------------------------------------------
+// Mount options
+//
+// Volumes are mounted with the daemon wide default options followed by the
+// options given on create (-o mountopts=noatime,noexec), so that options of
+// the volume win over the defaults, e.g. atime over a default noatime. Only
+// options from an allowlist are accepted; options like bind or loop would
+// give users of the docker API control over the host, and dev, suid and exec
+// would undo the hardening by nodev, nosuid and noexec. The defaults apply to
+// the volumes of every storage class and are checked against the filesystem
+// of each. The resulting list is stored with the volume when it is created
+// and used for every mount, a change of the defaults only applies to new
+// volumes. The exception are volumes created before mount options were
+// stored, which have none and are mounted with the current defaults.
+// --------------------------------------------------------------------------
+
+const (
+    MountOptionsOption = "mountopts"
+    ReadOnlyOption = "readonly"
+)
+
+// DefaultMountOptions harden volumes against device files and setuid
+// programs placed on them by a container
+var DefaultMountOptions = []string{"nodev", "nosuid"}
+
+// options accepted for every filesystem; the pattern validates the value of
+// key=value options, nil marks options without value. dev, suid and exec are
+// left out on purpose, they are the kernel defaults anyway.
+var mountOptionAllowlist = map[string]*regexp.Regexp{
+    "atime": nil, "noatime": nil, "relatime": nil, "strictatime": nil,
+    "diratime": nil, "nodiratime": nil, "lazytime": nil, "nolazytime": nil,
+    "nodev": nil, "nosuid": nil, "noexec": nil,
+    "sync": nil, "async": nil, "dirsync": nil, "ro": nil, "rw": nil,
+    "discard": nil, "nodiscard": nil,
+}
+
+// options accepted for a specific filesystem
+var fsMountOptionAllowlist = map[string]map[string]*regexp.Regexp{
+    "ext4": {
+        "data": regexp.MustCompile("^(ordered|journal|writeback)$"),
+        "commit": regexp.MustCompile("^[0-9]{1,4}$"),
+        "barrier": regexp.MustCompile("^[01]$"),
+        "errors": regexp.MustCompile("^(continue|remount-ro|panic)$"),
+        "journal_checksum": nil, "nojournal_checksum": nil,
+        "auto_da_alloc": nil, "noauto_da_alloc": nil,
+        "delalloc": nil, "nodelalloc": nil,
+        "dioread_lock": nil, "dioread_nolock": nil,
+        "user_xattr": nil, "nouser_xattr": nil, "acl": nil, "noacl": nil,
+    },
+    "xfs": {
+        "allocsize": regexp.MustCompile("^[0-9]{1,7}[kmg]?$"),
+        "logbufs": regexp.MustCompile("^[2-8]$"),
+        "logbsize": regexp.MustCompile("^(16|32|64|128|256)k$"),
+        "inode64": nil, "noinode64": nil, "largeio": nil, "nolargeio": nil,
+        "wsync": nil, "nouuid": nil,
+    },
+}
+
+// ParseMountOptions splits a comma separated list of mount options and
+// checks every option against the allowlist for the filesystem
+func ParseMountOptions(s string, fs string) ([]string, error) {
+    options := []string{}
+    for _, o := range strings.Split(s, ",") {
+        o = strings.TrimSpace(o)
+        if o == "" {
+            continue
+        }
+        if err := validateMountOption(o, fs); err != nil {
+            return nil, err
+        }
+        options = append(options, o)
+    }
+    return options, nil
+}
+
+// ParseDefaultMountOptions parses the daemon wide default options and checks
+// them against the filesystem of every storage class
+func ParseDefaultMountOptions(s string, classes *StorageClasses) ([]string, error) {
+    options := []string{}
+    for _, class := range classes.Classes {
+        fs := class.Filesystem
+        if fs == "" {
+            fs = DEFAULT_FILESYSTEM
+        }
+        parsed, err := ParseMountOptions(s, fs)
+        if err != nil {
+            return nil, errors.New(AsError(err).Message + " for the " + fs + " volumes of storage class " + class.Name)
+        }
+        options = parsed
+    }
+    return options, nil
+}
+
+func validateMountOption(option string, fs string) (error) {
+    kv := strings.SplitN(option, "=", 2)
+    pattern, ok := mountOptionAllowlist[kv[0]]
+    if !ok {
+        pattern, ok = fsMountOptionAllowlist[fs][kv[0]]
+    }
+    if !ok {
+        return InvalidArgument("Mount option " + option + " is not allowed")
+    }
+    if (pattern == nil) != (len(kv) == 1) || (pattern != nil && !pattern.MatchString(kv[1])) {
+        return InvalidArgument("Illegal value for mount option " + option)
+    }
+    return nil
+}
+
+// parseReadOnly returns whether the options request a read-only volume
+func parseReadOnly(options map[string]string) (bool, error) {
+    val, ok := options[ReadOnlyOption]
+    if !ok {
+        return false, nil
+    }
+    readOnly, err := strconv.ParseBool(val)
+    if err != nil {
+        return false, InvalidArgument("Illegal value " + val + " for option " + ReadOnlyOption + ", expected true or false")
+    }
+    return readOnly, nil
+}
+
+// volumeMountOptions returns the options a new volume is mounted with: the
+// defaults of the daemon, the options given on create and ro for read-only
+// volumes. Options specific to a filesystem are checked against fs.
+func (d *VolumeDriver) volumeMountOptions(options map[string]string, fs string) ([]string, bool, error) {
+    mountOptions := append([]string{}, d.DefaultMountOptions...)
+    if val, ok := options[MountOptionsOption]; ok {
+        parsed, err := ParseMountOptions(val, fs)
+        if err != nil {
+            return nil, false, err
+        }
+        mountOptions = append(mountOptions, parsed...)
+    }
+    readOnly, err := parseReadOnly(options)
+    if err != nil {
+        return nil, false, err
+    }
+    if readOnly {
+        mountOptions = append(mountOptions, "ro")
+    }
+    return mountOptions, readOnly, nil
+}
+
+// mountOptions returns the options a volume is mounted with. Volumes
+// created before mount options were stored get the current defaults.
+func (d *VolumeDriver) mountOptions(meta *VolumeMetadata) ([]string) {
+    if meta.MountOptions == nil {
+        return d.DefaultMountOptions
+    }
+    return meta.MountOptions
+}
+
+// mountArgs returns the arguments for mount to apply the options
+func mountArgs(options []string) ([]string) {
+    if len(options) == 0 {
+        return []string{}
+    }
+    return []string{"-o", strings.Join(options, ",")}
+}
@@ -0,0 +1,194 @@
+package daemon
+
+import (
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// OpenAPI document of the admin API
+//
+// The document is generated from the route table and the request and
+// response types, so it cannot drift from the implementation.
+// --------------------------------------------------------------------------
+
+const openAPIVersion = "3.0.3"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema returns the schema of a type, following the encoding/json rules
+// for field names and omitempty.
+func jsonSchema(t reflect.Type) (map[string]interface{}) {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    if t == timeType {
+        return map[string]interface{}{"type": "string", "format": "date-time"}
+    }
+    switch t.Kind() {
+    case reflect.Bool:
+        return map[string]interface{}{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+        return map[string]interface{}{"type": "integer", "format": "int32"}
+    case reflect.Int64, reflect.Uint64:
+        return map[string]interface{}{"type": "integer", "format": "int64"}
+    case reflect.Float32, reflect.Float64:
+        return map[string]interface{}{"type": "number"}
+    case reflect.String:
+        return map[string]interface{}{"type": "string"}
+    case reflect.Slice, reflect.Array:
+        return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+    case reflect.Map:
+        return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+    case reflect.Struct:
+        properties := make(map[string]interface{})
+        required := []string{}
+        for i := 0; i < t.NumField(); i++ {
+            f := t.Field(i)
+            if f.PkgPath != "" {
+                continue
+            }
+            // fields of embedded structs are promoted like encoding/json does
+            if f.Anonymous && f.Tag.Get("json") == "" && f.Type.Kind() == reflect.Struct {
+                embedded := jsonSchema(f.Type)
+                for k, v := range embedded["properties"].(map[string]interface{}) {
+                    properties[k] = v
+                }
+                if r, ok := embedded["required"].([]string); ok {
+                    required = append(required, r...)
+                }
+                continue
+            }
+            name := f.Name
+            omitempty := false
+            if tag := f.Tag.Get("json"); tag != "" {
+                parts := strings.Split(tag, ",")
+                if parts[0] == "-" {
+                    continue
+                }
+                if parts[0] != "" {
+                    name = parts[0]
+                }
+                for _, p := range parts[1:] {
+                    omitempty = omitempty || p == "omitempty"
+                }
+            }
+            properties[name] = jsonSchema(f.Type)
+            if !omitempty && f.Type.Kind() != reflect.Ptr {
+                required = append(required, name)
+            }
+        }
+        schema := map[string]interface{}{"type": "object", "properties": properties}
+        if len(required) > 0 {
+            schema["required"] = required
+        }
+        return schema
+    }
+    return map[string]interface{}{}
+}
+
+func schemaRef(t reflect.Type, schemas map[string]interface{}) (map[string]interface{}) {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    schemas[t.Name()] = jsonSchema(t)
+    return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+}
+
+func jsonContent(schema map[string]interface{}) (map[string]interface{}) {
+    return map[string]interface{}{adminContentType: map[string]interface{}{"schema": schema}}
+}
+
+func streamContent() (map[string]interface{}) {
+    schema := map[string]interface{}{"type": "string", "format": "binary"}
+    return map[string]interface{}{ExportContentType: map[string]interface{}{"schema": schema}}
+}
+
+// openAPIDocument builds the OpenAPI document for the routes
+func openAPIDocument(routes []adminRoute) (map[string]interface{}) {
+    schemas := make(map[string]interface{})
+    errorRef := schemaRef(reflect.TypeOf(ErrorResponse{}), schemas)
+    paths := make(map[string]interface{})
+    for _, route := range routes {
+        operation := map[string]interface{}{
+            "summary": route.Summary,
+            "operationId": strings.ToLower(route.Method) + operationName(route.Path),
+        }
+        parameters := []interface{}{}
+        for _, seg := range strings.Split(route.Path, "/") {
+            if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+                parameters = append(parameters, map[string]interface{}{
+                    "name": seg[1:len(seg)-1], "in": "path", "required": true,
+                    "schema": map[string]interface{}{"type": "string"},
+                })
+            }
+        }
+        for _, q := range route.Query {
+            parameters = append(parameters, map[string]interface{}{
+                "name": q.Name, "in": "query", "description": q.Description,
+                "schema": map[string]interface{}{"type": q.Type},
+            })
+        }
+        if len(parameters) > 0 {
+            operation["parameters"] = parameters
+        }
+        if route.StreamRequest {
+            operation["requestBody"] = map[string]interface{}{"required": true, "content": streamContent()}
+        } else if route.Request != nil {
+            operation["requestBody"] = map[string]interface{}{
+                "required": true,
+                "content": jsonContent(schemaRef(reflect.TypeOf(route.Request), schemas)),
+            }
+        }
+        success := map[string]interface{}{"description": http.StatusText(route.Status)}
+        if route.StreamResponse {
+            success["content"] = streamContent()
+        } else if route.Response != nil {
+            success["content"] = jsonContent(schemaRef(reflect.TypeOf(route.Response), schemas))
+        } else if route.Status != http.StatusNoContent {
+            success["content"] = jsonContent(map[string]interface{}{"type": "object"})
+        }
+        operation["responses"] = map[string]interface{}{
+            strconv.Itoa(route.Status): success,
+            "default": map[string]interface{}{"description": "Error", "content": jsonContent(errorRef)},
+        }
+        item, ok := paths[route.Path].(map[string]interface{})
+        if !ok {
+            item = make(map[string]interface{})
+            paths[route.Path] = item
+        }
+        item[strings.ToLower(route.Method)] = operation
+    }
+    return map[string]interface{}{
+        "openapi": openAPIVersion,
+        "info": map[string]interface{}{
+            "title": VolumeDriverName + " admin API",
+            "version": AdminApiVersion,
+        },
+        "components": map[string]interface{}{
+            "schemas": schemas,
+            "securitySchemes": map[string]interface{}{
+                "bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+            },
+        },
+        "security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+        "paths": paths,
+    }
+}
+
+// operationName turns /v1/volumes/{name}/snapshots into VolumesNameSnapshots
+func operationName(path string) (string) {
+    name := ""
+    for _, seg := range strings.Split(path, "/") {
+        seg = strings.Trim(seg, "{}")
+        if seg == "" || seg == AdminApiVersion {
+            continue
+        }
+        seg = strings.TrimSuffix(seg, ".json")
+        name += strings.ToUpper(seg[:1]) + seg[1:]
+    }
+    return name
+}
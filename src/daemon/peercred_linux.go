@@ -0,0 +1,26 @@
+package daemon
+
+import (
+    "net"
+    "syscall"
+)
+
+// peerCaller determines the process on the other side of a unix socket
+// connection using SO_PEERCRED.
+func peerCaller(c *net.UnixConn) (Caller) {
+    caller := Caller{Transport: "unix"}
+    raw, err := c.SyscallConn()
+    if err != nil {
+        return caller
+    }
+    var cred *syscall.Ucred
+    raw.Control(func(fd uintptr) {
+        cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+    })
+    if err == nil && cred != nil {
+        caller.Pid = &cred.Pid
+        caller.Uid = &cred.Uid
+        caller.Gid = &cred.Gid
+    }
+    return caller
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package daemon
+
+import (
+    "net"
+)
+
+// peerCaller cannot determine peer credentials on this platform.
+func peerCaller(c *net.UnixConn) (Caller) {
+    return Caller{Transport: "unix"}
+}
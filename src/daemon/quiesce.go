@@ -0,0 +1,372 @@
+package daemon
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Quiesce for snapshots
+//
+// A snapshot of a mounted filesystem is crash consistent only, writes in
+// flight are lost. A volume created with -o snapshot-freeze=true is frozen
+// with fsfreeze while lvcreate takes a snapshot of it, so that the
+// filesystem in the snapshot is clean; this applies to snapshots of the
+// admin API, to the snapshots of exports and backups and to thin clones.
+// The freeze blocks all writers and is limited by --freeze-timeout: an
+// lvcreate which takes longer is killed, and the volume is thawed on every
+// error.
+//
+// A volume created with -o snapshot-hook=<name> additionally runs the
+// commands of a hook configured by the operator in the file given with
+// --snapshot-hooks, e.g. to flush and lock a database:
+//
+//   {"hooks": [{"name": "postgres",
+//               "pre": ["/usr/local/bin/pg-checkpoint", "{volume}", "{mountpoint}"],
+//               "post": ["/usr/local/bin/pg-resume", "{volume}"],
+//               "timeout": "30s"}]}
+//
+// The pre command runs before the freeze; if it fails, no snapshot is
+// taken. The post command runs after the volume was thawed, also if the
+// snapshot failed; its failure is logged only. Volumes select hooks by name
+// only, a create option cannot run arbitrary commands. Unmounted volumes are
+// neither frozen nor are their hooks run.
+//
+// The frozen volumes are recorded in the state directory. Close waits for
+// the snapshots of frozen volumes to finish and thaws them, and does not let
+// new ones start; volumes a crashed daemon left frozen are thawed on start.
+// --------------------------------------------------------------------------
+
+const (
+    SnapshotFreezeOption = "snapshot-freeze"
+    SnapshotHookOption = "snapshot-hook"
+
+    DefaultFreezeTimeout = 30 * time.Second
+    defaultHookTimeout = time.Minute
+    // attempts to thaw a frozen volume before giving up
+    thawAttempts = 3
+    thawRetryDelay = time.Second
+    frozenStateFile = "frozen.json"
+)
+
+// quiesces tracks the running quiesced snapshots and the frozen volumes
+type quiesces struct {
+    m sync.Mutex
+    running sync.WaitGroup
+    closed bool
+    // mountpoints of the frozen volumes
+    frozen map[string]string
+}
+
+// QuiescePolicy is how a volume is prepared for a snapshot
+type QuiescePolicy struct {
+    Freeze bool `json:"freeze"`
+    // name of the snapshot hook
+    Hook string `json:"hook,omitempty"`
+}
+
+type SnapshotHook struct {
+    Name string `json:"name"`
+    // command lines run before and after the snapshot; {volume} and
+    // {mountpoint} in the arguments are replaced
+    Pre []string `json:"pre,omitempty"`
+    Post []string `json:"post,omitempty"`
+    // time after which a command is killed, default 1m
+    Timeout string `json:"timeout,omitempty"`
+    timeout time.Duration
+}
+
+type SnapshotHooks struct {
+    Hooks []*SnapshotHook `json:"hooks"`
+}
+
+// LoadSnapshotHooks reads the snapshot hooks from a JSON file
+func LoadSnapshotHooks(file string) (*SnapshotHooks, error) {
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    var h SnapshotHooks
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&h); err != nil {
+        return nil, errors.New("Illegal snapshot hooks in " + file + ": " + err.Error())
+    }
+    if err := h.validate(); err != nil {
+        return nil, errors.New("Illegal snapshot hooks in " + file + ": " + err.Error())
+    }
+    return &h, nil
+}
+
+func (h *SnapshotHooks) validate() (error) {
+    names := make(map[string]bool)
+    for _, hook := range h.Hooks {
+        if hook == nil || !classNamePattern.MatchString(hook.Name) {
+            return errors.New("snapshot hooks need a name of letters, digits and underscores")
+        }
+        if names[hook.Name] {
+            return errors.New("snapshot hook " + hook.Name + " is defined twice")
+        }
+        names[hook.Name] = true
+        if len(hook.Pre) == 0 && len(hook.Post) == 0 {
+            return errors.New("snapshot hook " + hook.Name + " has neither a pre nor a post command")
+        }
+        for _, cmd := range [][]string{hook.Pre, hook.Post} {
+            if len(cmd) > 0 && !filepath.IsAbs(cmd[0]) {
+                return errors.New("snapshot hook " + hook.Name + " has command " + cmd[0] + ", expected an absolute path")
+            }
+        }
+        hook.timeout = defaultHookTimeout
+        if hook.Timeout != "" {
+            t, err := time.ParseDuration(hook.Timeout)
+            if err != nil || t <= 0 {
+                return errors.New("snapshot hook " + hook.Name + " has an illegal timeout " + hook.Timeout)
+            }
+            hook.timeout = t
+        }
+    }
+    return nil
+}
+
+// Get returns the hook of the given name, nil if there is none
+func (h *SnapshotHooks) Get(name string) (*SnapshotHook) {
+    if h == nil {
+        return nil
+    }
+    for _, hook := range h.Hooks {
+        if hook.Name == name {
+            return hook
+        }
+    }
+    return nil
+}
+
+// parseQuiesce returns the quiesce policy given by the options, nil if the
+// volume is not prepared for snapshots
+func (d *VolumeDriver) parseQuiesce(options map[string]string) (*QuiescePolicy, error) {
+    p := &QuiescePolicy{}
+    if val, ok := options[SnapshotFreezeOption]; ok {
+        freeze, err := strconv.ParseBool(val)
+        if err != nil {
+            return nil, InvalidArgument("Illegal value " + val + " for option " + SnapshotFreezeOption + ", expected true or false")
+        }
+        p.Freeze = freeze
+    }
+    if val, ok := options[SnapshotHookOption]; ok {
+        if d.SnapshotHooks.Get(val) == nil {
+            return nil, InvalidArgument("Snapshot hook " + val + " is not configured, the daemon has to be started with --snapshot-hooks")
+        }
+        p.Hook = val
+    }
+    if !p.Freeze && p.Hook == "" {
+        return nil, nil
+    }
+    return p, nil
+}
+
+func (d *VolumeDriver) frozenStateFile() (string) {
+    if d.State == nil {
+        return ""
+    }
+    return filepath.Join(d.State.Dir, frozenStateFile)
+}
+
+// beginQuiesce registers a quiesced snapshot, which is refused once the
+// driver is closed
+func (d *VolumeDriver) beginQuiesce(name string) (error) {
+    q := &d.quiesces
+    q.m.Lock()
+    defer q.m.Unlock()
+    if q.closed {
+        return newError(CodeCanceled, "Daemon is shutting down, volume " + name + " cannot be quiesced for a snapshot")
+    }
+    q.running.Add(1)
+    return nil
+}
+
+func (d *VolumeDriver) endQuiesce() {
+    d.quiesces.running.Done()
+}
+
+// setFrozen records whether a volume is frozen, the record survives a crash
+// of the daemon
+func (d *VolumeDriver) setFrozen(name string, frozen bool) (error) {
+    q := &d.quiesces
+    q.m.Lock()
+    defer q.m.Unlock()
+    if q.frozen == nil {
+        q.frozen = make(map[string]string)
+    }
+    if frozen {
+        q.frozen[name] = d.getMountpoint(name)
+    } else {
+        delete(q.frozen, name)
+    }
+    file := d.frozenStateFile()
+    if file == "" {
+        return nil
+    }
+    if len(q.frozen) == 0 {
+        if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        return nil
+    }
+    data, err := json.MarshalIndent(q.frozen, "", "  ")
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(file, data, 0600)
+}
+
+// ThawStale thaws the volumes which a crashed daemon left frozen
+func (d *VolumeDriver) ThawStale(ctx context.Context) {
+    file := d.frozenStateFile()
+    if file == "" {
+        return
+    }
+    data, err := ioutil.ReadFile(file)
+    if err != nil {
+        return
+    }
+    l := LoggerFrom(ctx)
+    frozen := make(map[string]string)
+    if err := json.Unmarshal(data, &frozen); err != nil {
+        l.Warn("Ignoring corrupt state of frozen volumes", "path", file, "error", err)
+    }
+    for name, mountpoint := range frozen {
+        l.Warn("Thawing volume left frozen", "volume", name, "mountpoint", mountpoint)
+        if status := d.runCommand(ctx, "fsfreeze", []string{"-u", mountpoint}); status.status != 0 {
+            // not frozen anymore, e.g. after a reboot
+            l.Info("Volume left frozen cannot be thawed", "volume", name, "error", status.stderr)
+        }
+    }
+    if err := os.Remove(file); err != nil {
+        l.Warn("Cannot remove state of frozen volumes", "path", file, "error", err)
+    }
+}
+
+// closeQuiesces refuses new quiesced snapshots and waits for the running
+// ones, which thaw their volumes when done
+func (d *VolumeDriver) closeQuiesces() {
+    q := &d.quiesces
+    q.m.Lock()
+    q.closed = true
+    q.m.Unlock()
+    q.running.Wait()
+}
+
+func (d *VolumeDriver) freezeTimeout() (time.Duration) {
+    if d.FreezeTimeout > 0 {
+        return d.FreezeTimeout
+    }
+    return DefaultFreezeTimeout
+}
+
+// quiesced takes a snapshot of a volume with snapshot. A mounted volume with
+// a quiesce policy runs the pre command of its hook and is frozen before,
+// and is thawed and runs the post command of its hook afterwards, also if
+// the snapshot fails.
+func (d *VolumeDriver) quiesced(ctx context.Context, info *VolumeInfo, meta *VolumeMetadata, snapshot func(ctx context.Context) (error)) (error) {
+    p := meta.Quiesce
+    if p == nil || !info.Mounted {
+        return snapshot(ctx)
+    }
+    if err := d.beginQuiesce(info.Name); err != nil {
+        return err
+    }
+    defer d.endQuiesce()
+    l := LoggerFrom(ctx).With("volume", info.Name)
+    if p.Hook != "" {
+        hook := d.SnapshotHooks.Get(p.Hook)
+        if hook == nil {
+            return InvalidArgument("Snapshot hook " + p.Hook + " of volume " + info.Name + " is not configured")
+        }
+        if err := d.runHook(ctx, hook, hook.Pre, info.Name); err != nil {
+            return err
+        }
+        defer func() {
+            if err := d.runHook(context.WithoutCancel(ctx), hook, hook.Post, info.Name); err != nil {
+                l.Warn("Post command of snapshot hook failed", "hook", hook.Name, "error", err)
+            }
+        }()
+    }
+    if !p.Freeze {
+        return snapshot(ctx)
+    }
+    if err := d.setFrozen(info.Name, true); err != nil {
+        return Internal("Cannot record freeze of volume " + info.Name + ": " + err.Error())
+    }
+    if err := d.freeze(ctx, info.Name); err != nil {
+        d.setFrozen(info.Name, false)
+        return err
+    }
+    start := time.Now()
+    timeout := d.freezeTimeout()
+    frozenCtx, cancel := context.WithTimeout(ctx, timeout)
+    err := snapshot(frozenCtx)
+    expired := frozenCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+    cancel()
+    terr := d.thawFrozen(context.WithoutCancel(ctx), info.Name)
+    if terr == nil {
+        // a volume which stays frozen is thawed on the next start
+        if serr := d.setFrozen(info.Name, false); serr != nil {
+            l.Warn("Cannot record thaw of volume", "error", serr)
+        }
+    } else if err == nil {
+        err = terr
+    }
+    l.Info("Volume was frozen for the snapshot", "duration", time.Since(start).Round(time.Millisecond).String())
+    if err != nil && expired {
+        return newError(CodeTimeout, "Snapshot of volume " + info.Name + " did not finish within the freeze timeout of " + timeout.String())
+    }
+    return err
+}
+
+// thawFrozen thaws a volume frozen for a snapshot and retries if that
+// fails, a frozen volume blocks all writers
+func (d *VolumeDriver) thawFrozen(ctx context.Context, name string) (error) {
+    var err error
+    for i := 0; i < thawAttempts; i++ {
+        if i > 0 {
+            time.Sleep(thawRetryDelay)
+        }
+        if err = d.thaw(ctx, name); err == nil {
+            return nil
+        }
+        LoggerFrom(ctx).Warn("Cannot thaw volume", "volume", name, "attempt", i + 1, "error", err)
+    }
+    LoggerFrom(ctx).Error("Volume stays frozen, thaw it with fsfreeze -u", "volume", name, "mountpoint", d.getMountpoint(name))
+    return err
+}
+
+// runHook runs a command of a snapshot hook through the executor
+func (d *VolumeDriver) runHook(ctx context.Context, hook *SnapshotHook, cmd []string, volume string) (error) {
+    if len(cmd) == 0 {
+        return nil
+    }
+    r := strings.NewReplacer("{volume}", volume, "{mountpoint}", d.getMountpoint(volume))
+    args := make([]string, len(cmd) - 1)
+    for i, arg := range cmd[1:] {
+        args[i] = r.Replace(arg)
+    }
+    hookCtx, cancel := context.WithTimeout(ctx, hook.timeout)
+    defer cancel()
+    status := d.runCommand(hookCtx, cmd[0], args)
+    if hookCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+        return newError(CodeTimeout, "Command " + cmd[0] + " of snapshot hook " + hook.Name + " did not finish within " + hook.timeout.String())
+    }
+    if status.status != 0 {
+        return commandError(status, "Command " + cmd[0] + " of snapshot hook " + hook.Name + " failed: " + status.String())
+    }
+    return nil
+}
@@ -0,0 +1,281 @@
+package daemon
+
+import (
+    "context"
+    "errors"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// --------------------------------------------------------------------------
+// RAID and striped volumes
+//
+// Volumes are linear logical volumes by default. A volume created with
+// -o raid=raid1 is mirrored on -o mirrors=<n> additional physical volumes
+// (default 1), raid5 and raid6 stripe over -o stripes=<n> physical volumes
+// (default 2 and 3) plus one or two for the parity, and raid10 stripes over
+// -o stripes=<n> mirrors (default 2 with 1 additional copy each). -o
+// stripes=<n> without raid creates a striped volume, which is faster but
+// lost with any of its physical volumes. -o stripesize=<size> sets the
+// size of the stripes, e.g. 64K.
+//
+// The layout has to fit the number of physical volumes of the volume group
+// of the class, as LVM places the legs of a RAID volume on different ones;
+// thin volumes get the layout of their pool and take no layout options.
+// The sync of the legs and the health LVM reports are surfaced in Status of
+// the volume and a volume whose RAID has lost a leg fails the raid check of
+// /ready until it is repaired with lvconvert --repair.
+// --------------------------------------------------------------------------
+
+const (
+    RaidOption = "raid"
+    MirrorsOption = "mirrors"
+    StripesOption = "stripes"
+    StripeSizeOption = "stripesize"
+
+    RaidLevel1 = "raid1"
+    RaidLevel5 = "raid5"
+    RaidLevel6 = "raid6"
+    RaidLevel10 = "raid10"
+    // striping without redundancy
+    segtypeStriped = "striped"
+
+    // lv_health_status of RAID volumes which lost a leg
+    raidHealthPartial = "partial"
+    raidHealthRefresh = "refresh needed"
+)
+
+// RaidLayout is the layout of a RAID or striped volume
+type RaidLayout struct {
+    Type string `json:"type"`
+    // additional copies of raid1 and raid10
+    Mirrors int `json:"mirrors,omitempty"`
+    // data stripes of raid5, raid6, raid10 and striped volumes
+    Stripes int `json:"stripes,omitempty"`
+    // size of a stripe, the LVM default if zero
+    StripeSizeKB int `json:"stripe_size_kb,omitempty"`
+}
+
+// RaidStatus is the layout of a volume with the state LVM reports
+type RaidStatus struct {
+    RaidLayout
+    // percentage of the legs in sync, not set for striped volumes
+    SyncPercent *float64 `json:"sync_percent,omitempty"`
+    // lv_health_status of LVM, empty if healthy
+    Health string `json:"health,omitempty"`
+    // a leg is missing or failed
+    Degraded bool `json:"degraded"`
+}
+
+var stripeSizePattern = regexp.MustCompile("(?i)^([0-9]+)\\s*([KMG])?B?$")
+
+// parseStripeSize converts a stripe size (e.g. "64K", "1M", plain numbers
+// are KiB like with lvcreate) into KiB
+func parseStripeSize(s string) (int, error) {
+    m := stripeSizePattern.FindStringSubmatch(strings.TrimSpace(s))
+    v := 0
+    if m != nil {
+        v, _ = strconv.Atoi(m[1])
+        switch strings.ToUpper(m[2]) {
+        case "M":
+            v *= 1024
+        case "G":
+            v *= 1024 * 1024
+        }
+    }
+    if v < 4 || v & (v - 1) != 0 {
+        return 0, InvalidArgument("Illegal value " + s + " for option " + StripeSizeOption + ", expected a power of 2 of at least 4K")
+    }
+    return v, nil
+}
+
+// parseCount parses a number of mirrors or stripes of at least min
+func parseCount(options map[string]string, option string, min int, def int) (int, error) {
+    val, ok := options[option]
+    if !ok {
+        return def, nil
+    }
+    n, err := strconv.Atoi(strings.TrimSpace(val))
+    if err != nil || n < min {
+        return 0, InvalidArgument("Illegal value " + val + " for option " + option + ", expected a number of at least " + strconv.Itoa(min))
+    }
+    return n, nil
+}
+
+// parseRaid returns the layout given by the options, nil for linear volumes
+func parseRaid(options map[string]string) (*RaidLayout, error) {
+    level, raid := options[RaidOption]
+    _, mirrors := options[MirrorsOption]
+    _, stripes := options[StripesOption]
+    _, stripeSize := options[StripeSizeOption]
+    if !raid && !stripes {
+        for _, o := range []struct {
+            given bool
+            name string
+        }{{mirrors, MirrorsOption}, {stripeSize, StripeSizeOption}} {
+            if o.given {
+                return nil, InvalidArgument("Option " + o.name + " requires option " + RaidOption + " or " + StripesOption)
+            }
+        }
+        return nil, nil
+    }
+    l := &RaidLayout{Type: level}
+    var err error
+    switch level {
+    case RaidLevel1:
+        if stripes {
+            return nil, InvalidArgument("Option " + StripesOption + " is not supported for " + RaidLevel1)
+        }
+        l.Mirrors, err = parseCount(options, MirrorsOption, 1, 1)
+    case RaidLevel5, RaidLevel6:
+        if mirrors {
+            return nil, InvalidArgument("Option " + MirrorsOption + " is not supported for " + level)
+        }
+        if level == RaidLevel5 {
+            l.Stripes, err = parseCount(options, StripesOption, 2, 2)
+        } else {
+            l.Stripes, err = parseCount(options, StripesOption, 3, 3)
+        }
+    case RaidLevel10:
+        if l.Stripes, err = parseCount(options, StripesOption, 2, 2); err == nil {
+            l.Mirrors, err = parseCount(options, MirrorsOption, 1, 1)
+        }
+    case "":
+        if mirrors {
+            return nil, InvalidArgument("Option " + MirrorsOption + " requires option " + RaidOption)
+        }
+        l.Type = segtypeStriped
+        l.Stripes, err = parseCount(options, StripesOption, 2, 2)
+    default:
+        return nil, InvalidArgument("Illegal value " + level + " for option " + RaidOption + ", expected raid1, raid5, raid6 or raid10")
+    }
+    if err != nil {
+        return nil, err
+    }
+    if stripeSize {
+        if l.Type == RaidLevel1 {
+            return nil, InvalidArgument("Option " + StripeSizeOption + " is not supported for " + RaidLevel1)
+        }
+        if l.StripeSizeKB, err = parseStripeSize(options[StripeSizeOption]); err != nil {
+            return nil, err
+        }
+    }
+    return l, nil
+}
+
+// devices returns the number of physical volumes the layout needs
+func (l *RaidLayout) devices() (int) {
+    switch l.Type {
+    case RaidLevel1:
+        return l.Mirrors + 1
+    case RaidLevel5:
+        return l.Stripes + 1
+    case RaidLevel6:
+        return l.Stripes + 2
+    case RaidLevel10:
+        return l.Stripes * (l.Mirrors + 1)
+    }
+    return l.Stripes
+}
+
+// allocatedMB returns the space sizeMB of a volume with the layout take in
+// its volume group, the copies and parity included
+func (l *RaidLayout) allocatedMB(sizeMB int) (int) {
+    data := l.Stripes
+    if l.Type == RaidLevel1 || data < 1 {
+        data = 1
+    }
+    return sizeMB * l.devices() / data
+}
+
+// lvcreateArgs returns the arguments of lvcreate for the layout
+func (l *RaidLayout) lvcreateArgs() ([]string) {
+    args := []string{"--type", l.Type}
+    if l.Mirrors > 0 {
+        args = append(args, "-m", strconv.Itoa(l.Mirrors))
+    }
+    if l.Stripes > 0 {
+        args = append(args, "-i", strconv.Itoa(l.Stripes))
+    }
+    if l.StripeSizeKB > 0 {
+        args = append(args, "-I", strconv.Itoa(l.StripeSizeKB) + "k")
+    }
+    return args
+}
+
+// checkRaid refuses a layout the class cannot provide
+func (d *VolumeDriver) checkRaid(ctx context.Context, class *StorageClass, l *RaidLayout) (error) {
+    if l == nil {
+        return nil
+    }
+    if class.ThinPool != "" {
+        return InvalidArgument("Volumes of storage class " + class.Name + " are thin volumes, which have the layout of their pool; options " +
+            RaidOption + " and " + StripesOption + " are not supported")
+    }
+    vg, err := d.VolumeGroupInfo(ctx, class.VolumeGroup)
+    if err != nil {
+        return err
+    }
+    if n := l.devices(); n > vg.PvCount {
+        return InvalidArgument("A " + l.Type + " volume of this layout needs " + strconv.Itoa(n) + " physical volumes, volume group " +
+            vg.Name + " has " + strconv.Itoa(vg.PvCount))
+    }
+    return nil
+}
+
+// raidDegraded tells whether the health of a RAID volume means a lost leg
+func raidDegraded(health string) (bool) {
+    return health == raidHealthPartial || health == raidHealthRefresh
+}
+
+// newRaidStatus returns the status of a volume from a row of lvsReport with
+// sync_percent and lv_health_status
+func newRaidStatus(l *RaidLayout, row map[string]string) (*RaidStatus) {
+    s := &RaidStatus{RaidLayout: *l, Health: row["lv_health_status"]}
+    if v, err := strconv.ParseFloat(row["sync_percent"], 64); err == nil {
+        s.SyncPercent = &v
+    }
+    s.Degraded = raidDegraded(s.Health)
+    return s
+}
+
+// raidReportFields are the fields of lvsReport needed for the status of
+// RAID volumes
+var raidReportFields = []string{"sync_percent", "lv_health_status"}
+
+// raidStatus returns the status of a RAID or striped volume, nil for linear
+// volumes
+func (d *VolumeDriver) raidStatus(ctx context.Context, meta *VolumeMetadata) (*RaidStatus, error) {
+    if meta.Raid == nil {
+        return nil, nil
+    }
+    report, err := d.lvsReport(ctx, append([]string{"lv_name"}, raidReportFields...))
+    if err != nil {
+        return nil, err
+    }
+    for _, row := range report {
+        if row["lv_name"] == meta.Name {
+            return newRaidStatus(meta.Raid, row), nil
+        }
+    }
+    return nil, NotFound("Volume " + meta.Name + " does not exist")
+}
+
+// checkRaidHealth fails if a RAID volume has lost a leg
+func (d *VolumeDriver) checkRaidHealth(ctx context.Context) (error) {
+    report, err := d.lvsReport(ctx, []string{"lv_name", "lv_health_status"})
+    if err != nil {
+        return err
+    }
+    degraded := []string{}
+    for _, row := range report {
+        if strings.HasPrefix(row["segtype"], "raid") && raidDegraded(row["lv_health_status"]) {
+            degraded = append(degraded, row["lv_name"] + " (" + row["lv_health_status"] + ")")
+        }
+    }
+    if len(degraded) > 0 {
+        return errors.New("RAID volumes degraded: " + strings.Join(degraded, ", "))
+    }
+    return nil
+}
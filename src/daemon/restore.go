@@ -0,0 +1,234 @@
+package daemon
+
+import (
+    "bufio"
+    "context"
+    "io"
+    "strings"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Restore from the backup catalog
+//
+// A volume created with -o restore-from=<volume>/<backup id> gets the data
+// of a backup from the catalog of the backup target; restore-from=<backup
+// id> takes the backup from the catalog of the volume of the same name, e.g.
+// to bring back a removed volume, and latest instead of an id the newest
+// backup. The admin API restores a backup into a new volume as well.
+//
+// The chain of the backup is verified first, then the full backup is
+// imported and the incremental backups up to the one restored are applied
+// to the new volume, like the streams were imported one after the other;
+// the checksum of every stream is verified against its trailer and its
+// catalog record. The request lock is only held to set up and tear down,
+// create returns when the data is restored. A restore which fails removes
+// the new volume.
+//
+// The restored volume is complete: its filesystem gets a new UUID, so that
+// it can be mounted next to the volume it was backed up from, and no
+// further incremental backups can be imported into it. The logical volume
+// is tagged with lvmvd_restored_from=<volume>/<backup id> and the metadata
+// records the chain applied, so that restored data can be traced.
+// --------------------------------------------------------------------------
+
+const (
+    RestoreFromOption = "restore-from"
+    // newest backup of a volume
+    restoreLatest = "latest"
+
+    restoredTagPrefix = "lvmvd_restored_from="
+
+    metricRestore = "lvmvd_restore_total"
+    restoreHelp = "Restores from the backup catalog by result."
+)
+
+// RestoreInfo records the backup a volume was restored from
+type RestoreInfo struct {
+    Volume string `json:"volume"`
+    Backup string `json:"backup"`
+    // time the backup was taken
+    BackupCreated time.Time `json:"backup_created"`
+    // backups applied, from the full backup on
+    Backups []string `json:"backups"`
+    Restored time.Time `json:"restored"`
+}
+
+// parseRestoreFrom splits the value of option restore-from into the volume
+// whose catalog has the backup and the id of the backup. Without volume the
+// catalog of the volume name is used.
+func parseRestoreFrom(name string, val string) (string, string, error) {
+    volume, id := name, val
+    if i := strings.LastIndex(val, "/"); i >= 0 {
+        volume, id = val[:i], val[i+1:]
+    }
+    if err := validateName(volume); err != nil {
+        return "", "", InvalidArgument("Illegal value " + val + " for option " + RestoreFromOption + ", expected [<volume>/]<backup id>")
+    }
+    if id != restoreLatest && !backupIdPattern.MatchString(id) {
+        return "", "", InvalidArgument("Illegal value " + val + " for option " + RestoreFromOption + ", expected [<volume>/]<backup id>")
+    }
+    return volume, id, nil
+}
+
+// restoreChain returns the verified chain of a backup, of the newest backup
+// of the volume for latest
+func (d *VolumeDriver) restoreChain(ctx context.Context, volume string, id string) (*BackupChain, error) {
+    if id == restoreLatest {
+        records, err := d.ListBackups(ctx, volume)
+        if err != nil {
+            return nil, err
+        }
+        if len(records) == 0 {
+            return nil, NotFound("Volume " + volume + " has no backups")
+        }
+        id = records[len(records) - 1].Id
+    }
+    chain, err := d.BackupChain(ctx, volume, id)
+    if err != nil {
+        return nil, err
+    }
+    if !chain.Complete {
+        return nil, InvalidArgument("Backup " + id + " of volume " + volume + " cannot be restored: " + chain.Error)
+    }
+    return chain, nil
+}
+
+// openBackupStream opens the stream of a backup and reads its header
+func (d *VolumeDriver) openBackupStream(ctx context.Context, record *BackupRecord) (io.ReadCloser, *bufio.Reader, *ExportHeader, error) {
+    r, err := d.BackupTarget.Get(ctx, backupKey(record.Volume, record.Id, backupStreamSuffix))
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    in := bufio.NewReaderSize(r, transferFrameSize)
+    header, err := ReadExportHeader(in)
+    if err != nil {
+        r.Close()
+        return nil, nil, nil, InvalidArgument("Stream of backup " + record.Id + " is corrupt: " + err.Error())
+    }
+    return r, in, header, nil
+}
+
+// readBackupStream reads the payload of a backup into the volume of an
+// import and verifies it against the catalog record
+func (d *VolumeDriver) readBackupStream(ctx context.Context, job *transferJob, record *BackupRecord, in *bufio.Reader) (error) {
+    if err := d.ReadImport(ctx, job, in); err != nil {
+        return err
+    }
+    if job.trailer.Bytes != record.Bytes || job.trailer.SHA256 != record.SHA256 {
+        return InvalidArgument("Stream of backup " + record.Id + " does not match its catalog record, expected SHA-256 " + record.SHA256)
+    }
+    return nil
+}
+
+// applyBackup applies an incremental backup of a chain to the volume of a
+// restore, to which the backups before it have been applied
+func (d *VolumeDriver) applyBackup(ctx context.Context, job *transferJob, record *BackupRecord) (error) {
+    r, in, header, err := d.openBackupStream(ctx, record)
+    if err != nil {
+        return err
+    }
+    defer r.Close()
+    if header.Format != TransferFormatDelta || header.Backup != record.Id || header.Base != job.header.Backup ||
+        header.SizeMB != job.header.SizeMB {
+        return InvalidArgument("Stream of backup " + record.Id + " does not apply to backup " + job.header.Backup)
+    }
+    job.header = *header
+    LoggerFrom(ctx).Info("Applying incremental backup", "volume", job.name, "backup", record.Id)
+    return d.readBackupStream(ctx, job, record, in)
+}
+
+// markRestored tags the logical volume of a restore with its provenance and
+// records the chain applied in its metadata
+func (d *VolumeDriver) markRestored(ctx context.Context, job *transferJob, chain *BackupChain) (error) {
+    last := chain.Backups[len(chain.Backups) - 1]
+    meta, err := d.loadMetadata(job.name)
+    if err != nil {
+        return Internal("Cannot read metadata of volume " + job.name + ": " + err.Error())
+    }
+    tag := restoredTagPrefix + last.Volume + "/" + last.Id
+    if status := d.runCommand(ctx, "lvchange", []string{"--addtag", tag, d.getDeviceName(job.name)}); status.status != 0 {
+        return commandError(status, "Cannot tag restored volume " + job.name + ": " + status.stderr)
+    }
+    meta.RestoredFrom = &RestoreInfo{
+        Volume: last.Volume,
+        Backup: last.Id,
+        BackupCreated: last.Created,
+        Backups: []string{},
+        Restored: time.Now().UTC(),
+    }
+    for _, record := range chain.Backups {
+        meta.RestoredFrom.Backups = append(meta.RestoredFrom.Backups, record.Id)
+    }
+    return d.saveMetadata(meta)
+}
+
+// Restore creates the volume name from the backup given by option
+// restore-from with the other options. The request lock is only held to
+// set up and to finish the restore.
+func (s *Daemon) Restore(ctx context.Context, name string, options map[string]string) (error) {
+    create := make(map[string]string)
+    for k, v := range options {
+        if k != RestoreFromOption {
+            create[k] = v
+        }
+    }
+    volume, id, err := parseRestoreFrom(name, options[RestoreFromOption])
+    if err != nil {
+        return err
+    }
+    if _, ok := create[CloneFromOption]; ok {
+        return InvalidArgument("Options " + RestoreFromOption + " and " + CloneFromOption + " exclude each other")
+    }
+    err = s.restore(ctx, name, volume, id, create)
+    result := BackupSucceeded
+    if err != nil {
+        result = BackupFailed
+    }
+    s.Metrics.Inc(metricRestore, restoreHelp, "result", result)
+    return err
+}
+
+func (s *Daemon) restore(ctx context.Context, name string, volume string, id string, options map[string]string) (error) {
+    d := s.driver
+    if err := validateName(name); err != nil {
+        return err
+    }
+    chain, err := d.restoreChain(ctx, volume, id)
+    if err != nil {
+        return err
+    }
+    l := LoggerFrom(ctx).With("volume", name, "from", volume)
+    ctx = WithLogger(ctx, l)
+    full := &chain.Backups[0]
+    r, in, header, err := d.openBackupStream(ctx, full)
+    if err != nil {
+        return err
+    }
+    defer r.Close()
+    s.m.Lock("restore " + name)
+    job, err := d.StartImport(ctx, name, options, header)
+    s.m.Unlock()
+    if err != nil {
+        return err
+    }
+    l.Info("Restoring backup", "backup", chain.Backups[len(chain.Backups) - 1].Id, "backups", len(chain.Backups))
+    err = d.readBackupStream(ctx, job, full, in)
+    for i := 1; err == nil && i < len(chain.Backups); i++ {
+        err = d.applyBackup(ctx, job, &chain.Backups[i])
+    }
+    s.m.Lock("restore " + name)
+    defer s.m.Unlock()
+    bg := context.WithoutCancel(ctx)
+    if err == nil {
+        err = d.markRestored(bg, job, chain)
+    }
+    // the volume has the image of the full backup with the changes applied:
+    // it gets a new filesystem UUID now and leaves the chain
+    job.header.Format, job.header.Backup, job.header.Base = full.Format, "", ""
+    if err = d.FinishImport(bg, job, err); err != nil {
+        return err
+    }
+    l.Info("Volume restored", "backup", chain.Backups[len(chain.Backups) - 1].Id)
+    return nil
+}
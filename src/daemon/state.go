@@ -0,0 +1,189 @@
+package daemon
+
+import (
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Persistent state
+//
+// The driver keeps metadata about each volume it created in a JSON file per
+// volume below the state directory. LVM itself stays the source of truth for
+// which volumes exist; the metadata records what cannot be derived from LVM,
+// e.g. the options a volume was created with.
+// --------------------------------------------------------------------------
+
+const (
+    DefaultStateDir = "/var/lib/lvm-volume-driver"
+    stateFileSuffix = ".json"
+)
+
+type VolumeMetadata struct {
+    Name string `json:"name"`
+    Created time.Time `json:"created"`
+    // docker asked to remove the volume and the removal failed, see gc.go
+    RemoveRequested *time.Time `json:"remove_requested,omitempty"`
+    Options map[string]string `json:"options,omitempty"`
+    // set for snapshots
+    Origin string `json:"origin,omitempty"`
+    // LUKS formatted, see encryption.go
+    Encrypted bool `json:"encrypted,omitempty"`
+    // options for every mount, see mountopts.go; null for volumes created
+    // before options were stored
+    MountOptions []string `json:"mount_options"`
+    ReadOnly bool `json:"readonly,omitempty"`
+    // last check of the filesystem before a mount, see fsck.go
+    Fsck *FsckResult `json:"fsck,omitempty"`
+    // growth when the volume fills up, see autogrow.go
+    AutoGrow *AutoGrowPolicy `json:"autogrow,omitempty"`
+    // storage class and where the volume lives, see classes.go; empty for
+    // volumes created before storage classes
+    Class string `json:"class,omitempty"`
+    VolumeGroup string `json:"volume_group,omitempty"`
+    ThinPool string `json:"thin_pool,omitempty"`
+    // ext4 if empty
+    Filesystem string `json:"filesystem,omitempty"`
+    // set for clones, see clone.go
+    Clone *CloneStatus `json:"clone,omitempty"`
+    // merge of a snapshot into this volume which is not finished, see
+    // merge.go
+    Merge *MergeStatus `json:"merge,omitempty"`
+    // set while the volume is being imported, see transfer.go
+    Importing bool `json:"importing,omitempty"`
+    // backup schedule and result of the last backup, see backup.go
+    Backup *BackupPolicy `json:"backup,omitempty"`
+    LastBackup *BackupStatus `json:"last_backup,omitempty"`
+    // snapshot kept for the next incremental backup, see incremental.go
+    BackupBase *BackupBase `json:"backup_base,omitempty"`
+    // last backup imported into the volume while it was not mounted yet;
+    // the filesystem gets a new UUID at the first mount
+    ImportedBackup string `json:"imported_backup,omitempty"`
+    RenewUUID bool `json:"renew_uuid,omitempty"`
+    // freeze and hook around snapshots, see quiesce.go
+    Quiesce *QuiescePolicy `json:"quiesce,omitempty"`
+    // limits of the I/O and the io.max entry applied while mounted, see
+    // iolimits.go
+    IOLimits *IOLimits `json:"io_limits,omitempty"`
+    IOMax string `json:"io_max,omitempty"`
+    // layout of RAID and striped volumes, see raid.go
+    Raid *RaidLayout `json:"raid,omitempty"`
+    // backup the volume was restored from, see restore.go
+    RestoredFrom *RestoreInfo `json:"restored_from,omitempty"`
+}
+
+type StateStore struct {
+    Dir string
+    m sync.Mutex
+}
+
+func NewStateStore(dir string) (*StateStore, error) {
+    if err := os.MkdirAll(filepath.Join(dir, "volumes"), 0700); err != nil {
+        return nil, err
+    }
+    return &StateStore{Dir: dir}, nil
+}
+
+func (s *StateStore) volumeFile(name string) (string) {
+    return filepath.Join(s.Dir, "volumes", name + stateFileSuffix)
+}
+
+// writeFileAtomic replaces the file so that readers never see partial content
+func writeFileAtomic(filename string, data []byte, mode os.FileMode) (error) {
+    tmp := filename + ".tmp"
+    f, err := os.OpenFile(tmp, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, mode)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        os.Remove(tmp)
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        os.Remove(tmp)
+        return err
+    }
+    if err := f.Close(); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return os.Rename(tmp, filename)
+}
+
+// Load returns the metadata of a volume or nil if there is none, e.g. for
+// volumes created by older versions of the driver.
+func (s *StateStore) Load(name string) (*VolumeMetadata, error) {
+    s.m.Lock()
+    defer s.m.Unlock()
+    data, err := ioutil.ReadFile(s.volumeFile(name))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    var meta VolumeMetadata
+    if err := json.Unmarshal(data, &meta); err != nil {
+        return nil, errors.New("Corrupt metadata for volume " + name + ": " + err.Error())
+    }
+    return &meta, nil
+}
+
+func (s *StateStore) Save(meta *VolumeMetadata) (error) {
+    data, err := json.MarshalIndent(meta, "", "  ")
+    if err != nil {
+        return err
+    }
+    s.m.Lock()
+    defer s.m.Unlock()
+    return writeFileAtomic(s.volumeFile(meta.Name), data, 0600)
+}
+
+func (s *StateStore) Delete(name string) (error) {
+    s.m.Lock()
+    defer s.m.Unlock()
+    if err := os.Remove(s.volumeFile(name)); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+// Names returns the names of all volumes with metadata
+func (s *StateStore) Names() ([]string, error) {
+    s.m.Lock()
+    defer s.m.Unlock()
+    entries, err := ioutil.ReadDir(filepath.Join(s.Dir, "volumes"))
+    if err != nil {
+        return nil, err
+    }
+    names := []string{}
+    for _, e := range entries {
+        if !e.IsDir() && strings.HasSuffix(e.Name(), stateFileSuffix) {
+            names = append(names, strings.TrimSuffix(e.Name(), stateFileSuffix))
+        }
+    }
+    sort.Strings(names)
+    return names, nil
+}
+
+// Check verifies that the state directory can be read and written
+func (s *StateStore) Check() (error) {
+    if _, err := s.Names(); err != nil {
+        return err
+    }
+    f, err := ioutil.TempFile(s.Dir, ".check")
+    if err != nil {
+        return err
+    }
+    f.Close()
+    return os.Remove(f.Name())
+}
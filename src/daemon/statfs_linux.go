@@ -0,0 +1,19 @@
+package daemon
+
+import (
+    "syscall"
+)
+
+// statfs returns the usage of the filesystem mounted on path
+func statfs(path string) (FsUsage, error) {
+    var st syscall.Statfs_t
+    if err := syscall.Statfs(path, &st); err != nil {
+        return FsUsage{}, err
+    }
+    bsize := uint64(st.Bsize)
+    return FsUsage{
+        SizeBytes: st.Blocks * bsize,
+        UsedBytes: (st.Blocks - st.Bfree) * bsize,
+        AvailBytes: st.Bavail * bsize,
+    }, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package daemon
+
+import (
+    "errors"
+)
+
+// statfs is not supported on this platform.
+func statfs(path string) (FsUsage, error) {
+    return FsUsage{}, errors.New("statfs is not supported on this platform")
+}
@@ -0,0 +1,1051 @@
+package daemon
+
+import (
+    "bufio"
+    "compress/gzip"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Volume export and import
+//
+// A volume is exported as a stream which another daemon imports into a new
+// volume, e.g. to move a service to another host. The stream is either the
+// raw block device or a tar archive of the filesystem, optionally
+// compressed with gzip or zstd. Exports read from a snapshot, so that the
+// volume can stay in use and the stream is consistent: thin volumes get a
+// thin snapshot, mounted thick volumes a snapshot of their size; an
+// unmounted thick volume is read directly and cannot be mounted meanwhile.
+// The snapshot is tagged and hidden from all listings, and removed when the
+// export is done or at the next start of the daemon.
+//
+// Encrypted volumes are exported decrypted through their opened LUKS
+// container and imported into a new encrypted volume with a key of its own,
+// the keys never leave the host. The stream carries the data in the clear,
+// it should therefore only travel over https.
+//
+// Stream format:
+//
+//   LVMVD-EXPORT 1\n
+//   {header as JSON}\n
+//   frames of <4 byte big endian length><payload>, a frame of length 0 ends
+//   the payload
+//   {trailer as JSON}\n
+//
+// The trailer has the length and the SHA-256 of the uncompressed payload.
+// Incremental backups have a payload of format delta, see incremental.go.
+// The payload is streamed without the request lock; the lock is only held
+// to set up and tear down. An import which fails, e.g. because the stream is
+// truncated or its checksum does not match, removes the new volume.
+// --------------------------------------------------------------------------
+
+const (
+    TransferFormatRaw = "raw"
+    TransferFormatTar = "tar"
+    // changed blocks of incremental backups, not exported otherwise
+    TransferFormatDelta = "delta"
+
+    CompressionNone = "none"
+    CompressionGzip = "gzip"
+    CompressionZstd = "zstd"
+
+    ExportContentType = "application/octet-stream"
+
+    exportMagic = "LVMVD-EXPORT 1\n"
+    exportTag = "lvmvd_export"
+    exportNamePrefix = "lvmvd-export-"
+    // directory below the state directory with the mountpoints of
+    // filesystems being exported or imported
+    transferDir = "transfers"
+    transferFrameSize = 1024 * 1024
+    // larger frames are corrupt, whatever wrote them
+    maxTransferFrame = 16 * 1024 * 1024
+    maxTransferLine = 64 * 1024
+)
+
+var transferFormats = []string{TransferFormatRaw, TransferFormatTar}
+var compressions = []string{CompressionNone, CompressionGzip, CompressionZstd}
+
+// ExportHeader describes the exported volume, an import creates the new
+// volume like it by default
+type ExportHeader struct {
+    Name string `json:"name"`
+    Format string `json:"format"`
+    Compression string `json:"compression"`
+    SizeMB int64 `json:"size_mb"`
+    Filesystem string `json:"filesystem"`
+    Encrypted bool `json:"encrypted"`
+    MountOptions []string `json:"mount_options"`
+    ReadOnly bool `json:"readonly,omitempty"`
+    Created time.Time `json:"created"`
+    // id of the backup the stream is stored as and, for delta streams, of
+    // the backup it applies to
+    Backup string `json:"backup,omitempty"`
+    Base string `json:"base,omitempty"`
+}
+
+type ExportTrailer struct {
+    // length of the uncompressed payload
+    Bytes int64 `json:"bytes"`
+    SHA256 string `json:"sha256"`
+}
+
+type transferJob struct {
+    name string
+    export bool
+    header ExportHeader
+    // snapshot an export reads from, empty if it reads the volume itself
+    snapshot string
+    // device the payload is read from or written to
+    device string
+    // the LUKS container was opened for the transfer
+    opened bool
+    // mountpoint of the filesystem for tar
+    mountpoint string
+    // length and checksum of the payload, set when the export is written
+    // or the import has been read
+    trailer ExportTrailer
+    // ranges written by a delta export
+    delta []deltaExtent
+    // the snapshot is kept as base of the next backup if the backup
+    // succeeds
+    keepSnapshot bool
+}
+
+// source returns the volume the data is read from or written to
+func (j *transferJob) source() (string) {
+    if j.snapshot != "" {
+        return j.snapshot
+    }
+    return j.name
+}
+
+// transfers keeps the running exports and imports
+type transfers struct {
+    m sync.Mutex
+    jobs map[*transferJob]bool
+}
+
+func (t *transfers) add(job *transferJob) {
+    if t == nil {
+        return
+    }
+    t.m.Lock()
+    t.jobs[job] = true
+    t.m.Unlock()
+}
+
+func (t *transfers) remove(job *transferJob) {
+    if t == nil {
+        return
+    }
+    t.m.Lock()
+    delete(t.jobs, job)
+    t.m.Unlock()
+}
+
+// find returns the first job for which match is true
+func (t *transfers) find(match func(job *transferJob) (bool)) (*transferJob) {
+    if t == nil {
+        return nil
+    }
+    t.m.Lock()
+    defer t.m.Unlock()
+    for job := range t.jobs {
+        if match(job) {
+            return job
+        }
+    }
+    return nil
+}
+
+// names returns the volumes and snapshots the running transfers read from
+// or write to
+func (t *transfers) names() ([]string) {
+    names := []string{}
+    if t == nil {
+        return names
+    }
+    t.m.Lock()
+    defer t.m.Unlock()
+    for job := range t.jobs {
+        names = append(names, job.source())
+    }
+    return names
+}
+
+// transferBusy refuses changes of a volume being imported and of a volume
+// an export reads directly
+func (d *VolumeDriver) transferBusy(name string) (error) {
+    job := d.transfers.find(func(job *transferJob) (bool) {
+        return job.name == name && job.snapshot == ""
+    })
+    switch {
+    case job == nil:
+        return nil
+    case job.export:
+        return InUse("Volume " + name + " is being exported")
+    }
+    return InUse("Volume " + name + " is being imported")
+}
+
+// exportBusy refuses the removal of a volume being exported, which would
+// take the snapshot of the export with it
+func (d *VolumeDriver) exportBusy(name string) (error) {
+    if job := d.transfers.find(func(job *transferJob) (bool) { return job.export && job.name == name }); job != nil {
+        return InUse("Volume " + name + " is being exported")
+    }
+    return nil
+}
+
+// transferring reports whether a volume or snapshot is used by a running
+// export or import, reconciliation and garbage collection leave it alone
+func (d *VolumeDriver) transferring(name string) (bool) {
+    return d.transfers.find(func(job *transferJob) (bool) {
+        return (!job.export && job.name == name) || (job.snapshot != "" && job.snapshot == name)
+    }) != nil
+}
+
+func (d *VolumeDriver) transferMountpoint(name string) (string) {
+    dir := DefaultStateDir
+    if d.State != nil {
+        dir = d.State.Dir
+    }
+    return filepath.Join(dir, transferDir, name)
+}
+
+// StartTransfers sets up the bookkeeping of running transfers and removes
+// what exports and imports interrupted by a restart left behind: the
+// snapshots of exports and the volumes which were not completely imported.
+func (d *VolumeDriver) StartTransfers(ctx context.Context) (error) {
+    d.transfers = &transfers{jobs: make(map[*transferJob]bool)}
+    l := DefaultLogger().With("component", "transfers")
+    ctx = WithLogger(ctx, l)
+    bases := make(map[string]string)
+    for _, vg := range d.Classes.VolumeGroups() {
+        status := d.runCommand(ctx, "lvs", []string{"--noheadings", "--separator", lvsSeparator, "-o", "lv_name,lv_tags", vg})
+        if status.status != 0 {
+            return commandError(status, status.String())
+        }
+        for _, line := range strings.Split(status.stdout, "\n") {
+            values := strings.SplitN(strings.TrimSpace(line), lvsSeparator, 2)
+            if len(values) == 2 && hasTag(values[1], backupBaseTag) {
+                bases[strings.TrimSpace(values[0])] = vg
+            }
+            if len(values) == 2 && hasTag(values[1], exportTag) {
+                name := strings.TrimSpace(values[0])
+                l.Warn("Removing snapshot of an export interrupted by a restart", "snapshot", name)
+                d.releaseTransfer(ctx, &transferJob{export: true, snapshot: name, opened: true,
+                    mountpoint: d.transferMountpoint(name)})
+            }
+        }
+    }
+    d.removeOrphanedBases(ctx, bases)
+    if d.State == nil {
+        return nil
+    }
+    names, err := d.State.Names()
+    if err != nil {
+        return err
+    }
+    for _, name := range names {
+        meta, err := d.State.Load(name)
+        if err != nil || meta == nil || !meta.Importing {
+            continue
+        }
+        l.Warn("Removing volume of an import interrupted by a restart", "volume", name)
+        job := &transferJob{name: name, opened: meta.Encrypted, mountpoint: d.transferMountpoint(name)}
+        if err := d.releaseTransfer(ctx, job); err == nil {
+            err = d.removeLogicalVolume(ctx, name)
+        }
+        if err != nil {
+            l.Error("Cannot remove volume of interrupted import", "volume", name, "error", err)
+        }
+    }
+    return nil
+}
+
+func parseTransferFormat(format string, compression string) (string, string, error) {
+    if format == "" {
+        format = TransferFormatRaw
+    }
+    if compression == "" {
+        compression = CompressionNone
+    }
+    if !stringInList(format, transferFormats) {
+        return "", "", InvalidArgument("Unknown export format " + format + ", expected " + strings.Join(transferFormats, " or "))
+    }
+    if !stringInList(compression, compressions) {
+        return "", "", InvalidArgument("Unknown compression " + compression + ", expected " + strings.Join(compressions, ", "))
+    }
+    return format, compression, nil
+}
+
+// StartExport prepares the export of a volume: the snapshot is taken, an
+// encrypted volume opened and, for tar, the filesystem mounted read-only.
+// The export has to be finished with FinishExport.
+func (d *VolumeDriver) StartExport(ctx context.Context, name string, format string, compression string) (*transferJob, error) {
+    return d.startExport(ctx, name, format, compression, false)
+}
+
+// startExport prepares an export, with snapshot also of an unmounted thick
+// volume so that it can be mounted meanwhile. Thick snapshots cannot be
+// snapshotted and are always read directly.
+func (d *VolumeDriver) startExport(ctx context.Context, name string, format string, compression string, snapshot bool) (*transferJob, error) {
+    format, compression, err := parseTransferFormat(format, compression)
+    if err != nil {
+        return nil, err
+    }
+    info, err := d.InspectVolume(ctx, name)
+    if err != nil {
+        return nil, err
+    }
+    meta, err := d.loadMetadata(name)
+    if err != nil {
+        return nil, Internal("Cannot read metadata of volume " + name + ": " + err.Error())
+    }
+    if err := checkCloneComplete(meta); err != nil {
+        return nil, err
+    }
+    for _, busy := range []func(string) (error){d.cloneBusy, d.mergeBusy, d.transferBusy} {
+        if err := busy(name); err != nil {
+            return nil, err
+        }
+    }
+    if info.Encrypted {
+        if err := d.requireKeyProvider(); err != nil {
+            return nil, err
+        }
+    }
+    thin := info.ThinPool != ""
+    if !thin && info.Mounted && info.Origin != "" {
+        return nil, InUse("Snapshot " + name + " is mounted, LVM cannot take a snapshot of it; unmount it for the export")
+    }
+    job := &transferJob{name: name, export: true, header: ExportHeader{
+        Name: name,
+        Format: format,
+        Compression: compression,
+        SizeMB: info.SizeMB,
+        Filesystem: info.Filesystem,
+        Encrypted: info.Encrypted,
+        MountOptions: meta.MountOptions,
+        ReadOnly: meta.ReadOnly,
+        Created: time.Now().UTC(),
+    }}
+    l := LoggerFrom(ctx).With("volume", name)
+    if thin || info.Mounted || (snapshot && info.Origin == "") {
+        if job.snapshot, err = d.exportSnapshot(ctx, info, meta); err != nil {
+            return nil, err
+        }
+        l = l.With("snapshot", job.snapshot)
+    }
+    d.transfers.add(job)
+    if err := d.openTransfer(ctx, job, info.Encrypted); err != nil {
+        d.FinishExport(ctx, job)
+        return nil, err
+    }
+    l.Info("Export started", "format", format, "compression", compression)
+    return job, nil
+}
+
+// exportSnapshot takes the hidden snapshot an export or the copy of a clone
+// reads from. It gets metadata and, if encrypted, a key like other
+// snapshots, until it is removed by releaseTransfer.
+func (d *VolumeDriver) exportSnapshot(ctx context.Context, info *VolumeInfo, meta *VolumeMetadata) (string, error) {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return "", Internal("Cannot generate name: " + err.Error())
+    }
+    snapshot := exportNamePrefix + hex.EncodeToString(b)
+    if info.Encrypted {
+        if err := d.KeyProvider.CopyKey(ctx, info.Name, snapshot); err != nil {
+            return "", err
+        }
+    }
+    args := []string{"-s", "--addtag", exportTag, "-n", snapshot, info.VolumeGroup + "/" + info.Name}
+    if info.ThinPool != "" {
+        // -kn: thin snapshots are skipped on activation by default
+        args = append([]string{"-kn"}, args...)
+    } else {
+        // the size of the origin, so that the snapshot cannot overflow
+        args = append([]string{"-L", strconv.FormatInt(info.SizeMB, 10) + "M"}, args...)
+    }
+    err := d.quiesced(ctx, info, meta, func(ctx context.Context) (error) {
+        if status := d.runCommand(ctx, "lvcreate", args); status.status != 0 {
+            return commandError(status, "Cannot create hidden snapshot of volume " + info.Name + ": " + status.stderr)
+        }
+        return nil
+    })
+    if err == nil {
+        if err = d.saveMetadata(&VolumeMetadata{
+            Name: snapshot,
+            Created: time.Now().UTC(),
+            Origin: info.Name,
+            Encrypted: info.Encrypted,
+            Class: info.Class,
+            VolumeGroup: info.VolumeGroup,
+            ThinPool: info.ThinPool,
+            Filesystem: meta.Filesystem,
+        }); err != nil {
+            d.runCommand(ctx, "lvremove", []string{"-f", d.devicePath(info.VolumeGroup, snapshot)})
+        }
+    }
+    if err == nil {
+        return snapshot, nil
+    }
+    if info.Encrypted {
+        if err := d.KeyProvider.DeleteKey(ctx, snapshot); err != nil {
+            LoggerFrom(ctx).Warn("Cannot delete key of volume", "volume", snapshot, "error", err)
+        }
+    }
+    return "", err
+}
+
+// openTransfer opens the LUKS container of the volume the data is read from
+// or written to and mounts its filesystem for tar
+func (d *VolumeDriver) openTransfer(ctx context.Context, job *transferJob, encrypted bool) (error) {
+    source := job.source()
+    job.device = d.getDeviceName(source)
+    if encrypted {
+        open, err := d.isOpen(ctx, source)
+        if err != nil {
+            return err
+        }
+        if job.device, err = d.openEncrypted(ctx, source); err != nil {
+            return err
+        }
+        job.opened = !open
+    }
+    if job.header.Format != TransferFormatTar {
+        return nil
+    }
+    mp := d.transferMountpoint(source)
+    if err := os.MkdirAll(mp, 0700); err != nil {
+        return Internal("Cannot create mountpoint: " + err.Error())
+    }
+    job.mountpoint = mp
+    var options []string
+    if job.export {
+        options = []string{"ro"}
+        // the snapshot has the UUID of its mounted origin
+        if job.header.Filesystem == "xfs" {
+            options = append(options, "nouuid")
+        }
+    }
+    return d.mount(ctx, job.device, mp, mountArgs(options))
+}
+
+// releaseTransfer unmounts the filesystem and closes the LUKS container
+// opened for a transfer and removes the snapshot of an export
+func (d *VolumeDriver) releaseTransfer(ctx context.Context, job *transferJob) (error) {
+    l := LoggerFrom(ctx)
+    var err error
+    if job.mountpoint != "" {
+        if _, serr := os.Stat(job.mountpoint); serr == nil {
+            if mounted, merr := d.transferMounted(ctx, job.mountpoint); merr != nil {
+                err = merr
+            } else if mounted {
+                err = d.unmount(ctx, job.mountpoint)
+            }
+            if err == nil {
+                if status := d.runCommand(ctx, "rmdir", []string{job.mountpoint}); status.status != 0 {
+                    l.Warn("Cannot remove mountpoint of transfer", "mountpoint", job.mountpoint, "error", status.String())
+                }
+            }
+        }
+    }
+    source := job.source()
+    if err == nil && job.opened {
+        err = d.closeEncrypted(ctx, source)
+    }
+    if err != nil || job.snapshot == "" {
+        return err
+    }
+    meta, merr := d.loadMetadata(job.snapshot)
+    if merr != nil {
+        return Internal("Cannot read metadata of volume " + job.snapshot + ": " + merr.Error())
+    }
+    if status := d.runCommand(ctx, "lvremove", []string{"-f", d.getDeviceName(job.snapshot)}); status.status != 0 {
+        return commandError(status, "Cannot remove snapshot " + job.snapshot + " of export: " + status.stderr)
+    }
+    if meta.Encrypted && d.KeyProvider != nil {
+        if err := d.KeyProvider.DeleteKey(ctx, job.snapshot); err != nil {
+            l.Warn("Cannot delete key of export snapshot", "snapshot", job.snapshot, "error", err)
+        }
+    }
+    if d.State != nil {
+        if err := d.State.Delete(job.snapshot); err != nil {
+            l.Warn("Cannot delete metadata of export snapshot", "snapshot", job.snapshot, "error", err)
+        }
+    }
+    return nil
+}
+
+// transferMounted reports whether a filesystem is mounted on the mountpoint
+// of a transfer
+func (d *VolumeDriver) transferMounted(ctx context.Context, mountpoint string) (bool, error) {
+    status := d.runCommand(ctx, "mount", []string{})
+    if status.status != 0 {
+        return false, commandError(status, "Unable to retrieve mountpoints: " + status.stderr)
+    }
+    for _, line := range strings.Split(status.stdout, "\n") {
+        if fields := strings.Fields(line); len(fields) > 2 && fields[2] == mountpoint {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+// FinishExport releases what the export set up
+func (d *VolumeDriver) FinishExport(ctx context.Context, job *transferJob) {
+    if err := d.releaseTransfer(ctx, job); err != nil {
+        LoggerFrom(ctx).Error("Cannot clean up after export, the leftovers are removed at the next start",
+            "volume", job.name, "snapshot", job.snapshot, "error", err)
+    }
+    d.transfers.remove(job)
+}
+
+// WriteExport writes the export stream to w and returns the length of the
+// payload
+func (d *VolumeDriver) WriteExport(ctx context.Context, job *transferJob, w io.Writer) (int64, error) {
+    header, err := json.Marshal(job.header)
+    if err != nil {
+        return 0, Internal("Cannot encode export header: " + err.Error())
+    }
+    bw := bufio.NewWriterSize(w, transferFrameSize)
+    if _, err := bw.WriteString(exportMagic + string(header) + "\n"); err != nil {
+        return 0, transferWriteError(err)
+    }
+    frames := &frameWriter{w: bw}
+    payload, err := d.compressor(ctx, frames, job.header.Compression)
+    if err != nil {
+        return 0, err
+    }
+    sum := sha256.New()
+    counter := &countingWriter{}
+    out := io.MultiWriter(payload, sum, counter)
+    switch job.header.Format {
+    case TransferFormatTar:
+        args := []string{"-c", "--numeric-owner", "--xattrs", "--acls", "--sparse",
+            "--exclude", "./" + lostFoundDir, "-f", "-", "-C", job.mountpoint, "."}
+        if status := d.runStream(ctx, "tar", args, nil, out); status.status != 0 {
+            err = commandError(status, "Cannot archive volume " + job.name + ": " + status.stderr)
+        }
+    case TransferFormatDelta:
+        err = writeDelta(ctx, job.device, job.delta, job.header.SizeMB * 1024 * 1024, out)
+    default:
+        err = copyFromDevice(ctx, job.device, out)
+    }
+    if cerr := payload.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return counter.n, err
+    }
+    if err := frames.Close(); err != nil {
+        return counter.n, transferWriteError(err)
+    }
+    job.trailer = ExportTrailer{Bytes: counter.n, SHA256: hex.EncodeToString(sum.Sum(nil))}
+    trailer, _ := json.Marshal(job.trailer)
+    if _, err := bw.WriteString(string(trailer) + "\n"); err != nil {
+        return counter.n, transferWriteError(err)
+    }
+    if err := bw.Flush(); err != nil {
+        return counter.n, transferWriteError(err)
+    }
+    LoggerFrom(ctx).Info("Export finished", "volume", job.name, "bytes", counter.n)
+    return counter.n, nil
+}
+
+func transferWriteError(err error) (error) {
+    return Internal("Cannot write export stream: " + err.Error())
+}
+
+func copyFromDevice(ctx context.Context, device string, out io.Writer) (error) {
+    in, err := os.Open(device)
+    if err != nil {
+        return Internal("Cannot open " + device + ": " + err.Error())
+    }
+    defer in.Close()
+    buf := make([]byte, transferFrameSize)
+    for {
+        if ctx.Err() != nil {
+            return newError(CodeCanceled, "Export of " + device + " canceled")
+        }
+        n, err := in.Read(buf)
+        if n > 0 {
+            if _, err := out.Write(buf[:n]); err != nil {
+                return transferWriteError(err)
+            }
+        }
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return Internal("Cannot read from " + device + ": " + err.Error())
+        }
+    }
+}
+
+// ReadExportHeader reads the start of an export stream up to the header
+func ReadExportHeader(r *bufio.Reader) (*ExportHeader, error) {
+    magic := make([]byte, len(exportMagic))
+    if _, err := io.ReadFull(r, magic); err != nil || string(magic) != exportMagic {
+        return nil, InvalidArgument("Not an export stream of " + VolumeDriverName)
+    }
+    line, err := readTransferLine(r)
+    if err != nil {
+        return nil, err
+    }
+    var header ExportHeader
+    if err := json.Unmarshal(line, &header); err != nil {
+        return nil, InvalidArgument("Corrupt export header: " + err.Error())
+    }
+    format := header.Format
+    if format == TransferFormatDelta {
+        if header.Base == "" {
+            return nil, InvalidArgument("Incremental export stream without base backup")
+        }
+        format = TransferFormatRaw
+    }
+    if _, _, err := parseTransferFormat(format, header.Compression); err != nil {
+        return nil, err
+    }
+    if header.Format == "" || header.Compression == "" || header.SizeMB <= 0 {
+        return nil, InvalidArgument("Incomplete export header")
+    }
+    if header.Filesystem == "" {
+        header.Filesystem = DEFAULT_FILESYSTEM
+    }
+    return &header, nil
+}
+
+func readTransferLine(r *bufio.Reader) ([]byte, error) {
+    var line []byte
+    for {
+        part, isPrefix, err := r.ReadLine()
+        if err != nil {
+            return nil, InvalidArgument("Export stream is truncated")
+        }
+        line = append(line, part...)
+        if len(line) > maxTransferLine {
+            return nil, InvalidArgument("Corrupt export stream, line too long")
+        }
+        if !isPrefix {
+            return line, nil
+        }
+    }
+}
+
+// StartImport creates the volume for an import with the options given and
+// by default the size, encryption and, on the same filesystem, the mount
+// options of the exported volume. Raw imports need the size and filesystem
+// of the export. The volume is opened and mounted for the import, which has
+// to be finished with FinishImport. Incremental backups are applied to an
+// existing volume instead.
+func (d *VolumeDriver) StartImport(ctx context.Context, name string, options map[string]string, header *ExportHeader) (*transferJob, error) {
+    if header.Format == TransferFormatDelta {
+        return d.startDeltaImport(ctx, name, options, header)
+    }
+    for _, o := range []string{CloneFromOption, CloneFreezeOption, RestoreFromOption} {
+        if _, ok := options[o]; ok {
+            return nil, InvalidArgument("Option " + o + " is not supported for imports")
+        }
+    }
+    raw := header.Format == TransferFormatRaw
+    if raw {
+        for _, o := range []string{UidOption, GidOption, ModeOption, LostFoundOption} {
+            if _, ok := options[o]; ok {
+                return nil, InvalidArgument("Option " + o + " is not supported for raw imports, they have the root directory of the export")
+            }
+        }
+    }
+    create := make(map[string]string)
+    for k, v := range options {
+        create[k] = v
+    }
+    if _, ok := create["size"]; !ok && getSizeFromName(name) == 0 {
+        create["size"] = strconv.FormatInt(header.SizeMB, 10) + "M"
+    }
+    if _, ok := create[EncryptedOption]; !ok && header.Encrypted {
+        create[EncryptedOption] = "true"
+    }
+    if err := validateName(name); err != nil {
+        return nil, err
+    }
+    class, err := d.selectClass(name, create)
+    if err != nil {
+        return nil, err
+    }
+    if raw && class.Filesystem != header.Filesystem {
+        return nil, InvalidArgument("Raw exports of " + header.Filesystem + " volumes can only be imported into a storage class with " +
+            header.Filesystem + ", class " + class.Name + " has " + class.Filesystem)
+    }
+    size := getSizeFromName(name)
+    if val, ok := create["size"]; ok {
+        if size, err = parseSize(val); err != nil {
+            return nil, err
+        }
+    }
+    if raw && int64(size) != header.SizeMB {
+        return nil, InvalidArgument("Raw imports have the size of the export, " + strconv.FormatInt(header.SizeMB, 10) + "MB; resize the volume afterwards")
+    }
+    // the mount options of the export, which include the defaults of its
+    // daemon, unless options are given or they are of another filesystem
+    _, hasMountOptions := options[MountOptionsOption]
+    _, hasReadOnly := options[ReadOnlyOption]
+    inherit := !hasMountOptions && !hasReadOnly && class.Filesystem == header.Filesystem && header.MountOptions != nil
+    if inherit {
+        for _, o := range header.MountOptions {
+            if err := validateMountOption(o, header.Filesystem); err != nil {
+                return nil, err
+            }
+        }
+    }
+    if err := d.DockerCreateVolume(ctx, name, create); err != nil {
+        return nil, err
+    }
+    meta, err := d.loadMetadata(name)
+    if err == nil {
+        meta.Importing = true
+        if inherit {
+            meta.MountOptions, meta.ReadOnly = header.MountOptions, header.ReadOnly
+        }
+        err = d.saveMetadata(meta)
+    }
+    job := &transferJob{name: name, header: *header}
+    d.transfers.add(job)
+    if err == nil {
+        err = d.openTransfer(ctx, job, meta.Encrypted)
+    }
+    if err != nil {
+        return nil, d.FinishImport(ctx, job, err)
+    }
+    LoggerFrom(ctx).Info("Import started", "volume", name, "format", header.Format, "compression", header.Compression, "from", header.Name)
+    return job, nil
+}
+
+// ReadImport reads the payload and the trailer of an export stream into the
+// volume and verifies the checksum
+func (d *VolumeDriver) ReadImport(ctx context.Context, job *transferJob, r *bufio.Reader) (error) {
+    frames := &frameReader{r: r}
+    payload, err := d.decompressor(ctx, frames, job.header.Compression)
+    if err != nil {
+        return err
+    }
+    defer payload.Close()
+    sum := sha256.New()
+    counter := &countingWriter{}
+    in := io.TeeReader(payload, io.MultiWriter(sum, counter))
+    switch job.header.Format {
+    case TransferFormatTar:
+        args := []string{"-x", "--numeric-owner", "--same-owner", "--same-permissions", "--xattrs", "--xattrs-include=*",
+            "--acls", "-f", "-", "-C", job.mountpoint}
+        if status := d.runStream(ctx, "tar", args, in, nil); status.status != 0 {
+            err = commandError(status, "Cannot extract archive into volume " + job.name + ": " + status.stderr)
+        }
+    case TransferFormatDelta:
+        err = applyDelta(ctx, in, job.device, job.header.SizeMB * 1024 * 1024)
+    default:
+        err = copyToDevice(ctx, in, job.device, job.header.SizeMB * 1024 * 1024)
+    }
+    if err == nil {
+        // tar stops at the end of the archive, the padding is part of the
+        // checksum as well
+        if _, cerr := io.Copy(ioutil.Discard, in); cerr != nil {
+            err = cerr
+        }
+    }
+    if cerr := payload.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return transferReadError(err)
+    }
+    if _, err := io.Copy(ioutil.Discard, frames); err != nil {
+        return transferReadError(err)
+    }
+    line, err := readTransferLine(r)
+    if err != nil {
+        return err
+    }
+    var trailer ExportTrailer
+    if err := json.Unmarshal(line, &trailer); err != nil {
+        return InvalidArgument("Corrupt export trailer: " + err.Error())
+    }
+    checksum := hex.EncodeToString(sum.Sum(nil))
+    if trailer.Bytes != counter.n || trailer.SHA256 != checksum {
+        return InvalidArgument("Checksum mismatch, the export stream is corrupt: got " + strconv.FormatInt(counter.n, 10) +
+            " bytes with SHA-256 " + checksum + ", expected " + strconv.FormatInt(trailer.Bytes, 10) + " bytes with " + trailer.SHA256)
+    }
+    job.trailer = trailer
+    LoggerFrom(ctx).Info("Import verified", "volume", job.name, "bytes", counter.n, "sha256", checksum)
+    return nil
+}
+
+// transferReadError keeps errors of the driver and reports the others as a
+// broken stream
+func transferReadError(err error) (error) {
+    var e *Error
+    if errors.As(err, &e) {
+        return e
+    }
+    if err == io.ErrUnexpectedEOF {
+        return InvalidArgument("Export stream is truncated")
+    }
+    return InvalidArgument("Cannot read export stream: " + err.Error())
+}
+
+func copyToDevice(ctx context.Context, in io.Reader, device string, size int64) (error) {
+    out, err := os.OpenFile(device, os.O_WRONLY, 0)
+    if err != nil {
+        return Internal("Cannot open " + device + ": " + err.Error())
+    }
+    defer out.Close()
+    buf := make([]byte, transferFrameSize)
+    var written int64
+    for {
+        if ctx.Err() != nil {
+            return newError(CodeCanceled, "Import into " + device + " canceled")
+        }
+        n, err := in.Read(buf)
+        if n > 0 {
+            if written + int64(n) > size {
+                return InvalidArgument("Export stream is larger than the volume, " + strconv.FormatInt(size / (1024 * 1024), 10) + "MB")
+            }
+            if _, err := out.Write(buf[:n]); err != nil {
+                return Internal("Cannot write to " + device + ": " + err.Error())
+            }
+            written += int64(n)
+        }
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return err
+        }
+    }
+    if err := out.Sync(); err != nil {
+        return Internal("Cannot sync " + device + ": " + err.Error())
+    }
+    return nil
+}
+
+// FinishImport releases what the import set up. A raw import gets a new
+// filesystem UUID, of a backup only at its first mount so that incremental
+// backups can be applied until then. If the import failed, the volume is
+// removed and err returned.
+func (d *VolumeDriver) FinishImport(ctx context.Context, job *transferJob, err error) (error) {
+    l := LoggerFrom(ctx).With("volume", job.name)
+    if rerr := d.releaseTransfer(ctx, job); err == nil {
+        err = rerr
+    }
+    meta, merr := d.loadMetadata(job.name)
+    if err == nil {
+        err = merr
+    }
+    if err == nil && job.header.Backup != "" && job.header.Format != TransferFormatTar {
+        meta.ImportedBackup, meta.RenewUUID = job.header.Backup, true
+    } else if err == nil && job.header.Format == TransferFormatRaw {
+        err = d.newFilesystemUUID(ctx, meta)
+    }
+    d.transfers.remove(job)
+    if err != nil {
+        l.Error("Import failed, removing the volume", "error", err)
+        if rerr := d.removeLogicalVolume(ctx, job.name); rerr != nil {
+            l.Error("Cannot remove volume of failed import", "error", rerr)
+        }
+        return err
+    }
+    meta.Importing = false
+    if err := d.saveMetadata(meta); err != nil {
+        return err
+    }
+    l.Info("Volume imported", "from", job.header.Name)
+    return nil
+}
+
+// --------------------------------------------------------------------------
+// Framing and compression of the payload
+// --------------------------------------------------------------------------
+
+type countingWriter struct {
+    n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+    c.n += int64(len(p))
+    return len(p), nil
+}
+
+// frameWriter writes the payload in frames, so that its end is recognized
+// without knowing its length in advance
+type frameWriter struct {
+    w io.Writer
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := len(p)
+        if n > transferFrameSize {
+            n = transferFrameSize
+        }
+        var length [4]byte
+        binary.BigEndian.PutUint32(length[:], uint32(n))
+        if _, err := f.w.Write(length[:]); err != nil {
+            return written, err
+        }
+        if _, err := f.w.Write(p[:n]); err != nil {
+            return written, err
+        }
+        written += n
+        p = p[n:]
+    }
+    return written, nil
+}
+
+// Close writes the frame ending the payload
+func (f *frameWriter) Close() (error) {
+    _, err := f.w.Write([]byte{0, 0, 0, 0})
+    return err
+}
+
+// frameReader returns the payload of the frames up to the end frame
+type frameReader struct {
+    r io.Reader
+    // rest of the current frame
+    remaining int
+    done bool
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+    if f.done {
+        return 0, io.EOF
+    }
+    if f.remaining == 0 {
+        var length [4]byte
+        if _, err := io.ReadFull(f.r, length[:]); err != nil {
+            return 0, io.ErrUnexpectedEOF
+        }
+        f.remaining = int(binary.BigEndian.Uint32(length[:]))
+        if f.remaining == 0 {
+            f.done = true
+            return 0, io.EOF
+        }
+        if f.remaining > maxTransferFrame {
+            return 0, errors.New("corrupt frame of " + strconv.Itoa(f.remaining) + " bytes")
+        }
+    }
+    if len(p) > f.remaining {
+        p = p[:f.remaining]
+    }
+    n, err := f.r.Read(p)
+    f.remaining -= n
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return n, err
+}
+
+type nopWriteCloser struct {
+    io.Writer
+}
+
+func (nopWriteCloser) Close() (error) { return nil }
+
+// processWriter feeds a program through a pipe; Close waits for it
+type processWriter struct {
+    *io.PipeWriter
+    done chan error
+}
+
+func (p *processWriter) Close() (error) {
+    p.PipeWriter.Close()
+    return <-p.done
+}
+
+// processReader reads the output of a program through a pipe; Close stops
+// it and returns its error
+type processReader struct {
+    *io.PipeReader
+    done chan error
+}
+
+func (p *processReader) Close() (error) {
+    p.PipeReader.CloseWithError(errors.New("reader closed"))
+    err, ok := <-p.done
+    if !ok {
+        return nil
+    }
+    return err
+}
+
+// compressor returns the writer compressing the payload into w
+func (d *VolumeDriver) compressor(ctx context.Context, w io.Writer, compression string) (io.WriteCloser, error) {
+    switch compression {
+    case CompressionGzip:
+        return gzip.NewWriter(w), nil
+    case CompressionZstd:
+        pr, pw := io.Pipe()
+        p := &processWriter{PipeWriter: pw, done: make(chan error, 1)}
+        go func() {
+            status := d.runStream(ctx, "zstd", []string{"-q", "-c"}, pr, w)
+            var err error
+            if status.status != 0 {
+                err = commandError(status, "Cannot compress export: " + status.stderr)
+            }
+            // writes fail instead of blocking once zstd is gone
+            pr.CloseWithError(errors.New("zstd exited"))
+            p.done <- err
+        }()
+        return p, nil
+    }
+    return nopWriteCloser{w}, nil
+}
+
+// decompressor returns the reader of the uncompressed payload of r
+func (d *VolumeDriver) decompressor(ctx context.Context, r io.Reader, compression string) (io.ReadCloser, error) {
+    switch compression {
+    case CompressionGzip:
+        gz, err := gzip.NewReader(r)
+        if err != nil {
+            return nil, transferReadError(err)
+        }
+        return gz, nil
+    case CompressionZstd:
+        pr, pw := io.Pipe()
+        p := &processReader{PipeReader: pr, done: make(chan error, 1)}
+        go func() {
+            status := d.runStream(ctx, "zstd", []string{"-d", "-q", "-c"}, r, pw)
+            var err error
+            switch {
+            case status.err != nil:
+                err = status.err
+            case status.status != 0:
+                err = InvalidArgument("Cannot decompress export stream: " + strings.TrimSpace(status.stderr))
+            }
+            if err != nil {
+                pw.CloseWithError(err)
+            } else {
+                pw.Close()
+            }
+            p.done <- err
+            close(p.done)
+        }()
+        return p, nil
+    }
+    return ioutil.NopCloser(r), nil
+}
@@ -4,7 +4,6 @@ import (
     "net"
     "os"
     "syscall"
-    "log"
 )
 
 const (
@@ -42,7 +41,7 @@ func setSocketGroup(path, group string) error {
         if group != "docker" {
             return err
         }
-        log.Printf("Warning: could not change group %s to docker: %v", path, err)
+        DefaultLogger().Warn("Could not change group to docker", "path", path, "error", err)
     }
     return nil
 }
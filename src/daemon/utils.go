@@ -41,6 +41,14 @@ func Mkdir(path string, mode os.FileMode, group string) (error) {
     }
 }
 
+func stringInList(s string, list []string) (bool) {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
 
 func RootCheck() (error) {
     if u, err := user.Current() ; err != nil {
@@ -0,0 +1,393 @@
+package daemon
+
+import (
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// --------------------------------------------------------------------------
+// Secure wipe on remove
+//
+// The extents of a removed volume are handed out to the next volume created
+// in the volume group, so the data of a removed volume has to be destroyed
+// before the extents are released. Wiping a large volume takes much longer
+// than docker waits for a remove, therefore a remove only tags the logical
+// volume and renames it out of the way; the name can be used again at once.
+// A background worker wipes and finally removes the tagged volumes. Tagged
+// volumes left over by a restart are picked up again on start.
+//
+// Thin volumes are always discarded, whatever the policy: overwriting their
+// whole virtual size would allocate every block in the pool and could fill
+// it, stopping all volumes in it. The discard returns their blocks to the
+// pool, which zeroes blocks before handing them to another thin volume
+// unless it was created with zeroing disabled (lvcreate -Z n).
+//
+// A volume with snapshots is not removed: LVM would copy every block
+// overwritten by the wipe into the copy-on-write area of each snapshot,
+// which either overflows and invalidates it or keeps the data visible in
+// the snapshot. The snapshots have to be removed first. A removed thick
+// snapshot is split from its origin (lvconvert --splitsnapshot), which
+// leaves a plain volume holding its copy-on-write area to be wiped;
+// overwriting the snapshot itself would only fill that area.
+// --------------------------------------------------------------------------
+
+type WipePolicy string
+
+const (
+    // extents are released without being overwritten
+    WipeNone WipePolicy = "none"
+    // blkdiscard, only safe on devices returning zeros for discarded blocks
+    WipeDiscard WipePolicy = "discard"
+    // overwrite with zeros
+    WipeZero WipePolicy = "zero"
+    // overwrite with random data, WipePasses times
+    WipeRandom WipePolicy = "random"
+
+    // tag of logical volumes waiting to be wiped, they are hidden from all
+    // listings
+    wipeTag = "lvmvd_wipe"
+    wipeNamePrefix = "lvmvd-wipe-"
+    wipeBlockSize = 4 * 1024 * 1024
+    // percentage steps in which progress is logged
+    wipeProgressStep = 10
+)
+
+var wipePolicies = []WipePolicy{WipeNone, WipeDiscard, WipeZero, WipeRandom}
+
+func ParseWipePolicy(s string) (WipePolicy, error) {
+    for _, p := range wipePolicies {
+        if string(p) == s {
+            return p, nil
+        }
+    }
+    return WipeNone, errors.New("Unknown wipe policy " + s + ", expected none, discard, zero or random")
+}
+
+type wipeJob struct {
+    vg string
+    // current name of the logical volume
+    name string
+    // name of the volume before it was removed
+    volume string
+    // thin volumes are discarded only
+    thin bool
+    l *Logger
+}
+
+type wiper struct {
+    d *VolumeDriver
+    m sync.Mutex
+    queue []wipeJob
+    // vg/name -> vg
+    queued map[string]string
+    wake chan struct{}
+}
+
+func newWiper(d *VolumeDriver) (*wiper) {
+    return &wiper{d: d, queued: make(map[string]string), wake: make(chan struct{}, 1)}
+}
+
+func (job wipeJob) key() (string) {
+    return job.vg + "/" + job.name
+}
+
+func (w *wiper) add(job wipeJob) {
+    w.m.Lock()
+    if _, ok := w.queued[job.key()]; !ok {
+        w.queued[job.key()] = job.vg
+        w.queue = append(w.queue, job)
+    }
+    w.m.Unlock()
+    select {
+    case w.wake <- struct{}{}:
+    default:
+    }
+}
+
+func (w *wiper) next() (wipeJob, bool) {
+    w.m.Lock()
+    defer w.m.Unlock()
+    if len(w.queue) == 0 {
+        return wipeJob{}, false
+    }
+    job := w.queue[0]
+    w.queue = w.queue[1:]
+    return job, true
+}
+
+func (w *wiper) done(job wipeJob) {
+    w.m.Lock()
+    delete(w.queued, job.key())
+    w.m.Unlock()
+}
+
+// pending returns the number of queued jobs in the volume group
+func (w *wiper) pending(vg string) (int) {
+    w.m.Lock()
+    defer w.m.Unlock()
+    n := 0
+    for _, v := range w.queued {
+        if v == vg {
+            n++
+        }
+    }
+    return n
+}
+
+func (w *wiper) run(ctx context.Context) {
+    for {
+        job, ok := w.next()
+        if !ok {
+            select {
+            case <-ctx.Done():
+                return
+            case <-w.wake:
+                continue
+            }
+        }
+        if err := w.d.wipeAndRemove(ctx, job); err != nil {
+            // the volume keeps its tag and is retried on the next start
+            job.l.Error("Wipe failed, volume is kept", "error", err)
+        }
+        w.done(job)
+    }
+}
+
+// StartWiper starts the background worker for removed volumes and queues the
+// volumes still waiting to be wiped. It returns immediately.
+func (d *VolumeDriver) StartWiper(ctx context.Context) (error) {
+    d.wiper = newWiper(d)
+    jobs, err := d.pendingWipes(ctx)
+    if err != nil {
+        return err
+    }
+    for _, job := range jobs {
+        job.l = DefaultLogger().With("volume", job.name, "lv", job.name, "vg", job.vg)
+        job.l.Info("Resuming wipe of removed volume")
+        d.wiper.add(job)
+    }
+    d.background(func() { d.wiper.run(ctx) })
+    return nil
+}
+
+// PendingWipes returns the number of removed volumes in the volume group
+// not yet wiped
+func (d *VolumeDriver) PendingWipes(vg string) (int) {
+    if d.wiper == nil {
+        return 0
+    }
+    return d.wiper.pending(vg)
+}
+
+func hasWipeTag(tags string) (bool) {
+    return hasTag(tags, wipeTag)
+}
+
+// hasTag reports whether a comma separated list of LVM tags contains tag
+func hasTag(tags string, tag string) (bool) {
+    for _, t := range strings.Split(tags, ",") {
+        if strings.TrimSpace(t) == tag {
+            return true
+        }
+    }
+    return false
+}
+
+// pendingWipes returns the logical volumes tagged for wiping in the volume
+// groups of all storage classes
+func (d *VolumeDriver) pendingWipes(ctx context.Context) ([]wipeJob, error) {
+    jobs := []wipeJob{}
+    for _, vg := range d.Classes.VolumeGroups() {
+        status := d.runCommand(ctx, "lvs", []string{"--noheadings", "--separator", lvsSeparator, "-o", "lv_name,pool_lv,lv_tags", vg})
+        if status.status != 0 {
+            return nil, commandError(status, status.String())
+        }
+        for _, line := range strings.Split(status.stdout, "\n") {
+            values := strings.SplitN(strings.TrimSpace(line), lvsSeparator, 3)
+            if len(values) == 3 && hasWipeTag(values[2]) {
+                name := strings.TrimSpace(values[0])
+                jobs = append(jobs, wipeJob{vg: vg, name: name, volume: name, thin: strings.TrimSpace(values[1]) != ""})
+            }
+        }
+    }
+    return jobs, nil
+}
+
+// snapshotsOf returns the snapshots of a logical volume
+func (d *VolumeDriver) snapshotsOf(ctx context.Context, vg string, volume string) ([]string, error) {
+    status := d.runCommand(ctx, "lvs", []string{"--noheadings", "--separator", lvsSeparator, "-o", "lv_name,origin", vg})
+    if status.status != 0 {
+        return nil, commandError(status, status.String())
+    }
+    snapshots := []string{}
+    for _, line := range strings.Split(status.stdout, "\n") {
+        values := strings.SplitN(strings.TrimSpace(line), lvsSeparator, 2)
+        if len(values) == 2 && strings.TrimSpace(values[1]) == volume {
+            snapshots = append(snapshots, strings.TrimSpace(values[0]))
+        }
+    }
+    return snapshots, nil
+}
+
+// scheduleWipe hides the volume from all listings and queues it for wiping.
+// The volume is tagged before it is renamed, so that a crash in between
+// cannot leave a renamed volume which is not wiped.
+func (d *VolumeDriver) scheduleWipe(ctx context.Context, volume string) (error) {
+    l := LoggerFrom(ctx).With("volume", volume)
+    meta, err := d.loadMetadata(volume)
+    if err != nil {
+        return Internal("Cannot read metadata of volume " + volume + ": " + err.Error())
+    }
+    vg := d.volumeGroupOf(volume)
+    // snapshots are thick, also those of thin volumes
+    snapshots, err := d.snapshotsOf(ctx, vg, volume)
+    if err != nil {
+        return err
+    }
+    if len(snapshots) > 0 {
+        return InUse("Volume " + volume + " has snapshots " + strings.Join(snapshots, ", ") +
+            ", the wipe would overwrite them; remove them first")
+    }
+    if meta.Origin != "" {
+        if status := d.runCommand(ctx, "lvconvert", []string{"--splitsnapshot", vg + "/" + volume}); status.status != 0 {
+            return commandError(status, "Cannot split snapshot " + volume + " from its origin for wiping: " + status.stderr)
+        }
+    }
+    if status := d.runCommand(ctx, "lvchange", []string{"--addtag", wipeTag, vg + "/" + volume}); status.status != 0 {
+        return commandError(status, "Cannot tag volume " + volume + " for wiping: " + status.stderr)
+    }
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return Internal("Cannot generate name: " + err.Error())
+    }
+    name := wipeNamePrefix + hex.EncodeToString(b)
+    if status := d.runCommand(ctx, "lvrename", []string{vg, volume, name}); status.status != 0 {
+        // still tagged, so it is wiped under its old name after a restart
+        return commandError(status, "Cannot rename volume " + volume + " for wiping: " + status.stderr)
+    }
+    l = l.With("lv", name)
+    l.Info("Volume scheduled for wiping", "policy", string(d.WipePolicy))
+    d.wiper.add(wipeJob{vg: vg, name: name, volume: volume, thin: meta.ThinPool != "", l: l})
+    return nil
+}
+
+func (d *VolumeDriver) wipeAndRemove(ctx context.Context, job wipeJob) (error) {
+    ctx = WithLogger(ctx, job.l)
+    device := d.devicePath(job.vg, job.name)
+    start := time.Now()
+    policy := d.WipePolicy
+    if job.thin {
+        policy = WipeDiscard
+    }
+    job.l.Info("Wiping removed volume", "policy", string(policy), "device", device)
+    var err error
+    switch policy {
+    case WipeDiscard:
+        if status := d.runCommand(ctx, "blkdiscard", []string{device}); status.status != 0 {
+            err = commandError(status, "Cannot discard " + device + ": " + status.stderr)
+        }
+    case WipeZero:
+        err = overwriteDevice(ctx, device, nil, job.l)
+    case WipeRandom:
+        passes := d.WipePasses
+        if passes < 1 {
+            passes = 1
+        }
+        for pass := 1; pass <= passes && err == nil; pass++ {
+            var stream cipher.Stream
+            if stream, err = randomStream(); err == nil {
+                err = overwriteDevice(ctx, device, stream, job.l.With("pass", pass, "passes", passes))
+            }
+        }
+    }
+    if err != nil {
+        return err
+    }
+    job.l.Info("Volume wiped", "duration", time.Since(start).Round(time.Millisecond).String())
+    if status := d.runCommand(ctx, "lvremove", []string{"-f", device}); status.status != 0 {
+        return commandError(status, status.String())
+    }
+    return nil
+}
+
+// randomStream returns a keystream of AES-CTR with a random key, which is
+// indistinguishable from random data and much faster than crypto/rand
+func randomStream() (cipher.Stream, error) {
+    key := make([]byte, 32)
+    iv := make([]byte, aes.BlockSize)
+    if _, err := rand.Read(key); err != nil {
+        return nil, err
+    }
+    if _, err := rand.Read(iv); err != nil {
+        return nil, err
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewCTR(block, iv), nil
+}
+
+// overwriteDevice overwrites the whole device with zeros or, if stream is set,
+// with its keystream and logs the progress
+func overwriteDevice(ctx context.Context, device string, stream cipher.Stream, l *Logger) (error) {
+    f, err := os.OpenFile(device, os.O_WRONLY, 0)
+    if err != nil {
+        return Internal("Cannot open " + device + ": " + err.Error())
+    }
+    defer f.Close()
+    size, err := f.Seek(0, io.SeekEnd)
+    if err != nil {
+        return Internal("Cannot determine size of " + device + ": " + err.Error())
+    }
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+        return Internal("Cannot seek on " + device + ": " + err.Error())
+    }
+    buf := make([]byte, wipeBlockSize)
+    var written int64
+    nextStep := wipeProgressStep
+    start := time.Now()
+    for written < size {
+        if ctx.Err() != nil {
+            return newError(CodeCanceled, "Wipe of " + device + " canceled at " + strconv.FormatInt(written, 10) + " bytes")
+        }
+        n := int64(len(buf))
+        if size - written < n {
+            n = size - written
+        }
+        chunk := buf[:n]
+        if stream != nil {
+            for i := range chunk {
+                chunk[i] = 0
+            }
+            stream.XORKeyStream(chunk, chunk)
+        }
+        if _, err := f.Write(chunk); err != nil {
+            return Internal("Cannot write to " + device + ": " + err.Error())
+        }
+        written += n
+        if percent := int(written * 100 / size); percent >= nextStep {
+            elapsed := time.Since(start).Seconds()
+            rate := int64(0)
+            if elapsed > 0 {
+                rate = int64(float64(written) / elapsed / (1024 * 1024))
+            }
+            l.Info("Wipe progress", "percent", percent, "written_mb", written / (1024 * 1024), "size_mb", size / (1024 * 1024), "mb_per_s", rate)
+            nextStep = (percent / wipeProgressStep + 1) * wipeProgressStep
+        }
+    }
+    if err := f.Sync(); err != nil {
+        return Internal("Cannot sync " + device + ": " + err.Error())
+    }
+    return nil
+}
@@ -11,10 +11,14 @@ package main
 import (
     "fmt"
     "daemon"
+    "errors"
     "flag"
+    "io"
+    "io/ioutil"
     "os"
     "os/signal"
     "strconv"
+    "strings"
     "syscall"
     "path/filepath"
 )
@@ -36,20 +40,111 @@ The following options can be specified:
   --default-size=<size>      default size in megabytes for volumes in case no
                              size is specified (default: 512MB)
   --mount-root=<directory>   root directory for mount points (required)
-  --volume-group-name=<name> name of volume group (required)
+  --volume-group-name=<name> name of volume group (required unless storage
+                             classes are given)
+  --storage-classes=<file>   JSON file with storage classes mapping to volume
+                             groups and thin pools, see README (optional)
   --sock-file                name of file for socket spec file (default:
                              /run/docker/plugins/lvm-volume-driver.sock)
   --json-file                Name of directory for json file (default:
                              /etc/docker/plugins/lvm-volume-driver.json)
-`
+  --log-level=<level>        debug, info, warn or error (default: info)
+  --log-format=json|logfmt   format of log lines written to stderr (default:
+                             logfmt)
+  --debug                    same as --log-level=debug
+  --log-buffer-lines=<n>     number of recent log lines kept for the admin API
+                             (default: 1000)
+  --audit-log=<file>         append a record of every create, remove, mount
+                             and unmount to this file (optional)
+  --audit-log-max-size=<mb>  rotate the audit log when it exceeds this size
+                             (default: 100)
+  --audit-log-max-files=<n>  number of rotated audit logs to keep (default: 10)
+  --state-dir=<directory>    directory for volume metadata (default:
+                             /var/lib/lvm-volume-driver)
+  --lock-threshold=<dur>     /health fails if a request holds the request lock
+                             for longer than this (default: 5m)
+  --command-timeout=<dur>    time after which external programs (lvcreate,
+                             mkfs, mount, ...) are killed (default: 2m)
+  --command-timeouts=<list>  timeouts for individual programs, e.g.
+                             lvcreate=5m,mkfs.ext4=10m (optional)
+  --wipe=<policy>            how removed volumes are wiped before their space
+                             is released: none, discard (blkdiscard), zero or
+                             random (default: none)
+  --wipe-passes=<n>          number of passes for --wipe=random (default: 1)
+  --wipesignatures=y|n       passed to lvcreate --wipesignatures (optional)
+  --zero=y|n                 passed to lvcreate --zero (optional)
+  --mount-options=<list>     options for mounts of new volumes of all storage
+                             classes, volumes can add more with
+                             -o mountopts=<list> (default: nodev,nosuid)
+  --fsck=never|dirty|always  check the filesystem before a mount: never, only
+                             if not unmounted cleanly, or always (default:
+                             never)
+  --fsck-repair              repair errors found by the check automatically,
+                             otherwise the mount is refused (default: false)
+  --monitor-interval=<dur>   how often the usage of mounted volumes is sampled
+                             and volumes with autogrow are grown, 0 disables
+                             the monitor (default: 1m)
+  --autogrow-reserve=<size>  free space in the volume group which auto-grow
+                             does not use, e.g. 10G (default: 0)
+  --gc=off|report|remove     what the garbage collector does with orphaned
+                             volumes, mountpoints and device mapper targets
+                             (default: off)
+  --gc-interval=<dur>        how often the garbage collector runs (default: 1h)
+  --gc-grace=<dur>           time an orphan has to exist before it is removed
+                             (default: 24h)
+  --docker-socket=<file>     docker engine API asked for the volumes in use by
+                             the garbage collector (default:
+                             /var/run/docker.sock)
+  --key-provider=none|file   where the keys of encrypted volumes are kept,
+                             none disables encryption (default: none)
+  --key-dir=<directory>      directory of the file key provider (default:
+                             <state-dir>/keys)
+  --backup-target=none|dir   where backups of volumes are stored, none
+                             disables backups (default: none)
+  --backup-dir=<directory>   directory of the dir backup target (required
+                             for dir)
+  --backup-check-interval=<dur>
+                             how often the scheduler looks for volumes due
+                             for a backup, 0 disables scheduled backups
+                             (default: 1m)
+  --snapshot-hooks=<file>    commands which volumes with -o snapshot-hook=<name>
+                             run around their snapshots (optional)
+  --freeze-timeout=<dur>     time after which a snapshot of a volume frozen
+                             for it is aborted and the volume is thawed
+                             (default: 30s)
+  --io-cgroup=<directory>    cgroup v2 directory containing the containers,
+                             whose io.max gets the I/O limits of mounted
+                             volumes; without it the limits are only reported
+                             (optional)
+  --admin-listener=none|unix|http
+                             serve the admin API on a unix socket or https
+                             (default: none)
+  --admin-socket=<file>      socket for the admin API (default:
+                             /run/lvm-volume-driver/admin.sock)
+  --admin-host=<host>        host name for the admin API on https (default:
+                             localhost)
+  --admin-port=<port>        port for the admin API on https (default: 8443)
+  --admin-tls-cert=<file>    certificate for the admin API (required for http)
+  --admin-tls-key=<file>     private key for the admin API (required for http)
+  --admin-tls-client-ca=<file>
+                             require client certificates signed by this CA
+                             (optional)
+  --admin-token-file=<file>  require this bearer token for the admin API
+                             (optional)
+` + daemon.FakeUsage
 
 // --------------------------------------------------------------------------
 // Try not to leave stale files behind
 // --------------------------------------------------------------------------
 
 func cleanup(d *daemon.Daemon) {
+    // waits for frozen volumes to be thawed
+    d.Close()
     os.Remove(d.JsonLocation)
     os.Remove(d.SocketSpecLocation)
+    if d.AuditLog != nil {
+        d.AuditLog.Close()
+    }
 }
 
 func registerCleanupHandler(d *daemon.Daemon) {
@@ -72,15 +167,150 @@ func main() {
 
     listener := flag.String("listener", "unix", "listen on a unix socket or http port")
     mount_root := flag.String("mount-root", "", "root directory for mount points (required)")
-    volumeGroupName := flag.String("volume-group-name", "", "name of volume group (required)")
+    volumeGroupName := flag.String("volume-group-name", "", "name of volume group (required unless storage classes are given)")
+    storageClasses := flag.String("storage-classes", "", "JSON file with storage classes")
     defaultLogicalVolumeSize := flag.Int("default-size", daemon.DefaultVolumeSize, "default size of volume in megabytes")
     host := flag.String("host", "localhost", "host name in case http is specified")
     port := flag.String("port", "8080", "port number in case http is specified")
     sock := flag.String("sock-file", "", "name of file for socket spec file")
     jsonf := flag.String("json-file", "", "Name of directory for json file")
     debug := flag.Bool("debug", false, "Print verbose debug output")
+    logLevel := flag.String("log-level", "info", "debug, info, warn or error")
+    logFormat := flag.String("log-format", daemon.LogFormatLogfmt, "json or logfmt")
+    logBufferLines := flag.Int("log-buffer-lines", daemon.DefaultLogBufferLines, "number of recent log lines kept for the admin API")
+    stateDir := flag.String("state-dir", daemon.DefaultStateDir, "directory for volume metadata")
+    lockThreshold := flag.Duration("lock-threshold", daemon.DefaultLockThreshold, "maximum time a request may hold the request lock before /health fails")
+    commandTimeout := flag.Duration("command-timeout", daemon.DefaultCommandTimeout, "time after which external programs are killed")
+    commandTimeoutList := flag.String("command-timeouts", "", "timeouts for individual programs, e.g. lvcreate=5m,mkfs.ext4=10m")
+    auditLog := flag.String("audit-log", "", "file for audit records of volume operations")
+    auditLogMaxSize := flag.Int("audit-log-max-size", daemon.DefaultAuditLogMaxSize, "size in megabytes at which the audit log is rotated")
+    auditLogMaxFiles := flag.Int("audit-log-max-files", daemon.DefaultAuditLogMaxFiles, "number of rotated audit logs to keep")
+    wipe := flag.String("wipe", string(daemon.WipeNone), "none, discard, zero or random")
+    wipePasses := flag.Int("wipe-passes", 1, "number of passes for --wipe=random")
+    wipeSignatures := flag.String("wipesignatures", "", "passed to lvcreate --wipesignatures")
+    zero := flag.String("zero", "", "passed to lvcreate --zero")
+    mountOptions := flag.String("mount-options", strings.Join(daemon.DefaultMountOptions, ","), "options for mounts of new volumes")
+    fsck := flag.String("fsck", string(daemon.FsckNever), "never, dirty or always")
+    fsckRepair := flag.Bool("fsck-repair", false, "repair errors found by the filesystem check")
+    monitorInterval := flag.Duration("monitor-interval", daemon.DefaultMonitorInterval, "how often the usage of mounted volumes is sampled")
+    autoGrowReserve := flag.String("autogrow-reserve", "0", "free space in the volume group which auto-grow does not use")
+    gc := flag.String("gc", string(daemon.GCPolicyOff), "off, report or remove")
+    gcInterval := flag.Duration("gc-interval", daemon.DefaultGCInterval, "how often the garbage collector runs")
+    gcGrace := flag.Duration("gc-grace", daemon.DefaultGCGrace, "time an orphan has to exist before it is removed")
+    dockerSocket := flag.String("docker-socket", daemon.DefaultDockerSocket, "docker engine API")
+    keyProvider := flag.String("key-provider", daemon.KeyProviderNone, "none or file")
+    keyDir := flag.String("key-dir", "", "directory of the file key provider")
+    backupTarget := flag.String("backup-target", daemon.BackupTargetNone, "none or dir")
+    backupDir := flag.String("backup-dir", "", "directory of the dir backup target")
+    backupCheckInterval := flag.Duration("backup-check-interval", daemon.DefaultBackupCheckInterval, "how often the scheduler looks for due backups")
+    snapshotHooks := flag.String("snapshot-hooks", "", "file with the commands run around snapshots")
+    freezeTimeout := flag.Duration("freeze-timeout", daemon.DefaultFreezeTimeout, "time after which a snapshot of a frozen volume is aborted")
+    ioCgroup := flag.String("io-cgroup", "", "cgroup v2 directory whose io.max gets the I/O limits of volumes")
+    adminListener := flag.String("admin-listener", "none", "serve the admin API on a unix socket or https")
+    adminSocket := flag.String("admin-socket", daemon.DefaultAdminSocket, "socket for the admin API")
+    adminHost := flag.String("admin-host", "localhost", "host name for the admin API on https")
+    adminPort := flag.Int("admin-port", daemon.DefaultAdminPort, "port for the admin API on https")
+    adminTLSCert := flag.String("admin-tls-cert", "", "certificate for the admin API")
+    adminTLSKey := flag.String("admin-tls-key", "", "private key for the admin API")
+    adminTLSClientCA := flag.String("admin-tls-client-ca", "", "CA for client certificates of the admin API")
+    adminTokenFile := flag.String("admin-token-file", "", "file with the bearer token for the admin API")
+    // only in builds with the fake tag, see daemon/fake_backends.go
+    fake := daemon.RegisterFakeFlags(flag.CommandLine)
     flag.Parse()
 
+    level, err := daemon.ParseLogLevel(*logLevel)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, err.Error() + "\n" + usage, os.Args[0])
+        os.Exit(1)
+    }
+    if *debug {
+        level = daemon.LevelDebug
+    }
+    logBuffer := daemon.NewLogBuffer(*logBufferLines)
+    logger, err := daemon.NewLogger(io.MultiWriter(os.Stderr, logBuffer), *logFormat, level)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, err.Error() + "\n" + usage, os.Args[0])
+        os.Exit(1)
+    }
+    daemon.SetDefaultLogger(logger)
+
+    if timeouts, err := daemon.ParseCommandTimeouts(*commandTimeoutList); err != nil || *commandTimeout <= 0 {
+        if err == nil {
+            err = errors.New("command timeout must be positive")
+        }
+        fmt.Fprintf(os.Stderr, err.Error() + "\n" + usage, os.Args[0])
+        os.Exit(1)
+    } else {
+        daemon.SetCommandTimeouts(daemon.CommandTimeouts{Default: *commandTimeout, Commands: timeouts})
+    }
+
+    wipePolicy, err := daemon.ParseWipePolicy(*wipe)
+    if err == nil && *wipePasses < 1 {
+        err = errors.New("wipe passes must be at least 1")
+    }
+    for _, yn := range []string{*wipeSignatures, *zero} {
+        if err == nil && yn != "" && yn != "y" && yn != "n" {
+            err = errors.New("--wipesignatures and --zero expect y or n")
+        }
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, err.Error() + "\n" + usage, os.Args[0])
+        os.Exit(1)
+    }
+
+    fsckPolicy, err := daemon.ParseFsckPolicy(*fsck)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, err.Error() + "\n" + usage, os.Args[0])
+        os.Exit(1)
+    }
+
+    reserveMB, err := daemon.ParseReserve(*autoGrowReserve)
+    if err == nil && *monitorInterval < 0 {
+        err = errors.New("monitor interval must not be negative")
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, err.Error() + "\n" + usage, os.Args[0])
+        os.Exit(1)
+    }
+
+    gcPolicy, err := daemon.ParseGCPolicy(*gc)
+    if err == nil && (*gcInterval < 0 || *gcGrace < 0) {
+        err = errors.New("gc interval and grace period must not be negative")
+    }
+    if err == nil && *backupCheckInterval < 0 {
+        err = errors.New("backup check interval must not be negative")
+    }
+    if err == nil && *freezeTimeout <= 0 {
+        err = errors.New("freeze timeout must be positive")
+    }
+    if err == nil {
+        err = fake.Validate()
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, err.Error() + "\n" + usage, os.Args[0])
+        os.Exit(1)
+    }
+
+    var classes *daemon.StorageClasses
+    switch {
+    case *storageClasses != "" && *volumeGroupName != "":
+        err = errors.New("--volume-group-name and --storage-classes cannot be combined")
+    case *storageClasses != "":
+        classes, err = daemon.LoadStorageClasses(*storageClasses, *defaultLogicalVolumeSize)
+    case *volumeGroupName == "":
+        err = errors.New("must specify a volume group or storage classes")
+    default:
+        classes = daemon.SingleStorageClass(*volumeGroupName, *defaultLogicalVolumeSize)
+    }
+    var defaultMountOptions []string
+    if err == nil {
+        defaultMountOptions, err = daemon.ParseDefaultMountOptions(*mountOptions, classes)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, err.Error() + "\n" + usage, os.Args[0])
+        os.Exit(1)
+    }
+
     if *mount_root == "" {
         fmt.Fprintf(os.Stderr, "must specify a root directory for mounted filesystems\n" + usage, os.Args[0])
         os.Exit(1)
@@ -94,8 +324,68 @@ func main() {
         MountRoot: *mount_root,
         VolumeGroupName: *volumeGroupName,
         DefaultLogicalVolumeSize: *defaultLogicalVolumeSize,
+        StorageClasses: classes,
         SocketSpecLocation: *sock,
-        Debug: *debug,
+        StateDir: *stateDir,
+        LockThreshold: *lockThreshold,
+        LogBuffer: logBuffer,
+        WipePolicy: wipePolicy,
+        WipePasses: *wipePasses,
+        WipeSignatures: *wipeSignatures,
+        Zero: *zero,
+        MountOptions: defaultMountOptions,
+        FsckPolicy: fsckPolicy,
+        FsckRepair: *fsckRepair,
+        MonitorInterval: *monitorInterval,
+        AutoGrowReserveMB: reserveMB,
+        GCPolicy: gcPolicy,
+        GCInterval: *gcInterval,
+        GCGrace: *gcGrace,
+        BackupCheckInterval: *backupCheckInterval,
+        FreezeTimeout: *freezeTimeout,
+        DockerEngine: &daemon.SocketDockerEngine{Socket: *dockerSocket},
+        AdminListener: *adminListener,
+        AdminSocket: *adminSocket,
+        AdminHost: *adminHost,
+        AdminPort: *adminPort,
+        AdminTLSCert: *adminTLSCert,
+        AdminTLSKey: *adminTLSKey,
+        AdminTLSClientCA: *adminTLSClientCA,
+    }
+    if *keyDir == "" {
+        *keyDir = filepath.Join(*stateDir, "keys")
+    }
+    if d.KeyProvider, err = daemon.NewKeyProvider(*keyProvider, *keyDir); err != nil {
+        fmt.Fprintf(os.Stderr, "Cannot set up key provider: %s\n", err.Error())
+        os.Exit(1)
+    }
+    if d.BackupTarget, err = daemon.NewBackupTarget(*backupTarget, *backupDir); err != nil {
+        fmt.Fprintf(os.Stderr, "Cannot set up backup target: %s\n", err.Error())
+        os.Exit(1)
+    }
+    if *snapshotHooks != "" {
+        if d.SnapshotHooks, err = daemon.LoadSnapshotHooks(*snapshotHooks); err != nil {
+            fmt.Fprintf(os.Stderr, "Cannot load snapshot hooks: %s\n", err.Error())
+            os.Exit(1)
+        }
+    }
+    if *ioCgroup != "" {
+        if d.IOController, err = daemon.NewCgroupIOController(*ioCgroup); err != nil {
+            fmt.Fprintf(os.Stderr, "Cannot set up I/O limits: %s\n", err.Error())
+            os.Exit(1)
+        }
+    }
+    if *adminTokenFile != "" {
+        token, err := ioutil.ReadFile(*adminTokenFile)
+        if err != nil || strings.TrimSpace(string(token)) == "" {
+            fmt.Fprintf(os.Stderr, "Cannot read admin token from %s\n", *adminTokenFile)
+            os.Exit(1)
+        }
+        d.AdminToken = strings.TrimSpace(string(token))
+    }
+    if err := fake.Apply(d); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+        os.Exit(1)
     }
     if *jsonf != "" {
         d.JsonLocation = *jsonf
@@ -108,6 +398,15 @@ func main() {
         d.SocketSpecLocation = filepath.Join(daemon.DefaultSocketSpecLocation, daemon.VolumeDriverName + ".sock")
     }
 
+    if *auditLog != "" {
+        if a, err := daemon.OpenAuditLog(*auditLog, *auditLogMaxSize, *auditLogMaxFiles); err != nil {
+            fmt.Fprintf(os.Stderr, "Cannot open audit log: %s\n", err.Error())
+            os.Exit(1)
+        } else {
+            d.AuditLog = a
+        }
+    }
+
     registerCleanupHandler(d)
 
     d.StartServer()
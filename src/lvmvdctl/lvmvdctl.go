@@ -0,0 +1,901 @@
+/*
+ * Command line client for the admin API of the lvm volume driver
+ *
+ * see README.md for further information
+ */
+
+package main
+
+import (
+    "client"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "daemon"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+var usage =
+`usage: %s [options] <command> [arguments]
+
+Talks to the admin API of a running lvm volume driver (lvmvd has to be
+started with --admin-listener=unix or --admin-listener=http).
+
+Commands:
+
+  list                       list all volumes
+  inspect <name>             show details of a volume
+  create <name> [key=value]  create a volume, e.g. create vol1 size=2G
+  remove <name>              remove a volume
+  merge [--force] <snapshot> merge a snapshot into its origin, which rolls
+                             the origin back to the snapshot; with --force
+                             a mounted origin is rolled back once unmounted
+  clone-status <name>        show source and copy progress of a clone, e.g.
+                             of create vol2 clone-from=vol1
+  clone-cancel <name>        cancel the running copy of a clone
+  export [--format=raw|tar] [--compression=none|gzip|zstd] [--file=<file>] <name>
+                             export a volume as a stream, to stdout by
+                             default; raw is the block device, tar the files
+  import [--file=<file>] <name> [key=value]
+                             create a volume from an export, read from stdin
+                             by default; options default to the exported
+                             volume
+  backup <name>              back up a volume now
+  backups <name>             list the backups of a volume, also of a removed
+                             one
+  backup-delete <name> <id>  delete a backup
+  backup-chain <name> <id>   list the backups to import, in this order, to
+                             restore an incremental backup and verify that
+                             they are stored
+  restore [--to=<new name>] <name> <id> [key=value]
+                             create a volume from a backup and the backups
+                             it is based on, by default with the name of the
+                             backed up volume
+  mount-status [name]        show which volumes are mounted where
+  capacity [--class=<name>]  show size and free space of the volume group of
+                             a storage class (default: the default class)
+  classes                    list the storage classes and their usage
+  reconcile [--dry-run]      align metadata with the logical volumes and
+                             remove stale mountpoints
+  gc [--dry-run]             find orphaned volumes, mountpoints and device
+                             mapper targets and remove them according to the
+                             gc policy of the daemon
+  logs [--lines=<n>] [--request-id=<id>]
+                             show recent log lines of the daemon
+
+The following options can be specified:
+
+  --socket=<file>            admin socket of the daemon (default:
+                             /run/lvm-volume-driver/admin.sock)
+  --url=<url>                address of the admin API on https, e.g.
+                             https://host:8443 (optional, overrides --socket)
+  --cacert=<file>            CA to verify the certificate of the daemon
+  --cert=<file>              client certificate (optional)
+  --key=<file>               private key of the client certificate (optional)
+  --token-file=<file>        file with the bearer token (optional)
+  --output=table|json        output format (default: table)
+  --timeout=<dur>            timeout for a request (default: 10m)
+`
+
+// newConfig returns the client configuration for the admin API
+func newConfig(socket, rawurl, cacert, cert, key, tokenFile string, timeout time.Duration) (client.Config, error) {
+    config := client.Config{Socket: socket, URL: rawurl, Timeout: timeout}
+    if tokenFile != "" {
+        token, err := ioutil.ReadFile(tokenFile)
+        if err != nil {
+            return config, err
+        }
+        config.Token = strings.TrimSpace(string(token))
+    }
+    if rawurl == "" {
+        return config, nil
+    }
+    tlsConfig := &tls.Config{}
+    if cacert != "" {
+        pem, err := ioutil.ReadFile(cacert)
+        if err != nil {
+            return config, err
+        }
+        tlsConfig.RootCAs = x509.NewCertPool()
+        if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+            return config, errors.New("No certificates found in " + cacert)
+        }
+    }
+    if cert != "" || key != "" {
+        pair, err := tls.LoadX509KeyPair(cert, key)
+        if err != nil {
+            return config, err
+        }
+        tlsConfig.Certificates = []tls.Certificate{pair}
+    }
+    config.TLSConfig = tlsConfig
+    return config, nil
+}
+
+// --------------------------------------------------------------------------
+// Output
+// --------------------------------------------------------------------------
+
+func formatSize(mb int64) (string) {
+    if mb >= 1024 && mb % 1024 == 0 {
+        return strconv.FormatInt(mb / 1024, 10) + "G"
+    }
+    return strconv.FormatInt(mb, 10) + "M"
+}
+
+// formatBytes returns a length in bytes in the largest unit with at least
+// one whole
+func formatBytes(n int64) (string) {
+    units := []string{"B", "K", "M", "G", "T"}
+    i := 0
+    v := float64(n)
+    for v >= 1024 && i < len(units) - 1 {
+        v /= 1024
+        i++
+    }
+    if i == 0 {
+        return strconv.FormatInt(n, 10) + "B"
+    }
+    return strconv.FormatFloat(v, 'f', 1, 64) + units[i]
+}
+
+func formatTime(t *time.Time) (string) {
+    if t == nil {
+        return "-"
+    }
+    return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func orDash(s string) (string) {
+    if s == "" {
+        return "-"
+    }
+    return s
+}
+
+func printJson(v interface{}) {
+    data, _ := json.MarshalIndent(v, "", "  ")
+    fmt.Println(string(data))
+}
+
+func printTable(header []string, rows [][]string) {
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, strings.Join(header, "\t"))
+    for _, row := range rows {
+        fmt.Fprintln(w, strings.Join(row, "\t"))
+    }
+    w.Flush()
+}
+
+func printVolume(v *daemon.VolumeInfo) {
+    rows := [][]string{
+        {"Name:", v.Name},
+        {"Size:", formatSize(v.SizeMB)},
+        {"Device:", v.Device},
+        {"Class:", orDash(v.Class)},
+        {"Filesystem:", v.Filesystem},
+        {"Mounted:", strconv.FormatBool(v.Mounted)},
+        {"Mountpoint:", orDash(v.Mountpoint)},
+        {"Origin:", orDash(v.Origin)},
+        {"Encrypted:", strconv.FormatBool(v.Encrypted)},
+        {"Mount options:", orDash(strings.Join(v.MountOptions, ","))},
+        {"Read-only:", strconv.FormatBool(v.ReadOnly)},
+        {"Created:", formatTime(v.Created)},
+    }
+    if v.AutoGrow != nil {
+        step := formatSize(int64(v.AutoGrow.StepMB))
+        if v.AutoGrow.StepPercent != 0 {
+            step = strconv.Itoa(v.AutoGrow.StepPercent) + "%"
+        }
+        rows = append(rows, []string{"Auto-grow:", "at " + strconv.Itoa(v.AutoGrow.Threshold) + "% by " + step + " up to " + formatSize(int64(v.AutoGrow.MaxMB))})
+    }
+    if v.Merge != nil {
+        rows = append(rows, []string{"Merging:", v.Merge.Snapshot + " (" + v.Merge.State + ")"})
+    }
+    if v.Merging {
+        rows = append(rows, []string{"Merging into:", v.Origin})
+    }
+    if v.Clone != nil {
+        rows = append(rows, []string{"Clone of:", v.Clone.Source + " (" + formatClone(v.Clone) + ")"})
+    }
+    if v.Importing {
+        rows = append(rows, []string{"Importing:", "true"})
+    }
+    if v.Backup != nil {
+        every := (time.Duration(v.Backup.IntervalSeconds) * time.Second).String()
+        backup := "every " + every + ", keep " + strconv.Itoa(v.Backup.Keep) + ", " + v.Backup.Format + "/" + v.Backup.Compression
+        if v.Backup.Incremental {
+            backup += ", incremental, full every " + strconv.Itoa(v.Backup.FullEvery)
+        }
+        rows = append(rows, []string{"Backup:", backup})
+    }
+    if q := v.Quiesce; q != nil {
+        quiesce := []string{}
+        if q.Freeze {
+            quiesce = append(quiesce, "frozen")
+        }
+        if q.Hook != "" {
+            quiesce = append(quiesce, "hook " + q.Hook)
+        }
+        rows = append(rows, []string{"Snapshots:", strings.Join(quiesce, ", ")})
+    }
+    if l := v.IOLimits; l != nil {
+        limits := []string{}
+        for _, limit := range []struct {
+            name string
+            value int64
+            unit string
+        }{{"read", l.ReadBPS, " bytes/s"}, {"write", l.WriteBPS, " bytes/s"}, {"read", l.ReadIOPS, " IOPS"}, {"write", l.WriteIOPS, " IOPS"}} {
+            if limit.value > 0 {
+                limits = append(limits, limit.name + " " + strconv.FormatInt(limit.value, 10) + limit.unit)
+            }
+        }
+        rows = append(rows, []string{"I/O limits:", strings.Join(limits, ", ")})
+    }
+    if v.IOMax != "" {
+        rows = append(rows, []string{"io.max:", v.IOMax})
+    }
+    if r := v.Raid; r != nil {
+        raid := []string{r.Type}
+        if r.Stripes > 0 {
+            raid = append(raid, strconv.Itoa(r.Stripes) + " stripes")
+        }
+        if r.Mirrors > 0 {
+            raid = append(raid, strconv.Itoa(r.Mirrors) + " mirrors")
+        }
+        if r.StripeSizeKB > 0 {
+            raid = append(raid, strconv.Itoa(r.StripeSizeKB) + "KiB stripe size")
+        }
+        if r.SyncPercent != nil {
+            raid = append(raid, strconv.FormatFloat(*r.SyncPercent, 'f', -1, 64) + "% in sync")
+        }
+        if r.Degraded {
+            raid = append(raid, "degraded (" + r.Health + ")")
+        }
+        rows = append(rows, []string{"RAID:", strings.Join(raid, ", ")})
+    }
+    if b := v.LastBackup; b != nil {
+        last := b.Result + " (" + formatTime(&b.Time) + ")"
+        if b.Error != "" {
+            last += ": " + b.Error
+        }
+        rows = append(rows, []string{"Last backup:", last})
+    }
+    if v.ImportedBackup != "" {
+        rows = append(rows, []string{"Imported backup:", v.ImportedBackup})
+    }
+    if r := v.RestoredFrom; r != nil {
+        rows = append(rows, []string{"Restored from:", r.Volume + "/" + r.Backup + " (" + formatTime(&r.BackupCreated) + ", " +
+            strconv.Itoa(len(r.Backups)) + " backups applied)"})
+    }
+    if v.Fsck != nil {
+        rows = append(rows, []string{"Last fsck:", v.Fsck.Result + " (" + v.Fsck.Mode + ", " + formatTime(&v.Fsck.Time) + ")"})
+    }
+    keys := []string{}
+    for k := range v.Options {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        rows = append(rows, []string{"Option " + k + ":", v.Options[k]})
+    }
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+    for _, row := range rows {
+        fmt.Fprintln(w, strings.Join(row, "\t"))
+    }
+    w.Flush()
+}
+
+// formatClone returns the state of a clone, with the progress of a running
+// copy
+func formatClone(c *daemon.CloneStatus) (string) {
+    if c.State == daemon.CloneCopying {
+        return c.Method + ", " + c.State + " " + strconv.Itoa(c.Percent) + "%"
+    }
+    return c.Method + ", " + c.State
+}
+
+func printCloneStatus(name string, c *daemon.CloneStatus) {
+    rows := [][]string{
+        {"Clone:", name},
+        {"Source:", c.Source},
+        {"Method:", c.Method},
+        {"State:", c.State},
+        {"Copied:", formatSize(c.CopiedMB) + " of " + formatSize(c.SizeMB) + " (" + strconv.Itoa(c.Percent) + "%)"},
+        {"Source frozen:", strconv.FormatBool(c.Frozen)},
+        {"Started:", formatTime(&c.Started)},
+        {"Finished:", formatTime(c.Finished)},
+    }
+    if c.Error != "" {
+        rows = append(rows, []string{"Error:", c.Error})
+    }
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+    for _, row := range rows {
+        fmt.Fprintln(w, strings.Join(row, "\t"))
+    }
+    w.Flush()
+}
+
+// --------------------------------------------------------------------------
+// Commands
+// --------------------------------------------------------------------------
+
+type command struct {
+    ctx context.Context
+    c *client.AdminClient
+    json bool
+    args []string
+}
+
+func (cmd *command) arg(usage string) (string, error) {
+    if len(cmd.args) != 1 || cmd.args[0] == "" {
+        return "", errors.New("usage: " + usage)
+    }
+    return cmd.args[0], nil
+}
+
+func (cmd *command) list() (error) {
+    volumes, err := cmd.c.ListVolumes(cmd.ctx)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(daemon.VolumeList{Volumes: volumes})
+        return nil
+    }
+    rows := [][]string{}
+    for _, v := range volumes {
+        rows = append(rows, []string{v.Name, formatSize(v.SizeMB), strconv.FormatBool(v.Mounted), orDash(v.Origin), formatTime(v.Created), orDash(v.Class)})
+    }
+    printTable([]string{"NAME", "SIZE", "MOUNTED", "ORIGIN", "CREATED", "CLASS"}, rows)
+    return nil
+}
+
+func (cmd *command) inspect() (error) {
+    name, err := cmd.arg("inspect <name>")
+    if err != nil {
+        return err
+    }
+    v, err := cmd.c.InspectVolume(cmd.ctx, name)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(v)
+    } else {
+        printVolume(v)
+    }
+    return nil
+}
+
+func (cmd *command) create() (error) {
+    if len(cmd.args) < 1 {
+        return errors.New("usage: create <name> [key=value ...]")
+    }
+    options := make(map[string]string)
+    for _, opt := range cmd.args[1:] {
+        kv := strings.SplitN(opt, "=", 2)
+        if len(kv) != 2 || kv[0] == "" {
+            return errors.New("Illegal option " + opt + ", expected key=value")
+        }
+        options[kv[0]] = kv[1]
+    }
+    v, err := cmd.c.CreateVolume(cmd.ctx, cmd.args[0], options)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(v)
+    } else {
+        printVolume(v)
+    }
+    return nil
+}
+
+func (cmd *command) remove() (error) {
+    name, err := cmd.arg("remove <name>")
+    if err != nil {
+        return err
+    }
+    if err := cmd.c.RemoveVolume(cmd.ctx, name); err != nil {
+        return err
+    }
+    if !cmd.json {
+        fmt.Println("Removed volume " + name)
+    }
+    return nil
+}
+
+func (cmd *command) merge() (error) {
+    fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+    force := fs.Bool("force", false, "merge into a mounted origin once it is unmounted")
+    if err := fs.Parse(cmd.args); err != nil {
+        return err
+    }
+    if fs.NArg() != 1 {
+        return errors.New("usage: merge [--force] <snapshot>")
+    }
+    name := fs.Arg(0)
+    status, err := cmd.c.MergeSnapshot(cmd.ctx, name, *force)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(status)
+        return nil
+    }
+    switch status.State {
+    case daemon.MergeMerged:
+        fmt.Println("Merged snapshot " + name + " into volume " + status.Origin)
+    case daemon.MergePending:
+        fmt.Println("Snapshot " + name + " will be merged into volume " + status.Origin + " when it is unmounted")
+    default:
+        fmt.Println("Merging snapshot " + name + " into volume " + status.Origin)
+    }
+    return nil
+}
+
+func (cmd *command) export() (error) {
+    fs := flag.NewFlagSet("export", flag.ContinueOnError)
+    format := fs.String("format", "", "raw or tar, default raw")
+    compression := fs.String("compression", "", "none, gzip or zstd, default none")
+    file := fs.String("file", "", "file to write the export to, default stdout")
+    if err := fs.Parse(cmd.args); err != nil {
+        return err
+    }
+    if fs.NArg() != 1 {
+        return errors.New("usage: export [--format=raw|tar] [--compression=none|gzip|zstd] [--file=<file>] <name>")
+    }
+    name := fs.Arg(0)
+    if *file == "" {
+        return cmd.c.ExportVolume(cmd.ctx, name, *format, *compression, os.Stdout)
+    }
+    f, err := os.OpenFile(*file, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+    if err != nil {
+        return err
+    }
+    err = cmd.c.ExportVolume(cmd.ctx, name, *format, *compression, f)
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        // an incomplete export is useless
+        os.Remove(*file)
+        return err
+    }
+    if !cmd.json {
+        fmt.Println("Exported volume " + name + " to " + *file)
+    }
+    return nil
+}
+
+func (cmd *command) importVolume() (error) {
+    fs := flag.NewFlagSet("import", flag.ContinueOnError)
+    file := fs.String("file", "", "file to read the export from, default stdin")
+    if err := fs.Parse(cmd.args); err != nil {
+        return err
+    }
+    if fs.NArg() < 1 {
+        return errors.New("usage: import [--file=<file>] <name> [key=value ...]")
+    }
+    options := make(map[string]string)
+    for _, opt := range fs.Args()[1:] {
+        kv := strings.SplitN(opt, "=", 2)
+        if len(kv) != 2 || kv[0] == "" {
+            return errors.New("Illegal option " + opt + ", expected key=value")
+        }
+        options[kv[0]] = kv[1]
+    }
+    in := os.Stdin
+    if *file != "" {
+        f, err := os.Open(*file)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        in = f
+    }
+    v, err := cmd.c.ImportVolume(cmd.ctx, fs.Arg(0), options, in)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(v)
+    } else {
+        printVolume(v)
+    }
+    return nil
+}
+
+func (cmd *command) backup() (error) {
+    name, err := cmd.arg("backup <name>")
+    if err != nil {
+        return err
+    }
+    b, err := cmd.c.CreateBackup(cmd.ctx, name)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(b)
+    } else {
+        kind := ""
+        if b.Base != "" {
+            kind = ", incremental on " + b.Base
+        }
+        fmt.Println("Backed up volume " + name + " as " + b.Id + " (" + formatBytes(b.StoredBytes) + kind + ")")
+    }
+    return nil
+}
+
+func (cmd *command) backups() (error) {
+    name, err := cmd.arg("backups <name>")
+    if err != nil {
+        return err
+    }
+    backups, err := cmd.c.ListBackups(cmd.ctx, name)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(daemon.BackupList{Backups: backups})
+        return nil
+    }
+    rows := [][]string{}
+    for _, b := range backups {
+        created := b.Created
+        base := b.Base
+        if base == "" {
+            base = "-"
+        }
+        rows = append(rows, []string{b.Id, formatTime(&created), b.Trigger, b.Format, b.Compression, formatBytes(b.StoredBytes), b.Duration, base})
+    }
+    printTable([]string{"ID", "CREATED", "TRIGGER", "FORMAT", "COMPRESSION", "STORED", "DURATION", "BASE"}, rows)
+    return nil
+}
+
+func (cmd *command) backupChain() (error) {
+    if len(cmd.args) != 2 || cmd.args[0] == "" || cmd.args[1] == "" {
+        return errors.New("usage: backup-chain <name> <id>")
+    }
+    chain, err := cmd.c.BackupChain(cmd.ctx, cmd.args[0], cmd.args[1])
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(chain)
+    } else {
+        rows := [][]string{}
+        for _, b := range chain.Backups {
+            created := b.Created
+            rows = append(rows, []string{b.Id, formatTime(&created), b.Format, formatBytes(b.StoredBytes)})
+        }
+        printTable([]string{"ID", "CREATED", "FORMAT", "STORED"}, rows)
+    }
+    if !chain.Complete {
+        return errors.New("Backup chain is incomplete: " + chain.Error)
+    }
+    return nil
+}
+
+func (cmd *command) restore() (error) {
+    fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+    to := fs.String("to", "", "name of the new volume, default the name of the backed up volume")
+    if err := fs.Parse(cmd.args); err != nil {
+        return err
+    }
+    if fs.NArg() < 2 || fs.Arg(0) == "" || fs.Arg(1) == "" {
+        return errors.New("usage: restore [--to=<new name>] <name> <id> [key=value ...]")
+    }
+    options := make(map[string]string)
+    for _, opt := range fs.Args()[2:] {
+        kv := strings.SplitN(opt, "=", 2)
+        if len(kv) != 2 || kv[0] == "" {
+            return errors.New("Illegal option " + opt + ", expected key=value")
+        }
+        options[kv[0]] = kv[1]
+    }
+    v, err := cmd.c.RestoreBackup(cmd.ctx, fs.Arg(0), fs.Arg(1), *to, options)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(v)
+    } else {
+        printVolume(v)
+    }
+    return nil
+}
+
+func (cmd *command) backupDelete() (error) {
+    if len(cmd.args) != 2 || cmd.args[0] == "" || cmd.args[1] == "" {
+        return errors.New("usage: backup-delete <name> <id>")
+    }
+    if err := cmd.c.DeleteBackup(cmd.ctx, cmd.args[0], cmd.args[1]); err != nil {
+        return err
+    }
+    if !cmd.json {
+        fmt.Println("Deleted backup " + cmd.args[1] + " of volume " + cmd.args[0])
+    }
+    return nil
+}
+
+func (cmd *command) cloneStatus() (error) {
+    name, err := cmd.arg("clone-status <name>")
+    if err != nil {
+        return err
+    }
+    status, err := cmd.c.CloneStatus(cmd.ctx, name)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(status)
+    } else {
+        printCloneStatus(name, status)
+    }
+    return nil
+}
+
+func (cmd *command) cloneCancel() (error) {
+    name, err := cmd.arg("clone-cancel <name>")
+    if err != nil {
+        return err
+    }
+    status, err := cmd.c.CancelClone(cmd.ctx, name)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(status)
+    } else {
+        fmt.Println("Canceled copy of clone " + name + " at " + strconv.Itoa(status.Percent) + "%, remove the clone")
+    }
+    return nil
+}
+
+func (cmd *command) mountStatus() (error) {
+    if len(cmd.args) > 1 {
+        return errors.New("usage: mount-status [name]")
+    }
+    all, err := cmd.c.ListVolumes(cmd.ctx)
+    if err != nil {
+        return err
+    }
+    volumes := []daemon.VolumeInfo{}
+    for _, v := range all {
+        if len(cmd.args) == 0 || v.Name == cmd.args[0] {
+            volumes = append(volumes, v)
+        }
+    }
+    if len(cmd.args) == 1 && len(volumes) == 0 {
+        return daemon.NotFound("Volume " + cmd.args[0] + " does not exist")
+    }
+    if cmd.json {
+        printJson(daemon.VolumeList{Volumes: volumes})
+        return nil
+    }
+    rows := [][]string{}
+    for _, v := range volumes {
+        rows = append(rows, []string{v.Name, strconv.FormatBool(v.Mounted), orDash(v.Mountpoint), v.Device})
+    }
+    printTable([]string{"NAME", "MOUNTED", "MOUNTPOINT", "DEVICE"}, rows)
+    return nil
+}
+
+func (cmd *command) capacity() (error) {
+    fs := flag.NewFlagSet("capacity", flag.ContinueOnError)
+    class := fs.String("class", "", "storage class")
+    if err := fs.Parse(cmd.args); err != nil {
+        return err
+    }
+    vg, err := cmd.c.VolumeGroup(cmd.ctx, *class)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(vg)
+        return nil
+    }
+    used := "-"
+    if vg.SizeMB > 0 {
+        used = strconv.FormatInt((vg.SizeMB - vg.FreeMB) * 100 / vg.SizeMB, 10) + "%"
+    }
+    printTable([]string{"VG", "SIZE", "FREE", "USED", "PVS", "LVS", "WIPING"}, [][]string{{
+        vg.Name, formatSize(vg.SizeMB), formatSize(vg.FreeMB), used, strconv.Itoa(vg.PvCount), strconv.Itoa(vg.LvCount), strconv.Itoa(vg.PendingWipes),
+    }})
+    return nil
+}
+
+func (cmd *command) classes() (error) {
+    classes, err := cmd.c.Classes(cmd.ctx)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(daemon.ClassList{Classes: classes})
+        return nil
+    }
+    rows := [][]string{}
+    for _, c := range classes {
+        name := c.Name
+        if c.Default {
+            name += " (default)"
+        }
+        maxSize, maxVolumes := "-", "-"
+        if c.MaxSizeMB > 0 {
+            maxSize = formatSize(int64(c.MaxSizeMB))
+        }
+        if c.MaxVolumes > 0 {
+            maxVolumes = strconv.Itoa(c.MaxVolumes)
+        }
+        rows = append(rows, []string{name, c.VolumeGroup, orDash(c.ThinPool), c.Filesystem, formatSize(int64(c.DefaultSizeMB)),
+            maxSize, strconv.Itoa(c.Volumes) + "/" + maxVolumes, formatSize(c.AllocatedMB), formatSize(c.VolumeGroupInfo.FreeMB)})
+    }
+    printTable([]string{"CLASS", "VG", "THIN POOL", "FS", "DEFAULT SIZE", "MAX SIZE", "VOLUMES", "ALLOCATED", "VG FREE"}, rows)
+    return nil
+}
+
+func (cmd *command) reconcile() (error) {
+    fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+    dryRun := fs.Bool("dry-run", false, "only report what would be changed")
+    if err := fs.Parse(cmd.args); err != nil {
+        return err
+    }
+    report, err := cmd.c.Reconcile(cmd.ctx, *dryRun)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(report)
+        return nil
+    }
+    prefix := ""
+    if report.DryRun {
+        prefix = "(dry run) "
+    }
+    rows := [][]string{}
+    for _, n := range report.MetadataRemoved {
+        rows = append(rows, []string{prefix + "removed metadata", n})
+    }
+    for _, n := range report.MetadataCreated {
+        rows = append(rows, []string{prefix + "created metadata", n})
+    }
+    for _, n := range report.MountpointsRemoved {
+        rows = append(rows, []string{prefix + "removed mountpoint", n})
+    }
+    if len(rows) == 0 {
+        fmt.Println("Nothing to do")
+        return nil
+    }
+    printTable([]string{"ACTION", "VOLUME"}, rows)
+    return nil
+}
+
+func (cmd *command) gc() (error) {
+    fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+    dryRun := fs.Bool("dry-run", false, "only report the orphans")
+    if err := fs.Parse(cmd.args); err != nil {
+        return err
+    }
+    report, err := cmd.c.GC(cmd.ctx, *dryRun)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(report)
+        return nil
+    }
+    if len(report.Items) == 0 {
+        fmt.Println("No orphans found")
+        return nil
+    }
+    rows := [][]string{}
+    for _, item := range report.Items {
+        first := item.FirstSeen
+        rows = append(rows, []string{item.Kind, item.Name, formatTime(&first), item.Action, orDash(item.Error)})
+    }
+    printTable([]string{"KIND", "NAME", "FIRST SEEN", "ACTION", "ERROR"}, rows)
+    return nil
+}
+
+func (cmd *command) logs() (error) {
+    fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+    count := fs.Int("lines", 100, "number of lines")
+    requestId := fs.String("request-id", "", "only lines of this request")
+    if err := fs.Parse(cmd.args); err != nil {
+        return err
+    }
+    lines, err := cmd.c.Logs(cmd.ctx, *count, *requestId)
+    if err != nil {
+        return err
+    }
+    if cmd.json {
+        printJson(daemon.LogResponse{Lines: lines})
+        return nil
+    }
+    for _, line := range lines {
+        fmt.Println(line)
+    }
+    return nil
+}
+
+// --------------------------------------------------------------------------
+// Program entry point
+// --------------------------------------------------------------------------
+
+func main() {
+
+    flag.Usage = func() {
+        fmt.Fprintf(os.Stderr, usage, os.Args[0])
+    }
+    socket := flag.String("socket", daemon.DefaultAdminSocket, "admin socket of the daemon")
+    rawurl := flag.String("url", "", "address of the admin API on https")
+    cacert := flag.String("cacert", "", "CA to verify the certificate of the daemon")
+    cert := flag.String("cert", "", "client certificate")
+    key := flag.String("key", "", "private key of the client certificate")
+    tokenFile := flag.String("token-file", "", "file with the bearer token")
+    output := flag.String("output", "table", "table or json")
+    timeout := flag.Duration("timeout", 10 * time.Minute, "timeout for a request")
+    flag.Parse()
+
+    if flag.NArg() < 1 || (*output != "table" && *output != "json") {
+        flag.Usage()
+        os.Exit(2)
+    }
+
+    config, err := newConfig(*socket, *rawurl, *cacert, *cert, *key, *tokenFile, *timeout)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        os.Exit(1)
+    }
+    c, err := client.NewAdminClient(config)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        os.Exit(1)
+    }
+
+    cmd := &command{ctx: context.Background(), c: c, json: *output == "json", args: flag.Args()[1:]}
+    commands := map[string]func() (error){
+        "list": cmd.list,
+        "inspect": cmd.inspect,
+        "create": cmd.create,
+        "remove": cmd.remove,
+        "merge": cmd.merge,
+        "clone-status": cmd.cloneStatus,
+        "clone-cancel": cmd.cloneCancel,
+        "export": cmd.export,
+        "import": cmd.importVolume,
+        "backup": cmd.backup,
+        "backups": cmd.backups,
+        "backup-delete": cmd.backupDelete,
+        "backup-chain": cmd.backupChain,
+        "restore": cmd.restore,
+        "mount-status": cmd.mountStatus,
+        "capacity": cmd.capacity,
+        "classes": cmd.classes,
+        "reconcile": cmd.reconcile,
+        "gc": cmd.gc,
+        "logs": cmd.logs,
+    }
+    run, ok := commands[flag.Arg(0)]
+    if !ok {
+        fmt.Fprintf(os.Stderr, "Unknown command %s\n", flag.Arg(0))
+        flag.Usage()
+        os.Exit(2)
+    }
+    if err := run(); err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,125 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Fixtures of the tests against the fake LVM backend
+#
+# A test sets TEST, the name of its work directory, and PORT before it
+# sources this file, or LISTENER=unix to serve docker on the unix socket
+# SOCKET. Afterwards it sets DAEMON_ARGS, the options of the daemon besides
+# the listener, the files in the work directory and the volumes. VOLUMES
+# selects the volume group or the storage classes, test-vg by default; it is
+# read at every start of the daemon.
+# ---------------------------------------------------------------------------
+
+CURL=${CURL:-curl}
+LVMVD=${LVMVD:-../src/lvmvd}
+LVMVDCTL=${LVMVDCTL:-../src/lvmvdctl}
+WORKDIR=$(mktemp -d /tmp/lvmvd-${TEST}-test.XXXXXX)
+LVMVD_LOG=${WORKDIR}/lvmvd.log
+SOCKET=${WORKDIR}/lvmvd.sock
+ADMIN_SOCKET=${WORKDIR}/admin.sock
+if [ "${LISTENER}" == "unix" ]; then
+    URL=http://localhost
+else
+    URL=http://localhost:${PORT}
+fi
+URL_PREFIX=${URL}/VolumeDriver.
+HEADERS="Content-Type: application/json"
+CTL="${LVMVDCTL} --socket=${ADMIN_SOCKET} --output=json"
+VOLUMES=--volume-group-name=test-vg
+DAEMON_ARGS=()
+
+# ---------------------------------------------------------------------------
+
+# check <name> <expected> <actual>
+check() {
+    if [ "$2" == "$3" ]; then
+        echo "Test $1 ok"
+        return 0
+    fi
+    echo "Test $1 failed: expected '$2' but received '$3'"
+    return 1
+}
+
+# json <document> <python expression on doc>
+json() {
+    python3 -c 'import json,sys; doc=json.loads(sys.argv[1]); print(eval(sys.argv[2]))' "$1" "$2"
+}
+
+docker() {
+    ${CURL} -s -d "$2" --header "$HEADERS" ${URL_PREFIX}$1
+}
+
+# admin <method> <path> [body]; sets $status and $body, authenticates with
+# TOKEN if set
+admin() {
+    local out
+    out=$(${CURL} -s --unix-socket ${ADMIN_SOCKET} -X "$1" -H "Content-Type: application/json" \
+        ${TOKEN:+-H "Authorization: Bearer ${TOKEN}"} ${3:+-d "$3"} -w '\n%{http_code}' "http://localhost$2")
+    status=$(echo "$out" | tail -n 1)
+    body=$(echo "$out" | sed '$d')
+}
+
+# import <name> <file> [query]; sets $status and $body
+import() {
+    local out
+    out=$(${CURL} -s --unix-socket ${ADMIN_SOCKET} -X POST -H "Content-Type: application/octet-stream" \
+        --data-binary @$2 -w '\n%{http_code}' "http://localhost/v1/volumes/$1/import$3")
+    status=$(echo "$out" | tail -n 1)
+    body=$(echo "$out" | sed '$d')
+}
+
+# err_code <response>: prints the error code of a docker response
+err_code() {
+    json "$1" 'doc["Err"].split(":")[0]'
+}
+
+# listed <volume>: prints whether docker lists the volume
+listed() {
+    json "$(docker List '{}')" 'str("'$1'" in [v["Name"] for v in doc["Volumes"]]).lower()'
+}
+
+# exists <path>
+exists() {
+    [ -e "$1" ] && echo true || echo false
+}
+
+# alive <pid>: prints whether the process runs, zombies do not count
+alive() {
+    case "$(ps -o stat= -p $1)" in
+    ""|Z*) echo false;;
+    *) echo true;;
+    esac
+}
+
+# start_daemon [options]: starts the daemon with DAEMON_ARGS and the options
+start_daemon() {
+    local listener="--listener=http --port=${PORT}"
+    if [ "${LISTENER}" == "unix" ]; then
+        listener="--listener=unix --sock-file=${SOCKET}"
+    fi
+    ${LVMVD} ${listener} --json-file=${WORKDIR}/lvm-volume-driver.json ${VOLUMES} \
+        --mount-root=${WORKDIR}/mnt --state-dir=${WORKDIR}/state --fake-lvm-dir=${WORKDIR}/lvm \
+        "${DAEMON_ARGS[@]}" "$@" >>${LVMVD_LOG} 2>&1 &
+    lvmvdpid=$!
+    sleep 2
+}
+
+stop_daemon() {
+    kill -15 $lvmvdpid
+    sleep 1
+}
+
+# finish <name of the tests>: reports the result, the work directory is
+# removed if all tests passed
+finish() {
+    if [ $failed -ne 0 ]; then
+        echo "$failed $1 tests failed, logs in ${LVMVD_LOG}"
+        exit 1
+    fi
+    rm -rf ${WORKDIR}
+    echo "All $1 tests passed"
+}
+
+failed=0
+echo "Note: lvmvd logs are written to ${LVMVD_LOG}"
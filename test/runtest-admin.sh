@@ -0,0 +1,134 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the admin API of the lvm volume driver
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl >= 7.40 (unix sockets) and python3.
+# ---------------------------------------------------------------------------
+
+TEST=admin
+PORT=${PORT:-8090}
+. $(dirname $0)/lib.sh
+TOKEN=admin-test-token
+DAEMON_ARGS=(--admin-listener=unix --admin-socket=${ADMIN_SOCKET} --admin-token-file=${WORKDIR}/token
+    --debug)
+
+echo -n ${TOKEN} > ${WORKDIR}/token
+start_daemon
+
+# no token
+status=$(${CURL} -s -o /dev/null -w '%{http_code}' --unix-socket ${ADMIN_SOCKET} http://localhost/v1/volumes)
+check "Unauthorized" 401 "$status"
+((failed+=$?))
+
+admin GET /v1/volumes
+check "List empty" "200 0" "$status $(json "$body" 'len(doc["volumes"])')"
+((failed+=$?))
+
+admin POST /v1/volumes '{"name": "admin1", "options": {"size": "100M"}}'
+check "Create" "201 admin1 100" "$status $(json "$body" 'doc["name"], doc["size_mb"]' | tr -d "(),'")"
+((failed+=$?))
+
+admin POST /v1/volumes '{"name": "admin1"}'
+check "Create again" "409 AlreadyExists" "$status $(json "$body" 'doc["code"]')"
+((failed+=$?))
+
+admin POST /v1/volumes '{"name": "../admin"}'
+check "Create illegal name" "400 InvalidArgument" "$status $(json "$body" 'doc["code"]')"
+((failed+=$?))
+
+admin GET /v1/volumes/admin1
+check "Inspect" "200 admin1 False" "$status $(json "$body" 'doc["name"], doc["mounted"]' | tr -d "(),'")"
+((failed+=$?))
+
+admin GET /v1/volumes/missing
+check "Inspect missing" "404 NotFound" "$status $(json "$body" 'doc["code"]')"
+((failed+=$?))
+
+admin POST /v1/volumes/admin1/resize '{"size": "200M"}'
+check "Resize" "200 200" "$status $(json "$body" 'doc["size_mb"]')"
+((failed+=$?))
+
+admin POST /v1/volumes/admin1/resize '{"size": "50M"}'
+check "Shrink" "400 InvalidArgument" "$status $(json "$body" 'doc["code"]')"
+((failed+=$?))
+
+admin POST /v1/volumes/admin1/snapshots '{"name": "admin1-snap"}'
+check "Snapshot" "201 admin1" "$status $(json "$body" 'doc["origin"]')"
+((failed+=$?))
+
+admin GET /v1/volumes/admin1/snapshots
+check "List snapshots" "200 admin1-snap" "$status $(json "$body" '",".join(v["name"] for v in doc["volumes"])')"
+((failed+=$?))
+
+admin GET /v1/volumegroup
+check "Volume group" "200 test-vg 2" "$status $(json "$body" 'doc["name"], doc["lv_count"]' | tr -d "(),'")"
+((failed+=$?))
+
+# a volume created behind the back of the driver and a stale mountpoint,
+# the fake backend picks up the volume on restart
+kill -15 $lvmvdpid
+sleep 1
+truncate -s 10M ${WORKDIR}/lvm/test-vg/manual
+mkdir -p ${WORKDIR}/mnt/stale
+start_daemon
+admin POST "/v1/reconcile?dry_run=true"
+check "Reconcile dry run" "200 manual stale" \
+    "$status $(json "$body" '",".join(doc["metadata_created"]), ",".join(doc["mountpoints_removed"])' | tr -d "(),'")"
+((failed+=$?))
+check "Reconcile dry run keeps mountpoint" "yes" "$([ -d ${WORKDIR}/mnt/stale ] && echo yes)"
+((failed+=$?))
+
+admin POST /v1/reconcile
+check "Reconcile" "200 manual" "$status $(json "$body" '",".join(doc["metadata_created"])')"
+((failed+=$?))
+check "Reconcile removes mountpoint" "no" "$([ -d ${WORKDIR}/mnt/stale ] && echo yes || echo no)"
+((failed+=$?))
+
+for v in admin1-snap admin1 manual; do
+    admin DELETE /v1/volumes/$v
+    check "Remove $v" 204 "$status"
+    ((failed+=$?))
+done
+
+admin GET /v1/volumes
+check "List after remove" "200 0" "$status $(json "$body" 'len(doc["volumes"])')"
+((failed+=$?))
+
+admin PUT /v1/volumes
+check "Method not allowed" 405 "$status"
+((failed+=$?))
+
+admin GET /v1/openapi.json
+check "OpenAPI" "200 3.0.3 True" "$status $(json "$body" 'doc["openapi"], "post" in doc["paths"]["/v1/volumes/{name}/resize"]' | tr -d "(),'")"
+((failed+=$?))
+
+admin GET "/v1/logs?lines=5"
+check "Logs" "200 5" "$status $(json "$body" 'len(doc["lines"])')"
+((failed+=$?))
+
+# lvmvdctl
+CTL="${LVMVDCTL} --socket=${ADMIN_SOCKET} --token-file=${WORKDIR}/token"
+${CTL} create ctl1 size=1G >/dev/null
+check "lvmvdctl create" 0 $?
+((failed+=$?))
+check "lvmvdctl list" "ctl1 1G false" "$(${CTL} list | awk '$1 == "ctl1" {print $1, $2, $3}')"
+((failed+=$?))
+check "lvmvdctl mount-status" "ctl1 false" "$(${CTL} mount-status ctl1 | awk 'NR == 2 {print $1, $2}')"
+((failed+=$?))
+check "lvmvdctl capacity json" "9216" "$(json "$(${CTL} --output=json capacity)" 'doc["free_mb"]')"
+((failed+=$?))
+request_id=$(${CTL} logs --lines=1000 | grep 'volume=ctl1' | head -n 1 | sed 's/.*request_id=\([0-9a-f]*\).*/\1/')
+check "lvmvdctl logs" "yes" "$([ -n "$request_id" ] && ${CTL} logs --request-id=$request_id | grep -q 'msg="Creating volume"' && echo yes)"
+((failed+=$?))
+check "lvmvdctl inspect missing" "Error: NotFound: Volume ctl2 does not exist" "$(${CTL} inspect ctl2 2>&1)"
+((failed+=$?))
+${CTL} remove ctl1 >/dev/null
+check "lvmvdctl remove" 0 $?
+((failed+=$?))
+
+kill -15 $lvmvdpid
+sleep 1
+
+finish admin
@@ -0,0 +1,115 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the audit log: the records of the requests, the peer credentials
+# of callers on the unix socket, and the rotation of the file
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=audit
+LISTENER=unix
+. $(dirname $0)/lib.sh
+AUDIT_LOG=${WORKDIR}/audit.log
+DAEMON_ARGS=(--admin-listener=unix --admin-socket=${ADMIN_SOCKET} --audit-log=${AUDIT_LOG})
+
+# ---------------------------------------------------------------------------
+
+# docker <request> <body> <request id>: sends the request on the unix socket
+# and prints the pid of the caller
+docker() {
+    ${CURL} -s -o ${WORKDIR}/response.json -d "$2" --header "$HEADERS" --header "X-Request-Id: $3" \
+        --unix-socket ${SOCKET} ${URL_PREFIX}$1 &
+    echo $!
+    wait $!
+}
+
+# audit <request id> <python expression on the record>: evaluates the
+# expression on the record of the request
+audit() {
+    python3 -c '
+import json, sys
+for line in open(sys.argv[1]):
+    entry = json.loads(line)
+    if entry.get("request_id") == sys.argv[2]:
+        print(eval(sys.argv[3]))' ${AUDIT_LOG} "$1" "$2"
+}
+
+# programs <request id>: prints the programs executed for the request
+programs() {
+    audit "$1" '" ".join(sorted(set(c.split()[0] for c in entry["commands"])))'
+}
+
+# pad <file>: appends a line of 1MB to the file, so that the next record
+# exceeds a limit of 1MB
+pad() {
+    python3 -c 'import sys; open(sys.argv[1], "a").write("x" * (1024 * 1024 - 1) + "\n")' "$1"
+}
+
+# records of the docker requests with the peer credentials of the caller
+start_daemon
+pid=$(docker Create '{"Name": "vol1", "Opts": {"size": "100M"}}' create-1)
+check "Create" "create vol1 100M success" \
+    "$(audit create-1 'entry["operation"] + " " + entry["volume"] + " " + entry["options"]["size"] + " " + entry["result"]')"
+((failed+=$?))
+check "Caller" "unix $(id -u) $(id -g) ${pid}" \
+    "$(audit create-1 'entry["caller"]["transport"] + " " + " ".join(str(entry["caller"][k]) for k in ("uid", "gid", "pid"))')"
+((failed+=$?))
+check "Commands of create" "true" "$(programs create-1 | grep -qw lvcreate && programs create-1 | grep -qw mkfs.ext4 && echo true || echo false)"
+((failed+=$?))
+check "Command line" "True" "$(audit create-1 '"lvcreate -L 100M -n vol1 test-vg" in entry["commands"]')"
+((failed+=$?))
+docker Mount '{"Name": "vol1", "ID": "c1"}' mount-1 >/dev/null
+check "Commands of mount" "true" "$(programs mount-1 | grep -qw mount && echo true || echo false)"
+((failed+=$?))
+docker Unmount '{"Name": "vol1", "ID": "c1"}' unmount-1 >/dev/null
+check "Unmount" "unmount success" "$(audit unmount-1 'entry["operation"] + " " + entry["result"]')"
+((failed+=$?))
+
+# failures are recorded with their error
+docker Create '{"Name": "vol1"}' create-2 >/dev/null
+check "Failure" "failure True" "$(audit create-2 'entry["result"] + " " + str(len(entry["error"]) > 0)')"
+((failed+=$?))
+docker Remove '{"Name": "vol1"}' remove-1 >/dev/null
+check "Remove" "remove success True" \
+    "$(audit remove-1 'entry["operation"] + " " + entry["result"] + " " + str(any(c.startswith("lvremove") for c in entry["commands"]))')"
+((failed+=$?))
+
+# the admin API on its unix socket as well
+${CURL} -s -o /dev/null -X POST -H "X-Request-Id: admin-1" -H "Content-Type: application/json" \
+    -d '{"name": "vol2", "options": {"size": "100M"}}' --unix-socket ${ADMIN_SOCKET} http://localhost/v1/volumes
+check "Admin create" "admin-create vol2 success unix $(id -u)" \
+    "$(audit admin-1 'entry["operation"] + " " + entry["volume"] + " " + entry["result"] + " " + entry["caller"]["transport"] + " " + str(entry["caller"]["uid"])')"
+((failed+=$?))
+stop_daemon
+
+# the file is rotated when a record would exceed the size limit, and only
+# --audit-log-max-files old files are kept
+records=$(wc -l <${AUDIT_LOG})
+pad ${AUDIT_LOG}
+start_daemon --audit-log-max-size=1 --audit-log-max-files=2
+docker Create '{"Name": "vol3"}' rotate-1 >/dev/null
+check "Rotated" "$((records + 1)) 1" "$(wc -l <${AUDIT_LOG}.1) $(wc -l <${AUDIT_LOG})"
+((failed+=$?))
+check "Record after rotation" "create" "$(audit rotate-1 'entry["operation"]')"
+((failed+=$?))
+docker Remove '{"Name": "vol3"}' rotate-2 >/dev/null
+check "Not rotated below the limit" "2 false" "$(wc -l <${AUDIT_LOG}) $([ -e ${AUDIT_LOG}.2 ] && echo true || echo false)"
+((failed+=$?))
+stop_daemon
+for i in 1 2; do
+    pad ${AUDIT_LOG}
+    start_daemon --audit-log-max-size=1 --audit-log-max-files=2
+    docker Create '{"Name": "vol4-'$i'"}' rotate-pad-$i >/dev/null
+    stop_daemon
+done
+check "Old files kept" "true true false" \
+    "$([ -e ${AUDIT_LOG}.1 ] && echo true || echo false) $([ -e ${AUDIT_LOG}.2 ] && echo true || echo false) $([ -e ${AUDIT_LOG}.3 ] && echo true || echo false)"
+((failed+=$?))
+check "Oldest file dropped" "0 0 1" "$(cat ${AUDIT_LOG}* | grep -c '"create-1"') $(grep -c rotate-1 ${AUDIT_LOG}.1) $(grep -c rotate-1 ${AUDIT_LOG}.2)"
+((failed+=$?))
+check "Permissions" "600" "$(stat -c %a ${AUDIT_LOG})"
+((failed+=$?))
+
+finish audit
@@ -0,0 +1,135 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the usage monitor and auto-grow
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=autogrow
+PORT=${PORT:-8096}
+. $(dirname $0)/lib.sh
+
+# ---------------------------------------------------------------------------
+
+# size_mb <volume>: prints the size of the fake logical volume
+size_mb() {
+    echo $(( $(stat -c %s ${WORKDIR}/lvm/test-vg/$1) / 1024 / 1024 ))
+}
+
+# metric <sample>: prints the value of a sample from /metrics
+metric() {
+    ${CURL} -s ${URL}/metrics | grep -F "$1 " | cut -d " " -f 2
+}
+
+# fill <volume> <mb>: makes the files on the volume use mb megabytes
+fill() {
+    truncate -s $2M ${WORKDIR}/mnt/$1/data
+}
+
+start_daemon --monitor-interval=1s
+check "Create with autogrow" '{"Err":""}' \
+    "$(docker Create '{"Name": "ag1", "Opts": {"size": "100M", "autogrow": "80", "autogrow_step": "50M", "autogrow_max": "200M"}}')"
+((failed+=$?))
+check "Status autogrow" "80 50 200" \
+    "$(json "$(docker Get '{"Name": "ag1"}')" '" ".join(str(doc["Volume"]["Status"]["autogrow"][k]) for k in ["threshold", "step_mb", "max_mb"])')"
+((failed+=$?))
+for opts in '"autogrow": "0", "autogrow_max": "1G"' '"autogrow": "80"' '"autogrow": "80", "autogrow_max": "100M"' \
+        '"autogrow_max": "1G"' '"autogrow": "80", "autogrow_step": "0%", "autogrow_max": "1G"' \
+        '"autogrow": "80", "autogrow_max": "1G", "encrypted": "true"'; do
+    check "Illegal {$opts}" "InvalidArgument" \
+        "$(err_code "$(docker Create '{"Name": "ag9", "Opts": {"size": "100M", '"$opts"'}}')")"
+    ((failed+=$?))
+done
+
+docker Mount '{"Name": "ag1"}' >/dev/null
+fill ag1 70
+sleep 2
+check "Below threshold" "100" "$(size_mb ag1)"
+((failed+=$?))
+check "Used metric" "$((70 * 1024 * 1024))" "$(metric 'lvmvd_volume_used_bytes{volume="ag1"}')"
+((failed+=$?))
+fill ag1 85
+sleep 2
+check "Grown by step" "150" "$(size_mb ag1)"
+((failed+=$?))
+fill ag1 140
+sleep 2
+check "Grown to maximum" "200" "$(size_mb ag1)"
+((failed+=$?))
+fill ag1 190
+sleep 3
+check "Not beyond maximum" "200" "$(size_mb ag1)"
+((failed+=$?))
+check "Grown metric" "2" "$(metric 'lvmvd_autogrow_total{volume="ag1",result="grown"}')"
+((failed+=$?))
+check "Grown bytes metric" "$((100 * 1024 * 1024))" "$(metric 'lvmvd_autogrow_bytes_total{volume="ag1"}')"
+((failed+=$?))
+check "Limit metric" "1" "$(metric 'lvmvd_autogrow_total{volume="ag1",result="limit_reached"}')"
+((failed+=$?))
+check "Limit logged once" "1" "$(grep -c 'msg="Volume reached its maximum size' ${LVMVD_LOG})"
+((failed+=$?))
+docker Unmount '{"Name": "ag1"}' >/dev/null
+sleep 2
+check "No usage when unmounted" "" "$(metric 'lvmvd_volume_used_bytes{volume="ag1"}')"
+((failed+=$?))
+stop_daemon
+
+# the reserve of the volume group is not used for growing
+start_daemon --monitor-interval=1s --autogrow-reserve=10G
+docker Create '{"Name": "ag2", "Opts": {"size": "100M", "autogrow": "50%", "autogrow_max": "1G"}}' >/dev/null
+docker Mount '{"Name": "ag2"}' >/dev/null
+fill ag2 60
+sleep 2
+check "Reserve kept" "100" "$(size_mb ag2)"
+((failed+=$?))
+check "Capacity metric" "1" "$(metric 'lvmvd_autogrow_total{volume="ag2",result="insufficient_capacity"}')"
+((failed+=$?))
+docker Unmount '{"Name": "ag2"}' >/dev/null
+stop_daemon
+
+# without reserve it grows by the default step of 20%
+start_daemon --monitor-interval=1s
+docker Mount '{"Name": "ag2"}' >/dev/null
+fill ag2 55
+sleep 3
+check "Default step" "120" "$(size_mb ag2)"
+((failed+=$?))
+docker Unmount '{"Name": "ag2"}' >/dev/null
+stop_daemon
+
+# RAID volumes need the space of their copies; 9520MB are free, growing the
+# raid1 volume with 4 legs by 1000MB takes 4000MB of them
+start_daemon --monitor-interval=1s --fake-pvs=4 --autogrow-reserve=6000M
+docker Create '{"Name": "ag3", "Opts": {"size": "100M", "raid": "raid1", "mirrors": "3", "autogrow": "50%", "autogrow_step": "1000M", "autogrow_max": "2G"}}' >/dev/null
+docker Mount '{"Name": "ag3"}' >/dev/null
+fill ag3 60
+sleep 2
+check "Reserve kept for RAID copies" "100" "$(size_mb ag3)"
+((failed+=$?))
+check "RAID capacity metric" "1" "$(metric 'lvmvd_autogrow_total{volume="ag3",result="insufficient_capacity"}')"
+((failed+=$?))
+check "RAID space logged" "true" "$(grep -q 'growing volume ag3 by 1000MB takes 4000MB with its raid1 layout' ${LVMVD_LOG} && echo true || echo false)"
+((failed+=$?))
+docker Unmount '{"Name": "ag3"}' >/dev/null
+stop_daemon
+start_daemon --monitor-interval=1s --fake-pvs=4 --autogrow-reserve=5000M
+docker Mount '{"Name": "ag3"}' >/dev/null
+sleep 3
+check "RAID grown" "1100" "$(size_mb ag3)"
+((failed+=$?))
+docker Unmount '{"Name": "ag3"}' >/dev/null
+stop_daemon
+
+# no monitor
+start_daemon --monitor-interval=0
+check "Monitor disabled" "" "$(metric lvmvd_monitor_last_run_timestamp_seconds)"
+((failed+=$?))
+stop_daemon
+
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --autogrow-reserve=lots >>${LVMVD_LOG} 2>&1
+check "Illegal reserve" "1" "$?"
+((failed+=$?))
+
+finish autogrow
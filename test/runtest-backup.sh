@@ -0,0 +1,152 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for backups of volumes
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=backup
+PORT=${PORT:-8102}
+. $(dirname $0)/lib.sh
+DEVICES=${WORKDIR}/lvm/test-vg
+BACKUPS=${WORKDIR}/backups
+DAEMON_ARGS=(--key-provider=file --admin-listener=unix --admin-socket=${ADMIN_SOCKET})
+
+# ---------------------------------------------------------------------------
+
+# mark <volume> <text>: writes text to the start of the fake device
+mark() {
+    printf "$2" | dd of=${DEVICES}/$1 conv=notrunc status=none
+}
+
+# content <volume>: prints the start of the fake device
+content() {
+    head -c 6 ${DEVICES}/$1
+}
+
+# count <volume>: prints the number of backups in the catalog of a volume
+count() {
+    json "$(${CTL} backups $1)" 'len(doc["backups"])'
+}
+
+# backups require a backup target
+start_daemon
+check "Schedule without target" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "vol0", "Opts": {"backup-interval": "1h"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+docker Create '{"Name": "vol0"}' >/dev/null
+admin POST /v1/volumes/vol0/backups
+check "Backup without target" "400" "$status"
+((failed+=$?))
+stop_daemon
+
+BACKUP_OPTS="--backup-target=dir --backup-dir=${BACKUPS} --backup-check-interval=1s"
+start_daemon ${BACKUP_OPTS}
+
+check "Keep without interval" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "bad", "Opts": {"backup-keep": "3"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+check "Illegal interval" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "bad", "Opts": {"backup-interval": "often"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+check "Illegal keep" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "bad", "Opts": {"backup-interval": "1h", "backup-keep": "0"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+check "Illegal backup format" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "bad", "Opts": {"backup-interval": "1h", "backup-format": "zip"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+docker Create '{"Name": "daily", "Opts": {"backup-interval": "1d", "backup-max-age": "30d"}}' >/dev/null
+check "Policy of volume" "86400 7 2592000 raw gzip" \
+    "$(json "$(${CTL} inspect daily)" '" ".join(str(doc["backup"][k]) for k in ["interval_seconds", "keep", "max_age_seconds", "format", "compression"])')"
+((failed+=$?))
+
+# manual backups, also of volumes without schedule
+docker Create '{"Name": "vol1", "Opts": {"size": "100M"}}' >/dev/null
+mark vol1 "data01"
+b=$(${CTL} backup vol1)
+id=$(json "$b" 'doc["id"]')
+check "Manual backup" "vol1 manual raw gzip 104857600" \
+    "$(json "$b" '" ".join(str(doc[k]) for k in ["volume", "trigger", "format", "compression", "bytes"])')"
+((failed+=$?))
+check "Backup stored" "true true" "$(exists ${BACKUPS}/vol1/${id}.stream) $(exists ${BACKUPS}/vol1/${id}.json)"
+((failed+=$?))
+check "Backup snapshot removed" "" "$(ls ${DEVICES} | grep lvmvd-export)"
+((failed+=$?))
+check "Catalog" "1 ${id}" "$(count vol1) $(json "$(${CTL} backups vol1)" 'doc["backups"][0]["id"]')"
+((failed+=$?))
+admin GET /v1/volumes/vol1/backups/${id}
+check "Get backup" "200 ${id}" "$status $(json "$body" 'doc["id"]')"
+((failed+=$?))
+admin GET /v1/volumes/vol1/backups/20200101T000000Z-0000
+check "Get missing backup" "404" "$status"
+((failed+=$?))
+admin GET /v1/volumes/vol1/backups/latest
+check "Illegal backup id" "400" "$status"
+((failed+=$?))
+check "Last backup" "success ${id}" \
+    "$(json "$(docker Get '{"Name": "vol1"}')" 'doc["Volume"]["Status"]["last_backup"]["result"] + " " + doc["Volume"]["Status"]["last_backup"]["id"]')"
+((failed+=$?))
+
+# a backup is an export stream, it can be imported
+${CTL} import --file=${BACKUPS}/vol1/${id}.stream vol1-restored >/dev/null
+check "Import backup" "data01" "$(content vol1-restored)"
+((failed+=$?))
+
+# mounted volumes are backed up through a snapshot and stay usable
+mp=$(json "$(docker Mount '{"Name": "vol1"}')" 'doc["Mountpoint"]')
+${CTL} backup vol1 >/dev/null
+check "Backup mounted" "0 2" "$? $(count vol1)"
+((failed+=$?))
+docker Unmount '{"Name": "vol1"}' >/dev/null
+
+# backups stay in the catalog when the volume is removed
+docker Remove '{"Name": "vol1"}' >/dev/null
+check "Catalog of removed volume" "2" "$(count vol1)"
+((failed+=$?))
+check "Delete backup" "" "$(${CTL} backup-delete vol1 ${id})"
+((failed+=$?))
+check "Deleted backup gone" "1 false" "$(count vol1) $(exists ${BACKUPS}/vol1/${id}.stream)"
+((failed+=$?))
+admin DELETE /v1/volumes/vol1/backups/${id}
+check "Delete missing backup" "404" "$status"
+((failed+=$?))
+admin POST /v1/volumes/vol1/backups
+check "Backup removed volume" "404" "$status"
+((failed+=$?))
+
+# retention by age, the newest backup is always kept
+docker Create '{"Name": "vol2", "Opts": {"size": "100M", "backup-interval": "1h", "backup-keep": "10", "backup-max-age": "2s", "backup-format": "tar"}}' >/dev/null
+${CTL} backup vol2 >/dev/null
+sleep 3
+check "Newest backup kept" "1" "$(count vol2)"
+((failed+=$?))
+${CTL} backup vol2 >/dev/null
+check "Expired backup removed" "1" "$(count vol2)"
+((failed+=$?))
+
+check "Backup metrics" "true" \
+    "$(${CURL} -s http://localhost:${PORT}/metrics | grep -q 'lvmvd_backup_total{volume="vol2",result="success"} 2' && echo true || echo false)"
+((failed+=$?))
+
+# scheduled backups with retention by count
+docker Create '{"Name": "vol3", "Opts": {"size": "100M", "backup-interval": "2s", "backup-keep": "2"}}' >/dev/null
+sleep 8
+check "Scheduled backups kept" "2" "$(count vol3)"
+((failed+=$?))
+check "Scheduled trigger" "schedule" "$(json "$(${CTL} backups vol3)" 'doc["backups"][-1]["trigger"]')"
+((failed+=$?))
+check "Last scheduled backup" "success" "$(json "$(${CTL} inspect vol3)" 'doc["last_backup"]["result"]')"
+((failed+=$?))
+stop_daemon
+
+# the snapshot of a backup interrupted by a stop is removed at start
+start_daemon ${BACKUP_OPTS} --backup-check-interval=0
+check "No leftover snapshots" "" "$(ls ${DEVICES} | grep lvmvd-export)"
+((failed+=$?))
+check "No partial objects" "" "$(find ${BACKUPS} -name '*.partial')"
+((failed+=$?))
+stop_daemon
+
+finish backup
@@ -0,0 +1,128 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for storage classes
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=classes
+PORT=${PORT:-8098}
+. $(dirname $0)/lib.sh
+VOLUMES=
+DAEMON_ARGS=(--admin-listener=unix --admin-socket=${ADMIN_SOCKET})
+
+# ---------------------------------------------------------------------------
+
+# lv <vg> <volume>: prints the size in megabytes of the fake logical volume
+# or "missing"
+lv() {
+    if [ -f ${WORKDIR}/lvm/$1/$2 ]; then
+        echo $(( $(stat -c %s ${WORKDIR}/lvm/$1/$2) / 1024 / 1024 ))
+    else
+        echo missing
+    fi
+}
+
+cat >${WORKDIR}/classes.json <<EOF
+{
+    "default": "ssd",
+    "classes": [
+        {"name": "ssd", "volume_group": "vg-ssd", "default_size_mb": 200},
+        {"name": "hdd", "volume_group": "vg-hdd", "filesystem": "xfs", "max_size_mb": 1024, "max_volumes": 2},
+        {"name": "thin", "volume_group": "vg-ssd", "thin_pool": "pool", "default_size_mb": 100}
+    ]
+}
+EOF
+
+start_daemon --storage-classes=${WORKDIR}/classes.json
+
+check "Create default class" '{"Err":""}' "$(docker Create '{"Name": "c1"}')"
+((failed+=$?))
+check "Default class volume group" "200" "$(lv vg-ssd c1)"
+((failed+=$?))
+check "Create by option" '{"Err":""}' "$(docker Create '{"Name": "c2", "Opts": {"class": "hdd"}}')"
+((failed+=$?))
+check "Option volume group" "512" "$(lv vg-hdd c2)"
+((failed+=$?))
+check "Status class" "hdd" "$(json "$(docker Get '{"Name": "c2"}')" 'doc["Volume"]["Status"]["class"]')"
+((failed+=$?))
+check "Class filesystem" "xfs" "$(json "$(${CTL} inspect c2)" 'doc["filesystem"]')"
+((failed+=$?))
+check "Create by name suffix" '{"Err":""}' "$(docker Create '{"Name": "c3-oChdd-oS300M"}')"
+((failed+=$?))
+check "Suffix volume group" "300" "$(lv vg-hdd c3-oChdd-oS300M)"
+((failed+=$?))
+check "Unknown class" "InvalidArgument" "$(err_code "$(docker Create '{"Name": "c4", "Opts": {"class": "tape"}}')")"
+((failed+=$?))
+check "Unique names" "AlreadyExists" "$(err_code "$(docker Create '{"Name": "c1", "Opts": {"class": "hdd"}}')")"
+((failed+=$?))
+check "Maximum size" "InvalidArgument" "$(err_code "$(docker Create '{"Name": "c5", "Opts": {"class": "hdd", "size": "2G"}}')")"
+((failed+=$?))
+check "Maximum volumes" "InsufficientCapacity" "$(err_code "$(docker Create '{"Name": "c6", "Opts": {"class": "hdd"}}')")"
+((failed+=$?))
+check "Filesystem mount options" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "c7", "Opts": {"mountopts": "data=journal", "class": "hdd"}}')")"
+((failed+=$?))
+
+ssdfree=$(json "$(${CTL} capacity --class=ssd)" 'doc["free_mb"]')
+check "Create thin" '{"Err":""}' "$(docker Create '{"Name": "t1", "Opts": {"class": "thin", "size": "8G"}}')"
+((failed+=$?))
+check "Thin volume" "8192 pool" "$(lv vg-ssd t1) $(json "$(${CTL} inspect t1)" 'doc["thin_pool"]')"
+((failed+=$?))
+check "Thin volume takes no space" "$ssdfree" "$(json "$(${CTL} capacity --class=ssd)" 'doc["free_mb"]')"
+((failed+=$?))
+check "List across classes" "c1 c2 c3-oChdd-oS300M t1" \
+    "$(json "$(docker List '{}')" '" ".join(sorted(v["Name"] for v in doc["Volumes"]))')"
+((failed+=$?))
+check "Classes" "ssd:True:1 hdd:False:2 thin:False:1" \
+    "$(json "$(${CTL} classes)" '" ".join(c["name"] + ":" + str(c["default"]) + ":" + str(c["volumes"]) for c in doc["classes"])')"
+((failed+=$?))
+
+check "Mount other class" "${WORKDIR}/mnt/c2" "$(json "$(docker Mount '{"Name": "c2"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+check "Unmount other class" '{"Err":""}' "$(docker Unmount '{"Name": "c2"}')"
+((failed+=$?))
+check "Remove other class" '{"Err":""}' "$(docker Remove '{"Name": "c2"}')"
+((failed+=$?))
+check "Removed from volume group" "missing" "$(lv vg-hdd c2)"
+((failed+=$?))
+check "Limit freed" '{"Err":""}' "$(docker Create '{"Name": "c6", "Opts": {"class": "hdd"}}')"
+((failed+=$?))
+stop_daemon
+
+start_daemon --storage-classes=${WORKDIR}/classes.json
+check "Mount after restart" "${WORKDIR}/mnt/c6" "$(json "$(docker Mount '{"Name": "c6"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+check "Filesystem after restart" "xfs" "$(json "$(${CTL} inspect c6)" 'doc["filesystem"]')"
+((failed+=$?))
+docker Unmount '{"Name": "c6"}' >/dev/null
+stop_daemon
+
+# the volume group given on the command line is the single class "default",
+# the thin volume keeps its class; its default mount options are checked
+# against ext4 only
+start_daemon --volume-group-name=vg-ssd --mount-options=nodev,data=journal
+check "Single class" "default:vg-ssd:1" \
+    "$(json "$(${CTL} classes)" '" ".join(c["name"] + ":" + c["volume_group"] + ":" + str(c["volumes"]) for c in doc["classes"])')"
+((failed+=$?))
+stop_daemon
+
+${LVMVD} --volume-group-name=vg-ssd --storage-classes=${WORKDIR}/classes.json --mount-root=${WORKDIR}/mnt >>${LVMVD_LOG} 2>&1
+check "Exclusive flags" "1" "$?"
+((failed+=$?))
+# default mount options apply to the volumes of every class
+for opts in data=journal allocsize=64k; do
+    ${LVMVD} --storage-classes=${WORKDIR}/classes.json --mount-root=${WORKDIR}/mnt --mount-options=${opts} \
+        >/dev/null 2>${WORKDIR}/stderr
+    check "Default mount option ${opts} for all classes" "1 true" \
+        "$? $(grep -q "Mount option ${opts} is not allowed for the .* volumes of storage class" ${WORKDIR}/stderr && echo true)"
+    ((failed+=$?))
+done
+echo '{"classes": [{"name": "a", "volume_group": "vg", "filesystem": "btrfs"}]}' >${WORKDIR}/bad.json
+${LVMVD} --storage-classes=${WORKDIR}/bad.json --mount-root=${WORKDIR}/mnt >>${LVMVD_LOG} 2>&1
+check "Illegal classes" "1" "$?"
+((failed+=$?))
+
+finish "storage class"
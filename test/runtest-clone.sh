@@ -0,0 +1,203 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for volume cloning
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=clone
+PORT=${PORT:-8099}
+. $(dirname $0)/lib.sh
+VOLUMES=--storage-classes=${WORKDIR}/classes.json
+DAEMON_ARGS=(--admin-listener=unix --admin-socket=${ADMIN_SOCKET} --log-level=debug)
+
+# ---------------------------------------------------------------------------
+
+# uuid <vg> <volume>: prints the UUID of the fake filesystem
+uuid() {
+    cat ${WORKDIR}/lvm/.uuid/$1/$2 2>/dev/null
+}
+
+# commands <program>: prints the arguments the program was called with, one
+# call per line
+commands() {
+    grep 'msg="Executing command"' ${LVMVD_LOG} | grep -o "cmd=\"$1 [^\"]*\"" | sed -e "s/^cmd=\"$1 //" -e 's/"$//'
+}
+
+# snapshots <vg>: prints the number of hidden snapshots in the volume group
+snapshots() {
+    ls ${WORKDIR}/lvm/$1 | grep -c '^lvmvd-export-'
+}
+
+# clone_state <volume>: prints the state of a clone
+clone_state() {
+    json "$(${CTL} clone-status $1)" 'doc["state"]'
+}
+
+# wait_clone <volume>: waits until the copy of a clone has finished and
+# prints its state
+wait_clone() {
+    for i in $(seq 1 30); do
+        state=$(clone_state $1)
+        if [ "$state" != "copying" ]; then
+            break
+        fi
+        sleep 1
+    done
+    echo $state
+}
+
+cat >${WORKDIR}/classes.json <<EOC
+{
+    "default": "ssd",
+    "classes": [
+        {"name": "ssd", "volume_group": "vg-ssd"},
+        {"name": "hdd", "volume_group": "vg-hdd", "filesystem": "xfs"},
+        {"name": "thin", "volume_group": "vg-ssd", "thin_pool": "pool"}
+    ]
+}
+EOC
+
+start_daemon
+
+docker Create '{"Name": "src", "Opts": {"size": "100M", "mountopts": "noatime"}}' >/dev/null
+check "Clone unmounted" '{"Err":""}' "$(docker Create '{"Name": "c1", "Opts": {"clone-from": "src"}}')"
+((failed+=$?))
+check "Copy completed" "completed" "$(wait_clone c1)"
+((failed+=$?))
+status=$(${CTL} clone-status c1)
+check "Copy status" "src copy 100 100" "$(json "$status" '" ".join(str(v) for v in [doc["source"], doc["method"], doc["percent"], doc["copied_mb"]])')"
+((failed+=$?))
+check "Clone size and mount options" "100 nodev,nosuid,noatime" \
+    "$(json "$(${CTL} inspect c1)" 'str(doc["size_mb"]) + " " + ",".join(doc["mount_options"])')"
+((failed+=$?))
+check "New filesystem UUID" "true" "$([ -n "$(uuid vg-ssd c1)" ] && [ "$(uuid vg-ssd c1)" != "$(uuid vg-ssd src)" ] && echo true)"
+((failed+=$?))
+check "Docker status" "completed" "$(json "$(docker Get '{"Name": "c1"}')" 'doc["Volume"]["Status"]["clone"]["state"]')"
+((failed+=$?))
+
+docker Mount '{"Name": "src"}' >/dev/null
+check "Mounted source" "InUse" "$(err_code "$(docker Create '{"Name": "c2", "Opts": {"clone-from": "src"}}')")"
+((failed+=$?))
+check "Clone frozen source" '{"Err":""}' "$(docker Create '{"Name": "c2", "Opts": {"clone-from": "src", "clone-freeze": "true"}}')"
+((failed+=$?))
+check "Frozen copy completed" "completed true" "$(wait_clone c2) $(json "$(${CTL} clone-status c2)" 'str(doc["frozen"]).lower()')"
+((failed+=$?))
+check "Source and clone mounted" "${WORKDIR}/mnt/c2" "$(json "$(docker Mount '{"Name": "c2"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+check "Source thawed" '{"Err":""}' "$(docker Unmount '{"Name": "src"}')"
+((failed+=$?))
+check "Frozen for the snapshot" "-f ${WORKDIR}/mnt/src -u ${WORKDIR}/mnt/src" "$(commands fsfreeze | tr '\n' ' ' | sed 's/ $//')"
+((failed+=$?))
+check "Copied from the snapshot" "0" "$(snapshots vg-ssd)"
+((failed+=$?))
+docker Unmount '{"Name": "c2"}' >/dev/null
+
+check "Clone of a clone" '{"Err":""}' "$(docker Create '{"Name": "c3", "Opts": {"clone-from": "c1", "class": "hdd"}}')"
+((failed+=$?))
+check "Clone into other class" "completed hdd 100" \
+    "$(wait_clone c3) $(json "$(${CTL} inspect c3)" 'doc["class"] + " " + str(doc["size_mb"])')"
+((failed+=$?))
+
+docker Create '{"Name": "t1", "Opts": {"class": "thin", "size": "200M"}}' >/dev/null
+docker Mount '{"Name": "t1"}' >/dev/null
+check "Thin clone of mounted volume" '{"Err":""}' "$(docker Create '{"Name": "t2", "Opts": {"clone-from": "t1"}}')"
+((failed+=$?))
+check "Thin snapshot" "thin-snapshot completed pool" \
+    "$(json "$(${CTL} inspect t2)" 'doc["clone"]["method"] + " " + doc["clone"]["state"] + " " + doc["thin_pool"]')"
+((failed+=$?))
+check "Thin clone UUID" "true" "$([ "$(uuid vg-ssd t2)" != "$(uuid vg-ssd t1)" ] && echo true)"
+((failed+=$?))
+check "Mount thin clone" "${WORKDIR}/mnt/t2" "$(json "$(docker Mount '{"Name": "t2"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+docker Unmount '{"Name": "t2"}' >/dev/null
+docker Unmount '{"Name": "t1"}' >/dev/null
+
+docker Create '{"Name": "x1", "Opts": {"class": "hdd", "size": "100M"}}' >/dev/null
+docker Mount '{"Name": "x1"}' >/dev/null
+docker Create '{"Name": "x2", "Opts": {"clone-from": "x1", "clone-freeze": "true"}}' >/dev/null
+check "xfs clone" "completed" "$(wait_clone x2)"
+((failed+=$?))
+check "Mount xfs clone next to source" "${WORKDIR}/mnt/x2" "$(json "$(docker Mount '{"Name": "x2"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+docker Unmount '{"Name": "x2"}' >/dev/null
+docker Unmount '{"Name": "x1"}' >/dev/null
+
+check "Unknown source" "NotFound" "$(err_code "$(docker Create '{"Name": "e1", "Opts": {"clone-from": "nosuch"}}')")"
+((failed+=$?))
+check "Other size" "InvalidArgument" "$(err_code "$(docker Create '{"Name": "e1", "Opts": {"clone-from": "src", "size": "1G"}}')")"
+((failed+=$?))
+check "Root options" "InvalidArgument" "$(err_code "$(docker Create '{"Name": "e1", "Opts": {"clone-from": "src", "uid": "1000"}}')")"
+((failed+=$?))
+check "Existing name" "AlreadyExists" "$(err_code "$(docker Create '{"Name": "c1", "Opts": {"clone-from": "src"}}')")"
+((failed+=$?))
+check "Freeze without clone" "InvalidArgument" "$(err_code "$(docker Create '{"Name": "e1", "Opts": {"clone-freeze": "true"}}')")"
+((failed+=$?))
+check "No clone" "NotFound" "$(json "$(${CTL} clone-status src 2>&1 >/dev/null | sed 's/^Error: //' | python3 -c 'import json,sys; print(json.dumps({"e": sys.stdin.read()}))')" 'doc["e"].split(":")[0]')"
+((failed+=$?))
+stop_daemon
+
+# slow copies to watch and cancel
+start_daemon --fake-copy-rate=50
+docker Create '{"Name": "big", "Opts": {"size": "2G"}}' >/dev/null
+check "Slow clone" '{"Err":""}' "$(docker Create '{"Name": "s1", "Opts": {"clone-from": "big"}}')"
+((failed+=$?))
+sleep 2
+check "Copy in progress" "copying" "$(clone_state s1)"
+((failed+=$?))
+check "Progress" "true" "$(json "$(${CTL} clone-status s1)" 'str(0 < doc["percent"] < 100).lower()')"
+((failed+=$?))
+check "Mount clone during copy" "InUse" "$(err_code "$(docker Mount '{"Name": "s1"}')")"
+((failed+=$?))
+check "Mount source during copy" "InUse" "$(err_code "$(docker Mount '{"Name": "big"}')")"
+((failed+=$?))
+check "Remove source during copy" "InUse" "$(err_code "$(docker Remove '{"Name": "big"}')")"
+((failed+=$?))
+check "Remove clone during copy" "InUse" "$(err_code "$(docker Remove '{"Name": "s1"}')")"
+((failed+=$?))
+
+# a mounted source is thawed as soon as the snapshot is taken
+docker Create '{"Name": "busy", "Opts": {"size": "200M"}}' >/dev/null
+docker Mount '{"Name": "busy"}' >/dev/null
+docker Create '{"Name": "s3", "Opts": {"clone-from": "busy", "clone-freeze": "true"}}' >/dev/null
+sleep 1
+check "Snapshot during frozen copy" "copying 1" "$(clone_state s3) $(snapshots vg-ssd)"
+((failed+=$?))
+check "Thawed during copy" "-u ${WORKDIR}/mnt/busy" "$(commands fsfreeze | tail -1)"
+((failed+=$?))
+check "Unmount clone during frozen copy" "InUse" "$(err_code "$(docker Unmount '{"Name": "s3"}')")"
+((failed+=$?))
+check "Unmount source during frozen copy" '{"Err":""}' "$(docker Unmount '{"Name": "busy"}')"
+((failed+=$?))
+check "Mount source during frozen copy" "true" "$(docker Mount '{"Name": "busy"}' | grep -q '"Err":""' && echo true || echo false)"
+((failed+=$?))
+check "Frozen copy completed from snapshot" "completed 0" "$(wait_clone s3) $(snapshots vg-ssd)"
+((failed+=$?))
+docker Unmount '{"Name": "busy"}' >/dev/null
+check "Cancel" "canceled" "$(json "$(${CTL} clone-cancel s1)" 'doc["state"]')"
+((failed+=$?))
+check "Cancel again" "1" "$(${CTL} clone-cancel s1 >/dev/null 2>&1; echo $?)"
+((failed+=$?))
+check "Mount canceled clone" "InvalidArgument" "$(err_code "$(docker Mount '{"Name": "s1"}')")"
+((failed+=$?))
+check "Remove canceled clone" '{"Err":""}' "$(docker Remove '{"Name": "s1"}')"
+((failed+=$?))
+
+docker Create '{"Name": "s2", "Opts": {"clone-from": "big"}}' >/dev/null
+sleep 1
+stop_daemon
+start_daemon
+check "Interrupted copy" "failed" "$(clone_state s2)"
+((failed+=$?))
+check "Mount interrupted clone" "InvalidArgument" "$(err_code "$(docker Mount '{"Name": "s2"}')")"
+((failed+=$?))
+check "Remove interrupted clone" '{"Err":""}' "$(docker Remove '{"Name": "s2"}')"
+((failed+=$?))
+check "Source usable" "${WORKDIR}/mnt/big" "$(json "$(docker Mount '{"Name": "big"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+docker Unmount '{"Name": "big"}' >/dev/null
+stop_daemon
+
+finish clone
@@ -0,0 +1,75 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the timeouts of external programs and the kill of their process
+# groups
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. The fake runs LVM in the daemon, so snapshot hooks stand in for
+# hanging programs. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=command
+PORT=${PORT:-8109}
+. $(dirname $0)/lib.sh
+DAEMON_ARGS=(--snapshot-hooks=${WORKDIR}/hooks.json --admin-listener=unix --admin-socket=${ADMIN_SOCKET}
+    --log-level=debug)
+
+# ---------------------------------------------------------------------------
+
+# hang.sh starts a child in its process group and waits for it
+cat >${WORKDIR}/hang.sh <<EOF
+#!/bin/bash
+sleep 30 &
+echo \$! >${WORKDIR}/child.pid
+wait
+EOF
+chmod +x ${WORKDIR}/hang.sh
+
+cat >${WORKDIR}/hooks.json <<EOF
+{
+    "hooks": [
+        {"name": "hanging", "pre": ["${WORKDIR}/hang.sh"], "timeout": "1m"}
+    ]
+}
+EOF
+
+# a program that exceeds its command timeout is killed with its children
+start_daemon --command-timeouts=${WORKDIR}/hang.sh=500ms
+docker Create '{"Name": "vol1", "Opts": {"size": "100M", "snapshot-hook": "hanging"}}' >/dev/null
+docker Mount '{"Name": "vol1"}' >/dev/null
+admin POST /v1/volumes/vol1/snapshots '{"name": "snap1"}'
+check "Command timeout" "504 Timeout" "$status $(json "$body" 'doc["code"]')"
+((failed+=$?))
+check "Killed after command timeout" "true" \
+    "$(json "$body" 'doc["message"]' | grep -q 'hang.sh" did not finish within 500ms and was killed' && echo true || echo false)"
+((failed+=$?))
+check "Process group killed" "false" "$(alive $(cat ${WORKDIR}/child.pid))"
+((failed+=$?))
+check "No snapshot" "404" "$(admin GET /v1/volumes/snap1; echo $status)"
+((failed+=$?))
+docker Unmount '{"Name": "vol1"}' >/dev/null
+stop_daemon
+
+# the default timeout applies to programs without their own
+rm -f ${WORKDIR}/child.pid
+start_daemon --command-timeout=500ms
+docker Mount '{"Name": "vol1"}' >/dev/null
+admin POST /v1/volumes/vol1/snapshots '{"name": "snap2"}'
+check "Default command timeout" "504 true" \
+    "$status $(json "$body" 'doc["message"]' | grep -q 'did not finish within 500ms' && echo true || echo false)"
+((failed+=$?))
+check "Process group killed by default timeout" "false" "$(alive $(cat ${WORKDIR}/child.pid))"
+((failed+=$?))
+docker Unmount '{"Name": "vol1"}' >/dev/null
+docker Remove '{"Name": "vol1"}' >/dev/null
+stop_daemon
+
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --command-timeouts=lvcreate >>${LVMVD_LOG} 2>&1
+check "Illegal command timeouts" "1" "$?"
+((failed+=$?))
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --command-timeout=0s >>${LVMVD_LOG} 2>&1
+check "Illegal command timeout" "1" "$?"
+((failed+=$?))
+
+finish command
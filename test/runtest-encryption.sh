@@ -0,0 +1,86 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for LUKS encrypted volumes
+#
+# Runs against the fake LVM backend, so neither root nor cryptsetup is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=encryption
+PORT=${PORT:-8093}
+. $(dirname $0)/lib.sh
+KEYDIR=${WORKDIR}/keys
+
+# encryption is disabled without a key provider
+start_daemon
+check "Create without key provider" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "enc0", "Opts": {"encrypted": "true"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+stop_daemon
+
+start_daemon --key-provider=file --key-dir=${KEYDIR}
+check "Create encrypted" '{"Err":""}' "$(docker Create '{"Name": "enc1", "Opts": {"encrypted": "true", "size": "20M"}}')"
+((failed+=$?))
+check "Key file" "600" "$(stat -c %a ${KEYDIR}/enc1.key)"
+((failed+=$?))
+check "Illegal option" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "enc2", "Opts": {"encrypted": "maybe"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+check "Create plain" '{"Err":""}' "$(docker Create '{"Name": "plain1"}')"
+((failed+=$?))
+
+get=$(docker Get '{"Name": "enc1"}')
+check "Status closed" "True False" "$(json "$get" 'str(doc["Volume"]["Status"]["encrypted"]) + " " + str(doc["Volume"]["Status"]["opened"])')"
+((failed+=$?))
+get=$(docker Get '{"Name": "plain1"}')
+check "Status plain" "False" "$(json "$get" 'doc["Volume"]["Status"]["encrypted"]')"
+((failed+=$?))
+
+check "Mount encrypted" "${WORKDIR}/mnt/enc1" "$(json "$(docker Mount '{"Name": "enc1"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+get=$(docker Get '{"Name": "enc1"}')
+check "Status opened" "True ${WORKDIR}/lvm/mapper/lvmvd-crypt-test-vg-enc1" \
+    "$(json "$get" 'str(doc["Volume"]["Status"]["opened"]) + " " + doc["Volume"]["Status"]["mapper"]')"
+((failed+=$?))
+check "Remove while mounted" "InUse" "$(json "$(docker Remove '{"Name": "enc1"}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+check "Unmount encrypted" '{"Err":""}' "$(docker Unmount '{"Name": "enc1"}')"
+((failed+=$?))
+get=$(docker Get '{"Name": "enc1"}')
+check "Status closed after unmount" "False" "$(json "$get" 'doc["Volume"]["Status"]["opened"]')"
+((failed+=$?))
+stop_daemon
+
+# the volume can be opened again after a restart
+start_daemon --key-provider=file --key-dir=${KEYDIR}
+check "Mount after restart" "${WORKDIR}/mnt/enc1" "$(json "$(docker Mount '{"Name": "enc1"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+check "Unmount after restart" '{"Err":""}' "$(docker Unmount '{"Name": "enc1"}')"
+((failed+=$?))
+
+# a wrong key does not open the volume
+cp ${KEYDIR}/enc1.key ${WORKDIR}/enc1.key
+head -c 64 /dev/urandom > ${KEYDIR}/enc1.key
+check "Mount with wrong key" "ExternalCommandFailed" "$(json "$(docker Mount '{"Name": "enc1"}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+cp ${WORKDIR}/enc1.key ${KEYDIR}/enc1.key
+
+check "Remove encrypted" '{"Err":""}' "$(docker Remove '{"Name": "enc1"}')"
+((failed+=$?))
+check "Key deleted" "no" "$([ -e ${KEYDIR}/enc1.key ] && echo yes || echo no)"
+((failed+=$?))
+docker Remove '{"Name": "plain1"}' >/dev/null
+
+# the root of the filesystem inside the container is initialized
+docker Create '{"Name": "enc3", "Opts": {"encrypted": "true", "mode": "0700", "lostfound": "false"}}' >/dev/null
+docker Mount '{"Name": "enc3"}' >/dev/null
+check "Encrypted mode" "700" "$(stat -c %a ${WORKDIR}/mnt/enc3)"
+((failed+=$?))
+check "Encrypted lost+found removed" "" "$(ls -A ${WORKDIR}/mnt/enc3)"
+((failed+=$?))
+docker Unmount '{"Name": "enc3"}' >/dev/null
+docker Remove '{"Name": "enc3"}' >/dev/null
+stop_daemon
+
+finish encryption
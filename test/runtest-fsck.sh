@@ -0,0 +1,167 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the filesystem check before mount
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=fsck
+PORT=${PORT:-8095}
+. $(dirname $0)/lib.sh
+
+# ---------------------------------------------------------------------------
+
+# fsstate <volume> <state>: sets the state of the fake filesystem, only
+# read when the daemon starts
+fsstate() {
+    mkdir -p ${WORKDIR}/lvm/.fsstate/test-vg
+    echo -n "$2" >${WORKDIR}/lvm/.fsstate/test-vg/$1
+}
+
+# fsck_runs: prints the number of filesystem checks executed
+fsck_runs() {
+    grep -c 'msg="Executing command".* cmd="e2fsck ' ${LVMVD_LOG}
+}
+
+# e2fsck_since <line>: prints the modes of e2fsck executed after a line of
+# the log
+e2fsck_since() {
+    tail -n +$(($1 + 1)) ${LVMVD_LOG} | grep 'msg="Executing command"' | \
+        grep -o 'cmd="e2fsck [^ ]* [^ ]*' | sed 's/cmd="e2fsck //' | tr '\n' ',' | sed 's/,$//'
+}
+
+# commands_since <line>: prints the programs checking, mounting and
+# unmounting filesystems executed after a line of the log
+commands_since() {
+    tail -n +$(($1 + 1)) ${LVMVD_LOG} | grep 'msg="Executing command"' | \
+        sed -e 's/.* cmd="\([^"]*\)".*/\1/' -e 's/ .*//' | grep -E '^(xfs_repair|mount|umount)$' | tr '\n' ' ' | sed 's/ $//'
+}
+
+start_daemon
+for v in fsck1 fsck2 fsck3; do
+    docker Create '{"Name": "'$v'"}' >/dev/null
+done
+# never is the default
+fsstate fsck1 corrupt
+stop_daemon
+start_daemon --log-level=debug
+check "Policy never" '' "$(json "$(docker Mount '{"Name": "fsck1"}')" 'doc["Err"]')"
+((failed+=$?))
+check "No check with never" "0" "$(fsck_runs)"
+((failed+=$?))
+docker Unmount '{"Name": "fsck1"}' >/dev/null
+stop_daemon
+
+# dirty only checks filesystems not marked clean
+fsstate fsck1 dirty
+start_daemon --log-level=debug --fsck=dirty
+docker Mount '{"Name": "fsck2"}' >/dev/null
+check "Clean not checked" "0" "$(fsck_runs)"
+((failed+=$?))
+docker Unmount '{"Name": "fsck2"}' >/dev/null
+# the read-only check would report the journal as errors, so it is replayed
+# first
+seen=$(wc -l <${LVMVD_LOG})
+check "Dirty checked" '' "$(json "$(docker Mount '{"Name": "fsck1"}')" 'doc["Err"]')"
+((failed+=$?))
+check "Journal replayed before check" "-E journal_only,-n -f" "$(e2fsck_since $seen)"
+((failed+=$?))
+check "Check recorded" "check clean" \
+    "$(json "$(docker Get '{"Name": "fsck1"}')" 'doc["Volume"]["Status"]["fsck"]["mode"] + " " + doc["Volume"]["Status"]["fsck"]["result"]')"
+((failed+=$?))
+docker Unmount '{"Name": "fsck1"}' >/dev/null
+stop_daemon
+
+# errors refuse the mount without repair
+fsstate fsck3 corrupt
+start_daemon --log-level=debug --fsck=always
+mount=$(docker Mount '{"Name": "fsck3"}')
+check "Corrupt refused" "FilesystemCorrupt" "$(err_code "$mount")"
+((failed+=$?))
+check "Not mounted" "" "$(json "$(docker Get '{"Name": "fsck3"}')" 'doc["Volume"]["Mountpoint"]')"
+((failed+=$?))
+check "Errors recorded" "check errors" \
+    "$(json "$(docker Get '{"Name": "fsck3"}')" 'doc["Volume"]["Status"]["fsck"]["mode"] + " " + doc["Volume"]["Status"]["fsck"]["result"]')"
+((failed+=$?))
+# always checks clean filesystems too
+runs=$(fsck_runs)
+docker Mount '{"Name": "fsck2"}' >/dev/null
+check "Clean checked with always" "$((runs + 1))" "$(fsck_runs)"
+((failed+=$?))
+docker Unmount '{"Name": "fsck2"}' >/dev/null
+stop_daemon
+
+# repair fixes what can be fixed
+fsstate fsck2 broken
+start_daemon --log-level=debug --fsck=always --fsck-repair
+check "Repaired" '' "$(json "$(docker Mount '{"Name": "fsck3"}')" 'doc["Err"]')"
+((failed+=$?))
+check "Repair recorded" "repair repaired" \
+    "$(json "$(docker Get '{"Name": "fsck3"}')" 'doc["Volume"]["Status"]["fsck"]["mode"] + " " + doc["Volume"]["Status"]["fsck"]["result"]')"
+((failed+=$?))
+check "Unrepairable refused" "FilesystemCorrupt" "$(err_code "$(docker Mount '{"Name": "fsck2"}')")"
+((failed+=$?))
+# a daemon killed with a mounted volume leaves its filesystem dirty
+kill -9 $lvmvdpid
+wait $lvmvdpid 2>/dev/null
+check "Dirty after crash" "dirty" "$(cat ${WORKDIR}/lvm/.fsstate/test-vg/fsck3)"
+((failed+=$?))
+runs=$(fsck_runs)
+start_daemon --log-level=debug --fsck=dirty --fsck-repair
+check "Mount after crash" '' "$(json "$(docker Mount '{"Name": "fsck3"}')" 'doc["Err"]')"
+((failed+=$?))
+check "Checked after crash" "$((runs + 1))" "$(fsck_runs)"
+((failed+=$?))
+docker Unmount '{"Name": "fsck3"}' >/dev/null
+check "Clean after unmount" "0" "$(ls ${WORKDIR}/lvm/.fsstate/test-vg/ | grep -c fsck3)"
+((failed+=$?))
+stop_daemon
+
+# xfs has no state, and a log which needs replay is replayed by a mount
+# before the check
+cat >${WORKDIR}/classes.json <<EOF
+{"default": "xfs", "classes": [{"name": "xfs", "volume_group": "test-vg", "filesystem": "xfs"}]}
+EOF
+VOLUMES=--storage-classes=${WORKDIR}/classes.json
+start_daemon
+for v in xfs1 xfs2 xfs3; do
+    docker Create '{"Name": "'$v'"}' >/dev/null
+done
+stop_daemon
+fsstate xfs1 dirty
+fsstate xfs2 corrupt
+start_daemon --log-level=debug --fsck=dirty
+seen=$(wc -l <${LVMVD_LOG})
+check "xfs log replayed" '' "$(json "$(docker Mount '{"Name": "xfs1"}')" 'doc["Err"]')"
+((failed+=$?))
+check "xfs replay before check" "xfs_repair mount umount xfs_repair mount" "$(commands_since $seen)"
+((failed+=$?))
+check "xfs replay without access" "1" \
+    "$(tail -n +$((seen + 1)) ${LVMVD_LOG} | grep 'msg="Executing command"' | grep -c 'cmd="mount -o nodev,nosuid,noexec /')"
+((failed+=$?))
+check "xfs check recorded" "check clean" \
+    "$(json "$(docker Get '{"Name": "xfs1"}')" 'doc["Volume"]["Status"]["fsck"]["mode"] + " " + doc["Volume"]["Status"]["fsck"]["result"]')"
+((failed+=$?))
+docker Unmount '{"Name": "xfs1"}' >/dev/null
+seen=$(wc -l <${LVMVD_LOG})
+docker Mount '{"Name": "xfs3"}' >/dev/null
+check "Clean xfs checked with dirty" "xfs_repair mount" "$(commands_since $seen)"
+((failed+=$?))
+docker Unmount '{"Name": "xfs3"}' >/dev/null
+check "Corrupt xfs refused" "FilesystemCorrupt" "$(err_code "$(docker Mount '{"Name": "xfs2"}')")"
+((failed+=$?))
+stop_daemon
+start_daemon --log-level=debug --fsck=dirty --fsck-repair
+check "xfs repaired" '' "$(json "$(docker Mount '{"Name": "xfs2"}')" 'doc["Err"]')"
+((failed+=$?))
+docker Unmount '{"Name": "xfs2"}' >/dev/null
+stop_daemon
+
+# illegal policies are rejected on start
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --fsck=sometimes >>${LVMVD_LOG} 2>&1
+check "Illegal policy" "1" "$?"
+((failed+=$?))
+
+finish fsck
@@ -0,0 +1,114 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the garbage collector
+#
+# Runs against the fake LVM backend and a fake docker engine, so neither root,
+# docker nor a volume group is required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=gc
+PORT=${PORT:-8097}
+. $(dirname $0)/lib.sh
+DOCKER_VOLUMES=${WORKDIR}/docker-volumes
+DAEMON_ARGS=(--fake-docker-engine=${DOCKER_VOLUMES} --key-provider=file --admin-listener=unix
+    --admin-socket=${ADMIN_SOCKET} --debug)
+
+# ---------------------------------------------------------------------------
+
+# gc_items [--dry-run]: runs the garbage collector and prints kind, name and
+# action of the orphans
+gc_items() {
+    json "$(${CTL} gc "$@")" '" ".join(i["kind"] + ":" + i["name"] + ":" + i["action"] for i in doc["items"])'
+}
+
+printf "used\nenc1\n" >${DOCKER_VOLUMES}
+start_daemon --gc=report --gc-interval=0
+for v in used unused; do
+    docker Create '{"Name": "'$v'"}' >/dev/null
+done
+docker Create '{"Name": "enc1", "Opts": {"encrypted": "true", "lostfound": "false"}}' >/dev/null
+${CURL} -s --unix-socket ${ADMIN_SOCKET} -X POST -H "Content-Type: application/json" \
+    -d '{"name": "snap1"}' http://localhost/v1/volumes/used/snapshots >/dev/null
+docker Mount '{"Name": "enc1"}' >/dev/null
+# a volume docker removed while mounted is forgotten by docker, a later mount
+# withdraws the removal
+for v in forced revived; do
+    docker Create '{"Name": "'$v'", "Opts": {"lostfound": "false"}}' >/dev/null
+    docker Mount '{"Name": "'$v'"}' >/dev/null
+done
+check "Remove of mounted volume" "InUse InUse" \
+    "$(json "$(docker Remove '{"Name": "forced"}')" 'doc["Err"].split(":")[0]') $(json "$(docker Remove '{"Name": "revived"}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+check "Removal recorded" "True" "$(json "$(cat ${WORKDIR}/state/volumes/forced.json)" '"remove_requested" in doc')"
+((failed+=$?))
+docker Unmount '{"Name": "revived"}' >/dev/null
+docker Mount '{"Name": "revived"}' >/dev/null
+check "Removal withdrawn" "False" "$(json "$(cat ${WORKDIR}/state/volumes/revived.json)" '"remove_requested" in doc')"
+((failed+=$?))
+# the device mapper target stays open when the daemon crashes
+{ kill -9 $lvmvdpid; wait $lvmvdpid; } 2>/dev/null
+mkdir -p ${WORKDIR}/mnt/stale
+
+MAPPER=lvmvd-crypt-test-vg-enc1
+# volumes no container uses are only reported
+UNUSED="volume:revived:found volume:unused:found"
+REMOVABLE="mapper:${MAPPER}:found mountpoint:enc1:found mountpoint:revived:found mountpoint:stale:found volume:forced:found"
+ORPHANS="${REMOVABLE} ${UNUSED}"
+start_daemon --gc=report --gc-interval=0
+check "Dry run" "${ORPHANS}" "$(gc_items --dry-run)"
+((failed+=$?))
+check "Report" "${ORPHANS}" "$(gc_items)"
+((failed+=$?))
+check "Reported only" "yes" "$([ -f ${WORKDIR}/lvm/test-vg/unused ] && [ -d ${WORKDIR}/mnt/stale ] && echo yes)"
+((failed+=$?))
+check "Orphan metric" "3" "$(${CURL} -s http://localhost:${PORT}/metrics | grep -F 'lvmvd_gc_orphans{kind="mountpoint"}' | cut -d ' ' -f 2)"
+((failed+=$?))
+stop_daemon
+
+# orphans are removed only after the grace period
+start_daemon --gc=remove --gc-interval=0 --gc-grace=1h
+check "Within grace period" "${REMOVABLE//found/pending} ${UNUSED}" "$(gc_items)"
+((failed+=$?))
+stop_daemon
+
+start_daemon --gc=remove --gc-interval=0 --gc-grace=1s
+rm ${DOCKER_VOLUMES}
+${CTL} gc >/dev/null 2>&1
+check "Docker unreachable" "1 yes" "$? $([ -f ${WORKDIR}/lvm/test-vg/unused ] && echo yes)"
+((failed+=$?))
+printf "used\nenc1\n" >${DOCKER_VOLUMES}
+check "Removed" "${REMOVABLE//found/removed} ${UNUSED}" "$(gc_items)"
+((failed+=$?))
+check "Volume removed" "enc1 revived snap1 unused used" "$(ls ${WORKDIR}/lvm/test-vg | tr '\n' ' ' | sed 's/ $//')"
+((failed+=$?))
+check "Mapper closed" "" "$(ls ${WORKDIR}/lvm/.mapper)"
+((failed+=$?))
+check "Mountpoints removed" "" "$(ls ${WORKDIR}/mnt)"
+((failed+=$?))
+check "Unused volumes left" "${UNUSED}" "$(gc_items)"
+((failed+=$?))
+# volumes in use are never orphans
+docker Mount '{"Name": "enc1"}' >/dev/null
+echo used >${DOCKER_VOLUMES}
+check "Mounted kept" "${UNUSED}" "$(gc_items)"
+((failed+=$?))
+docker Remove '{"Name": "enc1"}' >/dev/null
+docker Unmount '{"Name": "enc1"}' >/dev/null
+stop_daemon
+
+# scheduled runs; an unused volume created with docker volume create
+# survives the grace period
+start_daemon --gc=remove --gc-interval=1s --gc-grace=0s
+sleep 3
+check "Scheduled removal" "revived snap1 unused used" "$(ls ${WORKDIR}/lvm/test-vg | tr '\n' ' ' | sed 's/ $//')"
+((failed+=$?))
+check "Key removed" "" "$(ls ${WORKDIR}/state/keys)"
+((failed+=$?))
+stop_daemon
+
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --gc=sometimes >>${LVMVD_LOG} 2>&1
+check "Illegal policy" "1" "$?"
+((failed+=$?))
+
+finish gc
@@ -0,0 +1,211 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for incremental backups of thin volumes
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=incremental
+PORT=${PORT:-8103}
+. $(dirname $0)/lib.sh
+DEVICES=${WORKDIR}/lvm/test-vg
+BACKUPS=${WORKDIR}/backups
+VOLUMES=--storage-classes=${WORKDIR}/classes.json
+DAEMON_ARGS=(--key-provider=file --backup-target=dir --backup-dir=${BACKUPS}
+    --backup-check-interval=0 --admin-listener=unix --admin-socket=${ADMIN_SOCKET})
+
+# ---------------------------------------------------------------------------
+
+# import <volume> <file>; sets $status and $body
+import() {
+    local out
+    out=$(${CURL} -s --unix-socket ${ADMIN_SOCKET} -X POST -H "Content-Type: application/octet-stream" \
+        --data-binary @$2 -w '\n%{http_code}' "http://localhost/v1/volumes/$1/import")
+    status=$(echo "$out" | tail -n 1)
+    body=$(echo "$out" | sed '$d')
+}
+
+# mark <volume> <MB> <text>: writes text at an offset in MB into the fake
+# device
+mark() {
+    printf "$3" | dd of=${DEVICES}/$1 bs=1M seek=$2 conv=notrunc status=none
+}
+
+# content <volume> <MB>: prints the text at an offset in MB of the fake
+# device
+content() {
+    dd if=${DEVICES}/$1 bs=1M skip=$2 count=1 status=none | head -c 6
+}
+
+# backup <volume>: backs up a volume and prints the format, base and id of
+# the backup
+backup() {
+    json "$(${CTL} backup $1)" 'doc["format"] + " " + doc.get("base", "-") + " " + doc["id"]'
+}
+
+# stream <volume> <id>
+stream() {
+    echo ${BACKUPS}/$1/$2.stream
+}
+
+# base <volume>: prints the base snapshot of a volume
+base() {
+    python3 -c 'import json,sys; print(json.load(open(sys.argv[1])).get("backup_base", {}).get("snapshot", ""))' \
+        ${WORKDIR}/state/volumes/$1.json
+}
+
+# count <volume>: prints the number of backups in the catalog of a volume
+count() {
+    json "$(${CTL} backups $1)" 'len(doc["backups"])'
+}
+
+cat >${WORKDIR}/classes.json <<EOF
+{
+    "default": "thick",
+    "classes": [
+        {"name": "thick", "volume_group": "test-vg"},
+        {"name": "thin", "volume_group": "test-vg", "thin_pool": "pool"}
+    ]
+}
+EOF
+
+start_daemon
+
+check "Incremental of thick volume" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"backup-interval": "1h", "backup-incremental": "true"}}')")"
+((failed+=$?))
+check "Incremental tar" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"class": "thin", "backup-interval": "1h", "backup-incremental": "true", "backup-format": "tar"}}')")"
+((failed+=$?))
+check "Full every without incremental" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"class": "thin", "backup-interval": "1h", "backup-full-every": "3"}}')")"
+((failed+=$?))
+check "Incremental encrypted" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"class": "thin", "encrypted": "true", "backup-interval": "1h", "backup-incremental": "true"}}')")"
+((failed+=$?))
+
+docker Create '{"Name": "inc", "Opts": {"class": "thin", "size": "100M", "backup-interval": "1d", "backup-incremental": "true", "backup-full-every": "3"}}' >/dev/null
+check "Policy" "True 3" "$(json "$(${CTL} inspect inc)" 'str(doc["backup"]["incremental"]) + " " + str(doc["backup"]["full_every"])')"
+((failed+=$?))
+
+# the first backup is full, its snapshot is kept as base
+mark inc 0 "full01"
+read format base b1 <<<"$(backup inc)"
+check "First backup full" "raw -" "$format $base"
+((failed+=$?))
+snapshot=$(base inc)
+check "Base kept" "true" "$([ -n "${snapshot}" ] && [ -f ${DEVICES}/${snapshot} ] && echo true || echo false)"
+((failed+=$?))
+check "Base hidden" "1" "$(json "$(${CTL} list)" 'len(doc["volumes"])')"
+((failed+=$?))
+
+# the next ones only have the changed blocks
+mark inc 10 "delta2"
+read format base b2 <<<"$(backup inc)"
+check "Incremental backup" "delta ${b1}" "$format $base"
+((failed+=$?))
+check "Incremental is small" "True" "$(json "$(${CTL} backups inc)" 'str(doc["backups"][1]["bytes"] < 1024 * 1024)')"
+((failed+=$?))
+check "Previous base removed" "false" "$([ -f ${DEVICES}/${snapshot} ] && echo true || echo false)"
+((failed+=$?))
+mark inc 0 "third3"
+mark inc 50 "fifty3"
+read format base b3 <<<"$(backup inc)"
+check "Second incremental" "delta ${b2}" "$format $base"
+((failed+=$?))
+cp ${DEVICES}/inc ${WORKDIR}/inc-b3
+
+# the base survives a restart
+stop_daemon
+start_daemon
+mark inc 20 "after4"
+read format base b4 <<<"$(backup inc)"
+check "Full backup due" "raw -" "$format $base"
+((failed+=$?))
+read format base b5 <<<"$(backup inc)"
+check "Incremental after full" "delta ${b4}" "$format $base"
+((failed+=$?))
+
+# the chain of a backup from the full one on
+chain=$(${CTL} backup-chain inc ${b3})
+check "Chain" "${b1} ${b2} ${b3} True" "$(json "$chain" '" ".join(b["id"] for b in doc["backups"]) + " " + str(doc["complete"])')"
+((failed+=$?))
+
+# restore by importing the chain
+import restored $(stream inc ${b1})
+check "Import full backup" "201 ${b1}" "$status $(json "$body" 'doc["imported_backup"]')"
+((failed+=$?))
+import restored $(stream inc ${b3})
+check "Import out of order" "400" "$status"
+((failed+=$?))
+import restored $(stream inc ${b2})
+check "Import incremental" "201 ${b2}" "$status $(json "$body" 'doc["imported_backup"]')"
+((failed+=$?))
+import restored $(stream inc ${b3})
+check "Import second incremental" "201 third3 delta2 fifty3" \
+    "$status $(content restored 0) $(content restored 10) $(content restored 50)"
+((failed+=$?))
+check "Restored data identical" "0" "$(cmp -s ${DEVICES}/restored ${WORKDIR}/inc-b3; echo $?)"
+((failed+=$?))
+import missing $(stream inc ${b2})
+check "Import incremental without volume" "404" "$status"
+((failed+=$?))
+
+# a mount ends the chain
+import restored2 $(stream inc ${b4})
+docker Mount '{"Name": "restored2"}' >/dev/null
+docker Unmount '{"Name": "restored2"}' >/dev/null
+check "Chain ended by mount" "None" "$(json "$(${CTL} inspect restored2)" 'doc.get("imported_backup")')"
+((failed+=$?))
+import restored2 $(stream inc ${b5})
+check "Import after mount" "400" "$status"
+((failed+=$?))
+
+# backups with dependents cannot be deleted
+admin DELETE /v1/volumes/inc/backups/${b2}
+check "Delete base" "409" "$status"
+((failed+=$?))
+admin DELETE /v1/volumes/inc/backups/${b3}
+check "Delete newest of chain" "204" "$status"
+((failed+=$?))
+
+# a chain with a missing stream is incomplete
+rm $(stream inc ${b4})
+${CTL} backup-chain inc ${b5} >/dev/null 2>&1
+check "Incomplete chain" "1" "$?"
+((failed+=$?))
+admin GET /v1/volumes/inc/backups/${b5}/chain
+check "Incomplete chain reported" "200 False" "$status $(json "$body" 'str(doc["complete"])')"
+((failed+=$?))
+
+# retention keeps the bases of the backups kept
+docker Create '{"Name": "ret", "Opts": {"class": "thin", "size": "100M", "backup-interval": "1d", "backup-keep": "1", "backup-incremental": "true", "backup-full-every": "3"}}' >/dev/null
+counts=""
+for i in 1 2 3 4; do
+    mark ret $i "ret00$i"
+    backup ret >/dev/null
+    counts="$counts $(count ret)"
+done
+check "Retention keeps bases" " 1 2 3 1" "$counts"
+((failed+=$?))
+
+# the base goes with its volume, orphaned ones at the next start
+snapshot=$(base ret)
+docker Remove '{"Name": "ret"}' >/dev/null
+check "Base removed with volume" "false" "$([ -f ${DEVICES}/${snapshot} ] && echo true || echo false)"
+((failed+=$?))
+snapshot=$(base inc)
+stop_daemon
+python3 -c 'import json,sys; f=sys.argv[1]; m=json.load(open(f)); del m["backup_base"]; json.dump(m, open(f, "w"))' \
+    ${WORKDIR}/state/volumes/inc.json
+start_daemon
+check "Orphaned base removed" "false" "$([ -f ${DEVICES}/${snapshot} ] && echo true || echo false)"
+((failed+=$?))
+read format base b6 <<<"$(backup inc)"
+check "Full backup without base" "raw -" "$format $base"
+((failed+=$?))
+stop_daemon
+
+finish "incremental backup"
@@ -0,0 +1,121 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the I/O limits of volumes with cgroup v2 io.max
+#
+# Runs against the fake LVM backend and a fake cgroup directory, so neither
+# root nor a volume group is required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=iolimits
+PORT=${PORT:-8106}
+. $(dirname $0)/lib.sh
+CGROUP=${WORKDIR}/cgroup
+IO_MAX=${CGROUP}/io.max
+DAEMON_ARGS=(--key-provider=file --log-level=debug --admin-listener=unix
+    --admin-socket=${ADMIN_SOCKET})
+
+# ---------------------------------------------------------------------------
+
+# status <volume> <key>: prints a key of the Status of a volume
+status() {
+    json "$(docker Get '{"Name": "'$1'"}')" 'doc["Volume"]["Status"].get("'$2'")'
+}
+
+# entry <volume>: prints the line of io.max of the device of a mounted volume
+entry() {
+    local dev
+    dev=$(status $1 io_max | cut -d ' ' -f 1)
+    grep "^${dev} " ${IO_MAX}
+}
+
+mkdir -p ${CGROUP}
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --fake-lvm-dir=${WORKDIR}/lvm \
+    --io-cgroup=${CGROUP} >/dev/null 2>&1
+check "Cgroup without io.max" "1" "$?"
+((failed+=$?))
+
+# limits of other devices are kept
+echo "8:0 rbps=1048576 wbps=max riops=max wiops=max" >${IO_MAX}
+start_daemon --fake-io-cgroup=${CGROUP}
+
+check "Illegal bandwidth" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"read-bps": "fast"}}')")"
+((failed+=$?))
+check "Bandwidth overflow" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"read-bps": "9000000000G"}}')")"
+((failed+=$?))
+check "Zero IOPS" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"write-iops": "0"}}')")"
+((failed+=$?))
+check "Negative IOPS" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"read-iops": "-5"}}')")"
+((failed+=$?))
+
+docker Create '{"Name": "vol1", "Opts": {"size": "100M", "read-bps": "10M", "write-iops": "100"}}' >/dev/null
+check "Limits stored" "10485760 100" \
+    "$(json "$(${CTL} inspect vol1)" 'str(doc["io_limits"]["read_bps"]) + " " + str(doc["io_limits"]["write_iops"])')"
+((failed+=$?))
+check "Limits in status" "{'read_bps': 10485760, 'write_iops': 100}" "$(status vol1 io_limits)"
+((failed+=$?))
+check "No entry while unmounted" "None" "$(status vol1 io_max)"
+((failed+=$?))
+
+# the entry is written at mount
+docker Mount '{"Name": "vol1"}' >/dev/null
+entry1=$(status vol1 io_max)
+check "Entry reported" "rbps=10485760 wbps=max riops=max wiops=100" "$(echo "${entry1}" | cut -d ' ' -f 2-)"
+((failed+=$?))
+check "Entry applied" "${entry1}" "$(entry vol1)"
+((failed+=$?))
+docker Create '{"Name": "vol2", "Opts": {"size": "100M", "write-bps": "1G"}}' >/dev/null
+docker Mount '{"Name": "vol2"}' >/dev/null
+check "Second volume" "3 wbps=1073741824" "$(wc -l <${IO_MAX}) $(entry vol2 | cut -d ' ' -f 3)"
+((failed+=$?))
+check "lvmvdctl" "true" "$(${LVMVDCTL} --socket=${ADMIN_SOCKET} inspect vol1 | grep -q 'I/O limits: *read 10485760 bytes/s, write 100 IOPS' && echo true || echo false)"
+((failed+=$?))
+
+# and removed at unmount
+docker Unmount '{"Name": "vol1"}' >/dev/null
+check "Entry removed" "2 None" "$(wc -l <${IO_MAX}) $(status vol1 io_max)"
+((failed+=$?))
+check "Other device kept" "8:0 rbps=1048576 wbps=max riops=max wiops=max" "$(grep '^8:0 ' ${IO_MAX})"
+((failed+=$?))
+
+# volumes without limits are left alone
+docker Create '{"Name": "free"}' >/dev/null
+docker Mount '{"Name": "free"}' >/dev/null
+check "No limits" "2 None" "$(wc -l <${IO_MAX}) $(status free io_max)"
+((failed+=$?))
+
+# encrypted volumes are limited on their device mapper target
+docker Create '{"Name": "enc", "Opts": {"size": "100M", "encrypted": "true", "read-iops": "50"}}' >/dev/null
+docker Mount '{"Name": "enc"}' >/dev/null
+check "Encrypted volume" "true riops=50" \
+    "$(grep -q 'cmd="lsblk .*/mapper/' ${LVMVD_LOG} && echo true || echo false) $(entry enc | cut -d ' ' -f 4)"
+((failed+=$?))
+docker Unmount '{"Name": "enc"}' >/dev/null
+
+# clones have their own limits
+docker Unmount '{"Name": "vol2"}' >/dev/null
+check "Clone with limits" "" \
+    "$(json "$(docker Create '{"Name": "clone", "Opts": {"clone-from": "vol2", "read-iops": "20"}}')" 'doc["Err"]')"
+((failed+=$?))
+sleep 1
+check "Clone limits" "{'read_iops': 20}" "$(status clone io_limits)"
+((failed+=$?))
+stop_daemon
+
+# without a cgroup the entry is only reported
+start_daemon
+before=$(cat ${IO_MAX})
+docker Mount '{"Name": "vol1"}' >/dev/null
+check "Reported only" "rbps=10485760 wbps=max riops=max wiops=100 true" \
+    "$(status vol1 io_max | cut -d ' ' -f 2-) $([ "$(cat ${IO_MAX})" == "${before}" ] && echo true || echo false)"
+((failed+=$?))
+docker Unmount '{"Name": "vol1"}' >/dev/null
+check "Report removed" "None" "$(status vol1 io_max)"
+((failed+=$?))
+stop_daemon
+
+finish "I/O limit"
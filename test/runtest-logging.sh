@@ -0,0 +1,86 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the correlation of log lines by request id, in logfmt and in JSON
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=logging
+PORT=${PORT:-8108}
+. $(dirname $0)/lib.sh
+DAEMON_ARGS=(--log-level=debug)
+
+# ---------------------------------------------------------------------------
+
+# docker <request> <body> [<request id>]: prints the X-Request-Id returned
+docker() {
+    ${CURL} -s -o /dev/null -D - -d "$2" --header "$HEADERS" ${3:+--header "X-Request-Id: $3"} ${URL_PREFIX}$1 | \
+        grep -i '^X-Request-Id:' | sed 's/^[^:]*: *//' | tr -d '\r'
+}
+
+# commands <request id>: prints the programs executed for the request from
+# the logfmt lines
+commands() {
+    grep 'msg="Executing command"' ${LVMVD_LOG} | grep " request_id=$1 " | \
+        grep -o 'cmd="[^ "]*' | sed 's/cmd="//' | sort -u | tr '\n' ' ' | sed 's/ $//'
+}
+
+# json_commands <request id>: prints the number of lines which are no JSON
+# objects and the programs executed for the request from the JSON lines
+json_commands() {
+    python3 -c '
+import json, sys
+progs, bad = set(), 0
+for line in open(sys.argv[1]):
+    try:
+        doc = json.loads(line)
+    except ValueError:
+        bad += 1
+        continue
+    if doc.get("msg") == "Executing command" and doc.get("request_id") == sys.argv[2]:
+        progs.add(doc["cmd"].split()[0])
+print(str(bad) + " " + " ".join(sorted(progs)))' ${LVMVD_LOG} "$1"
+}
+
+# logfmt: the id of the caller is returned and marks the commands
+start_daemon
+check "Request id returned" "create-1" "$(docker Create '{"Name": "vol1", "Opts": {"size": "100M"}}' create-1)"
+((failed+=$?))
+check "Commands of create" "true" "$(commands create-1 | grep -qw lvcreate && commands create-1 | grep -qw mkfs.ext4 && echo true || echo false)"
+((failed+=$?))
+check "Request logged" "true" \
+    "$(grep 'msg="Request received"' ${LVMVD_LOG} | grep -q ' request_id=create-1 ' && echo true || echo false)"
+((failed+=$?))
+docker Mount '{"Name": "vol1", "ID": "c1"}' mount-1 >/dev/null
+check "Commands of mount" "true" "$(commands mount-1 | grep -qw mount && echo true || echo false)"
+((failed+=$?))
+check "No commands of other requests" "false" "$(commands mount-1 | grep -qw lvcreate && echo true || echo false)"
+((failed+=$?))
+
+# an id which is missing or not acceptable is replaced by a new one
+generated=$(docker Unmount '{"Name": "vol1", "ID": "c1"}')
+check "Id generated" "true" "$([ -n "${generated}" ] && echo true || echo false)"
+((failed+=$?))
+check "Commands of generated id" "true" "$(commands ${generated} | grep -qw umount && echo true || echo false)"
+((failed+=$?))
+replaced=$(docker Get '{"Name": "vol1"}' 'bad id')
+check "Bad id replaced" "true" "$([ -n "${replaced}" ] && [ "${replaced}" != "bad id" ] && echo true || echo false)"
+((failed+=$?))
+stop_daemon
+
+# JSON: every line is an object and carries the id as field request_id
+: >${LVMVD_LOG}
+start_daemon --log-format=json
+check "Request id returned in JSON mode" "remove-1" "$(docker Remove '{"Name": "vol1"}' remove-1)"
+((failed+=$?))
+check "JSON commands of remove" "true" "$(json_commands remove-1 | grep -q '^0 .*\blvremove\b' && echo true || echo false)"
+((failed+=$?))
+docker Create '{"Name": "vol2", "Opts": {"size": "100M"}}' create-2 >/dev/null
+check "JSON commands of create" "true" \
+    "$(json_commands create-2 | grep -q '^0 .*\blvcreate\b.*\bmkfs.ext4\b' && echo true || echo false)"
+((failed+=$?))
+stop_daemon
+
+finish logging
@@ -0,0 +1,132 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the merge of snapshots into their origin
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=merge
+PORT=${PORT:-8100}
+. $(dirname $0)/lib.sh
+DEVICES=${WORKDIR}/lvm/test-vg
+DAEMON_ARGS=(--key-provider=file --admin-listener=unix --admin-socket=${ADMIN_SOCKET})
+
+# ---------------------------------------------------------------------------
+
+# mark <volume> <text>: writes text to the start of the fake device
+mark() {
+    printf "$2" | dd of=${DEVICES}/$1 conv=notrunc status=none
+}
+
+# content <volume>: prints the start of the fake device
+content() {
+    head -c 6 ${DEVICES}/$1
+}
+
+start_daemon
+
+docker Create '{"Name": "vol1", "Opts": {"size": "100M"}}' >/dev/null
+mark vol1 "before"
+admin POST /v1/volumes/vol1/snapshots '{"name": "snap1"}'
+mark vol1 "after!"
+
+admin POST /v1/volumes/vol1/merge
+check "Merge volume" "400 InvalidArgument" "$status $(json "$body" 'doc["code"]')"
+((failed+=$?))
+admin POST /v1/volumes/missing/merge
+check "Merge missing snapshot" "404" "$status"
+((failed+=$?))
+admin POST "/v1/volumes/snap1/merge?force=maybe"
+check "Illegal force" "400" "$status"
+((failed+=$?))
+
+docker Mount '{"Name": "snap1"}' >/dev/null
+admin POST /v1/volumes/snap1/merge
+check "Merge mounted snapshot" "409 InUse" "$status $(json "$body" 'doc["code"]')"
+((failed+=$?))
+docker Unmount '{"Name": "snap1"}' >/dev/null
+
+docker Mount '{"Name": "vol1"}' >/dev/null
+admin POST /v1/volumes/snap1/merge
+check "Merge into mounted origin" "409 InUse" "$status $(json "$body" 'doc["code"]')"
+((failed+=$?))
+admin POST "/v1/volumes/snap1/merge?force=true"
+check "Forced merge" "200 pending vol1" "$status $(json "$body" 'doc["state"] + " " + doc["origin"]')"
+((failed+=$?))
+check "Snapshot not listed" "false" "$(listed snap1)"
+((failed+=$?))
+check "Origin listed" "true" "$(listed vol1)"
+((failed+=$?))
+check "Merge in status of origin" "pending snap1" \
+    "$(json "$(docker Get '{"Name": "vol1"}')" 'doc["Volume"]["Status"]["merge"]["state"] + " " + doc["Volume"]["Status"]["merge"]["snapshot"]')"
+((failed+=$?))
+check "Merge again" "400" "$(admin POST "/v1/volumes/snap1/merge?force=true"; echo $status)"
+((failed+=$?))
+check "Mount merging snapshot" "InUse" "$(json "$(docker Mount '{"Name": "snap1"}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+admin POST /v1/volumes/vol1/resize '{"size": "200M"}'
+check "Resize origin" "409" "$status"
+((failed+=$?))
+admin POST /v1/volumes/vol1/snapshots '{"name": "snap1b"}'
+check "Snapshot origin" "409" "$status"
+((failed+=$?))
+check "Data before unmount" "after!" "$(content vol1)"
+((failed+=$?))
+
+docker Unmount '{"Name": "vol1"}' >/dev/null
+check "Merged on unmount" "before" "$(content vol1)"
+((failed+=$?))
+admin GET /v1/volumes/vol1
+check "Merge finished" "200 False" "$status $(json "$body" 'str("merge" in doc)')"
+((failed+=$?))
+admin GET /v1/volumes/snap1
+check "Snapshot gone" "404" "$status"
+((failed+=$?))
+check "Snapshot metadata gone" "false" "$([ -f ${WORKDIR}/state/volumes/snap1.json ] && echo true || echo false)"
+((failed+=$?))
+check "Mount merged origin" "${WORKDIR}/mnt/vol1" "$(json "$(docker Mount '{"Name": "vol1"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+docker Unmount '{"Name": "vol1"}' >/dev/null
+
+docker Create '{"Name": "vol2", "Opts": {"size": "100M"}}' >/dev/null
+mark vol2 "before"
+admin POST /v1/volumes/vol2/snapshots '{"name": "snap2"}'
+mark vol2 "after!"
+check "Merge unmounted" "merged vol2" "$(json "$(${CTL} merge snap2)" 'doc["state"] + " " + doc["origin"]')"
+((failed+=$?))
+check "Merged at once" "before false" "$(content vol2) $(listed snap2)"
+((failed+=$?))
+
+docker Create '{"Name": "enc1", "Opts": {"size": "100M", "encrypted": "true"}}' >/dev/null
+admin POST /v1/volumes/enc1/snapshots '{"name": "enc1-snap"}'
+check "Key of snapshot" "true" "$([ -f ${WORKDIR}/state/keys/enc1-snap.key ] && echo true || echo false)"
+((failed+=$?))
+check "Merge encrypted" "merged" "$(json "$(${CTL} merge enc1-snap)" 'doc["state"]')"
+((failed+=$?))
+check "Key of merged snapshot" "false true" \
+    "$([ -f ${WORKDIR}/state/keys/enc1-snap.key ] && echo true || echo false) $([ -f ${WORKDIR}/state/keys/enc1.key ] && echo true || echo false)"
+((failed+=$?))
+check "Mount merged encrypted" "${WORKDIR}/mnt/enc1" "$(json "$(docker Mount '{"Name": "enc1"}')" 'doc["Mountpoint"]')"
+((failed+=$?))
+docker Unmount '{"Name": "enc1"}' >/dev/null
+
+# a pending merge starts with the next activation, e.g. after a reboot
+docker Create '{"Name": "vol3", "Opts": {"size": "100M"}}' >/dev/null
+mark vol3 "before"
+admin POST /v1/volumes/vol3/snapshots '{"name": "snap3"}'
+mark vol3 "after!"
+docker Mount '{"Name": "vol3"}' >/dev/null
+${CTL} merge --force snap3 >/dev/null
+stop_daemon
+rm -rf ${WORKDIR}/mnt/vol3
+start_daemon
+check "Merged after restart" "before 404" "$(content vol3) $(admin GET /v1/volumes/snap3; echo $status)"
+((failed+=$?))
+admin GET /v1/volumes/vol3
+check "Merge of restart finished" "False" "$(json "$body" 'str("merge" in doc)')"
+((failed+=$?))
+stop_daemon
+
+finish merge
@@ -0,0 +1,103 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for mount options and read-only volumes
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=mount
+PORT=${PORT:-8094}
+. $(dirname $0)/lib.sh
+
+# ---------------------------------------------------------------------------
+
+# last_mount <volume>: prints the mount command executed for the volume
+last_mount() {
+    grep 'msg="Executing command".* cmd="mount ' ${LVMVD_LOG} | grep "/mnt/$1\"" | tail -n 1 | sed 's/.*cmd="\([^"]*\)".*/\1/'
+}
+
+start_daemon --log-level=debug
+check "Create with options" '{"Err":""}' \
+    "$(docker Create '{"Name": "opts1", "Opts": {"mountopts": "noatime,noexec,data=journal", "readonly": "true"}}')"
+((failed+=$?))
+check "Create with defaults" '{"Err":""}' "$(docker Create '{"Name": "opts2"}')"
+((failed+=$?))
+check "Option not allowed" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "opts3", "Opts": {"mountopts": "bind"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+for opts in dev suid exec noatime,exec; do
+    check "Hardening not undone by ${opts}" "InvalidArgument" \
+        "$(json "$(docker Create '{"Name": "opts3", "Opts": {"mountopts": "'${opts}'"}}')" 'doc["Err"].split(":")[0]')"
+    ((failed+=$?))
+done
+check "Illegal option value" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "opts3", "Opts": {"mountopts": "data=unordered"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+check "Illegal readonly" "InvalidArgument" \
+    "$(json "$(docker Create '{"Name": "opts3", "Opts": {"readonly": "perhaps"}}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+
+get=$(docker Get '{"Name": "opts1"}')
+check "Status options" "nodev,nosuid,noatime,noexec,data=journal,ro True" \
+    "$(json "$get" '",".join(doc["Volume"]["Status"]["mount_options"]) + " " + str(doc["Volume"]["Status"]["readonly"])')"
+((failed+=$?))
+
+docker Mount '{"Name": "opts1"}' >/dev/null
+check "Mount with options" "mount -o nodev,nosuid,noatime,noexec,data=journal,ro ${WORKDIR}/lvm/test-vg/opts1 ${WORKDIR}/mnt/opts1" "$(last_mount opts1)"
+((failed+=$?))
+docker Unmount '{"Name": "opts1"}' >/dev/null
+docker Mount '{"Name": "opts2"}' >/dev/null
+check "Mount with defaults" "mount -o nodev,nosuid ${WORKDIR}/lvm/test-vg/opts2 ${WORKDIR}/mnt/opts2" "$(last_mount opts2)"
+((failed+=$?))
+docker Unmount '{"Name": "opts2"}' >/dev/null
+stop_daemon
+
+# changed defaults only apply to new volumes
+start_daemon --log-level=debug --mount-options=noatime
+docker Create '{"Name": "opts4"}' >/dev/null
+docker Mount '{"Name": "opts2"}' >/dev/null
+check "Stored options kept" "mount -o nodev,nosuid ${WORKDIR}/lvm/test-vg/opts2 ${WORKDIR}/mnt/opts2" "$(last_mount opts2)"
+((failed+=$?))
+docker Mount '{"Name": "opts4"}' >/dev/null
+check "New defaults" "mount -o noatime ${WORKDIR}/lvm/test-vg/opts4 ${WORKDIR}/mnt/opts4" "$(last_mount opts4)"
+((failed+=$?))
+docker Unmount '{"Name": "opts2"}' >/dev/null
+docker Unmount '{"Name": "opts4"}' >/dev/null
+stop_daemon
+
+# owner, mode and lost+found of the filesystem root
+start_daemon --log-level=debug
+check "Create with owner" '{"Err":""}' \
+    "$(docker Create '{"Name": "owned1", "Opts": {"uid": "999", "gid": "998", "mode": "0770", "lostfound": "false"}}')"
+((failed+=$?))
+check "Owner changed" "1" "$(grep -c "msg=\"Executing command\".* cmd=\"chown 999:998 /" ${LVMVD_LOG})"
+((failed+=$?))
+docker Mount '{"Name": "owned1"}' >/dev/null
+check "Mode" "770" "$(stat -c %a ${WORKDIR}/mnt/owned1)"
+((failed+=$?))
+check "Lost+found removed" "" "$(ls -A ${WORKDIR}/mnt/owned1)"
+((failed+=$?))
+docker Unmount '{"Name": "owned1"}' >/dev/null
+docker Create '{"Name": "owned2"}' >/dev/null
+docker Mount '{"Name": "owned2"}' >/dev/null
+check "Lost+found kept" "lost+found" "$(ls -A ${WORKDIR}/mnt/owned2)"
+((failed+=$?))
+docker Unmount '{"Name": "owned2"}' >/dev/null
+for opts in '"uid": "postgres"' '"gid": "-1"' '"mode": "rwx"' '"mode": "8777"' '"lostfound": "gone"'; do
+    check "Illegal {$opts}" "InvalidArgument" \
+        "$(json "$(docker Create '{"Name": "owned3", "Opts": {'"$opts"'}}')" 'doc["Err"].split(":")[0]')"
+    ((failed+=$?))
+done
+check "No volume after illegal option" "opts1 opts2 opts4 owned1 owned2" \
+    "$(json "$(docker List '{}')" '" ".join(sorted(v["Name"] for v in doc["Volumes"]))')"
+((failed+=$?))
+stop_daemon
+
+# illegal defaults are rejected on start
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --mount-options=loop >>${LVMVD_LOG} 2>&1
+check "Illegal default options" "1" "$?"
+((failed+=$?))
+
+finish mount
@@ -0,0 +1,189 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the freeze and the hooks around snapshots of mounted volumes
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=quiesce
+PORT=${PORT:-8105}
+. $(dirname $0)/lib.sh
+HOOK_LOG=${WORKDIR}/hook.log
+VOLUMES=--storage-classes=${WORKDIR}/classes.json
+DAEMON_ARGS=(--snapshot-hooks=${WORKDIR}/hooks.json --backup-target=dir
+    --backup-dir=${WORKDIR}/backups --backup-check-interval=0 --admin-listener=unix
+    --admin-socket=${ADMIN_SOCKET} --log-level=debug)
+
+# ---------------------------------------------------------------------------
+
+# since: remembers the end of the log for commands
+since() {
+    seen=$(wc -l <${LVMVD_LOG})
+}
+
+# commands: prints the programs of the freeze, the snapshot and the hooks
+# executed since the last call of since
+commands() {
+    tail -n +$((seen + 1)) ${LVMVD_LOG} | grep 'msg="Executing command"' | \
+        sed -e 's/.* cmd="\([^"]*\)".*/\1/' -e 's/.* cmd=\([^ ]*\).*/\1/' | grep -E '^(fsfreeze|lvcreate|/)' | \
+        sed -e 's/ .*//' -e 's/.*\///' | tr '\n' ' ' | sed 's/ $//'
+}
+
+cat >${WORKDIR}/classes.json <<EOF
+{
+    "default": "thick",
+    "classes": [
+        {"name": "thick", "volume_group": "test-vg"},
+        {"name": "thin", "volume_group": "test-vg", "thin_pool": "pool"}
+    ]
+}
+EOF
+
+cat >${WORKDIR}/hook.sh <<EOF
+#!/bin/bash
+echo "\$*" >>${HOOK_LOG}
+EOF
+chmod +x ${WORKDIR}/hook.sh
+
+cat >${WORKDIR}/hooks.json <<EOF
+{
+    "hooks": [
+        {"name": "record", "pre": ["${WORKDIR}/hook.sh", "pre", "{volume}", "{mountpoint}"],
+         "post": ["${WORKDIR}/hook.sh", "post", "{volume}"]},
+        {"name": "failing", "pre": ["/bin/false"], "post": ["${WORKDIR}/hook.sh", "post", "{volume}"]},
+        {"name": "slow", "pre": ["/bin/sleep", "5"], "timeout": "1s"},
+        {"name": "pausing", "pre": ["/bin/sleep", "2"]}
+    ]
+}
+EOF
+
+seen=0
+
+# the daemon refuses illegal hooks and freeze timeouts
+echo '{"hooks": [{"name": "relative", "pre": ["hook.sh"]}]}' >${WORKDIR}/bad-hooks.json
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --fake-lvm-dir=${WORKDIR}/lvm \
+    --snapshot-hooks=${WORKDIR}/bad-hooks.json >/dev/null 2>&1
+check "Hook with relative path" "1" "$?"
+((failed+=$?))
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --fake-lvm-dir=${WORKDIR}/lvm \
+    --freeze-timeout=0 >/dev/null 2>&1
+check "Freeze timeout zero" "1" "$?"
+((failed+=$?))
+
+start_daemon
+
+check "Illegal freeze" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"snapshot-freeze": "maybe"}}')")"
+((failed+=$?))
+check "Unknown hook" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"snapshot-hook": "missing"}}')")"
+((failed+=$?))
+
+# a mounted volume is frozen while the snapshot is taken, and the hook runs
+# around the freeze
+docker Create '{"Name": "vol1", "Opts": {"size": "100M", "snapshot-freeze": "true", "snapshot-hook": "record"}}' >/dev/null
+check "Policy" "True record" "$(json "$(${CTL} inspect vol1)" 'str(doc["quiesce"]["freeze"]) + " " + doc["quiesce"]["hook"]')"
+((failed+=$?))
+check "Policy in status" "True record" \
+    "$(json "$(docker Get '{"Name": "vol1"}')" 'str(doc["Volume"]["Status"]["quiesce"]["freeze"]) + " " + doc["Volume"]["Status"]["quiesce"]["hook"]')"
+((failed+=$?))
+docker Mount '{"Name": "vol1"}' >/dev/null
+since
+admin POST /v1/volumes/vol1/snapshots '{"name": "snap1"}'
+check "Snapshot of frozen volume" "201" "$status"
+((failed+=$?))
+check "Commands in order" "hook.sh fsfreeze lvcreate fsfreeze hook.sh" "$(commands)"
+((failed+=$?))
+check "Hook arguments" "pre vol1 ${WORKDIR}/mnt/vol1,post vol1" "$(tr '\n' ',' <${HOOK_LOG} | sed 's/,$//')"
+((failed+=$?))
+
+# a failed snapshot thaws the volume
+since
+admin POST /v1/volumes/vol1/snapshots '{"name": "snap2", "size": "1000G"}'
+check "Failed snapshot" "507 hook.sh fsfreeze lvcreate fsfreeze hook.sh" "$status $(commands)"
+((failed+=$?))
+admin POST /v1/volumes/vol1/snapshots '{"name": "snap2"}'
+check "Thawed after failure" "201" "$status"
+((failed+=$?))
+
+# exports and backups are quiesced as well
+since
+${CTL} backup vol1 >/dev/null
+check "Backup of frozen volume" "0 hook.sh fsfreeze lvcreate fsfreeze hook.sh" "$? $(commands)"
+((failed+=$?))
+
+# unmounted volumes are neither frozen nor run their hooks
+docker Unmount '{"Name": "vol1"}' >/dev/null
+since
+admin POST /v1/volumes/vol1/snapshots '{"name": "snap3"}'
+check "Snapshot of unmounted volume" "201 lvcreate" "$status $(commands)"
+((failed+=$?))
+
+# a failing pre command prevents the snapshot
+docker Create '{"Name": "vol2", "Opts": {"size": "100M", "snapshot-hook": "failing"}}' >/dev/null
+docker Mount '{"Name": "vol2"}' >/dev/null
+: >${HOOK_LOG}
+since
+admin POST /v1/volumes/vol2/snapshots '{"name": "snap4"}'
+check "Failing pre command" "502 false" "$status $(commands)"
+((failed+=$?))
+check "No snapshot" "false" "$([ -e ${WORKDIR}/lvm/test-vg/snap4 ] && echo true || echo false)"
+((failed+=$?))
+check "No post command" "" "$(cat ${HOOK_LOG})"
+((failed+=$?))
+
+# a pre command which takes too long is killed
+docker Create '{"Name": "vol3", "Opts": {"size": "100M", "snapshot-hook": "slow"}}' >/dev/null
+docker Mount '{"Name": "vol3"}' >/dev/null
+admin POST /v1/volumes/vol3/snapshots '{"name": "snap5"}'
+check "Slow pre command" "504 Timeout" "$status $(json "$body" 'doc["code"]')"
+((failed+=$?))
+
+# thin clones of mounted volumes are quiesced
+docker Create '{"Name": "thin1", "Opts": {"class": "thin", "size": "100M", "snapshot-freeze": "true"}}' >/dev/null
+docker Mount '{"Name": "thin1"}' >/dev/null
+since
+check "Thin clone of frozen volume" "" \
+    "$(json "$(docker Create '{"Name": "thin1-clone", "Opts": {"class": "thin", "clone-from": "thin1"}}')" 'doc["Err"]')"
+((failed+=$?))
+check "Thin clone frozen" "fsfreeze lvcreate fsfreeze" "$(commands)"
+((failed+=$?))
+check "Clone without policy" "None" "$(json "$(${CTL} inspect thin1-clone)" 'doc.get("quiesce")')"
+((failed+=$?))
+docker Unmount '{"Name": "thin1"}' >/dev/null
+check "Unmount after freeze" "False" "$(json "$(${CTL} inspect thin1)" 'doc["mounted"]')"
+((failed+=$?))
+
+# a daemon stopped during a quiesced snapshot finishes it and thaws the
+# volume before it exits
+docker Create '{"Name": "vol5", "Opts": {"size": "100M", "snapshot-freeze": "true", "snapshot-hook": "pausing"}}' >/dev/null
+docker Mount '{"Name": "vol5"}' >/dev/null
+since
+${CURL} -s -o /dev/null -w '%{http_code}' --unix-socket ${ADMIN_SOCKET} -X POST -H "Content-Type: application/json" \
+    -d '{"name": "snap7"}' http://localhost/v1/volumes/vol5/snapshots >${WORKDIR}/shutdown.status &
+snapshotpid=$!
+sleep 1
+kill -15 $lvmvdpid
+sleep 0.5
+check "Waits for the snapshot" "true" "$(alive $lvmvdpid)"
+((failed+=$?))
+wait $snapshotpid
+wait $lvmvdpid
+check "Snapshot during shutdown" "201 sleep fsfreeze lvcreate fsfreeze" "$(cat ${WORKDIR}/shutdown.status) $(commands)"
+((failed+=$?))
+check "No frozen volumes recorded" "false" "$([ -e ${WORKDIR}/state/frozen.json ] && echo true || echo false)"
+((failed+=$?))
+
+# volumes a crashed daemon left frozen are thawed on start
+echo '{"vol5": "'${WORKDIR}'/mnt/vol5"}' >${WORKDIR}/state/frozen.json
+since
+start_daemon
+check "Left frozen thawed" "1 false" \
+    "$(tail -n +$((seen + 1)) ${LVMVD_LOG} | grep 'msg="Executing command"' | grep -c "cmd=\"fsfreeze -u ${WORKDIR}/mnt/vol5\"") $([ -e ${WORKDIR}/state/frozen.json ] && echo true || echo false)"
+((failed+=$?))
+docker Unmount '{"Name": "vol5"}' >/dev/null
+stop_daemon
+
+finish quiesce
@@ -0,0 +1,151 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for RAID and striped volumes and the report of their sync and health
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=raid
+PORT=${PORT:-8107}
+. $(dirname $0)/lib.sh
+RAID_STATE=${WORKDIR}/lvm/.raidstate/test-vg
+VOLUMES=--storage-classes=${WORKDIR}/classes.json
+DAEMON_ARGS=(--key-provider=file --log-level=debug --admin-listener=unix
+    --admin-socket=${ADMIN_SOCKET})
+
+# ---------------------------------------------------------------------------
+
+# endpoint <path>: prints the HTTP status of a health endpoint
+endpoint() {
+    ${CURL} -s -o ${WORKDIR}/endpoint.json -w '%{http_code}' http://localhost:${PORT}$1
+}
+
+# raid_check: prints the result of the raid check of /ready; the fake LVM
+# lacks the LVM binaries, so /ready fails on them anyway
+raid_check() {
+    endpoint /ready >/dev/null
+    json "$(cat ${WORKDIR}/endpoint.json)" 'doc["checks"]["raid"]["status"] + " " + doc["checks"]["raid"].get("error", "")' | sed 's/ $//'
+}
+
+# raid <volume> <python expression on the raid status>
+raid() {
+    python3 -c 'import json,sys; raid=json.loads(sys.argv[1])["Volume"]["Status"].get("raid"); print(eval(sys.argv[2]))' \
+        "$(docker Get '{"Name": "'$1'"}')" "$2"
+}
+
+# lvcreate <volume>: prints the layout arguments lvcreate was called with
+lvcreate() {
+    grep 'msg="Executing command"' ${LVMVD_LOG} | grep -o "cmd=\"lvcreate -L [^ ]* -n $1 [^\"]*\"" | \
+        sed -e 's/.* -n [^ ]* //' -e 's/ --wipesignatures.*//' -e 's/ *test-vg"$//'
+}
+
+cat >${WORKDIR}/classes.json <<EOF
+{
+    "default": "thick",
+    "classes": [
+        {"name": "thick", "volume_group": "test-vg"},
+        {"name": "thin", "volume_group": "test-vg", "thin_pool": "pool"}
+    ]
+}
+EOF
+
+${LVMVD} --volume-group-name=test-vg --mount-root=${WORKDIR}/mnt --fake-lvm-dir=${WORKDIR}/lvm \
+    --fake-pvs=0 >/dev/null 2>&1
+check "No physical volumes" "1" "$?"
+((failed+=$?))
+
+# with a single physical volume only striping over one device would fit
+start_daemon
+check "Too few physical volumes" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"raid": "raid1"}}')")"
+((failed+=$?))
+check "Not created" "false" "$([ -e ${WORKDIR}/lvm/test-vg/bad ] && echo true || echo false)"
+((failed+=$?))
+stop_daemon
+
+start_daemon --fake-pvs=4
+for opts in '"raid": "raid0"' '"raid": "raid1", "stripes": "2"' '"raid": "raid5", "stripes": "1"' \
+    '"raid": "raid5", "mirrors": "1"' '"mirrors": "1"' '"stripesize": "64K"' '"stripes": "x"' \
+    '"stripes": "2", "stripesize": "48K"' '"raid": "raid1", "stripesize": "64K"'; do
+    check "Illegal options ${opts}" "InvalidArgument" \
+        "$(err_code "$(docker Create '{"Name": "bad", "Opts": {'"${opts}"'}}')")"
+    ((failed+=$?))
+done
+check "Thin class" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"class": "thin", "raid": "raid1"}}')")"
+((failed+=$?))
+check "Layout larger than the volume group" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"raid": "raid10", "stripes": "2", "mirrors": "2"}}')")"
+((failed+=$?))
+
+# the layouts are passed to lvcreate
+docker Create '{"Name": "mirror", "Opts": {"size": "100M", "raid": "raid1"}}' >/dev/null
+check "raid1" "--type raid1 -m 1" "$(lvcreate mirror)"
+((failed+=$?))
+docker Create '{"Name": "parity", "Opts": {"size": "100M", "raid": "raid5", "stripes": "3", "stripesize": "128K"}}' >/dev/null
+check "raid5" "--type raid5 -i 3 -I 128k" "$(lvcreate parity)"
+((failed+=$?))
+docker Create '{"Name": "r10", "Opts": {"size": "100M", "raid": "raid10"}}' >/dev/null
+check "raid10" "--type raid10 -m 1 -i 2" "$(lvcreate r10)"
+((failed+=$?))
+docker Create '{"Name": "striped", "Opts": {"size": "100M", "stripes": "4", "stripesize": "1M"}}' >/dev/null
+check "striped" "--type striped -i 4 -I 1024k" "$(lvcreate striped)"
+((failed+=$?))
+docker Create '{"Name": "linear", "Opts": {"size": "100M"}}' >/dev/null
+check "Linear" "" "$(lvcreate linear)"
+((failed+=$?))
+
+# the status reports the layout, the sync and the health
+check "Status of raid1" "raid1 1 100 False" \
+    "$(raid mirror 'raid["type"] + " " + str(raid["mirrors"]) + " " + str(raid["sync_percent"]) + " " + str(raid["degraded"])')"
+((failed+=$?))
+check "Status of striped" "striped 4 1024 None" \
+    "$(raid striped 'raid["type"] + " " + str(raid["stripes"]) + " " + str(raid["stripe_size_kb"]) + " " + str(raid.get("sync_percent"))')"
+((failed+=$?))
+check "Status of linear" "None" "$(raid linear 'raid')"
+((failed+=$?))
+check "Raid check" "ok" "$(raid_check)"
+((failed+=$?))
+
+# a running sync is not degraded
+mkdir -p ${RAID_STATE}
+echo "sync=42.50" >${RAID_STATE}/parity
+check "Sync running" "42.5 False" "$(raid parity 'str(raid["sync_percent"]) + " " + str(raid["degraded"])')"
+((failed+=$?))
+check "Raid check while syncing" "ok" "$(raid_check)"
+((failed+=$?))
+
+# a lost leg fails /ready but not /health
+printf "sync=100.00\nhealth=partial\n" >${RAID_STATE}/mirror
+check "Degraded" "True partial" "$(raid mirror 'str(raid["degraded"]) + " " + raid["health"]')"
+((failed+=$?))
+check "Degraded in inspect" "True" "$(json "$(${CTL} inspect mirror)" 'doc["raid"]["degraded"]')"
+((failed+=$?))
+check "lvmvdctl" "true" "$(${LVMVDCTL} --socket=${ADMIN_SOCKET} inspect mirror | grep -q 'RAID: *raid1, 1 mirrors, 100% in sync, degraded (partial)' && echo true || echo false)"
+((failed+=$?))
+check "Raid check failed" "failed RAID volumes degraded: mirror (partial)" "$(raid_check)"
+((failed+=$?))
+check "Still healthy" "200 failed" "$(endpoint /health) $(json "$(cat ${WORKDIR}/endpoint.json)" 'doc["checks"]["raid"]["status"]')"
+((failed+=$?))
+
+# the layout survives a restart, and a repaired volume is ready again
+stop_daemon
+rm ${RAID_STATE}/mirror
+start_daemon --fake-pvs=4
+check "Layout after restart" "raid5 3 False" "$(raid parity 'raid["type"] + " " + str(raid["stripes"]) + " " + str(raid["degraded"])')"
+((failed+=$?))
+check "Repaired" "ok" "$(raid_check)"
+((failed+=$?))
+
+# clones take a layout of their own
+check "Clone as raid1" "" \
+    "$(json "$(docker Create '{"Name": "clone", "Opts": {"clone-from": "linear", "raid": "raid1", "mirrors": "3"}}')" 'doc["Err"]')"
+((failed+=$?))
+sleep 1
+check "Clone layout" "--type raid1 -m 3 raid1" "$(lvcreate clone) $(raid clone 'raid["type"]')"
+((failed+=$?))
+stop_daemon
+
+finish RAID
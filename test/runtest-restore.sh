@@ -0,0 +1,175 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for restores of volumes from the backup catalog
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=restore
+PORT=${PORT:-8104}
+. $(dirname $0)/lib.sh
+DEVICES=${WORKDIR}/lvm/test-vg
+BACKUPS=${WORKDIR}/backups
+VOLUMES=--storage-classes=${WORKDIR}/classes.json
+DAEMON_ARGS=(--key-provider=file --backup-target=dir --backup-dir=${BACKUPS}
+    --backup-check-interval=0 --admin-listener=unix --admin-socket=${ADMIN_SOCKET})
+
+# ---------------------------------------------------------------------------
+
+# mark <volume> <MB> <text>: writes text at an offset in MB into the fake
+# device
+mark() {
+    printf "$3" | dd of=${DEVICES}/$1 bs=1M seek=$2 conv=notrunc status=none
+}
+
+# content <volume> <MB>: prints the text at an offset in MB of the fake
+# device
+content() {
+    dd if=${DEVICES}/$1 bs=1M skip=$2 count=1 status=none | head -c 6
+}
+
+# backup <volume>: backs up a volume and prints the id of the backup
+backup() {
+    json "$(${CTL} backup $1)" 'doc["id"]'
+}
+
+# stream <volume> <id>
+stream() {
+    echo ${BACKUPS}/$1/$2.stream
+}
+
+# tags <volume>: prints the tags of the fake logical volume
+tags() {
+    cat ${WORKDIR}/lvm/.tags/test-vg/$1 2>/dev/null
+}
+
+cat >${WORKDIR}/classes.json <<EOF
+{
+    "default": "thick",
+    "classes": [
+        {"name": "thick", "volume_group": "test-vg"},
+        {"name": "thin", "volume_group": "test-vg", "thin_pool": "pool"}
+    ]
+}
+EOF
+
+start_daemon
+
+# a full backup restored into a new volume
+docker Create '{"Name": "vol1", "Opts": {"size": "100M", "backup-interval": "1d"}}' >/dev/null
+mark vol1 0 "first1"
+b1=$(backup vol1)
+mark vol1 0 "later1"
+check "Restore with create" "" "$(json "$(docker Create '{"Name": "vol1-restored", "Opts": {"restore-from": "vol1/'${b1}'"}}')" 'doc["Err"]')"
+((failed+=$?))
+check "Restored data" "first1" "$(content vol1-restored 0)"
+((failed+=$?))
+info=$(${CTL} inspect vol1-restored)
+check "Restored size" "100" "$(json "$info" 'doc["size_mb"]')"
+((failed+=$?))
+check "Provenance recorded" "vol1 ${b1} ${b1}" \
+    "$(json "$info" 'doc["restored_from"]["volume"] + " " + doc["restored_from"]["backup"] + " " + ",".join(doc["restored_from"]["backups"])')"
+((failed+=$?))
+check "Provenance tag" "lvmvd_restored_from=vol1/${b1}" "$(tags vol1-restored)"
+((failed+=$?))
+check "Restored volume leaves the chain" "None" "$(json "$info" 'doc.get("imported_backup")')"
+((failed+=$?))
+check "Restore option not kept" "None" "$(json "$info" 'doc["options"].get("restore-from")')"
+((failed+=$?))
+
+# errors
+check "Restore into existing volume" "AlreadyExists" \
+    "$(err_code "$(docker Create '{"Name": "vol1", "Opts": {"restore-from": "vol1/'${b1}'"}}')")"
+((failed+=$?))
+check "Restore of missing backup" "NotFound" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"restore-from": "vol1/20000101T000000Z-0000"}}')")"
+((failed+=$?))
+check "Illegal backup id" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"restore-from": "vol1/yesterday"}}')")"
+((failed+=$?))
+check "Restore with clone" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"restore-from": "vol1/'${b1}'", "clone-from": "vol1"}}')")"
+((failed+=$?))
+check "Restore with other size" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "bad", "Opts": {"restore-from": "vol1/'${b1}'", "size": "200M"}}')")"
+((failed+=$?))
+check "Failed restores leave no volume" "false" "$(exists ${DEVICES}/bad)"
+((failed+=$?))
+
+# the catalog of the volume of the same name and the newest backup
+b2=$(backup vol1)
+docker Remove '{"Name": "vol1"}' >/dev/null
+check "Restore removed volume" "" "$(json "$(docker Create '{"Name": "vol1", "Opts": {"restore-from": "'${b1}'"}}')" 'doc["Err"]')"
+((failed+=$?))
+check "Restored removed volume" "first1" "$(content vol1 0)"
+((failed+=$?))
+docker Remove '{"Name": "vol1"}' >/dev/null
+docker Create '{"Name": "vol1", "Opts": {"restore-from": "latest"}}' >/dev/null
+check "Restore latest" "later1 ${b2}" "$(content vol1 0) $(json "$(${CTL} inspect vol1)" 'doc["restored_from"]["backup"]')"
+((failed+=$?))
+
+# checksums are verified against the trailer and the catalog record
+cp $(stream vol1 ${b1}) ${WORKDIR}/b1.stream
+python3 - $(stream vol1 ${b1}) <<'EOF'
+import sys
+data = bytearray(open(sys.argv[1], "rb").read())
+i = len(data) // 2
+data[i] ^= 0xff
+open(sys.argv[1], "wb").write(data)
+EOF
+check "Corrupt stream" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "corrupt", "Opts": {"restore-from": "vol1/'${b1}'"}}')")"
+((failed+=$?))
+check "Corrupt stream removed volume" "false" "$(exists ${DEVICES}/corrupt)"
+((failed+=$?))
+cp ${WORKDIR}/b1.stream $(stream vol1 ${b1})
+python3 - ${BACKUPS}/vol1/${b1}.json <<'EOF'
+import json, sys
+record = json.load(open(sys.argv[1]))
+record["sha256"] = "0" * 64
+json.dump(record, open(sys.argv[1], "w"))
+EOF
+check "Stream not matching record" "InvalidArgument" \
+    "$(err_code "$(docker Create '{"Name": "corrupt", "Opts": {"restore-from": "vol1/'${b1}'"}}')")"
+((failed+=$?))
+
+# incremental chains are applied up to the backup restored
+docker Create '{"Name": "inc", "Opts": {"class": "thin", "size": "100M", "backup-interval": "1d", "backup-incremental": "true"}}' >/dev/null
+mark inc 0 "full01"
+i1=$(backup inc)
+mark inc 10 "delta2"
+i2=$(backup inc)
+mark inc 0 "third3"
+mark inc 50 "fifty3"
+i3=$(backup inc)
+cp ${DEVICES}/inc ${WORKDIR}/inc-i3
+mark inc 20 "after4"
+i4=$(backup inc)
+admin POST /v1/volumes/inc/backups/${i3}/restore '{"name": "inc-restored", "options": {"class": "thin", "backup-interval": "1d"}}'
+check "Restore incremental with admin API" "201 ${i1},${i2},${i3}" "$status $(json "$body" '",".join(doc["restored_from"]["backups"])')"
+((failed+=$?))
+check "Incremental restored" "0" "$(cmp -s ${DEVICES}/inc-restored ${WORKDIR}/inc-i3; echo $?)"
+((failed+=$?))
+check "Restored with own policy" "86400 thin" "$(json "$body" 'str(doc["backup"]["interval_seconds"]) + " " + doc["class"]')"
+((failed+=$?))
+docker Remove '{"Name": "inc"}' >/dev/null
+admin POST /v1/volumes/inc/backups/${i4}/restore
+check "Restore without body" "201 inc after4" "$status $(json "$body" 'doc["name"]') $(content inc 20)"
+((failed+=$?))
+rm $(stream inc ${i2})
+admin POST /v1/volumes/inc/backups/${i3}/restore '{"name": "inc-broken"}'
+check "Restore of incomplete chain" "400 false" "$status $(exists ${DEVICES}/inc-broken)"
+((failed+=$?))
+
+# lvmvdctl
+out=$(${CTL} restore --to=vol1-ctl vol1 ${b2})
+check "Restore with lvmvdctl" "vol1-ctl ${b2}" "$(json "$out" 'doc["name"] + " " + doc["restored_from"]["backup"]')"
+((failed+=$?))
+check "Restore metrics" "true" \
+    "$(${CURL} -s http://localhost:${PORT}/metrics | grep -q 'lvmvd_restore_total{result="failure"}' && echo true || echo false)"
+((failed+=$?))
+stop_daemon
+
+finish restore
@@ -0,0 +1,181 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the export and import of volumes
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl, python3, tar, gzip and zstd.
+# ---------------------------------------------------------------------------
+
+TEST=transfer
+PORT=${PORT:-8101}
+. $(dirname $0)/lib.sh
+DEVICES=${WORKDIR}/lvm/test-vg
+EXPORTS=${WORKDIR}/exports
+DAEMON_ARGS=(--key-provider=file --admin-listener=unix --admin-socket=${ADMIN_SOCKET})
+
+# ---------------------------------------------------------------------------
+
+# mark <volume> <text>: writes text to the start of the fake device
+mark() {
+    printf "$2" | dd of=${DEVICES}/$1 conv=notrunc status=none
+}
+
+# content <volume>: prints the start of the fake device
+content() {
+    head -c 6 ${DEVICES}/$1
+}
+
+mkdir -p ${EXPORTS}
+
+start_daemon
+
+# raw exports copy the block device
+docker Create '{"Name": "vol1", "Opts": {"size": "100M", "mountopts": "noatime"}}' >/dev/null
+mark vol1 "raw123"
+check "Export raw" "" "$(${CTL} export --file=${EXPORTS}/vol1.raw vol1)"
+((failed+=$?))
+check "Export magic" "LVMVD-EXPORT 1" "$(head -n 1 ${EXPORTS}/vol1.raw)"
+((failed+=$?))
+check "Export header" "raw none 100" \
+    "$(json "$(sed -n 2p ${EXPORTS}/vol1.raw)" 'doc["format"] + " " + doc["compression"] + " " + str(doc["size_mb"])')"
+((failed+=$?))
+check "Export to existing file" "1" "$(${CTL} export --file=${EXPORTS}/vol1.raw vol1 >/dev/null 2>&1; echo $?)"
+((failed+=$?))
+v=$(${CTL} import --file=${EXPORTS}/vol1.raw vol1-copy)
+check "Import raw" "vol1-copy 100 True" "$(json "$v" 'doc["name"] + " " + str(doc["size_mb"]) + " " + str("noatime" in doc["mount_options"])')"
+((failed+=$?))
+check "Imported data" "raw123" "$(content vol1-copy)"
+((failed+=$?))
+check "Import existing" "AlreadyExists" \
+    "$(import vol1-copy ${EXPORTS}/vol1.raw; json "$body" 'doc["code"]')"
+((failed+=$?))
+import vol1-small ${EXPORTS}/vol1.raw "?size=200M"
+check "Import raw with other size" "400" "$status"
+((failed+=$?))
+check "Rejected import removed" "false" "$(listed vol1-small)"
+((failed+=$?))
+admin GET "/v1/volumes/vol1/export?format=zip"
+check "Illegal format" "400" "$status"
+((failed+=$?))
+admin GET /v1/volumes/missing/export
+check "Export missing volume" "404" "$status"
+((failed+=$?))
+
+# tar exports copy the files
+docker Create '{"Name": "vol2", "Opts": {"size": "100M"}}' >/dev/null
+mp=$(json "$(docker Mount '{"Name": "vol2"}')" 'doc["Mountpoint"]')
+mkdir -p $mp/dir
+echo "hello" > $mp/dir/file
+ln -s dir/file $mp/link
+docker Unmount '{"Name": "vol2"}' >/dev/null
+${CTL} export --format=tar --file=${EXPORTS}/vol2.tar vol2 >/dev/null
+check "Tar export without mountpoint" "false" "$(exists ${WORKDIR}/state/transfers/vol2)"
+((failed+=$?))
+${CTL} import --file=${EXPORTS}/vol2.tar vol2-copy size=200M >/dev/null
+mp=$(json "$(docker Mount '{"Name": "vol2-copy"}')" 'doc["Mountpoint"]')
+check "Imported files" "hello dir/file" "$(cat $mp/dir/file) $(readlink $mp/link)"
+((failed+=$?))
+check "Imported size" "200" "$(json "$(${CTL} inspect vol2-copy)" 'doc["size_mb"]')"
+((failed+=$?))
+docker Unmount '{"Name": "vol2-copy"}' >/dev/null
+
+for c in gzip zstd; do
+    ${CTL} export --format=tar --compression=$c --file=${EXPORTS}/vol2.tar.$c vol2 >/dev/null
+    ${CTL} import --file=${EXPORTS}/vol2.tar.$c vol2-$c >/dev/null
+    mp=$(json "$(docker Mount '{"Name": "vol2-'$c'"}')" 'doc["Mountpoint"]')
+    check "Import $c" "hello" "$(cat $mp/dir/file)"
+    ((failed+=$?))
+    docker Unmount '{"Name": "vol2-'$c'"}' >/dev/null
+done
+
+# corrupt and truncated streams are detected, the volume is removed
+python3 -c 'import sys; d=bytearray(open(sys.argv[1],"rb").read()); d[len(d)//2]^=0xff; open(sys.argv[2],"wb").write(d)' \
+    ${EXPORTS}/vol1.raw ${EXPORTS}/corrupt.raw
+import corrupt ${EXPORTS}/corrupt.raw
+check "Import corrupt stream" "400 false" "$status $(listed corrupt)"
+((failed+=$?))
+head -c $(($(stat -c %s ${EXPORTS}/vol2.tar.gzip) - 20)) ${EXPORTS}/vol2.tar.gzip >${EXPORTS}/truncated.tar.gzip
+import truncated ${EXPORTS}/truncated.tar.gzip
+check "Import truncated stream" "400 false" "$status $(listed truncated)"
+((failed+=$?))
+head -c 10 ${EXPORTS}/vol1.raw >${EXPORTS}/header.raw
+import header ${EXPORTS}/header.raw
+check "Import without header" "400 false" "$status $(listed header)"
+((failed+=$?))
+check "No metadata of failed imports" "false false" \
+    "$(exists ${WORKDIR}/state/volumes/corrupt.json) $(exists ${WORKDIR}/state/volumes/truncated.json)"
+((failed+=$?))
+
+# mounted volumes are exported through a hidden snapshot
+mp=$(json "$(docker Mount '{"Name": "vol2"}')" 'doc["Mountpoint"]')
+echo "mounted" > $mp/new
+${CTL} export --format=tar --file=${EXPORTS}/mounted.tar vol2 >/dev/null
+check "Export mounted" "0" "$?"
+((failed+=$?))
+check "Export snapshot removed" "" "$(ls ${DEVICES} | grep lvmvd-export)"
+((failed+=$?))
+docker Unmount '{"Name": "vol2"}' >/dev/null
+${CTL} import --file=${EXPORTS}/mounted.tar vol2-mounted >/dev/null
+mp=$(json "$(docker Mount '{"Name": "vol2-mounted"}')" 'doc["Mountpoint"]')
+check "Files of mounted export" "mounted hello" "$(cat $mp/new) $(cat $mp/dir/file)"
+((failed+=$?))
+docker Unmount '{"Name": "vol2-mounted"}' >/dev/null
+
+# encrypted volumes are exported in plain text and encrypted with a new key
+docker Create '{"Name": "enc1", "Opts": {"size": "100M", "encrypted": "true"}}' >/dev/null
+mp=$(json "$(docker Mount '{"Name": "enc1"}')" 'doc["Mountpoint"]')
+echo "secret" > $mp/file
+docker Unmount '{"Name": "enc1"}' >/dev/null
+${CTL} export --format=tar --file=${EXPORTS}/enc1.tar enc1 >/dev/null
+check "Export encrypted" "true" "$(json "$(sed -n 2p ${EXPORTS}/enc1.tar)" 'str(doc["encrypted"]).lower()')"
+((failed+=$?))
+check "Export closes container" "" "$(ls ${WORKDIR}/lvm/mapper 2>/dev/null)"
+((failed+=$?))
+v=$(${CTL} import --file=${EXPORTS}/enc1.tar enc1-copy)
+check "Import encrypted" "True" "$(json "$v" 'doc["encrypted"]')"
+((failed+=$?))
+check "Key of import" "true" "$(exists ${WORKDIR}/state/keys/enc1-copy.key)"
+((failed+=$?))
+mp=$(json "$(docker Mount '{"Name": "enc1-copy"}')" 'doc["Mountpoint"]')
+check "Imported encrypted files" "secret" "$(cat $mp/file)"
+((failed+=$?))
+docker Unmount '{"Name": "enc1-copy"}' >/dev/null
+v=$(${CTL} import --file=${EXPORTS}/enc1.tar enc1-plain encrypted=false)
+check "Import encrypted in plain text" "False" "$(json "$v" 'doc["encrypted"]')"
+((failed+=$?))
+
+# the target of a running import cannot be changed
+mkfifo ${EXPORTS}/pipe
+${CTL} import --file=${EXPORTS}/pipe slow >${EXPORTS}/slow.out 2>&1 &
+importpid=$!
+exec 3>${EXPORTS}/pipe
+head -c 1000 ${EXPORTS}/vol1.raw >&3
+sleep 1
+admin DELETE /v1/volumes/slow
+check "Remove importing volume" "409" "$status"
+((failed+=$?))
+check "Importing in status" "True" "$(json "$(${CTL} inspect slow)" 'doc["importing"]')"
+((failed+=$?))
+check "Mount importing volume" "InUse" "$(json "$(docker Mount '{"Name": "slow"}')" 'doc["Err"].split(":")[0]')"
+((failed+=$?))
+tail -c +1001 ${EXPORTS}/vol1.raw >&3
+exec 3>&-
+wait $importpid
+check "Slow import" "0 raw123" "$? $(content slow)"
+((failed+=$?))
+
+# an import interrupted by a restart is removed
+mkfifo ${EXPORTS}/pipe2
+${CTL} import --file=${EXPORTS}/pipe2 interrupted >/dev/null 2>&1 &
+exec 3>${EXPORTS}/pipe2
+head -c 1000 ${EXPORTS}/vol1.raw >&3
+sleep 1
+stop_daemon
+exec 3>&-
+start_daemon
+check "Interrupted import removed" "false false" "$(listed interrupted) $(exists ${DEVICES}/interrupted)"
+((failed+=$?))
+stop_daemon
+
+finish transfer
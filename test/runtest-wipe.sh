@@ -0,0 +1,129 @@
+#!/bin/bash
+
+# ---------------------------------------------------------------------------
+# Test for the wipe of removed volumes
+#
+# Runs against the fake LVM backend, so neither root nor a volume group is
+# required. Needs curl and python3.
+# ---------------------------------------------------------------------------
+
+TEST=wipe
+PORT=${PORT:-8092}
+. $(dirname $0)/lib.sh
+DEVDIR=${WORKDIR}/lvm/test-vg
+
+# ---------------------------------------------------------------------------
+
+# wait_gone <file>: waits up to 10s for the wipe to remove the device
+wait_gone() {
+    for i in $(seq 1 20); do
+        [ -e "$1" ] || return 0
+        sleep 0.5
+    done
+    return 1
+}
+
+for policy in zero random discard; do
+    start_daemon --wipe=${policy} --wipe-passes=2
+    docker Create '{"Name": "wipe1", "Opts": {"size": "20M"}}' >/dev/null
+    echo "tenant data" | dd of=${DEVDIR}/wipe1 conv=notrunc 2>/dev/null
+
+    check "Remove ($policy)" '{"Err":""}' "$(docker Remove '{"Name": "wipe1"}')"
+    ((failed+=$?))
+    check "List after remove ($policy)" '{"Err":"","Volumes":[]}' "$(docker List '{}')"
+    ((failed+=$?))
+    # the name is free again at once
+    check "Create same name ($policy)" '{"Err":""}' "$(docker Create '{"Name": "wipe1", "Opts": {"size": "20M"}}')"
+    ((failed+=$?))
+    check "New volume without old data ($policy)" "0" "$(grep -c 'tenant data' ${DEVDIR}/wipe1)"
+    ((failed+=$?))
+
+    wiped=$(grep 'msg="Volume scheduled for wiping"' ${LVMVD_LOG} | tail -n 1 | sed 's/.* lv=\([^ ]*\).*/\1/')
+    if wait_gone ${DEVDIR}/${wiped}; then
+        check "Wiped volume removed ($policy)" "yes" "yes"
+    else
+        check "Wiped volume removed ($policy)" "yes" "no"
+    fi
+    ((failed+=$?))
+    check "Wipe logged ($policy)" "yes" "$(grep -q "msg=\"Volume wiped\".*lv=${wiped}" ${LVMVD_LOG} && echo yes)"
+    ((failed+=$?))
+
+    docker Remove '{"Name": "wipe1"}' >/dev/null
+    stop_daemon
+done
+
+# a volume tagged for wiping left over from a crash is wiped on start
+dd if=/dev/urandom of=${DEVDIR}/lvmvd-wipe-leftover bs=1M count=10 2>/dev/null
+mkdir -p ${WORKDIR}/lvm/.tags/test-vg
+echo -n "lvmvd_wipe" > ${WORKDIR}/lvm/.tags/test-vg/lvmvd-wipe-leftover
+start_daemon --wipe=zero
+check "Leftover hidden" '{"Err":"","Volumes":[]}' "$(docker List '{}')"
+((failed+=$?))
+if wait_gone ${DEVDIR}/lvmvd-wipe-leftover; then
+    check "Leftover wiped" "yes" "yes"
+else
+    check "Leftover wiped" "yes" "no"
+fi
+((failed+=$?))
+check "Progress logged" "yes" "$(grep -q 'msg="Wipe progress".*lv=lvmvd-wipe-leftover.*percent=100' ${LVMVD_LOG} && echo yes)"
+((failed+=$?))
+stop_daemon
+
+# a volume with snapshots is not wiped, LVM would copy the overwritten
+# blocks into the snapshots
+start_daemon --wipe=zero --admin-listener=unix --admin-socket=${ADMIN_SOCKET} --log-level=debug
+docker Create '{"Name": "origin1", "Opts": {"size": "20M"}}' >/dev/null
+echo "tenant data" | dd of=${DEVDIR}/origin1 conv=notrunc 2>/dev/null
+check "Snapshot created" "201" "$(admin POST /v1/volumes/origin1/snapshots '{"name": "origin1-snap"}'; echo $status)"
+((failed+=$?))
+check "Remove with snapshot refused" "InUse True" \
+    "$(docker Remove '{"Name": "origin1"}' | python3 -c 'import json,sys; err=json.load(sys.stdin)["Err"]; print(err.split(":")[0], "origin1-snap" in err)')"
+((failed+=$?))
+check "Origin and snapshot kept" "origin1 origin1-snap 1" \
+    "$(ls ${DEVDIR} | tr '\n' ' ')$(grep -c 'tenant data' ${DEVDIR}/origin1)"
+((failed+=$?))
+# the copy-on-write area of a removed snapshot is split off and wiped
+check "Snapshot removed" "204" "$(admin DELETE /v1/volumes/origin1-snap; echo $status)"
+((failed+=$?))
+check "Snapshot split for wipe" "1" \
+    "$(grep 'msg="Executing command"' ${LVMVD_LOG} | grep -c 'cmd="lvconvert --splitsnapshot test-vg/origin1-snap"')"
+((failed+=$?))
+check "Remove without snapshot" '{"Err":""}' "$(docker Remove '{"Name": "origin1"}')"
+((failed+=$?))
+wiped=$(grep 'msg="Volume scheduled for wiping"' ${LVMVD_LOG} | tail -n 1 | sed 's/.* lv=\([^ ]*\).*/\1/')
+wait_gone ${DEVDIR}/${wiped}
+check "Origin wiped" "" "$(ls ${DEVDIR})"
+((failed+=$?))
+stop_daemon
+
+# without a policy the volume is removed at once
+start_daemon
+docker Create '{"Name": "wipe2"}' >/dev/null
+docker Remove '{"Name": "wipe2"}' >/dev/null
+check "Remove without wipe" "" "$(ls ${DEVDIR})"
+((failed+=$?))
+stop_daemon
+
+# thin volumes are discarded whatever the policy, overwriting them would
+# allocate their whole size in the pool
+cat >${WORKDIR}/classes.json <<EOF
+{"default": "thin", "classes": [{"name": "thin", "volume_group": "test-vg", "thin_pool": "pool"}]}
+EOF
+VOLUMES=--storage-classes=${WORKDIR}/classes.json
+start_daemon --wipe=random --log-level=debug
+docker Create '{"Name": "thin1", "Opts": {"size": "20M"}}' >/dev/null
+echo "tenant data" | dd of=${DEVDIR}/thin1 conv=notrunc 2>/dev/null
+docker Remove '{"Name": "thin1"}' >/dev/null
+wiped=$(grep 'msg="Volume scheduled for wiping"' ${LVMVD_LOG} | tail -n 1 | sed 's/.* lv=\([^ ]*\).*/\1/')
+if wait_gone ${DEVDIR}/${wiped}; then
+    check "Thin volume removed" "yes" "yes"
+else
+    check "Thin volume removed" "yes" "no"
+fi
+((failed+=$?))
+check "Thin volume discarded" "yes no" \
+    "$(grep -q "cmd=\"blkdiscard ${DEVDIR}/${wiped}\"" ${LVMVD_LOG} && echo yes || echo no) $(grep -q "msg=\"Wipe progress\".*lv=${wiped}" ${LVMVD_LOG} && echo yes || echo no)"
+((failed+=$?))
+stop_daemon
+
+finish wipe
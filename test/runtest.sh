@@ -153,7 +153,7 @@ run_tests() {
     # Create again -> error
     AUTOTEST_MSG='{"Name": "autotest1"}'
     val=$(${CURL} $socket -s -d "$AUTOTEST_MSG" --header "$HEADERS" ${base_url}Create)
-    expected='{"Err":"Volume autotest1 already exists"}'
+    expected='{"Err":"AlreadyExists: Volume autotest1 already exists"}'
     compare "Create again" "$expected" "$val"
     ((ret+=$?))
 
@@ -184,14 +184,14 @@ run_tests() {
     # Mount again (error)
     AUTOTEST_MSG='{"Name": "autotest1"}'
     val=$(${CURL} $socket -s -d "$AUTOTEST_MSG" --header "$HEADERS" ${base_url}Mount)
-    expected='{"Err":"Cannot mount device /dev/test-vg/autotest1: mount: /dev/mapper/test--vg-autotest1 already mounted or /var/volume/test-vg/autotest1 busy\nmount: according to mtab, /dev/mapper/test--vg-autotest1 is already mounted on /var/volume/test-vg/autotest1\n"}'
+    expected='{"Err":"ExternalCommandFailed: Cannot mount device /dev/test-vg/autotest1: mount: /dev/mapper/test--vg-autotest1 already mounted or /var/volume/test-vg/autotest1 busy\nmount: according to mtab, /dev/mapper/test--vg-autotest1 is already mounted on /var/volume/test-vg/autotest1\n"}'
     compare "Mount" "$expected" "$val"
     ((ret+=$?))
 
     # Remove (fail)
     AUTOTEST_MSG='{"Name": "autotest1"}'
     val=$(${CURL} $socket -s -d "$AUTOTEST_MSG" --header "$HEADERS" ${base_url}Remove)
-    expected='{"Err":"Volume autotest1 is still mounted"}'
+    expected='{"Err":"InUse: Volume autotest1 is still mounted"}'
     compare "Remove" "$expected" "$val"
     ((ret+=$?))
 
@@ -389,6 +389,17 @@ fi
 run_tests "" ${URL_PREFIX1} ${URL_PREFIX}
 ((failed+=$?))
 
+# health and readiness
+for endpoint in health ready; do
+    code=$(${CURL} -s -o /dev/null -w '%{http_code}' http://${HOST}:${PORT}/${endpoint})
+    if [ "$code" != "200" ]; then
+        echo "Test ${endpoint} failed: status $code"
+        ((failed+=1))
+    else
+        echo "Test ${endpoint} ok"
+    fi
+done
+
 kill -15 $lvmvdpid
 sleep 1
 